@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/moby/tool/src/moby"
+	log "github.com/sirupsen/logrus"
+)
+
+// Report the files that changed between two manifests
+func bomDiff(args []string) {
+	diffCmd := flag.NewFlagSet("bom-diff", flag.ExitOnError)
+	diffCmd.Usage = func() {
+		fmt.Printf("USAGE: %s bom-diff <old.manifest> <new.manifest>\n\n", os.Args[0])
+		fmt.Printf("Report the files added (+), removed (-) and changed (~) between the manifests\n")
+		fmt.Printf("written by the manifest output format of two builds\n")
+	}
+	if err := diffCmd.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := diffCmd.Args()
+	if len(remArgs) != 2 {
+		diffCmd.Usage()
+		os.Exit(1)
+	}
+
+	var manifests []map[string]moby.ManifestEntry
+	for _, file := range remArgs {
+		f, err := os.Open(file)
+		if err != nil {
+			log.Fatalf("Cannot open manifest: %v", err)
+		}
+		m, err := moby.ReadManifest(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Cannot read manifest %s: %v", file, err)
+		}
+		manifests = append(manifests, m)
+	}
+
+	if err := moby.WriteManifestDiff(os.Stdout, moby.DiffManifests(manifests[0], manifests[1])); err != nil {
+		log.Fatalf("Cannot write diff: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -9,14 +10,39 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/moby/tool/src/moby"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 )
 
 const defaultNameForStdin = "moby"
 
+// buildOptionsFile is the file in the working directory that build reads
+// default option values from
+const buildOptionsFile = ".mobybuild"
+
+// buildOptionsPath returns the options file to read, the one in the working
+// directory, or if there is none there, the one in the directory of the
+// first local config
+func buildOptionsPath(configs []string) string {
+	if _, err := os.Stat(buildOptionsFile); err == nil {
+		return buildOptionsFile
+	}
+	for _, conf := range configs {
+		if conf == "-" || strings.HasPrefix(conf, "http://") || strings.HasPrefix(conf, "https://") {
+			continue
+		}
+		return filepath.Join(filepath.Dir(conf), buildOptionsFile)
+	}
+	return buildOptionsFile
+}
+
 type formatList []string
 
 func (f *formatList) String() string {
@@ -31,9 +57,104 @@ func (f *formatList) Set(value string) error {
 	return nil
 }
 
+// formatValues holds per format settings given as format=value
+type formatValues map[string]string
+
+func (f formatValues) String() string {
+	return fmt.Sprint(map[string]string(f))
+}
+
+func (f formatValues) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("value must be of the form format=value: %s", value)
+	}
+	f[parts[0]] = parts[1]
+	return nil
+}
+
+type ulimitList []string
+
+func (u *ulimitList) String() string {
+	return fmt.Sprint(*u)
+}
+
+// Set converts a Docker style name=soft[:hard] ulimit into the name,soft,hard
+// form used by rlimits in the config
+func (u *ulimitList) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("ulimit must be of the form name=soft[:hard]: %s", value)
+	}
+	limits := strings.SplitN(parts[1], ":", 2)
+	if len(limits) == 1 {
+		limits = append(limits, limits[0])
+	}
+	*u = append(*u, strings.Join([]string{parts[0], limits[0], limits[1]}, ","))
+	return nil
+}
+
+// pullPolicy is the -pull option, which can also be given alone, as the
+// boolean option it was, to always pull, see pullArgs
+type pullPolicy moby.PullPolicy
+
+func (p *pullPolicy) String() string {
+	return string(*p)
+}
+
+func (p *pullPolicy) Set(value string) error {
+	policy, err := moby.ParsePullPolicy(value)
+	if err != nil {
+		return err
+	}
+	*p = pullPolicy(policy)
+	return nil
+}
+
+// pullArgs rewrites a -pull option given alone, as the boolean option it
+// was, to -pull=always, as the flag package would otherwise take the next
+// argument as its value. A -pull followed by a policy is left for the flag
+// package.
+func pullArgs(args []string) []string {
+	out := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			return append(out, args[i:]...)
+		}
+		if arg == "-pull" || arg == "--pull" {
+			if i+1 == len(args) {
+				arg += "=" + string(moby.PullAlways)
+			} else if _, err := moby.ParsePullPolicy(args[i+1]); err != nil {
+				arg += "=" + string(moby.PullAlways)
+			}
+		}
+		out = append(out, arg)
+	}
+	return out
+}
+
+type bindList []string
+
+func (b *bindList) String() string {
+	return fmt.Sprint(*b)
+}
+
+// Set adds a name:source:destination[:options] bind for the named container
+func (b *bindList) Set(value string) error {
+	if err := moby.AddExtraBind(value); err != nil {
+		return err
+	}
+	*b = append(*b, value)
+	return nil
+}
+
 // Process the build arguments and execute build
 func build(args []string) {
 	var buildFormats formatList
+	var buildUlimits ulimitList
+	var buildBinds bindList
+	buildPull := pullPolicy(moby.PullMissing)
+	buildOutputNames := formatValues{}
 
 	outputTypes := moby.OutputTypes()
 
@@ -42,18 +163,67 @@ func build(args []string) {
 		fmt.Printf("USAGE: %s build [options] <file>[.yml] | -\n\n", os.Args[0])
 		fmt.Printf("Options:\n")
 		buildCmd.PrintDefaults()
+		fmt.Printf("\nDefaults for the options are read from %s in the working directory, or else in the directory of the config file, if it exists.\n", buildOptionsFile)
 	}
 	buildName := buildCmd.String("name", "", "Name to use for output files")
-	buildDir := buildCmd.String("dir", "", "Directory for output files, default current directory")
+	buildDir := buildCmd.String("dir", "", "Directory for output files, created if needed, default current directory")
+	buildCmd.StringVar(buildDir, "output-dir", "", "Alias for -dir")
 	buildOutputFile := buildCmd.String("o", "", "File to use for a single output, or '-' for stdout")
 	buildSize := buildCmd.String("size", "1024M", "Size for output image, if supported and fixed size")
-	buildPull := buildCmd.Bool("pull", false, "Always pull images")
+	buildCmd.Var(&buildPull, "pull", "When to pull images, always, missing or never, including those of the LinuxKit helper image; -pull alone is always")
+	buildQcow2Backing := buildCmd.String("qcow2-backing-file", "", "Create the qcow2-bios output as an overlay on this qcow2 backing file")
+	buildMaxOutputs := buildCmd.Int("max-parallel-outputs", moby.ParallelOutputs, "Number of output formats to generate at the same time")
+	buildMaxHeavyOutputs := buildCmd.Int("max-parallel-heavy-outputs", moby.ParallelHeavyOutputs, "Number of output formats that run a qemu virtual machine, such as aws and qcow2-bios, to generate at the same time")
+	buildPullAttempts := buildCmd.Int("pull-attempts", envInt("MOBY_PULL_ATTEMPTS", moby.PullAttempts), "Number of times to try pulling an image that fails with a transient error, default $MOBY_PULL_ATTEMPTS or 3")
+	buildParallelPulls := buildCmd.Int("parallel-pulls", moby.ParallelPulls, "Number of images to pull at the same time, 1 pulls one at a time")
+	buildNoCache := buildCmd.Bool("no-cache", false, "Rebuild the cached LinuxKit image used to create some output formats")
+	buildRemoteCache := buildCmd.String("linuxkit-cache", os.Getenv("MOBY_LINUXKIT_CACHE"), "URL of an S3 compatible bucket to share the cached LinuxKit image through, eg https://s3.amazonaws.com/bucket/moby, default $MOBY_LINUXKIT_CACHE")
 	buildDisableTrust := buildCmd.Bool("disable-content-trust", false, "Skip image trust verification specified in trust section of config (default false)")
 	buildCmd.Var(&buildFormats, "format", "Formats to create [ "+strings.Join(outputTypes, " ")+" ]")
+	buildCmd.Var(buildOutputNames, "output-name", "Name to use for the output files of a format as format=name, may be repeated, prefixed with the name of each config with -separate")
+	buildSeparate := buildCmd.Bool("separate", false, "Build each config file as a separate image rather than appending them, with outputs named from the config file name, which must differ")
+	buildJobs := buildCmd.Int("jobs", 4, "Number of configs to build at once with -separate")
+	buildDebugShell := buildCmd.Bool("debug-shell", false, "Add a shell without a login on the console to the image, for debugging")
+	buildDebugOverlay := buildCmd.String("debug-overlay", "", "Config file to merge for a debug build instead of the default, implies -debug-shell")
+	buildOutputMode := buildCmd.String("output-mode", "", "Octal file mode to give the output files, eg 0640, default the mode each format writes")
+	buildOVAName := buildCmd.String("ova-name", "", "Name of the virtual machine in the ova output, default the name of the output")
+	buildDockerImageTag := buildCmd.String("docker-image-tag", "", "Name to load the docker-image output into Docker as, default the name of the output with the latest tag")
+	buildGCPCompression := buildCmd.String("gcp-compression", "gzip", "Compression for the gcp output, gzip for a .img.tar.gz tarball of the disk or none for a raw .img disk")
+	buildGCPLevel := buildCmd.Int("gcp-compression-level", -1, "Gzip compression level for the gcp output, 0-9, or -1 to use the default of the helper image")
+	buildRegistryAuth := buildCmd.String("registry-auth", "", "File in Docker config.json format with registry credentials, default ~/.docker/config.json")
+	buildRegistryHost := buildCmd.String("registry-host", "docker.io", "Registry host that -registry-user gives the credentials for")
+	buildRegistryUser := buildCmd.String("registry-user", "", "Username to pull images from the -registry-host with, instead of the credentials in the registry auth file, the password is read from $MOBY_REGISTRY_PASSWORD or stdin with -registry-password-stdin")
+	buildRegistryPasswordStdin := buildCmd.Bool("registry-password-stdin", false, "Read the password for -registry-user from stdin")
+	buildHelperMemory := buildCmd.String("helper-memory", os.Getenv("MOBY_HELPER_MEMORY"), "Memory limit for mkimage helper containers, eg 2g, default $MOBY_HELPER_MEMORY or unlimited")
+	buildHelperCPUs := buildCmd.String("helper-cpus", os.Getenv("MOBY_HELPER_CPUS"), "CPU limit for mkimage helper containers, eg 1.5, default $MOBY_HELPER_CPUS or unlimited")
+	buildTimeout := buildCmd.Duration("timeout", 0, "Time limit for each Docker API call and mkimage helper container, eg 10m, default no limit")
+	buildKeepFailedHelpers := buildCmd.Bool("keep-failed-helpers", false, "Keep mkimage helper containers that fail so they can be inspected")
+	buildLockfile := buildCmd.String("lockfile", "", "Lockfile mapping image references to digests to pin images to")
+	buildFrozen := buildCmd.Bool("frozen", false, "Fail if an image is not pinned to a digest or in the lockfile")
+	buildWriteLockfile := buildCmd.String("write-lockfile", "", "Write the digest of every image the build used to a lockfile")
+	buildStrict := buildCmd.Bool("strict", false, "Fail if parts of the config do not contribute to the image or bind mount sources are malformed")
+	buildRemapOwner := buildCmd.String("remap-owner", "", "Change the ownership of every file in the images, as +offset to add to the uid and gid or as uid:gid")
+	buildPlatform := buildCmd.String("platform", "", "Platform to pull images for as os/arch[/variant], default the platform of the Docker daemon")
+	buildArch := buildCmd.String("arch", moby.TargetArch, "Architecture every image must be built for, or empty to skip the check")
+	buildMetricsFile := buildCmd.String("metrics-file", "", "Write build metrics to a file in the Prometheus textfile format")
+	buildChecksum := buildCmd.Bool("checksum", false, "Write the SHA256 of each output file to a sidecar file with a .sha256 suffix, in the format of sha256sum")
+	buildManifest := buildCmd.String("manifest", "", "Write a JSON manifest of the format, path, size and SHA256 of each output file")
+	buildSummaryJSON := buildCmd.String("summary-json", "", "Write a JSON summary of the result, steps, artifacts and images used by the build to a file, even if it fails")
+	buildReproReport := buildCmd.String("repro-report", "", "Write the SHA256 of every output file to a JSON report")
+	buildReproPrior := buildCmd.String("repro-compare", "", "Report from a prior build to compare the output files against, failing if any differ")
+	buildContentStore := buildCmd.String("content-store", "", "Local containerd content store, eg /var/lib/containerd/io.containerd.content.v1.content, to read images pinned by digest from instead of exporting them with Docker")
+	buildContext := buildCmd.String("context", "", "Name of the Docker CLI context to build with, default the Docker environment variables")
+	buildConfigLabel := buildCmd.String("config-label", moby.ConfigLabel, "Image label to read default image config from")
+	buildCmd.Var(&buildUlimits, "ulimit", "Default ulimit for all containers as name=soft[:hard], may be repeated")
+	buildCmd.Var(&buildBinds, "bind", "Add a bind to a container as name:source:destination[:options], may be repeated")
 
-	if err := buildCmd.Parse(args); err != nil {
+	if err := buildCmd.Parse(pullArgs(args)); err != nil {
 		log.Fatal("Unable to parse args")
 	}
+	optionsFile := buildOptionsPath(buildCmd.Args())
+	if err := loadBuildOptions(buildCmd, optionsFile); err != nil {
+		log.Fatalf("Cannot use options from %s: %v", optionsFile, err)
+	}
 	remArgs := buildCmd.Args()
 
 	if len(remArgs) == 0 {
@@ -62,6 +232,41 @@ func build(args []string) {
 		os.Exit(1)
 	}
 
+	if *buildSeparate {
+		if *buildName != "" {
+			log.Fatal("The -name option cannot be specified with -separate")
+		}
+		if *buildOutputFile != "" {
+			log.Fatal("The -output option cannot be specified with -separate")
+		}
+		if *buildMetricsFile != "" {
+			log.Fatal("The -metrics-file option cannot be specified with -separate")
+		}
+		if *buildSummaryJSON != "" {
+			log.Fatal("The -summary-json option cannot be specified with -separate")
+		}
+		if *buildManifest != "" {
+			log.Fatal("The -manifest option cannot be specified with -separate")
+		}
+		if *buildReproReport != "" || *buildReproPrior != "" {
+			log.Fatal("The -repro-report and -repro-compare options cannot be specified with -separate")
+		}
+		for _, conf := range remArgs {
+			if conf == "-" {
+				log.Fatal("Cannot read a config from stdin with -separate")
+			}
+		}
+		if err := checkSeparateNames(remArgs); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *buildDir != "" {
+		if err := ensureOutputDir(*buildDir); err != nil {
+			log.Fatalf("Cannot use output directory: %v", err)
+		}
+	}
+
 	name := *buildName
 	if name == "" {
 		conf := remArgs[len(remArgs)-1]
@@ -95,7 +300,7 @@ func build(args []string) {
 	}
 
 	if len(buildFormats) == 1 && moby.Streamable(buildFormats[0]) {
-		if *buildOutputFile == "" {
+		if *buildOutputFile == "" && !*buildSeparate {
 			*buildOutputFile = filepath.Join(*buildDir, name+"."+buildFormats[0])
 			// stop the errors in the validation below
 			*buildName = ""
@@ -110,6 +315,15 @@ func build(args []string) {
 		}
 	}
 
+	var outputMode os.FileMode
+	if *buildOutputMode != "" {
+		mode, err := strconv.ParseUint(*buildOutputMode, 8, 32)
+		if err != nil || mode == 0 || mode&^0777 != 0 {
+			log.Fatalf("Invalid -output-mode %s, must be an octal file mode", *buildOutputMode)
+		}
+		outputMode = os.FileMode(mode)
+	}
+
 	var outputFile *os.File
 	if *buildOutputFile != "" {
 		if len(buildFormats) > 1 {
@@ -125,10 +339,13 @@ func build(args []string) {
 			log.Fatalf("The -output option cannot be specified for build type %s as it cannot be streamed", buildFormats[0])
 		}
 		if *buildOutputFile == "-" {
+			if *buildReproReport != "" || *buildReproPrior != "" {
+				log.Fatal("The -repro-report and -repro-compare options cannot be specified when writing to stdout")
+			}
 			outputFile = os.Stdout
 		} else {
 			var err error
-			outputFile, err = os.Create(*buildOutputFile)
+			outputFile, err = createOutput(*buildOutputFile, outputMode)
 			if err != nil {
 				log.Fatalf("Cannot open output file: %v", err)
 			}
@@ -136,88 +353,582 @@ func build(args []string) {
 		}
 	}
 
+	if *buildGCPLevel < -1 || *buildGCPLevel > 9 {
+		log.Fatalf("Invalid gcp compression level: %d", *buildGCPLevel)
+	}
+	moby.GCPCompressionLevel = *buildGCPLevel
+	if *buildGCPCompression != "gzip" && *buildGCPCompression != "none" {
+		log.Fatalf("Invalid gcp compression %s, must be gzip or none", *buildGCPCompression)
+	}
+	if *buildGCPCompression == "none" && *buildGCPLevel != -1 {
+		log.Fatalf("Cannot set a gcp compression level without gzip compression")
+	}
+	moby.GCPCompression = *buildGCPCompression
+	outputOpts := moby.OutputOptions{
+		Names:             buildOutputNames,
+		OVAName:           *buildOVAName,
+		DockerImageTag:    *buildDockerImageTag,
+		Mode:              outputMode,
+		QCOW2BackingFile:  *buildQcow2Backing,
+		Checksums:         *buildChecksum,
+		KeepFailedHelpers: *buildKeepFailedHelpers,
+		HelperMemory:      *buildHelperMemory,
+		HelperCPUs:        *buildHelperCPUs,
+		Timeout:           *buildTimeout,
+	}
+
 	size, err := getDiskSizeMB(*buildSize)
 	if err != nil {
 		log.Fatalf("Unable to parse disk size: %v", err)
 	}
 
+	if err := moby.UseDockerContext(*buildContext); err != nil {
+		log.Fatalf("Cannot use Docker context: %v", err)
+	}
+	moby.ContentStore = *buildContentStore
+	moby.DefaultRlimits = buildUlimits
+	moby.ConfigLabel = *buildConfigLabel
+	moby.RegistryAuthFile = *buildRegistryAuth
+	if *buildRegistryUser != "" {
+		password := os.Getenv("MOBY_REGISTRY_PASSWORD")
+		if *buildRegistryPasswordStdin {
+			for _, conf := range remArgs {
+				if conf == "-" {
+					log.Fatal("Cannot read both a config and the registry password from stdin")
+				}
+			}
+			b, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				log.Fatalf("Cannot read registry password: %v", err)
+			}
+			password = strings.TrimRight(string(b), "\r\n")
+		}
+		if err := moby.SetRegistryCredentials(*buildRegistryHost, *buildRegistryUser, password); err != nil {
+			log.Fatalf("%v", err)
+		}
+	} else if *buildRegistryPasswordStdin {
+		log.Fatal("The -registry-password-stdin option requires -registry-user")
+	}
+	if *buildTimeout < 0 {
+		log.Fatalf("Invalid -timeout %s, must not be negative", *buildTimeout)
+	}
+	moby.DockerTimeout = *buildTimeout
+	moby.NoCache = *buildNoCache
+	moby.RemoteCache = *buildRemoteCache
+	moby.LinuxkitPull = moby.PullPolicy(buildPull)
+	moby.TargetArch = *buildArch
+	if *buildPlatform != "" {
+		_, arch, _, err := moby.ParsePlatform(*buildPlatform)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		moby.Platform = *buildPlatform
+		archSet := false
+		buildCmd.Visit(func(f *flag.Flag) {
+			if f.Name == "arch" {
+				archSet = true
+			}
+		})
+		if !archSet {
+			moby.TargetArch = arch
+		}
+	}
+	outputOpts.Arch = moby.TargetArch
+	moby.StrictConfig = *buildStrict
+	if *buildRemapOwner != "" {
+		remap, err := moby.ParseIDRemap(*buildRemapOwner)
+		if err != nil {
+			log.Fatalf("Invalid -remap-owner: %v", err)
+		}
+		moby.OwnerRemap = remap
+	}
+	if *buildParallelPulls < 1 {
+		log.Fatalf("Invalid -parallel-pulls %d, must be at least 1", *buildParallelPulls)
+	}
+	moby.ParallelPulls = *buildParallelPulls
+	if *buildPullAttempts < 1 {
+		log.Fatalf("Invalid -pull-attempts %d, must be at least 1", *buildPullAttempts)
+	}
+	moby.PullAttempts = *buildPullAttempts
+	if *buildMaxOutputs < 1 {
+		log.Fatalf("Invalid -max-parallel-outputs %d, must be at least 1", *buildMaxOutputs)
+	}
+	if *buildMaxHeavyOutputs < 1 {
+		log.Fatalf("Invalid -max-parallel-heavy-outputs %d, must be at least 1", *buildMaxHeavyOutputs)
+	}
+	moby.ParallelOutputs = *buildMaxOutputs
+	moby.ParallelHeavyOutputs = *buildMaxHeavyOutputs
+	if *buildSeparate {
+		moby.CheckFdLimit(*buildJobs)
+	} else {
+		moby.CheckFdLimit(1)
+	}
+	knownTypes := map[string]bool{}
+	for _, t := range outputTypes {
+		knownTypes[t] = true
+	}
+	for f := range buildOutputNames {
+		if !knownTypes[f] {
+			log.Fatalf("Unknown format type %s in -output-name", f)
+		}
+	}
+
+	var debugOverlay []byte
+	if *buildDebugOverlay != "" {
+		debugOverlay, err = ioutil.ReadFile(*buildDebugOverlay)
+		if err != nil {
+			log.Fatalf("Cannot open debug overlay: %v", err)
+		}
+	}
+
+	lock := moby.Lockfile{}
+	if *buildLockfile != "" {
+		b, err := ioutil.ReadFile(*buildLockfile)
+		if err != nil {
+			log.Fatalf("Cannot open lockfile: %v", err)
+		}
+		if lock, err = moby.ParseLockfile(b); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	// resolved collects the digests of the images the builds used, for -write-lockfile
+	resolved := moby.Lockfile{}
+	var resolvedMu sync.Mutex
+	writeLockfile := func() {
+		if *buildWriteLockfile == "" {
+			return
+		}
+		if err := resolved.WriteFile(*buildWriteLockfile); err != nil {
+			log.Fatalf("Cannot write lockfile: %v", err)
+		}
+	}
+
+	// buildConfig assembles an image from a config, then writes it to outputFile
+	// if that is set, or otherwise creates the selected outputs named from base
+	// with opts, recording the steps in summary if it is not nil
+	buildConfig := func(m moby.Moby, outputFile *os.File, base string, opts moby.OutputOptions, summary *moby.BuildSummary) error {
+		if err := moby.ApplyLockfile(&m, lock, *buildFrozen); err != nil {
+			return err
+		}
+
+		if *buildDebugShell || *buildDebugOverlay != "" {
+			var err error
+			m, err = moby.DebugConfig(m, debugOverlay)
+			if err != nil {
+				return fmt.Errorf("Cannot apply debug overlay: %v", err)
+			}
+		}
+
+		if err := moby.ValidateExtraBinds(m); err != nil {
+			return err
+		}
+
+		if *buildDisableTrust {
+			log.Debugf("Disabling content trust checks for this build")
+			m.Trust = moby.TrustConfig{}
+		}
+
+		var tf *os.File
+		var w io.Writer
+		if outputFile != nil {
+			w = outputFile
+		} else {
+			var err error
+			if tf, err = ioutil.TempFile("", ""); err != nil {
+				return fmt.Errorf("Error creating tempfile: %v", err)
+			}
+			defer os.Remove(tf.Name())
+			w = tf
+		}
+
+		// this is a weird interface, but currently only streamable types can have additional files
+		// need to split up the base tarball outputs from the secondary stages
+		var tp string
+		if moby.Streamable(buildFormats[0]) {
+			tp = buildFormats[0]
+		}
+		err := summary.Step("build", func() error {
+			return moby.Build(m, w, moby.PullPolicy(buildPull), tp)
+		})
+		if err != nil {
+			return err
+		}
+
+		if *buildWriteLockfile != "" {
+			lock, err := moby.LockImages(m)
+			if err != nil {
+				return err
+			}
+			resolvedMu.Lock()
+			for image, d := range lock {
+				resolved[image] = d
+			}
+			resolvedMu.Unlock()
+		}
+
+		if outputFile != nil && opts.Checksums {
+			if fi, err := outputFile.Stat(); err == nil && fi.Mode().IsRegular() {
+				if err := moby.WriteChecksum(outputFile.Name()); err != nil {
+					return fmt.Errorf("Cannot write checksum of %s: %v", outputFile.Name(), err)
+				}
+			}
+		}
+
+		if outputFile == nil {
+			image := tf.Name()
+			if err := tf.Close(); err != nil {
+				return fmt.Errorf("Error closing tempfile: %v", err)
+			}
+
+			log.Infof("Create outputs:")
+			err := summary.Step("outputs", func() error {
+				return moby.Formats(base, image, buildFormats, size, m.HelperArgs(), m.Kernel.FullCmdline(), &opts)
+			})
+			if err != nil {
+				return fmt.Errorf("Error writing outputs: %v", err)
+			}
+		}
+		return nil
+	}
+
+	if *buildSeparate {
+		err := parallel(*buildJobs, remArgs, func(conf string) error {
+			m, err := readConfigs([]string{conf})
+			if err != nil {
+				return err
+			}
+			name := separateName(conf)
+			if moby.Streamable(buildFormats[0]) {
+				f, err := createOutput(filepath.Join(*buildDir, name+"."+buildFormats[0]), outputMode)
+				if err != nil {
+					return fmt.Errorf("Cannot open output file: %v", err)
+				}
+				defer f.Close()
+				return buildConfig(m, f, "", outputOpts, nil)
+			}
+			opts := outputOpts
+			opts.Names = separateNames(name, buildOutputNames)
+			return buildConfig(m, nil, filepath.Join(*buildDir, name), opts, nil)
+		})
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		writeLockfile()
+		return
+	}
+
+	start := time.Now()
+	var summary *moby.BuildSummary
+	if *buildSummaryJSON != "" {
+		summary = &moby.BuildSummary{}
+	}
+	base := filepath.Join(*buildDir, name)
+	err = summary.Step("config", func() error {
+		m, err := readConfigs(remArgs)
+		if err != nil {
+			return err
+		}
+		return buildConfig(m, outputFile, base, outputOpts, summary)
+	})
+	// the outputs are described once for the summary, manifest, metrics and
+	// reproducibility report
+	var artifacts []moby.Artifact
+	if err == nil && (summary != nil || *buildManifest != "" || *buildMetricsFile != "" || *buildReproReport != "" || *buildReproPrior != "") {
+		artifacts, err = buildArtifacts(outputFile, base, buildFormats, buildOutputNames)
+		if err != nil {
+			err = fmt.Errorf("Cannot describe outputs: %v", err)
+		}
+	}
+	if summary != nil {
+		summary.Artifacts = artifacts
+		summary.Finish(start, err)
+		if writeErr := summary.WriteFile(*buildSummaryJSON); writeErr != nil {
+			log.Errorf("Cannot write summary: %v", writeErr)
+		}
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	writeLockfile()
+
+	if *buildManifest != "" {
+		if err := moby.WriteArtifactManifest(*buildManifest, artifacts); err != nil {
+			log.Fatalf("Cannot write manifest: %v", err)
+		}
+	}
+
+	if *buildMetricsFile != "" {
+		metrics := moby.BuildMetrics{
+			Duration:     time.Since(start),
+			Artifacts:    moby.ArtifactSizes(artifacts),
+			ImagesPulled: moby.ImagesPulled(),
+		}
+		if err := metrics.WriteFile(*buildMetricsFile); err != nil {
+			log.Fatalf("Cannot write metrics file: %v", err)
+		}
+	}
+
+	if *buildReproReport != "" || *buildReproPrior != "" {
+		var files []string
+		for _, a := range artifacts {
+			files = append(files, a.Path)
+		}
+		report, err := moby.NewReproReport(files)
+		if err != nil {
+			log.Fatalf("Cannot hash outputs for reproducibility report: %v", err)
+		}
+		if *buildReproReport != "" {
+			if err := report.WriteFile(*buildReproReport); err != nil {
+				log.Fatalf("Cannot write reproducibility report: %v", err)
+			}
+		}
+		if *buildReproPrior != "" {
+			prior, err := moby.ReadReproReport(*buildReproPrior)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			diffs := report.Compare(prior)
+			for _, d := range diffs {
+				log.Errorf("Output %s differs: was %q, now %q", d.Name, d.Prior, d.Got)
+			}
+			if len(diffs) != 0 {
+				log.Fatalf("Build is not reproducible: %d outputs differ from %s", len(diffs), *buildReproPrior)
+			}
+			log.Infof("All outputs match %s", *buildReproPrior)
+		}
+	}
+}
+
+// createOutput creates an output file, with mode unless it is zero. The file
+// is opened with the mode, so it never has more permissions than it, then
+// set to exactly the mode, which the umask may have masked.
+func createOutput(name string, mode os.FileMode) (*os.File, error) {
+	if mode == 0 {
+		return os.Create(name)
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Cannot set mode of %s: %v", name, err)
+	}
+	return f, nil
+}
+
+// buildArtifacts describes the files created by the build, which are the
+// output file unless it is not a regular file, such as stdout
+func buildArtifacts(outputFile *os.File, base string, formats []string, names map[string]string) ([]moby.Artifact, error) {
+	if outputFile != nil {
+		if fi, err := outputFile.Stat(); err != nil || !fi.Mode().IsRegular() {
+			return []moby.Artifact{}, nil
+		}
+		a, err := moby.NewArtifact(outputFile.Name(), formats[0])
+		if err != nil {
+			return nil, err
+		}
+		return []moby.Artifact{a}, nil
+	}
+	return moby.OutputArtifacts(base, formats, names)
+}
+
+// separateName is the name of the outputs of a config built with -separate
+func separateName(conf string) string {
+	return strings.TrimSuffix(filepath.Base(conf), filepath.Ext(conf))
+}
+
+// checkSeparateNames checks that no two configs built with -separate write
+// outputs with the same name, as they are built at the same time
+func checkSeparateNames(configs []string) error {
+	seen := map[string]string{}
+	for _, conf := range configs {
+		name := separateName(conf)
+		if other, ok := seen[name]; ok {
+			return fmt.Errorf("Cannot build both %s and %s with -separate, as the outputs of both are named %s", other, conf, name)
+		}
+		seen[name] = conf
+	}
+	return nil
+}
+
+// separateNames returns the -output-name names for a config built with
+// -separate, prefixed with the name of the config so that each build names
+// its files differently
+func separateNames(config string, names map[string]string) map[string]string {
+	separate := map[string]string{}
+	for format, name := range names {
+		separate[format] = config + "-" + name
+	}
+	return separate
+}
+
+// loadBuildOptions sets flags that were not given on the command line from a
+// YAML file mapping option names to values. A list sets a repeatable option
+// once for each item, and a map sets it as key=value for each entry. It is
+// not an error for the file not to exist.
+func loadBuildOptions(fs *flag.FlagSet, file string) error {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var options map[string]optionValue
+	if err := yaml.Unmarshal(b, &options); err != nil {
+		return err
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("Unknown option %s", name)
+		}
+		if set[name] {
+			continue
+		}
+		for _, value := range options[name].values {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("Invalid value %q for %s: %v", value, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// optionValue is the value of an option in the options file, kept as the
+// text it is written as, so that a mode such as 0640 is not read as a number
+type optionValue struct {
+	values []string
+}
+
+// UnmarshalYAML reads a scalar as a single value, a list as a value for each
+// item and a map as a key=value for each entry
+func (o *optionValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err == nil {
+		o.values = []string{value}
+		return nil
+	}
+	if err := unmarshal(&o.values); err == nil {
+		return nil
+	}
+	var entries map[string]string
+	if err := unmarshal(&entries); err != nil {
+		return err
+	}
+	for k, v := range entries {
+		o.values = append(o.values, k+"="+v)
+	}
+	sort.Strings(o.values)
+	return nil
+}
+
+// readConfigs reads and appends config files, which may be "-" for stdin or a URL
+func readConfigs(args []string) (moby.Moby, error) {
 	var m moby.Moby
-	for _, arg := range remArgs {
+	for _, arg := range args {
 		var config []byte
+		local := false
 		if conf := arg; conf == "-" {
 			var err error
 			config, err = ioutil.ReadAll(os.Stdin)
 			if err != nil {
-				log.Fatalf("Cannot read stdin: %v", err)
+				return m, fmt.Errorf("Cannot read stdin: %v", err)
 			}
 		} else if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
 			buffer := new(bytes.Buffer)
 			response, err := http.Get(arg)
 			if err != nil {
-				log.Fatalf("Cannot fetch remote yaml file: %v", err)
+				return m, fmt.Errorf("Cannot fetch remote yaml file: %v", err)
 			}
 			defer response.Body.Close()
 			_, err = io.Copy(buffer, response.Body)
 			if err != nil {
-				log.Fatalf("Error reading http body: %v", err)
+				return m, fmt.Errorf("Error reading http body: %v", err)
 			}
 			config = buffer.Bytes()
 		} else {
 			var err error
 			config, err = ioutil.ReadFile(conf)
 			if err != nil {
-				log.Fatalf("Cannot open config file: %v", err)
+				return m, fmt.Errorf("Cannot open config file: %v", err)
 			}
+			local = true
 		}
 
-		c, err := moby.NewConfig(config)
+		var c moby.Moby
+		var err error
+		switch {
+		case local:
+			c, err = moby.NewConfigFile(arg, config)
+		case arg == "-":
+			c, err = moby.NewConfig(config)
+		default:
+			c, err = moby.NewRemoteConfig(config)
+		}
 		if err != nil {
-			log.Fatalf("Invalid config: %v", err)
+			return m, fmt.Errorf("Invalid config: %v", err)
 		}
 		m, err = moby.AppendConfig(m, c)
 		if err != nil {
-			log.Fatalf("Cannot append config files: %v", err)
+			return m, fmt.Errorf("Cannot append config files: %v", err)
 		}
 	}
+	return m, nil
+}
 
-	if *buildDisableTrust {
-		log.Debugf("Disabling content trust checks for this build")
-		m.Trust = moby.TrustConfig{}
+// parallel calls fn for each arg, running at most n at once, and returns
+// an error listing every arg that failed
+func parallel(n int, args []string, fn func(string) error) error {
+	if n < 1 {
+		n = 1
+	}
+	errs := make([]error, len(args))
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for i, arg := range args {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, arg string) {
+			defer wg.Done()
+			errs[i] = fn(arg)
+			<-sem
+		}(i, arg)
 	}
+	wg.Wait()
 
-	var tf *os.File
-	var w io.Writer
-	if outputFile != nil {
-		w = outputFile
-	} else {
-		if tf, err = ioutil.TempFile("", ""); err != nil {
-			log.Fatalf("Error creating tempfile: %v", err)
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", args[i], err))
 		}
-		defer os.Remove(tf.Name())
-		w = tf
 	}
-
-	// this is a weird interface, but currently only streamable types can have additional files
-	// need to split up the base tarball outputs from the secondary stages
-	var tp string
-	if moby.Streamable(buildFormats[0]) {
-		tp = buildFormats[0]
+	if len(failed) != 0 {
+		return errors.New(strings.Join(failed, "\n"))
 	}
-	err = moby.Build(m, w, *buildPull, tp)
-	if err != nil {
-		log.Fatalf("%v", err)
-	}
-
-	if outputFile == nil {
-		image := tf.Name()
-		if err := tf.Close(); err != nil {
-			log.Fatalf("Error closing tempfile: %v", err)
-		}
+	return nil
+}
 
-		log.Infof("Create outputs:")
-		err = moby.Formats(filepath.Join(*buildDir, name), image, buildFormats, size)
-		if err != nil {
-			log.Fatalf("Error writing outputs: %v", err)
+// ensureOutputDir creates the directory for the output files if it does not exist
+func ensureOutputDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("%s exists and is not a directory", dir)
 		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
 	}
+	return os.MkdirAll(dir, 0755)
 }
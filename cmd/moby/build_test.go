@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/moby/tool/src/moby"
+)
+
+func TestParallelSeparateConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configs := map[string]string{
+		"a.yml": "services:\n  - name: a\n    image: linuxkit/a:v1\n",
+		"b.yml": "services:\n  - name: b\n    image: linuxkit/b:v1\n",
+	}
+	var args []string
+	for name, contents := range configs {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		args = append(args, path)
+	}
+
+	var mu sync.Mutex
+	built := map[string][]string{}
+	err = parallel(2, args, func(conf string) error {
+		m, err := readConfigs([]string{conf})
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, s := range m.Services {
+			built[filepath.Base(conf)] = append(built[filepath.Base(conf)], s.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(built["a.yml"]) != 1 || built["a.yml"][0] != "a" {
+		t.Errorf("Expected a.yml to build only service a, got %v", built["a.yml"])
+	}
+	if len(built["b.yml"]) != 1 || built["b.yml"][0] != "b" {
+		t.Errorf("Expected b.yml to build only service b, got %v", built["b.yml"])
+	}
+}
+
+func TestParallelErrors(t *testing.T) {
+	var mu sync.Mutex
+	running, peak := 0, 0
+	err := parallel(2, []string{"a", "b", "c", "d", "e"}, func(arg string) error {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+		if arg == "b" || arg == "d" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if peak > 2 {
+		t.Errorf("Expected at most 2 builds at once, got %d", peak)
+	}
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if !strings.Contains(err.Error(), "b: failed") || !strings.Contains(err.Error(), "d: failed") {
+		t.Errorf("Expected error to name every failed build, got %v", err)
+	}
+}
+
+func TestEnsureOutputDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "artifacts", "amd64")
+	if err := ensureOutputDir(out); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(out); err != nil || !fi.IsDir() {
+		t.Errorf("Expected %s to be created: %v", out, err)
+	}
+	if err := ensureOutputDir(out); err != nil {
+		t.Errorf("Expected an existing directory to be used: %v", err)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureOutputDir(file); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("Expected a file to be rejected, got %v", err)
+	}
+}
+
+func TestLoadBuildOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, buildOptionsFile)
+	options := "size: 2G\npull: true\nname: fromfile\nformat: [iso-bios, raw-bios]\noutput-mode: 0640\n"
+	if err := ioutil.WriteFile(file, []byte(options), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var formats formatList
+	fs := flag.NewFlagSet("build", flag.ContinueOnError)
+	size := fs.String("size", "1024M", "")
+	pull := fs.Bool("pull", false, "")
+	name := fs.String("name", "", "")
+	mode := fs.String("output-mode", "", "")
+	fs.Var(&formats, "format", "")
+	if err := fs.Parse([]string{"-name", "fromflag", "linuxkit.yml"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadBuildOptions(fs, file); err != nil {
+		t.Fatal(err)
+	}
+	if *name != "fromflag" {
+		t.Errorf("Expected the -name flag to override the file, got %s", *name)
+	}
+	if *size != "2G" || !*pull {
+		t.Errorf("Expected size and pull from the file, got %s and %v", *size, *pull)
+	}
+	if strings.Join(formats, ",") != "iso-bios,raw-bios" {
+		t.Errorf("Expected formats from the file, got %v", formats)
+	}
+	if *mode != "0640" {
+		t.Errorf("Expected the output mode as written in the file, got %s", *mode)
+	}
+
+	if err := loadBuildOptions(fs, filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("Expected a missing file to be ignored: %v", err)
+	}
+	if err := ioutil.WriteFile(file, []byte("sise: 2G\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadBuildOptions(fs, file); err == nil || !strings.Contains(err.Error(), "Unknown option sise") {
+		t.Errorf("Expected an unknown option to be rejected, got %v", err)
+	}
+}
+
+func TestBuildOptionsPath(t *testing.T) {
+	for _, tc := range []struct {
+		configs []string
+		want    string
+	}{
+		{configs: []string{"linuxkit.yml"}, want: buildOptionsFile},
+		{configs: []string{"examples/sshd.yml", "other/extra.yml"}, want: filepath.Join("examples", buildOptionsFile)},
+		{configs: []string{"-", "https://example.com/base.yml", "/src/os.yml"}, want: filepath.Join("/src", buildOptionsFile)},
+		{configs: []string{"https://example.com/base.yml"}, want: buildOptionsFile},
+	} {
+		if got := buildOptionsPath(tc.configs); got != tc.want {
+			t.Errorf("%v: expected %s, got %s", tc.configs, tc.want, got)
+		}
+	}
+
+	// the file in the working directory comes first
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, buildOptionsFile), []byte("size: 2G\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if got := buildOptionsPath([]string{"examples/sshd.yml"}); got != buildOptionsFile {
+		t.Errorf("Expected the options file in the working directory, got %s", got)
+	}
+}
+
+func TestPullPolicyFlag(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want moby.PullPolicy
+		err  bool
+	}{
+		{args: nil, want: moby.PullMissing},
+		{args: []string{"-pull"}, want: moby.PullAlways},
+		{args: []string{"-pull=false"}, want: moby.PullMissing},
+		{args: []string{"-pull=always"}, want: moby.PullAlways},
+		{args: []string{"-pull=missing"}, want: moby.PullMissing},
+		{args: []string{"-pull=never"}, want: moby.PullNever},
+		{args: []string{"-pull=sometimes"}, err: true},
+		{args: []string{"-pull", "never"}, want: moby.PullNever},
+		{args: []string{"--pull", "always"}, want: moby.PullAlways},
+		{args: []string{"-pull", "false"}, want: moby.PullMissing},
+		{args: []string{"-pull", "-pull=never"}, want: moby.PullNever},
+		{args: []string{"-name", "x", "-pull"}, want: moby.PullAlways},
+	} {
+		fs := flag.NewFlagSet("build", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		pull := pullPolicy(moby.PullMissing)
+		fs.Var(&pull, "pull", "")
+		fs.String("name", "", "")
+		err := fs.Parse(pullArgs(append(tc.args, "config.yml")))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%v: expected an error", tc.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tc.args, err)
+			continue
+		}
+		if moby.PullPolicy(pull) != tc.want || fs.Arg(0) != "config.yml" {
+			t.Errorf("%v: expected policy %s and the config as an argument, got %s and %v", tc.args, tc.want, pull, fs.Args())
+		}
+	}
+}
+
+func TestSeparateNames(t *testing.T) {
+	names := formatValues{"iso-bios": "installer"}
+	if got := separateNames("sshd", names); !reflect.DeepEqual(got, map[string]string{"iso-bios": "sshd-installer"}) {
+		t.Errorf("Expected the output name prefixed with the config name, got %v", got)
+	}
+	if names["iso-bios"] != "installer" {
+		t.Errorf("Expected the names of the build to be left alone, got %v", names)
+	}
+}
+
+func TestCheckSeparateNames(t *testing.T) {
+	if err := checkSeparateNames([]string{"a/x.yml", "b/y.yml", "https://example.com/z.yml"}); err != nil {
+		t.Errorf("Expected configs with different names to be accepted, got %v", err)
+	}
+	if err := checkSeparateNames([]string{"a/x.yml", "b/x.yml"}); err == nil || !strings.Contains(err.Error(), "named x") {
+		t.Errorf("Expected configs with the same name to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/moby/tool/src/moby"
+	log "github.com/sirupsen/logrus"
+)
+
+// Save or restore the cached LinuxKit helper images
+func cache(args []string) {
+	cacheCmd := flag.NewFlagSet("cache", flag.ExitOnError)
+	cacheCmd.Usage = func() {
+		fmt.Printf("USAGE: %s cache import|export <file>\n\n", os.Args[0])
+		fmt.Printf("Export the cached LinuxKit helper images to a tarball, or import them from one.\n")
+		fmt.Printf("Use '-' for stdin or stdout. Entries for out of date helpers are skipped on import.\n")
+	}
+	if err := cacheCmd.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := cacheCmd.Args()
+	if len(remArgs) != 2 {
+		cacheCmd.Usage()
+		os.Exit(1)
+	}
+	file := remArgs[1]
+
+	switch remArgs[0] {
+	case "export":
+		var w io.WriteCloser = os.Stdout
+		if file != "-" {
+			f, err := os.Create(file)
+			if err != nil {
+				log.Fatalf("Cannot create cache export: %v", err)
+			}
+			w = f
+		}
+		log.Infof("Export cache:")
+		if err := moby.ExportCache(w); err != nil {
+			log.Fatalf("Cannot export cache: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			log.Fatalf("Cannot export cache: %v", err)
+		}
+	case "import":
+		var r io.ReadCloser = os.Stdin
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				log.Fatalf("Cannot open cache export: %v", err)
+			}
+			r = f
+		}
+		defer r.Close()
+		imported, skipped, err := moby.ImportCache(r)
+		if err != nil {
+			log.Fatalf("Cannot import cache: %v", err)
+		}
+		for _, name := range skipped {
+			log.Warnf("Skipped stale cache entry %s", name)
+		}
+		log.Infof("Imported %d cache files", len(imported))
+	default:
+		fmt.Printf("%q is not a valid cache command.\n\n", remArgs[0])
+		cacheCmd.Usage()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/moby/tool/src/moby"
+	log "github.com/sirupsen/logrus"
+)
+
+// Check that the output formats can be built without building them
+func checkOutputs(args []string) {
+	checkCmd := flag.NewFlagSet("check-outputs", flag.ExitOnError)
+	checkCmd.Usage = func() {
+		fmt.Printf("USAGE: %s check-outputs [options]\n\n", os.Args[0])
+		fmt.Printf("Check that the tools and images needed for the output formats are available,\n")
+		fmt.Printf("without pulling images or building the LinuxKit helper images\n")
+		fmt.Printf("Options:\n")
+		checkCmd.PrintDefaults()
+	}
+	var checkFormats formatList
+	checkCmd.Var(&checkFormats, "format", "Formats to check [ "+strings.Join(moby.OutputTypes(), " ")+" ]")
+	checkQcow2Backing := checkCmd.String("qcow2-backing-file", "", "Check the qcow2-bios output can be made an overlay on a backing file")
+	if err := checkCmd.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if len(checkFormats) == 0 {
+		checkCmd.Usage()
+		os.Exit(1)
+	}
+	opts := &moby.OutputOptions{QCOW2BackingFile: *checkQcow2Backing}
+	checks, err := moby.FormatChecks(checkFormats, opts)
+	if err != nil {
+		log.Fatalf("Error checking formats: %v", err)
+	}
+	if !moby.RunChecks(os.Stdout, checks) {
+		os.Exit(1)
+	}
+}
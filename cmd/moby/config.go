@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/moby/tool/src/moby"
+	log "github.com/sirupsen/logrus"
+)
+
+// Work with config files
+func config(args []string) {
+	if len(args) == 0 || args[0] != "dump" {
+		fmt.Printf("USAGE: %s config dump [options] <file>[.yml] | -\n\n", os.Args[0])
+		fmt.Printf("Run '%s config dump --help' for more information on the command\n", os.Args[0])
+		os.Exit(1)
+	}
+	configDump(args[1:])
+}
+
+// Print the effective config a build would use
+func configDump(args []string) {
+	dumpCmd := flag.NewFlagSet("config dump", flag.ExitOnError)
+	dumpCmd.Usage = func() {
+		fmt.Printf("USAGE: %s config dump [options] <file>[.yml] | -\n\n", os.Args[0])
+		fmt.Printf("Print the config that a build of the files would use, after merging them and\n")
+		fmt.Printf("applying the lockfile and debug overlay. Images that content trust is enforced\n")
+		fmt.Printf("for are pinned to their signed digests. With -lockfile, the config as written is\n")
+		fmt.Printf("printed first, followed by the config with the lockfile applied.\n")
+		fmt.Printf("Options:\n")
+		dumpCmd.PrintDefaults()
+	}
+	dumpFormat := dumpCmd.String("format", "yaml", "Format to print the config in, yaml or json")
+	dumpDisableTrust := dumpCmd.Bool("disable-content-trust", false, "Do not resolve the digests of images in the trust section of config")
+	dumpDebugShell := dumpCmd.Bool("debug-shell", false, "Add a shell without a login on the console to the image, for debugging")
+	dumpDebugOverlay := dumpCmd.String("debug-overlay", "", "Config file to merge for a debug build instead of the default, implies -debug-shell")
+	dumpLockfile := dumpCmd.String("lockfile", "", "Lockfile mapping image references to digests to pin images to")
+	dumpFrozen := dumpCmd.Bool("frozen", false, "Fail if an image is not pinned to a digest or in the lockfile")
+
+	if err := dumpCmd.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := dumpCmd.Args()
+	if len(remArgs) == 0 {
+		fmt.Println("Please specify a configuration file")
+		dumpCmd.Usage()
+		os.Exit(1)
+	}
+	if *dumpFormat != "yaml" && *dumpFormat != "json" {
+		log.Fatalf("Unknown format %s, must be yaml or json", *dumpFormat)
+	}
+
+	m, err := readConfigs(remArgs)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	var overlay []byte
+	if *dumpDebugOverlay != "" {
+		if overlay, err = ioutil.ReadFile(*dumpDebugOverlay); err != nil {
+			log.Fatalf("Cannot open debug overlay: %v", err)
+		}
+	}
+	debug := func(m moby.Moby) moby.Moby {
+		if !*dumpDebugShell && *dumpDebugOverlay == "" {
+			return m
+		}
+		m, err := moby.DebugConfig(m, overlay)
+		if err != nil {
+			log.Fatalf("Cannot apply debug overlay: %v", err)
+		}
+		return m
+	}
+
+	// with a lockfile, the config as written is printed first, so that a
+	// wrong pin can be told apart from a wrong reference in the config
+	if *dumpLockfile != "" {
+		b, err := ioutil.ReadFile(*dumpLockfile)
+		if err != nil {
+			log.Fatalf("Cannot open lockfile: %v", err)
+		}
+		lock, err := moby.ParseLockfile(b)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		printConfig(debug(m), *dumpFormat)
+		if *dumpFormat == "yaml" {
+			fmt.Println("---")
+		}
+		if err := moby.ApplyLockfile(&m, lock, *dumpFrozen); err != nil {
+			log.Fatalf("%v", err)
+		}
+	} else if *dumpFrozen {
+		if err := moby.ApplyLockfile(&m, moby.Lockfile{}, true); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	m = debug(m)
+
+	if *dumpDisableTrust {
+		m.Trust = moby.TrustConfig{}
+	}
+	if err := moby.ResolveTrust(&m); err != nil {
+		log.Fatalf("%v", err)
+	}
+	printConfig(m, *dumpFormat)
+}
+
+// printConfig prints a config in a format DumpConfig supports
+func printConfig(m moby.Moby, format string) {
+	b, err := moby.DumpConfig(m, format)
+	if err != nil {
+		log.Fatalf("Cannot print config: %v", err)
+	}
+	os.Stdout.Write(b)
+	if len(b) != 0 && b[len(b)-1] != '\n' {
+		fmt.Println()
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/moby/tool/src/moby"
+	log "github.com/sirupsen/logrus"
+)
+
+// Check that the tools and images needed to build are available
+func doctor(args []string) {
+	doctorCmd := flag.NewFlagSet("doctor", flag.ExitOnError)
+	doctorCmd.Usage = func() {
+		fmt.Printf("USAGE: %s doctor\n\n", os.Args[0])
+		fmt.Printf("Check that the tools and images needed to build images are available\n")
+	}
+	if err := doctorCmd.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	if !moby.RunChecks(os.Stdout, moby.DoctorChecks()) {
+		os.Exit(1)
+	}
+}
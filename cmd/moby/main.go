@@ -47,11 +47,32 @@ func defaultMobyConfigDir() string {
 	return filepath.Join(home, mobyDefaultDir)
 }
 
+// helperCommands are the commands that use the mkimage helper images
+var helperCommands = map[string]bool{
+	"build":          true,
+	"check-outputs":  true,
+	"doctor":         true,
+	"output":         true,
+	"verify-helpers": true,
+}
+
 func main() {
 	flag.Usage = func() {
 		fmt.Printf("USAGE: %s [options] COMMAND\n\n", filepath.Base(os.Args[0]))
 		fmt.Printf("Commands:\n")
+		fmt.Printf("  bom-diff    Report the files changed between two manifests\n")
 		fmt.Printf("  build       Build a Moby image from a YAML file\n")
+		fmt.Printf("  cache       Export or import the cached LinuxKit helper images\n")
+		fmt.Printf("  check-outputs  Check the output formats can be built\n")
+		fmt.Printf("  config dump Print the effective config a build would use\n")
+		fmt.Printf("  doctor      Check the environment can build images\n")
+		fmt.Printf("  init        Write a starter YAML file\n")
+		fmt.Printf("  output      Create outputs from an assembled image tarball\n")
+		fmt.Printf("  prune       Report on and remove stale entries from the cache directory\n")
+		fmt.Printf("  push        Upload built outputs to a registry\n")
+		fmt.Printf("  test        Check that the outputs of a YAML file boot\n")
+		fmt.Printf("  validate    Check YAML files are valid configs without building\n")
+		fmt.Printf("  verify-helpers  Check the mkimage helper images match their pinned digests\n")
 		fmt.Printf("  version     Print version information\n")
 		fmt.Printf("  help        Print this message\n")
 		fmt.Printf("\n")
@@ -67,6 +88,7 @@ func main() {
 
 	// config and cache directory
 	flagConfigDir := flag.String("config", defaultMobyConfigDir(), "Configuration directory")
+	flagHelperImages := flag.String("helper-images", os.Getenv("MOBY_HELPER_IMAGES"), "YAML file mapping mkimage helpers, such as iso-bios, to images to use instead of the pinned ones, default $MOBY_HELPER_IMAGES or helper-images.yml in the configuration directory")
 
 	// Set up logging
 	log.SetFormatter(new(infoFormatter))
@@ -104,6 +126,27 @@ func main() {
 		log.Fatalf("Could not create config tmp directory [%s]: %v", filepath.Join(mobyDir, "tmp"), err)
 	}
 	moby.MobyDir = mobyDir
+	moby.BuildVersion = Version
+	moby.BuildCommit = GitCommit
+
+	// only the commands that run the helpers read the overrides, so that a
+	// bad override does not stop the others
+	if helperCommands[args[0]] {
+		helperImages := *flagHelperImages
+		if helperImages == "" {
+			helperImages = filepath.Join(mobyDir, "helper-images.yml")
+		}
+		update, err := moby.HelperImageOverrides(os.Environ(), helperImages)
+		if err != nil {
+			log.Fatalf("Cannot override helper images: %v", err)
+		}
+		if err := moby.UpdateOutputImages(update); err != nil {
+			log.Fatalf("Cannot override helper images: %v", err)
+		}
+		for name, img := range update {
+			log.Debugf("Using %s for the %s helper instead of the pinned image", img, name)
+		}
+	}
 
 	if *flagCPUProfile != "" {
 		f, err := os.Create(*flagCPUProfile)
@@ -117,8 +160,32 @@ func main() {
 	}
 
 	switch args[0] {
+	case "bom-diff":
+		bomDiff(args[1:])
 	case "build":
 		build(args[1:])
+	case "cache":
+		cache(args[1:])
+	case "check-outputs":
+		checkOutputs(args[1:])
+	case "config":
+		config(args[1:])
+	case "doctor":
+		doctor(args[1:])
+	case "init":
+		initConfig(args[1:])
+	case "output":
+		output(args[1:])
+	case "prune":
+		prune(args[1:])
+	case "push":
+		push(args[1:])
+	case "test":
+		test(args[1:])
+	case "validate":
+		validate(args[1:])
+	case "verify-helpers":
+		verifyHelpers(args[1:])
 	case "version":
 		version()
 	case "help":
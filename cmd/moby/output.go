@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/tool/src/moby"
+	log "github.com/sirupsen/logrus"
+)
+
+// Create outputs from an image tarball that has already been assembled
+func output(args []string) {
+	var outputFormats formatList
+
+	outputCmd := flag.NewFlagSet("output", flag.ExitOnError)
+	outputCmd.Usage = func() {
+		fmt.Printf("USAGE: %s output [options] <assembly.tar>\n\n", os.Args[0])
+		fmt.Printf("Create outputs from an image tarball, as written by 'build -format tar',\n")
+		fmt.Printf("without pulling images or assembling the image again\n")
+		fmt.Printf("Options:\n")
+		outputCmd.PrintDefaults()
+	}
+	outputName := outputCmd.String("name", "", "Name to use for output files, default the name of the tarball")
+	outputDir := outputCmd.String("dir", "", "Directory for output files, created if needed, default current directory")
+	outputSize := outputCmd.String("size", "1024M", "Size for output image, if supported and fixed size")
+	outputCmd.Var(&outputFormats, "format", "Formats to create [ "+strings.Join(moby.OutputTypes(), " ")+" ]")
+	outputCmd.Var(&outputFormats, "output", "Alias for -format")
+	outputCmdline := outputCmd.String("cmdline", "", "Kernel command line for the outputs, default the one in the tarball")
+	outputChecksum := outputCmd.Bool("checksum", false, "Write the SHA256 of each output file to a sidecar file with a .sha256 suffix, in the format of sha256sum")
+	outputManifest := outputCmd.String("manifest", "", "Write a JSON manifest of the format, path, size and SHA256 of each output file")
+
+	if err := outputCmd.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	// allow the options to follow the tarball too
+	remArgs := outputCmd.Args()
+	if len(remArgs) > 1 {
+		if err := outputCmd.Parse(remArgs[1:]); err != nil {
+			log.Fatal("Unable to parse args")
+		}
+		if len(outputCmd.Args()) != 0 {
+			fmt.Println("Please specify a single image tarball")
+			outputCmd.Usage()
+			os.Exit(1)
+		}
+	}
+	if len(remArgs) == 0 {
+		fmt.Println("Please specify an image tarball")
+		outputCmd.Usage()
+		os.Exit(1)
+	}
+	if len(outputFormats) == 0 {
+		fmt.Println("Please specify the formats to create")
+		outputCmd.Usage()
+		os.Exit(1)
+	}
+
+	image := remArgs[0]
+	name := *outputName
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(image), filepath.Ext(image))
+	}
+	if *outputDir != "" {
+		if err := ensureOutputDir(*outputDir); err != nil {
+			log.Fatalf("Cannot use output directory: %v", err)
+		}
+	}
+	size, err := getDiskSizeMB(*outputSize)
+	if err != nil {
+		log.Fatalf("Unable to parse disk size: %v", err)
+	}
+
+	base := filepath.Join(*outputDir, name)
+	opts := &moby.OutputOptions{Checksums: *outputChecksum}
+	if err := outputAssembly(image, base, outputFormats, size, *outputCmdline, opts); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *outputManifest != "" {
+		artifacts, err := moby.OutputArtifacts(base, outputFormats, nil)
+		if err != nil {
+			log.Fatalf("Cannot describe outputs for manifest: %v", err)
+		}
+		if err := moby.WriteArtifactManifest(*outputManifest, artifacts); err != nil {
+			log.Fatalf("Cannot write manifest: %v", err)
+		}
+	}
+}
+
+// outputAssembly creates the formats from an assembled image tarball, named
+// from base with opts, with cmdline as the kernel command line if it is set
+func outputAssembly(image, base string, formats []string, size int, cmdline string, opts *moby.OutputOptions) error {
+	for _, f := range formats {
+		if moby.Streamable(f) {
+			return fmt.Errorf("Format %s is written while assembling the image, so cannot be created from a tarball", f)
+		}
+	}
+	if err := moby.ValidateFormats(formats); err != nil {
+		return err
+	}
+	fi, err := os.Stat(image)
+	if err != nil {
+		return fmt.Errorf("Cannot open image tarball: %v", err)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("Image tarball %s is not a regular file", image)
+	}
+
+	log.Infof("Create outputs:")
+	if err := moby.Formats(base, image, formats, size, nil, cmdline, opts); err != nil {
+		return fmt.Errorf("Error writing outputs: %v", err)
+	}
+	return nil
+}
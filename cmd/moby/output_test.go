@@ -0,0 +1,61 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutputAssembly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "assembly.tar")
+	f, err := os.Create(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	for name, contents := range map[string]string{
+		"boot/kernel":  "kernel",
+		"boot/cmdline": "console=ttyS0",
+		"etc/hostname": "moby",
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	base := filepath.Join(dir, "foo")
+	if err := outputAssembly(image, base, []string{"kernel+initrd"}, 1024, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	for suffix, want := range map[string]string{"-kernel": "kernel", "-cmdline": "console=ttyS0"} {
+		b, err := ioutil.ReadFile(base + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("Expected %s to be %q, got %q", base+suffix, want, b)
+		}
+	}
+	if fi, err := os.Stat(base + "-initrd.img"); err != nil || fi.Size() == 0 {
+		t.Errorf("Expected a non-empty initrd, got %v", err)
+	}
+
+	if err := outputAssembly(image, base, []string{"tar"}, 1024, "", nil); err == nil {
+		t.Error("Expected the tar format to be rejected")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/moby/tool/src/moby"
+	log "github.com/sirupsen/logrus"
+)
+
+// tmpPruneAge is how long an entry in the tmp directory must have been left
+// untouched before prune removes it, so that running builds are not broken
+const tmpPruneAge = 24 * time.Hour
+
+// Report on the cache directory and remove stale entries from it
+func prune(args []string) {
+	pruneCmd := flag.NewFlagSet("prune", flag.ExitOnError)
+	pruneCmd.Usage = func() {
+		fmt.Printf("USAGE: %s prune [options]\n\n", os.Args[0])
+		fmt.Printf("Report the size of the cache directory and list the cached LinuxKit helper images.\n")
+		fmt.Printf("Then remove the helper images not used by this version, and temporary files left\n")
+		fmt.Printf("by builds more than %s ago, or everything with -all.\n\n", tmpPruneAge)
+		fmt.Printf("Options:\n")
+		pruneCmd.PrintDefaults()
+	}
+	pruneAll := pruneCmd.Bool("all", false, "Remove all cached helper images and temporary files")
+	pruneList := pruneCmd.Bool("list", false, "Only report on the cache, do not remove anything")
+	if err := pruneCmd.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	if *pruneAll && *pruneList {
+		log.Fatal("The -all and -list options cannot be specified together")
+	}
+
+	before, err := moby.CacheSize()
+	if err != nil {
+		log.Fatalf("Cannot get cache size: %v", err)
+	}
+	fmt.Printf("Cache directory %s uses %s\n", moby.MobyDir, humanSize(before))
+	images, err := moby.ListLinuxkitCache()
+	if err != nil {
+		log.Fatalf("Cannot list cached images: %v", err)
+	}
+	for _, image := range images {
+		state := "current"
+		if !image.Current {
+			state = "stale"
+		}
+		fmt.Printf("  %-90s %10s  %s\n", image.Name, humanSize(image.Size), state)
+	}
+	if *pruneList {
+		return
+	}
+
+	if *pruneAll {
+		if err := moby.PruneAll(); err != nil {
+			log.Fatalf("Cannot prune cache: %v", err)
+		}
+	} else {
+		removed, err := moby.PruneLinuxkitCache()
+		for _, f := range removed {
+			log.Infof("Removed %s", f)
+		}
+		if err != nil {
+			log.Fatalf("Cannot prune cache: %v", err)
+		}
+		removed, err = moby.PruneTmp(tmpPruneAge)
+		for _, f := range removed {
+			log.Infof("Removed tmp/%s", f)
+		}
+		if err != nil {
+			log.Fatalf("Cannot prune cache: %v", err)
+		}
+	}
+
+	after, err := moby.CacheSize()
+	if err != nil {
+		log.Fatalf("Cannot get cache size: %v", err)
+	}
+	fmt.Printf("Reclaimed %s\n", humanSize(before-after))
+}
+
+// humanSize formats a size in bytes with a binary unit
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/moby/tool/src/moby"
+	log "github.com/sirupsen/logrus"
+)
+
+// Push built outputs to a registry
+func push(args []string) {
+	pushCmd := flag.NewFlagSet("push", flag.ExitOnError)
+	pushCmd.Usage = func() {
+		fmt.Printf("USAGE: %s push [options] <reference> <file>...\n\n", os.Args[0])
+		fmt.Printf("Upload built outputs to a registry as the image <reference>. A single .tar\n")
+		fmt.Printf("output is imported as the image filesystem, otherwise the files, such as the\n")
+		fmt.Printf("kernel, initrd and cmdline from kernel+initrd, are placed at the root of the\n")
+		fmt.Printf("image. The registry credentials are those the Docker client is configured with.\n")
+		fmt.Printf("Options:\n")
+		pushCmd.PrintDefaults()
+	}
+	if err := pushCmd.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := pushCmd.Args()
+	if len(remArgs) < 2 {
+		pushCmd.Usage()
+		os.Exit(1)
+	}
+
+	if err := moby.Push(remArgs[0], remArgs[1:]); err != nil {
+		log.Fatalf("Push failed: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/moby/tool/src/moby"
+	log "github.com/sirupsen/logrus"
+)
+
+// prompt asks a question on w, returning the answer read from r or def if the answer is empty
+func prompt(r *bufio.Reader, w io.Writer, question, def string) (string, error) {
+	fmt.Fprintf(w, "%s [%s]: ", question, def)
+	answer, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// Write a starter config file
+func initConfig(args []string) {
+	initCmd := flag.NewFlagSet("init", flag.ExitOnError)
+	initCmd.Usage = func() {
+		fmt.Printf("USAGE: %s init [options] [<file>.yml]\n\n", os.Args[0])
+		fmt.Printf("Write a starter config, asking for the kernel, init and a service, default moby.yml\n\n")
+		fmt.Printf("Options:\n")
+		initCmd.PrintDefaults()
+	}
+	initMinimal := initCmd.Bool("minimal", false, "Write a minimal config without asking any questions")
+	initForce := initCmd.Bool("f", false, "Overwrite an existing file")
+	if err := initCmd.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := initCmd.Args()
+	if len(remArgs) > 1 {
+		initCmd.Usage()
+		os.Exit(1)
+	}
+	file := "moby.yml"
+	if len(remArgs) == 1 {
+		file = remArgs[0]
+	}
+	if _, err := os.Stat(file); err == nil && !*initForce {
+		log.Fatalf("%s already exists, use -f to overwrite it", file)
+	}
+
+	o := moby.DefaultScaffoldOptions()
+	if !*initMinimal {
+		r := bufio.NewReader(os.Stdin)
+		var err error
+		if o.Kernel, err = prompt(r, os.Stdout, "Kernel image", o.Kernel); err != nil {
+			log.Fatalf("%v", err)
+		}
+		if o.Cmdline, err = prompt(r, os.Stdout, "Kernel command line", o.Cmdline); err != nil {
+			log.Fatalf("%v", err)
+		}
+		initImages, err := prompt(r, os.Stdout, "Init images, comma separated", strings.Join(o.Init, ","))
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		o.Init = strings.Split(initImages, ",")
+		if o.ServiceName, err = prompt(r, os.Stdout, "Service name", o.ServiceName); err != nil {
+			log.Fatalf("%v", err)
+		}
+		if o.ServiceImage, err = prompt(r, os.Stdout, "Service image", o.ServiceImage); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	b, err := moby.Scaffold(o)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		log.Fatalf("Cannot write config: %v", err)
+	}
+	log.Infof("Wrote %s", file)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/moby/tool/src/moby"
+	log "github.com/sirupsen/logrus"
+)
+
+// Build the bootable outputs for a config and check that each of them boots
+func test(args []string) {
+	var testFormats formatList
+	timeouts := formatValues{}
+	readys := formatValues{}
+	testCmd := flag.NewFlagSet("test", flag.ExitOnError)
+	testCmd.Usage = func() {
+		fmt.Printf("USAGE: %s test [options] <file>[.yml]\n\n", os.Args[0])
+		fmt.Printf("Build the bootable outputs for a config and boot each of them in qemu\n\n")
+		fmt.Printf("Options:\n")
+		testCmd.PrintDefaults()
+	}
+	testDir := testCmd.String("dir", "", "Directory for output files and console logs, default a temporary directory")
+	testName := testCmd.String("name", "", "Name to use for output files")
+	testTimeout := testCmd.Duration("timeout", moby.DefaultBootTimeout, "Default time to wait for each output to boot")
+	testReady := testCmd.String("ready", moby.DefaultBootReady, "Default console output that shows an output has booted")
+	testCmd.Var(&testFormats, "format", "Formats to test [ "+strings.Join(moby.BootableFormats(), " ")+" ]")
+	testCmd.Var(timeouts, "format-timeout", "Boot timeout for a format as format=duration, may be repeated")
+	testCmd.Var(readys, "format-ready", "Ready string for a format as format=string, may be repeated")
+
+	if err := testCmd.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := testCmd.Args()
+	if len(remArgs) != 1 {
+		fmt.Println("Please specify a single configuration file")
+		testCmd.Usage()
+		os.Exit(1)
+	}
+	conf := remArgs[0]
+	if !(filepath.Ext(conf) == ".yml" || filepath.Ext(conf) == ".yaml") {
+		conf = conf + ".yml"
+	}
+
+	if len(testFormats) == 0 {
+		testFormats = moby.BootableFormats()
+	}
+	tests := make([]moby.BootTest, 0, len(testFormats))
+	for _, f := range testFormats {
+		t := moby.BootTest{Format: f, Timeout: *testTimeout, Ready: *testReady}
+		if v, ok := timeouts[f]; ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				log.Fatalf("Invalid timeout for format %s: %v", f, err)
+			}
+			t.Timeout = d
+		}
+		if v, ok := readys[f]; ok {
+			t.Ready = v
+		}
+		tests = append(tests, t)
+	}
+
+	name := *testName
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(conf), filepath.Ext(conf))
+	}
+	dir := *testDir
+	if dir == "" {
+		tmp, err := ioutil.TempDir(filepath.Join(moby.MobyDir, "tmp"), "test")
+		if err != nil {
+			log.Fatalf("Cannot create test directory: %v", err)
+		}
+		dir = tmp
+	}
+
+	build([]string{"-dir", dir, "-name", name, "-format", strings.Join(testFormats, ","), conf})
+
+	base := filepath.Join(dir, name)
+	passed := true
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "FORMAT\tRESULT\tTIME\tCONSOLE\n")
+	for _, t := range tests {
+		log.Infof("Booting %s", t.Format)
+		r := moby.BootOutput(base, t)
+		logFile := base + "-" + t.Format + ".log"
+		if err := ioutil.WriteFile(logFile, []byte(r.Console), 0644); err != nil {
+			log.Fatalf("Cannot write console log: %v", err)
+		}
+		result := "PASS"
+		if !r.Passed {
+			passed = false
+			result = "FAIL"
+			log.Errorf("%s: %v", t.Format, r.Err)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", t.Format, result, r.Duration.Round(time.Second), logFile)
+	}
+	w.Flush()
+
+	if !passed {
+		os.Exit(1)
+	}
+}
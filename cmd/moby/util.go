@@ -1,8 +1,11 @@
 package main
 
 import (
+	"os"
 	"strconv"
 	"strings"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // This function parses the "size" parameter of a disk specification
@@ -27,3 +30,15 @@ func getDiskSizeMB(s string) (int, error) {
 	}
 	return 1024 * i, nil
 }
+
+// envInt returns the integer value of an environment variable, or def if it
+// is unset or not an integer
+func envInt(name string, def int) int {
+	if s := os.Getenv(name); s != "" {
+		if i, err := strconv.Atoi(s); err == nil {
+			return i
+		}
+		log.Warnf("Ignoring %s=%s as it is not an integer", name, s)
+	}
+	return def
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/moby/tool/src/moby"
+	log "github.com/sirupsen/logrus"
+)
+
+// Validate config files without building them
+func validate(args []string) {
+	validateCmd := flag.NewFlagSet("validate", flag.ExitOnError)
+	validateCmd.Usage = func() {
+		fmt.Printf("USAGE: %s validate [options] <file>[.yml] | -\n\n", os.Args[0])
+		fmt.Printf("Check that each file is a valid config, reporting every problem found,\n")
+		fmt.Printf("without pulling images or calling Docker\n")
+		fmt.Printf("Options:\n")
+		validateCmd.PrintDefaults()
+	}
+	if err := validateCmd.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+	remArgs := validateCmd.Args()
+	if len(remArgs) == 0 {
+		fmt.Println("Please specify a configuration file")
+		validateCmd.Usage()
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, conf := range remArgs {
+		var config []byte
+		var err error
+		if conf == "-" {
+			config, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			config, err = ioutil.ReadFile(conf)
+		}
+		if err != nil {
+			fmt.Printf("%s: %v\n", conf, err)
+			failed = true
+			continue
+		}
+		var errs []moby.ConfigError
+		if conf == "-" {
+			errs = moby.ValidateConfig(config)
+		} else {
+			errs = moby.ValidateConfigFile(conf, config)
+		}
+		if len(errs) != 0 {
+			failed = true
+		}
+		printConfigErrors(conf, config, errs)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// printConfigErrors prints each error as file:line: followed by the line
+func printConfigErrors(name string, config []byte, errs []moby.ConfigError) {
+	lines := strings.Split(string(config), "\n")
+	for _, e := range errs {
+		if e.Line == 0 {
+			fmt.Printf("%s: %v\n", name, e)
+			continue
+		}
+		fmt.Printf("%s:%d: %v\n", name, e.Line, e)
+		if e.Line <= len(lines) {
+			fmt.Printf("    %s\n", strings.TrimSpace(lines[e.Line-1]))
+		}
+	}
+}
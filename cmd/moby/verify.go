@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/moby/tool/src/moby"
+	log "github.com/sirupsen/logrus"
+)
+
+// Check that the mkimage helper images match their pinned digests
+func verifyHelpers(args []string) {
+	verifyCmd := flag.NewFlagSet("verify-helpers", flag.ExitOnError)
+	verifyCmd.Usage = func() {
+		fmt.Printf("USAGE: %s verify-helpers\n\n", os.Args[0])
+		fmt.Printf("Pull the mkimage helper images and check their content matches the pinned digests\n")
+	}
+	if err := verifyCmd.Parse(args); err != nil {
+		log.Fatal("Unable to parse args")
+	}
+
+	if !moby.WriteHelperStatus(os.Stdout, moby.VerifyHelpers()) {
+		os.Exit(1)
+	}
+}
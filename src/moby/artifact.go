@@ -0,0 +1,93 @@
+package moby
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Artifact is a file created for an output format
+type Artifact struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// NewArtifact describes a file created for an output format
+func NewArtifact(file, format string) (Artifact, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return Artifact{}, err
+	}
+	sum, err := fileSHA256(file)
+	if err != nil {
+		return Artifact{}, err
+	}
+	return Artifact{Path: file, Format: format, Size: fi.Size(), SHA256: sum}, nil
+}
+
+// OutputArtifacts describes the files created for each format from the
+// shared base name, or its own name in names, in the order of the formats. Files a format did not
+// create, such as the cmdline of an image without one, are left out, but a
+// format that created none of its files is an error.
+func OutputArtifacts(base string, formats []string, names map[string]string) ([]Artifact, error) {
+	artifacts := []Artifact{}
+	for _, f := range formats {
+		var missing error
+		found := false
+		for _, file := range OutputFiles(base, f, names) {
+			a, err := NewArtifact(file, f)
+			if os.IsNotExist(err) {
+				missing = err
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			found = true
+			artifacts = append(artifacts, a)
+		}
+		if !found && missing != nil {
+			return nil, missing
+		}
+	}
+	return artifacts, nil
+}
+
+// WriteArtifactManifest writes a JSON manifest of the artifacts of a build,
+// replacing the file atomically so that CI never reads a partial manifest
+func WriteArtifactManifest(filename string, artifacts []Artifact) error {
+	if artifacts == nil {
+		artifacts = []Artifact{}
+	}
+	b, err := json.MarshalIndent(struct {
+		Artifacts []Artifact `json:"artifacts"`
+	}{artifacts}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, append(b, '\n'))
+}
+
+// writeFileAtomic writes a file with mode 0644 by renaming a temporary file
+// in the same directory over it
+func writeFileAtomic(filename string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
@@ -0,0 +1,82 @@
+package moby
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteArtifactManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "test")
+	for file, contents := range map[string]string{"-kernel": "kernel", "-initrd.img": "initrd", "-cmdline": "console=ttyS0", ".iso": "iso"} {
+		if err := ioutil.WriteFile(base+file, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	artifacts, err := OutputArtifacts(base, []string{"iso-bios", "kernel+initrd"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := filepath.Join(dir, "manifest.json")
+	if err := WriteArtifactManifest(manifest, artifacts); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Artifacts []Artifact `json:"artifacts"`
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Artifact{
+		{Path: base + ".iso", Format: "iso-bios", Size: 3},
+		{Path: base + "-kernel", Format: "kernel+initrd", Size: 6},
+		{Path: base + "-initrd.img", Format: "kernel+initrd", Size: 6},
+		{Path: base + "-cmdline", Format: "kernel+initrd", Size: 13},
+	}
+	if len(got.Artifacts) != len(expected) {
+		t.Fatalf("Expected %d artifacts, got %+v", len(expected), got.Artifacts)
+	}
+	for i := range expected {
+		sum, err := fileSHA256(expected[i].Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[i].SHA256 = sum
+	}
+	if !reflect.DeepEqual(got.Artifacts, expected) {
+		t.Errorf("Expected artifacts %+v, got %+v", expected, got.Artifacts)
+	}
+
+	if _, err := OutputArtifacts(base, []string{"raw-bios"}, nil); err == nil {
+		t.Error("Expected a missing output file to be an error")
+	}
+
+	// squashfs of an image without a kernel has no cmdline
+	if err := ioutil.WriteFile(base+"-squashfs.img", []byte("squashfs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(base + "-cmdline"); err != nil {
+		t.Fatal(err)
+	}
+	artifacts, err = OutputArtifacts(base, []string{"squashfs"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(artifacts) != 1 || artifacts[0].Path != base+"-squashfs.img" {
+		t.Errorf("Expected only the squashfs image, got %+v", artifacts)
+	}
+}
@@ -0,0 +1,192 @@
+package moby
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// RegistryAuthFile is a file in the Docker config.json format giving the
+// credentials to use for each registry, ~/.docker/config.json by default
+var RegistryAuthFile string
+
+// registryCredentials are credentials given for registry hosts with
+// SetRegistryCredentials, which are used in preference to the auth file
+var registryCredentials = map[string]types.AuthConfig{}
+
+const dockerHubRegistry = "docker.io"
+
+// dockerHubAuthKey is the key used for Docker Hub in Docker config files
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+type authConfigFile struct {
+	Auths       map[string]types.AuthConfig `json:"auths"`
+	CredsStore  string                      `json:"credsStore,omitempty"`
+	CredHelpers map[string]string           `json:"credHelpers,omitempty"`
+}
+
+// registryHost returns the registry host for an image name, following the
+// Docker convention that the first component is a host only if it contains
+// a '.' or ':' or is localhost
+func registryHost(name string) string {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 1 {
+		return dockerHubRegistry
+	}
+	if strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost" {
+		if parts[0] == "index.docker.io" {
+			return dockerHubRegistry
+		}
+		return parts[0]
+	}
+	return dockerHubRegistry
+}
+
+// SetRegistryCredentials sets the username and password to pull images from
+// a registry host with, instead of any in the auth file. The host may be
+// given as in a Docker config file, such as https://index.docker.io/v1/.
+func SetRegistryCredentials(host, username, password string) error {
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+	host = strings.SplitN(host, "/", 2)[0]
+	switch host {
+	case "":
+		return fmt.Errorf("No registry host given for the credentials")
+	case "index.docker.io", "registry-1.docker.io":
+		host = dockerHubRegistry
+	}
+	if username == "" {
+		return fmt.Errorf("No username given for registry %s", host)
+	}
+	registryCredentials[host] = types.AuthConfig{Username: username, Password: password, ServerAddress: host}
+	return nil
+}
+
+// dockerConfigDir returns the Docker CLI configuration directory
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	return filepath.Join(homeDir(), ".docker")
+}
+
+func readAuthConfigFile() (authConfigFile, error) {
+	var config authConfigFile
+	filename := RegistryAuthFile
+	if filename == "" {
+		filename = filepath.Join(dockerConfigDir(), "config.json")
+	}
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) && RegistryAuthFile == "" {
+			return config, nil
+		}
+		return config, err
+	}
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return config, fmt.Errorf("Cannot parse registry auth file %s: %v", filename, err)
+	}
+	return config, nil
+}
+
+// lookupAuth finds the credentials for a registry host, returning an empty
+// config if there are none so that the pull is anonymous
+func lookupAuth(config authConfigFile, host string) (types.AuthConfig, error) {
+	keys := []string{host, "https://" + host, "http://" + host}
+	if host == dockerHubRegistry {
+		keys = append([]string{dockerHubAuthKey}, keys...)
+	}
+
+	helper := config.CredsStore
+	for _, key := range keys {
+		if h, ok := config.CredHelpers[key]; ok {
+			helper = h
+			break
+		}
+	}
+	for _, key := range keys {
+		auth, ok := config.Auths[key]
+		if !ok {
+			continue
+		}
+		if auth.Auth != "" && auth.Username == "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return types.AuthConfig{}, fmt.Errorf("Cannot decode auth for %s: %v", key, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return types.AuthConfig{}, fmt.Errorf("Invalid auth for %s", key)
+			}
+			auth.Username, auth.Password = parts[0], parts[1]
+			auth.Auth = ""
+		}
+		if auth.Username != "" || auth.IdentityToken != "" || auth.RegistryToken != "" {
+			auth.ServerAddress = key
+			return auth, nil
+		}
+	}
+	if helper != "" {
+		return credentialHelperAuth(helper, keys[0])
+	}
+	return types.AuthConfig{}, nil
+}
+
+// credentialHelperAuth runs docker-credential-<helper> to get the credentials for a server
+func credentialHelperAuth(helper, server string) (types.AuthConfig, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	out, err := cmd.Output()
+	if err != nil {
+		// the helper fails if it has no credentials for the server
+		log.Debugf("credential helper %s has no credentials for %s: %v", helper, server, err)
+		return types.AuthConfig{}, nil
+	}
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	if err := json.NewDecoder(bytes.NewReader(out)).Decode(&creds); err != nil {
+		return types.AuthConfig{}, fmt.Errorf("Cannot parse output of credential helper %s: %v", helper, err)
+	}
+	auth := types.AuthConfig{ServerAddress: server}
+	if creds.Username == "<token>" {
+		auth.IdentityToken = creds.Secret
+	} else {
+		auth.Username, auth.Password = creds.Username, creds.Secret
+	}
+	return auth, nil
+}
+
+// registryAuth returns the encoded credentials to use when pulling an image,
+// or the empty string to pull anonymously
+func registryAuth(image string) (string, error) {
+	host := registryHost(image)
+	auth, ok := registryCredentials[host]
+	if !ok {
+		config, err := readAuthConfigFile()
+		if err != nil {
+			return "", err
+		}
+		auth, err = lookupAuth(config, host)
+		if err != nil {
+			return "", err
+		}
+	}
+	if auth == (types.AuthConfig{}) {
+		return "", nil
+	}
+	buf, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,118 @@
+package moby
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestRegistryHost(t *testing.T) {
+	testCases := map[string]string{
+		"nginx":                           "docker.io",
+		"linuxkit/kernel":                 "docker.io",
+		"docker.io/library/alpine":        "docker.io",
+		"index.docker.io/linuxkit/init":   "docker.io",
+		"registry.example.com/team/image": "registry.example.com",
+		"localhost:5000/image":            "localhost:5000",
+		"localhost/image":                 "localhost",
+	}
+	for name, host := range testCases {
+		if h := registryHost(name); h != host {
+			t.Errorf("Expected registry %s for %s, got %s", host, name, h)
+		}
+	}
+}
+
+func TestRegistryAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := authConfigFile{Auths: map[string]types.AuthConfig{
+		"https://index.docker.io/v1/": {Auth: base64.StdEncoding.EncodeToString([]byte("hubuser:hubpass"))},
+		"registry.example.com":        {Username: "user", Password: "pass"},
+	}}
+	buf, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegistryAuthFile = filepath.Join(dir, "config.json")
+	defer func() { RegistryAuthFile = "" }()
+	if err := ioutil.WriteFile(RegistryAuthFile, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		image    string
+		username string
+		password string
+	}{
+		{"linuxkit/kernel", "hubuser", "hubpass"},
+		{"registry.example.com/team/image", "user", "pass"},
+		{"other.example.com/image", "", ""},
+	}
+	for _, tc := range testCases {
+		encoded, err := registryAuth(tc.image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.username == "" {
+			if encoded != "" {
+				t.Errorf("Expected anonymous pull for %s, got %s", tc.image, encoded)
+			}
+			continue
+		}
+		decoded, err := base64.URLEncoding.DecodeString(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var auth types.AuthConfig
+		if err := json.Unmarshal(decoded, &auth); err != nil {
+			t.Fatal(err)
+		}
+		if auth.Username != tc.username || auth.Password != tc.password {
+			t.Errorf("Expected credentials %s:%s for %s, got %s:%s", tc.username, tc.password, tc.image, auth.Username, auth.Password)
+		}
+	}
+}
+
+func TestSetRegistryCredentials(t *testing.T) {
+	RegistryAuthFile = "/nonexistent/config.json"
+	defer func() {
+		RegistryAuthFile = ""
+		registryCredentials = map[string]types.AuthConfig{}
+	}()
+
+	if err := SetRegistryCredentials("https://index.docker.io/v1/", "hubuser", "hubpass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetRegistryCredentials("registry.example.com", "", "pass"); err == nil {
+		t.Error("Expected credentials without a username to be rejected")
+	}
+
+	encoded, err := registryAuth("linuxkit/kernel")
+	if err != nil {
+		t.Fatalf("Expected the auth file not to be read for a registry with credentials: %v", err)
+	}
+	decoded, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var auth types.AuthConfig
+	if err := json.Unmarshal(decoded, &auth); err != nil {
+		t.Fatal(err)
+	}
+	if auth.Username != "hubuser" || auth.Password != "hubpass" {
+		t.Errorf("Expected credentials hubuser:hubpass, got %s:%s", auth.Username, auth.Password)
+	}
+	if _, err := registryAuth("registry.example.com/image"); err == nil {
+		t.Error("Expected other registries to read the auth file")
+	}
+}
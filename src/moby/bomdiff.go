@@ -0,0 +1,114 @@
+package moby
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ManifestEntry is a file in a manifest written by the manifest output format
+type ManifestEntry struct {
+	Path string
+	Type string
+	Mode int64
+	UID  int
+	GID  int
+	Size int64
+}
+
+// ManifestChange is a difference between two manifests, Old is nil for an
+// added file and New is nil for a removed file
+type ManifestChange struct {
+	Path string
+	Old  *ManifestEntry
+	New  *ManifestEntry
+}
+
+// ReadManifest reads a manifest written by the manifest output format
+func ReadManifest(r io.Reader) (map[string]ManifestEntry, error) {
+	entries := map[string]ManifestEntry{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("Invalid manifest line %d: expected 6 fields, got %d", line, len(fields))
+		}
+		e := ManifestEntry{Path: fields[0], Type: fields[1]}
+		var err error
+		if e.Mode, err = strconv.ParseInt(fields[2], 8, 64); err == nil {
+			if e.UID, err = strconv.Atoi(fields[3]); err == nil {
+				if e.GID, err = strconv.Atoi(fields[4]); err == nil {
+					e.Size, err = strconv.ParseInt(fields[5], 10, 64)
+				}
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid manifest line %d: %v", line, err)
+		}
+		// a later entry for a path replaces an earlier one, as when unpacking
+		entries[e.Path] = e
+	}
+	return entries, scanner.Err()
+}
+
+// DiffManifests returns the files added, removed and changed between two manifests, sorted by path
+func DiffManifests(old, next map[string]ManifestEntry) []ManifestChange {
+	var changes []ManifestChange
+	for p, o := range old {
+		o := o
+		n, ok := next[p]
+		if !ok {
+			changes = append(changes, ManifestChange{Path: p, Old: &o})
+			continue
+		}
+		if n != o {
+			changes = append(changes, ManifestChange{Path: p, Old: &o, New: &n})
+		}
+	}
+	for p, n := range next {
+		n := n
+		if _, ok := old[p]; !ok {
+			changes = append(changes, ManifestChange{Path: p, New: &n})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// WriteManifestDiff writes the changes between two manifests, one per line,
+// prefixed with + for added, - for removed and ~ for changed files
+func WriteManifestDiff(w io.Writer, changes []ManifestChange) error {
+	for _, c := range changes {
+		var err error
+		switch {
+		case c.Old == nil:
+			_, err = fmt.Fprintf(w, "+ %s %s %04o %d\n", c.Path, c.New.Type, c.New.Mode, c.New.Size)
+		case c.New == nil:
+			_, err = fmt.Fprintf(w, "- %s %s %04o %d\n", c.Path, c.Old.Type, c.Old.Mode, c.Old.Size)
+		default:
+			var diffs []string
+			if c.Old.Type != c.New.Type {
+				diffs = append(diffs, fmt.Sprintf("type %s->%s", c.Old.Type, c.New.Type))
+			}
+			if c.Old.Mode != c.New.Mode {
+				diffs = append(diffs, fmt.Sprintf("mode %04o->%04o", c.Old.Mode, c.New.Mode))
+			}
+			if c.Old.UID != c.New.UID || c.Old.GID != c.New.GID {
+				diffs = append(diffs, fmt.Sprintf("owner %d:%d->%d:%d", c.Old.UID, c.Old.GID, c.New.UID, c.New.GID))
+			}
+			if c.Old.Size != c.New.Size {
+				diffs = append(diffs, fmt.Sprintf("size %d->%d (%+d)", c.Old.Size, c.New.Size, c.New.Size-c.Old.Size))
+			}
+			_, err = fmt.Fprintf(w, "~ %s %s\n", c.Path, strings.Join(diffs, " "))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
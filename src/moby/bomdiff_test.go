@@ -0,0 +1,43 @@
+package moby
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestManifestDiff(t *testing.T) {
+	old, err := ReadManifest(strings.NewReader(strings.Join([]string{
+		"bin/sh\tfile\t0755\t0\t0\t1000",
+		"etc/motd\tfile\t0644\t0\t0\t10",
+		"etc/old\tfile\t0644\t0\t0\t5",
+		"usr\tdir\t0755\t0\t0\t0",
+	}, "\n") + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := ReadManifest(strings.NewReader(strings.Join([]string{
+		"bin/sh\tfile\t0755\t0\t0\t1000",
+		"etc/motd\tfile\t0600\t0\t0\t25",
+		"etc/new\tsymlink\t0777\t0\t0\t0",
+		"usr\tdir\t0755\t0\t0\t0",
+	}, "\n") + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := WriteManifestDiff(buf, DiffManifests(old, next)); err != nil {
+		t.Fatal(err)
+	}
+	expected := "~ etc/motd mode 0644->0600 size 10->25 (+15)\n" +
+		"+ etc/new symlink 0777 0\n" +
+		"- etc/old file 0644 5\n"
+	if buf.String() != expected {
+		t.Errorf("Expected diff:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	if _, err := ReadManifest(strings.NewReader("bin/sh\tfile\n")); err == nil {
+		t.Error("Expected a malformed manifest to be rejected")
+	}
+}
@@ -0,0 +1,130 @@
+package moby
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBootReady is printed on the console by LinuxKit init once it has started
+const DefaultBootReady = "Welcome to LinuxKit"
+
+// DefaultBootTimeout is how long to wait for an image to boot
+const DefaultBootTimeout = 2 * time.Minute
+
+// BootTest describes how to check that an output format boots
+type BootTest struct {
+	Format  string
+	Timeout time.Duration
+	Ready   string
+}
+
+// BootResult is the result of booting an output
+type BootResult struct {
+	Format   string
+	Passed   bool
+	Duration time.Duration
+	Console  string
+	Err      error
+}
+
+// BootableFormats returns the output formats that can be boot tested
+func BootableFormats() []string {
+	return []string{"iso-bios", "kernel+initrd", "qcow2-bios", "raw-bios"}
+}
+
+// bootCommand returns the emulator command that boots the output for a format
+var bootCommand = defaultBootCommand
+
+func defaultBootCommand(format, base string) (*exec.Cmd, error) {
+	qemu := []string{"-m", "1024", "-nographic", "-no-reboot"}
+	switch format {
+	case "kernel+initrd":
+		cmdline, err := ioutil.ReadFile(base + "-cmdline")
+		if err != nil {
+			return nil, err
+		}
+		qemu = append(qemu, "-kernel", base+"-kernel", "-initrd", base+"-initrd.img", "-append", string(cmdline))
+	case "iso-bios":
+		qemu = append(qemu, "-cdrom", base+".iso")
+	case "raw-bios":
+		qemu = append(qemu, "-drive", "file="+base+"-bios.img,format=raw")
+	case "qcow2-bios":
+		qemu = append(qemu, "-drive", "file="+base+".qcow2,format=qcow2")
+	default:
+		return nil, fmt.Errorf("Cannot boot test format %s", format)
+	}
+	return exec.Command(qemuName(), qemu...), nil
+}
+
+// BootOutput boots the output for a format named from base, and waits until
+// the ready string appears on the console or the timeout expires
+func BootOutput(base string, t BootTest) BootResult {
+	result := BootResult{Format: t.Format}
+	if t.Timeout == 0 {
+		t.Timeout = DefaultBootTimeout
+	}
+	if t.Ready == "" {
+		t.Ready = DefaultBootReady
+	}
+	cmd, err := bootCommand(t.Format, base)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	cmd.Stderr = cmd.Stdout
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		result.Err = err
+		return result
+	}
+
+	var mu sync.Mutex
+	console := new(bytes.Buffer)
+	ready := make(chan bool, 1)
+	go func() {
+		scanner := bufio.NewScanner(out)
+		found := false
+		for scanner.Scan() {
+			mu.Lock()
+			console.WriteString(scanner.Text() + "\n")
+			mu.Unlock()
+			if !found && strings.Contains(scanner.Text(), t.Ready) {
+				found = true
+				ready <- true
+			}
+		}
+		if !found {
+			ready <- false
+		}
+	}()
+
+	select {
+	case result.Passed = <-ready:
+		if !result.Passed {
+			result.Err = fmt.Errorf("emulator exited before %q appeared on the console", t.Ready)
+		}
+	case <-time.After(t.Timeout):
+		result.Err = fmt.Errorf("timed out after %v waiting for %q on the console", t.Timeout, t.Ready)
+	}
+	result.Duration = time.Since(start)
+	if cmd.Process != nil {
+		_ = cmd.Process.Kill()
+	}
+	_ = cmd.Wait()
+
+	mu.Lock()
+	result.Console = console.String()
+	mu.Unlock()
+	return result
+}
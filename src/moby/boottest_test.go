@@ -0,0 +1,45 @@
+package moby
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBootOutput(t *testing.T) {
+	bootCommand = func(format, base string) (*exec.Cmd, error) {
+		switch format {
+		case "kernel+initrd":
+			return exec.Command("sh", "-c", "echo booting; echo ready to go; sleep 10"), nil
+		case "iso-bios":
+			return exec.Command("sh", "-c", "echo booting; echo kernel panic"), nil
+		default:
+			return exec.Command("sh", "-c", "echo booting; sleep 10"), nil
+		}
+	}
+	defer func() {
+		bootCommand = defaultBootCommand
+	}()
+
+	r := BootOutput("test", BootTest{Format: "kernel+initrd", Timeout: 5 * time.Second, Ready: "ready to go"})
+	if !r.Passed || r.Err != nil {
+		t.Errorf("Expected kernel+initrd to boot, got %v", r.Err)
+	}
+	if !strings.Contains(r.Console, "booting") {
+		t.Errorf("Expected console log to be captured, got %q", r.Console)
+	}
+
+	r = BootOutput("test", BootTest{Format: "iso-bios", Timeout: 5 * time.Second, Ready: "ready to go"})
+	if r.Passed || r.Err == nil {
+		t.Error("Expected iso-bios to fail when the emulator exits")
+	}
+	if !strings.Contains(r.Console, "kernel panic") {
+		t.Errorf("Expected console log to be captured, got %q", r.Console)
+	}
+
+	r = BootOutput("test", BootTest{Format: "raw-bios", Timeout: 100 * time.Millisecond, Ready: "ready to go"})
+	if r.Passed || r.Err == nil || !strings.Contains(r.Err.Error(), "timed out") {
+		t.Errorf("Expected raw-bios to time out, got %v", r.Err)
+	}
+}
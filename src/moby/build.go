@@ -3,17 +3,22 @@ package moby
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
@@ -121,10 +126,10 @@ func enforceContentTrust(fullImageName string, config *TrustConfig) bool {
 	return false
 }
 
-func outputImage(image *Image, section string, prefix string, m Moby, idMap map[string]uint32, dupMap map[string]string, pull bool, iw *tar.Writer) error {
+func outputImage(image *Image, section string, prefix string, m Moby, idMap map[string]uint32, dupMap map[string]string, pull PullPolicy, iw *tar.Writer) error {
 	log.Infof("  Create OCI config for %s", image.Image)
 	useTrust := enforceContentTrust(image.Image, &m.Trust)
-	oci, runtime, err := ConfigToOCI(image, useTrust, idMap)
+	oci, runtime, err := configToOCI(image, useTrust, idMap, m.opts)
 	if err != nil {
 		return fmt.Errorf("Failed to create OCI spec for %s: %v", image.Image, err)
 	}
@@ -134,15 +139,73 @@ func outputImage(image *Image, section string, prefix string, m Moby, idMap map[
 	}
 	path := path.Join("containers", section, prefix+image.Name)
 	readonly := oci.Root.Readonly
-	err = ImageBundle(path, image.ref, config, runtime, iw, useTrust, pull, readonly, dupMap)
+	err = imageBundle(path, image.ref, config, runtime, iw, useTrust, pull, readonly, dupMap, m.ImageFiles, m.opts)
 	if err != nil {
 		return fmt.Errorf("Failed to extract root filesystem for %s: %v", image.Image, err)
 	}
 	return nil
 }
 
+// buildOptions are the settings of a build that come from the command line
+// rather than the config. LinuxKit helper images are built without them, as
+// the helpers are cached and shared between builds with different settings.
+type buildOptions struct {
+	remap    *IDRemap
+	rlimits  []string
+	binds    map[string][]string
+	arch     string
+	platform string
+	// timeout limits how long each Docker API call may take, 0 is no limit
+	timeout time.Duration
+	// strict makes parts of the config that do not contribute to the image,
+	// and malformed bind mount sources, an error
+	strict bool
+}
+
+// globalOptions returns the build options set in the package variables
+func globalOptions() *buildOptions {
+	return &buildOptions{remap: OwnerRemap, rlimits: DefaultRlimits, binds: ExtraBinds, arch: TargetArch, platform: Platform, timeout: DockerTimeout, strict: StrictConfig}
+}
+
+// hostOptions returns the build options for a LinuxKit helper image, which
+// runs on the host in a virtual machine
+func hostOptions() *buildOptions {
+	return &buildOptions{arch: runtime.GOARCH, timeout: DockerTimeout}
+}
+
+// key describes the build options, so that an image built with them can be
+// cached under a name that changes when they do
+func (o *buildOptions) key() string {
+	key := "arch: " + o.arch + "\nplatform: " + o.platform
+	if o.remap != nil {
+		key += fmt.Sprintf("\nremap: %d %d %d", o.remap.Offset, o.remap.UID, o.remap.GID)
+	}
+	for _, r := range o.rlimits {
+		key += "\nrlimit: " + r
+	}
+	images := make([]string, 0, len(o.binds))
+	for image := range o.binds {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+	for _, image := range images {
+		key += "\nbinds: " + image + " " + strings.Join(o.binds[image], " ")
+	}
+	return key
+}
+
+// options returns the build options of a config, those in the package
+// variables unless it is for a LinuxKit helper image
+func (m Moby) options() *buildOptions {
+	if m.opts == nil {
+		return globalOptions()
+	}
+	return m.opts
+}
+
 // Build performs the actual build process
-func Build(m Moby, w io.Writer, pull bool, tp string) error {
+func Build(m Moby, w io.Writer, pull PullPolicy, tp string) error {
+	m.opts = m.options()
 	if MobyDir == "" {
 		MobyDir = defaultMobyConfigDir()
 	}
@@ -152,6 +215,27 @@ func Build(m Moby, w io.Writer, pull bool, tp string) error {
 		return err
 	}
 
+	m.Files = append(append(append(bannerFiles(m.Banner), timezoneFiles(m.Timezone)...), fstabFiles(m.Fstab)...), m.Files...)
+
+	// check local file sources before pulling any images
+	if err := checkFileSources(m); err != nil {
+		return err
+	}
+
+	if warnings := unusedConfig(m); len(warnings) != 0 {
+		if m.opts.strict {
+			return fmt.Errorf("Unused config: %s", strings.Join(warnings, "; "))
+		}
+		for _, w := range warnings {
+			log.Warnf("Unused config: %s", w)
+		}
+	}
+
+	// pull the images before they are used, so later steps do not pull again
+	if err := prePull(m, pull); err != nil {
+		return err
+	}
+
 	iw := tar.NewWriter(w)
 
 	// add additions
@@ -179,8 +263,8 @@ func Build(m Moby, w io.Writer, pull bool, tp string) error {
 	if m.Kernel.ref != nil {
 		// get kernel and initrd tarball and ucode cpio archive from container
 		log.Infof("Extract kernel image: %s", m.Kernel.ref)
-		kf := newKernelFilter(iw, m.Kernel.Cmdline, m.Kernel.Binary, m.Kernel.Tar, m.Kernel.UCode)
-		err := ImageTar(m.Kernel.ref, "", kf, enforceContentTrust(m.Kernel.ref.String(), &m.Trust), pull, "")
+		kf := newKernelFilter(iw, m.Kernel.FullCmdline(), m.Kernel.Binary, m.Kernel.Tar, m.Kernel.UCode)
+		err := imageTar(m.Kernel.ref, "", kf, enforceContentTrust(m.Kernel.ref.String(), &m.Trust), pull, "", nil, m.opts)
 		if err != nil {
 			return fmt.Errorf("Failed to extract kernel image and tarball: %v", err)
 		}
@@ -189,6 +273,15 @@ func Build(m Moby, w io.Writer, pull bool, tp string) error {
 			return fmt.Errorf("Close error: %v", err)
 		}
 	}
+	if mc := m.Kernel.Microcode; mc != nil {
+		ucode, err := readMicrocode(mc, &m.Trust, pull, m.opts)
+		if err != nil {
+			return fmt.Errorf("Failed to read kernel microcode: %v", err)
+		}
+		if err := addMicrocode(iw, ucode, m.Kernel.ref == nil); err != nil {
+			return err
+		}
+	}
 
 	// convert init images to tarballs
 	if len(m.Init) != 0 {
@@ -196,7 +289,7 @@ func Build(m Moby, w io.Writer, pull bool, tp string) error {
 	}
 	for _, ii := range m.initRefs {
 		log.Infof("Process init image: %s", ii)
-		err := ImageTar(ii, "", iw, enforceContentTrust(ii.String(), &m.Trust), pull, resolvconfSymlink)
+		err := imageTar(ii, "", iw, enforceContentTrust(ii.String(), &m.Trust), pull, resolvconfSymlink, m.ImageFiles, m.opts)
 		if err != nil {
 			return fmt.Errorf("Failed to build init tarball from %s: %v", ii, err)
 		}
@@ -406,6 +499,102 @@ func (k *kernelFilter) WriteHeader(hdr *tar.Header) error {
 	return nil
 }
 
+// readMicrocode reads the microcode cpio archive from a local file or an image
+func readMicrocode(mc *MicrocodeConfig, trust *TrustConfig, pull PullPolicy, opts *buildOptions) ([]byte, error) {
+	var ucode []byte
+	if mc.Source != "" {
+		var err error
+		if ucode, err = ioutil.ReadFile(expandSource(mc.Source)); err != nil {
+			return nil, err
+		}
+	} else {
+		log.Infof("Extract microcode image: %s", mc.ref)
+		fc := &fileCapture{name: strings.TrimPrefix(path.Clean("/"+mc.Path), "/")}
+		if err := imageTar(mc.ref, "", fc, enforceContentTrust(mc.ref.String(), trust), pull, "", nil, opts); err != nil {
+			return nil, err
+		}
+		if !fc.found {
+			return nil, fmt.Errorf("did not find %s in image %s", mc.Path, mc.ref)
+		}
+		ucode = fc.buf.Bytes()
+	}
+	if err := checkCpio(ucode); err != nil {
+		return nil, err
+	}
+	return ucode, nil
+}
+
+// checkCpio checks that data is an uncompressed cpio archive in the newc
+// format, which is the only form the kernel loads early microcode from
+func checkCpio(data []byte) error {
+	switch {
+	case bytes.HasPrefix(data, []byte("070701")), bytes.HasPrefix(data, []byte("070702")):
+		return nil
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}), bytes.HasPrefix(data, []byte{0xfd, '7', 'z', 'X', 'Z'}),
+		bytes.HasPrefix(data, []byte{0x28, 0xb5, 0x2f, 0xfd}), bytes.HasPrefix(data, []byte("BZh")):
+		return errors.New("microcode must be an uncompressed cpio archive, not compressed")
+	default:
+		return errors.New("microcode is not a cpio archive in the newc format")
+	}
+}
+
+// addMicrocode adds the microcode to the image as /boot/ucode.cpio, which is
+// placed ahead of the initrd. The boot directory is created if there is no
+// kernel to create it.
+func addMicrocode(tw *tar.Writer, ucode []byte, bootDir bool) error {
+	if bootDir {
+		hdr := &tar.Header{
+			Name:     "boot",
+			Mode:     0755,
+			Typeflag: tar.TypeDir,
+			Format:   tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+	hdr := &tar.Header{
+		Name:   "boot/ucode.cpio",
+		Mode:   0644,
+		Size:   int64(len(ucode)),
+		Format: tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(ucode)
+	return err
+}
+
+// fileCapture is a tarWriter that keeps the contents of one named file and
+// discards everything else
+type fileCapture struct {
+	name    string
+	found   bool
+	capture bool
+	buf     bytes.Buffer
+}
+
+func (f *fileCapture) Close() error { return nil }
+
+func (f *fileCapture) Flush() error { return nil }
+
+func (f *fileCapture) Write(b []byte) (int, error) {
+	if f.capture {
+		return f.buf.Write(b)
+	}
+	return len(b), nil
+}
+
+func (f *fileCapture) WriteHeader(hdr *tar.Header) error {
+	f.capture = hdr.Name == f.name && hdr.Typeflag == tar.TypeReg
+	if f.capture {
+		f.found = true
+		f.buf.Reset()
+	}
+	return nil
+}
+
 func tarAppend(iw *tar.Writer, tr *tar.Reader) error {
 	for {
 		hdr, err := tr.Next()
@@ -441,6 +630,197 @@ func metadata(m Moby, md string) ([]byte, error) {
 	}
 }
 
+// DumpConfig returns a config as "yaml" or "json", in the same form as a
+// file with that metadata
+func DumpConfig(m Moby, format string) ([]byte, error) {
+	return metadata(m, format)
+}
+
+// expandSource expands a leading ~/ in a file source to the home directory
+func expandSource(source string) string {
+	if len(source) > 2 && source[:2] == "~/" {
+		return homeDir() + source[1:]
+	}
+	return source
+}
+
+// urlSource reports whether a file source is a URL rather than a local path
+func urlSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// sourceClient is the HTTP client that fetches URL file sources
+var sourceClient = &http.Client{Timeout: 10 * time.Minute}
+
+// readSource reads the source of a file from a local path or a URL, checking
+// it against the SHA256 of the file if it has one. It returns false if an
+// optional source is not found.
+func readSource(f File) ([]byte, bool, error) {
+	var contents []byte
+	if urlSource(f.Source) {
+		resp, err := sourceClient.Get(f.Source)
+		if err != nil {
+			return nil, false, fmt.Errorf("Cannot fetch source of %s: %v", f.Path, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound && f.Optional {
+			log.Debugf("Skipping file [%s] as not found and marked optional", f.Source)
+			return nil, false, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, false, fmt.Errorf("Cannot fetch source of %s from %s: %s", f.Path, f.Source, resp.Status)
+		}
+		contents, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, false, fmt.Errorf("Cannot fetch source of %s: %v", f.Path, err)
+		}
+	} else {
+		source := expandSource(f.Source)
+		if f.Optional {
+			if _, err := os.Stat(source); err != nil {
+				// skip if not found or readable
+				log.Debugf("Skipping file [%s] as not readable and marked optional", source)
+				return nil, false, nil
+			}
+		}
+		var err error
+		contents, err = ioutil.ReadFile(source)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if f.SHA256 != "" {
+		sum := sha256.Sum256(contents)
+		if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, f.SHA256) {
+			return nil, false, fmt.Errorf("Source of %s has SHA256 %s, expected %s", f.Path, got, f.SHA256)
+		}
+	}
+	return contents, true, nil
+}
+
+// bannerFiles returns the files that write the login banner
+func bannerFiles(b *BannerConfig) []File {
+	if b == nil {
+		return nil
+	}
+	paths := []string{"/etc/motd"}
+	if b.Issue {
+		paths = append(paths, "/etc/issue")
+	}
+	var files []File
+	for _, path := range paths {
+		f := File{Path: path, Source: b.Source, Mode: "0644"}
+		if b.Contents != "" {
+			contents := b.Contents
+			f.Contents = &contents
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// zoneinfoDir is where the tz database is found, both on the host and in images
+const zoneinfoDir = "/usr/share/zoneinfo"
+
+// timezoneFiles returns the files that set the timezone. The zone file is copied
+// from the host if it is there, otherwise the image must provide it.
+func timezoneFiles(zone string) []File {
+	if zone == "" {
+		return nil
+	}
+	contents := zone + "\n"
+	return []File{
+		{Path: path.Join(zoneinfoDir, zone), Source: filepath.Join(zoneinfoDir, zone), Optional: true, Mode: "0644"},
+		{Path: "/etc/localtime", Symlink: path.Join(zoneinfoDir, zone)},
+		{Path: "/etc/timezone", Contents: &contents, Mode: "0644"},
+	}
+}
+
+// fstabFiles returns the file for /etc/fstab with a line for each entry
+func fstabFiles(entries []FstabEntry) []File {
+	if len(entries) == 0 {
+		return nil
+	}
+	b := new(bytes.Buffer)
+	for _, e := range entries {
+		options := "defaults"
+		if len(e.Options) != 0 {
+			options = strings.Join(e.Options, ",")
+		}
+		fmt.Fprintf(b, "%s\t%s\t%s\t%s\t%d\t%d\n", e.Device, e.Mountpoint, e.Type, options, e.Dump, e.Pass)
+	}
+	contents := b.String()
+	return []File{{Path: "/etc/fstab", Contents: &contents, Mode: "0644"}}
+}
+
+// StrictConfig makes parts of the config that do not contribute to the image,
+// and malformed bind mount sources, an error
+var StrictConfig bool
+
+// tmpfsDirs are mounted as tmpfs at boot, hiding any files placed in them
+var tmpfsDirs = []string{"/run", "/tmp", "/var"}
+
+// unusedConfig returns a warning for each part of the config that does not
+// contribute to the image
+func unusedConfig(m Moby) []string {
+	var warnings []string
+	last := map[string]int{}
+	for i, f := range m.Files {
+		last[path.Clean("/"+f.Path)] = i
+	}
+	for i, f := range m.Files {
+		p := path.Clean("/" + f.Path)
+		if last[p] != i {
+			warnings = append(warnings, fmt.Sprintf("file %s is replaced by a later entry for the same path", f.Path))
+			continue
+		}
+		if f.Source != "" && f.Optional {
+			if _, err := os.Stat(expandSource(f.Source)); err != nil {
+				warnings = append(warnings, fmt.Sprintf("file %s is not added as optional source %s is missing", f.Path, f.Source))
+				continue
+			}
+		}
+		for _, dir := range tmpfsDirs {
+			if p == dir || strings.HasPrefix(p, dir+"/") {
+				warnings = append(warnings, fmt.Sprintf("file %s is hidden by the tmpfs mounted on %s", f.Path, dir))
+			}
+		}
+	}
+	aliases := []string{}
+	for name := range m.Images {
+		if !m.usedAliases[name] {
+			aliases = append(aliases, name)
+		}
+	}
+	sort.Strings(aliases)
+	for _, name := range aliases {
+		warnings = append(warnings, fmt.Sprintf("image alias %s is not used", name))
+	}
+	return warnings
+}
+
+// checkFileSources checks that every file source that is not optional can be read
+func checkFileSources(m Moby) error {
+	missing := []string{}
+	for _, f := range m.Files {
+		// URL sources are only fetched when the image is built
+		if f.Source == "" || f.Optional || urlSource(f.Source) {
+			continue
+		}
+		source := expandSource(f.Source)
+		fi, err := os.Open(source)
+		if err != nil {
+			missing = append(missing, source)
+			continue
+		}
+		fi.Close()
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("Cannot read file sources: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
 func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32) error {
 	// TODO also include the files added in other parts of the build
 	var addedFiles = map[string]bool{}
@@ -457,6 +837,17 @@ func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32) error {
 		if f.Path[0] == os.PathSeparator {
 			f.Path = f.Path[1:]
 		}
+		// a directory may be given with a trailing slash
+		f.Path = strings.TrimSuffix(f.Path, "/")
+		if f.Path == "" {
+			return errors.New("Cannot add a file at /")
+		}
+		if f.Directory && f.Symlink != "" {
+			return fmt.Errorf("Specified Directory and Symlink for file: %s", f.Path)
+		}
+		if f.SHA256 != "" && f.Source == "" {
+			return fmt.Errorf("Specified SHA256 without Source for file: %s", f.Path)
+		}
 		mode := int64(0600)
 		if f.Directory {
 			mode = 0700
@@ -478,6 +869,10 @@ func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32) error {
 		if dirMode&0007 != 0 {
 			dirMode |= 0001
 		}
+		// permissions are not used on symlinks, which are conventionally 0777
+		if f.Symlink != "" && f.Mode == "" {
+			mode = 0777
+		}
 
 		uid, err := idNumeric(f.UID, idMap)
 		if err != nil {
@@ -492,7 +887,21 @@ func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32) error {
 		if f.Contents != nil {
 			contents = []byte(*f.Contents)
 		}
-		if !f.Directory && f.Symlink == "" && f.Contents == nil {
+		if f.Directory || f.Symlink != "" {
+			kind := "Directory"
+			if f.Symlink != "" {
+				kind = "Symlink"
+			}
+			if f.Contents != nil {
+				return fmt.Errorf("Specified Contents and %s for file: %s", kind, f.Path)
+			}
+			if f.Source != "" {
+				return fmt.Errorf("Specified Source and %s for file: %s", kind, f.Path)
+			}
+			if f.Metadata != "" {
+				return fmt.Errorf("Specified Metadata and %s for file: %s", kind, f.Path)
+			}
+		} else if f.Contents == nil {
 			if f.Source == "" && f.Metadata == "" {
 				return fmt.Errorf("Contents of file (%s) not specified", f.Path)
 			}
@@ -500,23 +909,14 @@ func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32) error {
 				return fmt.Errorf("Specified Source and Metadata for file: %s", f.Path)
 			}
 			if f.Source != "" {
-				source := f.Source
-				if len(source) > 2 && source[:2] == "~/" {
-					source = homeDir() + source[1:]
-				}
-				if f.Optional {
-					_, err := os.Stat(source)
-					if err != nil {
-						// skip if not found or readable
-						log.Debugf("Skipping file [%s] as not readable and marked optional", source)
-						continue
-					}
-				}
-				var err error
-				contents, err = ioutil.ReadFile(source)
+				var found bool
+				contents, found, err = readSource(f)
 				if err != nil {
 					return err
 				}
+				if !found {
+					continue
+				}
 			} else {
 				contents, err = metadata(m, f.Metadata)
 				if err != nil {
@@ -568,9 +968,6 @@ func filesystem(m Moby, tw *tar.Writer, idMap map[string]uint32) error {
 			Format: tar.FormatPAX,
 		}
 		if f.Directory {
-			if f.Contents != nil {
-				return errors.New("Directory with contents not allowed")
-			}
 			hdr.Typeflag = tar.TypeDir
 			err := tw.WriteHeader(hdr)
 			if err != nil {
@@ -0,0 +1,487 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckFileSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	present := filepath.Join(dir, "present")
+	if err := ioutil.WriteFile(present, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+	optional := filepath.Join(dir, "optional")
+
+	m := Moby{Files: []File{
+		{Path: "etc/present", Source: present},
+		{Path: "etc/optional", Source: optional, Optional: true},
+	}}
+	if err := checkFileSources(m); err != nil {
+		t.Errorf("Expected present and optional sources to pass, got %v", err)
+	}
+
+	m.Files = append(m.Files, File{Path: "etc/missing", Source: missing})
+	err = checkFileSources(m)
+	if err == nil {
+		t.Fatal("Expected an error for a missing source")
+	}
+	if !strings.Contains(err.Error(), missing) || strings.Contains(err.Error(), optional) {
+		t.Errorf("Expected error to list only the missing source, got %v", err)
+	}
+}
+
+func TestBanner(t *testing.T) {
+	m, err := NewConfig([]byte(`
+banner:
+  contents: |
+    Welcome to the build host
+    Authorised use only
+  issue: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Files = append(bannerFiles(m.Banner), m.Files...)
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := filesystem(m, tw, map[string]uint32{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{}
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(b)
+	}
+	expected := "Welcome to the build host\nAuthorised use only\n"
+	for _, path := range []string{"etc/motd", "etc/issue"} {
+		if files[path] != expected {
+			t.Errorf("Expected %s to contain the banner, got %q", path, files[path])
+		}
+	}
+
+	if _, err := NewConfig([]byte("banner:\n  issue: true\n")); err == nil {
+		t.Error("Expected a banner without contents or source to be rejected")
+	}
+}
+
+func TestTimezone(t *testing.T) {
+	if _, err := NewConfig([]byte("timezone: Mars/Olympus_Mons\n")); err == nil {
+		t.Error("Expected an unknown timezone to be rejected")
+	}
+	m, err := NewConfig([]byte("timezone: UTC\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Files = timezoneFiles(m.Timezone)
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := filesystem(m, tw, map[string]uint32{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	hdrs := map[string]*tar.Header{}
+	contents := map[string]string{}
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdrs[hdr.Name] = hdr
+		contents[hdr.Name] = string(b)
+	}
+	localtime, ok := hdrs["etc/localtime"]
+	if !ok || localtime.Typeflag != tar.TypeSymlink || localtime.Linkname != "/usr/share/zoneinfo/UTC" {
+		t.Errorf("Expected /etc/localtime to link to the UTC zone, got %v", localtime)
+	}
+	if contents["etc/timezone"] != "UTC\n" {
+		t.Errorf("Expected /etc/timezone to name the zone, got %q", contents["etc/timezone"])
+	}
+}
+
+func TestFstab(t *testing.T) {
+	m, err := NewConfig([]byte(`
+fstab:
+  - device: LABEL=data
+    mountpoint: /var/lib/data
+    type: ext4
+    options: [noatime, nodev]
+    pass: 2
+  - device: /dev/sdb1
+    mountpoint: none
+    type: swap
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := fstabFiles(m.Fstab)
+	if len(files) != 1 || files[0].Path != "/etc/fstab" {
+		t.Fatalf("Expected a file for /etc/fstab, got %v", files)
+	}
+	expected := "LABEL=data\t/var/lib/data\text4\tnoatime,nodev\t0\t2\n/dev/sdb1\tnone\tswap\tdefaults\t0\t0\n"
+	if *files[0].Contents != expected {
+		t.Errorf("Expected fstab:\n%s\ngot:\n%s", expected, *files[0].Contents)
+	}
+
+	invalid := []string{
+		"fstab:\n  - device: LABEL=data\n    mountpoint: var/lib/data\n    type: ext4\n",
+		"fstab:\n  - device: LABEL=my data\n    mountpoint: /data\n    type: ext4\n",
+		"fstab:\n  - device: LABEL=data\n    mountpoint: /data\n    type: ext4\n    options: [\"rw,noatime\"]\n",
+		"fstab:\n  - device: LABEL=data\n    mountpoint: /data\n    type: ext4\n    pass: 3\n",
+		"fstab:\n  - device: LABEL=data\n    mountpoint: /data\n    type: ext4\n  - device: LABEL=other\n    mountpoint: /data\n    type: ext4\n",
+		"fstab:\n  - device: LABEL=data\n    mountpoint: /data\n",
+	}
+	for _, config := range invalid {
+		if _, err := NewConfig([]byte(config)); err == nil {
+			t.Errorf("Expected invalid fstab to be rejected:\n%s", config)
+		}
+	}
+
+	other, err := NewConfig([]byte("fstab:\n  - device: LABEL=other\n    mountpoint: /var/lib/data\n    type: ext4\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AppendConfig(m, other); err == nil {
+		t.Error("Expected appending a config that mounts the same path to be rejected")
+	}
+}
+
+func TestInitArgs(t *testing.T) {
+	if _, err := NewConfig([]byte("kernel:\n  cmdline: \"console=ttyS0 -- single\"\n  initArgs: [\"--verbose\"]\n")); err == nil {
+		t.Error("Expected a cmdline with '--' and initArgs to be rejected")
+	}
+	m, err := NewConfig([]byte("kernel:\n  cmdline: \"console=ttyS0 quiet\"\n  initArgs: [\"--verbose\", \"single\"]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	none := "none"
+	kf := newKernelFilter(tw, m.Kernel.FullCmdline(), "", &none, nil)
+	if err := kf.WriteHeader(&tar.Header{Name: "kernel", Typeflag: tar.TypeReg, Mode: 0644, Size: 6}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kf.Write([]byte("kernel")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, cmdline, _, err := tarToInitrd(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmdline != "console=ttyS0 quiet -- --verbose single" {
+		t.Errorf("Expected init args after the separator, got %q", cmdline)
+	}
+}
+
+func TestUnusedConfig(t *testing.T) {
+	m, err := NewConfig([]byte(`
+images:
+  getty: linuxkit/getty:v1
+  sshd: linuxkit/sshd:v1
+services:
+  - name: getty
+    image: "@getty"
+files:
+  - path: etc/motd
+    contents: "first"
+  - path: etc/issue
+    contents: "issue"
+  - path: /etc/motd
+    contents: "second"
+  - path: var/lib/state
+    contents: "state"
+  - path: etc/extra
+    source: /nonexistent/extra
+    optional: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	warnings := unusedConfig(m)
+	expected := []string{
+		"file etc/motd is replaced by a later entry for the same path",
+		"file var/lib/state is hidden by the tmpfs mounted on /var",
+		"file etc/extra is not added as optional source /nonexistent/extra is missing",
+		"image alias sshd is not used",
+	}
+	if strings.Join(warnings, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected warnings:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(warnings, "\n"))
+	}
+}
+
+func TestMicrocode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ucode := []byte("070701" + strings.Repeat("0", 104) + "TRAILER!!!")
+	source := filepath.Join(dir, "intel-ucode.cpio")
+	if err := ioutil.WriteFile(source, ucode, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewConfig([]byte("kernel:\n  microcode:\n    source: " + source + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := readMicrocode(m.Kernel.Microcode, &m.Trust, PullMissing, globalOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := addMicrocode(tw, data, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []struct{ name, contents string }{{"boot/kernel", "kernel"}, {"boot/cmdline", "console=ttyS0"}, {"etc/hosts", "hosts"}} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.contents))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	imageFile := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(imageFile, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(dir, "test")
+	if err := Formats(base, imageFile, []string{"kernel+initrd"}, 0, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	initrd, err := ioutil.ReadFile(base + "-initrd.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(initrd, ucode) || len(initrd) == len(ucode) {
+		t.Errorf("Expected the microcode ahead of the initrd")
+	}
+
+	gz := filepath.Join(dir, "intel-ucode.cpio.gz")
+	if err := ioutil.WriteFile(gz, []byte{0x1f, 0x8b, 0x08, 0x00}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readMicrocode(&MicrocodeConfig{Source: gz}, &m.Trust, PullMissing, globalOptions()); err == nil || !strings.Contains(err.Error(), "uncompressed") {
+		t.Errorf("Expected compressed microcode to be rejected, got %v", err)
+	}
+
+	invalid := []string{
+		"kernel:\n  microcode: {}\n",
+		"kernel:\n  microcode:\n    image: docker.io/linuxkit/intel-ucode:v1\n",
+		"kernel:\n  microcode:\n    source: ucode.cpio\n    image: docker.io/linuxkit/intel-ucode:v1\n    path: ucode.cpio\n",
+		"kernel:\n  ucode: intel-ucode.cpio\n  microcode:\n    source: ucode.cpio\n",
+	}
+	for _, config := range invalid {
+		if _, err := NewConfig([]byte(config)); err == nil {
+			t.Errorf("Expected invalid microcode config to be rejected:\n%s", config)
+		}
+	}
+}
+
+// filesystemHeaders returns the tar headers written for the files in m, by name
+func filesystemHeaders(m Moby) (map[string]*tar.Header, error) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := filesystem(m, tw, map[string]uint32{}); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	hdrs := map[string]*tar.Header{}
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return hdrs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		hdrs[hdr.Name] = hdr
+	}
+}
+
+func TestDirectoryAndSymlinkFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "source")
+	if err := ioutil.WriteFile(source, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	contents := "contents"
+
+	for _, tc := range []struct {
+		name     string
+		file     File
+		path     string
+		typeflag byte
+		mode     int64
+		linkname string
+		err      string
+	}{
+		{name: "directory", file: File{Path: "/var/lib/app", Directory: true}, path: "var/lib/app", typeflag: tar.TypeDir, mode: 0700},
+		{name: "directory with mode", file: File{Path: "var/lib/app", Directory: true, Mode: "0755"}, path: "var/lib/app", typeflag: tar.TypeDir, mode: 0755},
+		{name: "directory with trailing slash", file: File{Path: "var/lib/app/", Directory: true, Mode: "0750"}, path: "var/lib/app", typeflag: tar.TypeDir, mode: 0750},
+		{name: "optional directory", file: File{Path: "var/lib/app", Directory: true, Optional: true}, path: "var/lib/app", typeflag: tar.TypeDir, mode: 0700},
+		{name: "symlink", file: File{Path: "etc/localtime", Symlink: "/usr/share/zoneinfo/UTC"}, path: "etc/localtime", typeflag: tar.TypeSymlink, mode: 0777, linkname: "/usr/share/zoneinfo/UTC"},
+		{name: "symlink with mode", file: File{Path: "etc/localtime", Symlink: "../usr/share/zoneinfo/UTC", Mode: "0644"}, path: "etc/localtime", typeflag: tar.TypeSymlink, mode: 0644, linkname: "../usr/share/zoneinfo/UTC"},
+		{name: "optional symlink", file: File{Path: "etc/localtime", Symlink: "/usr/share/zoneinfo/UTC", Optional: true}, path: "etc/localtime", typeflag: tar.TypeSymlink, mode: 0777, linkname: "/usr/share/zoneinfo/UTC"},
+		{name: "optional source", file: File{Path: "etc/app.conf", Source: source, Optional: true}, path: "etc/app.conf", typeflag: tar.TypeReg, mode: 0600},
+		{name: "missing optional source", file: File{Path: "etc/app.conf", Source: filepath.Join(dir, "missing"), Optional: true}},
+		{name: "directory and symlink", file: File{Path: "etc/app", Directory: true, Symlink: "/opt/app"}, err: "Directory and Symlink"},
+		{name: "directory with contents", file: File{Path: "etc/app", Directory: true, Contents: &contents}, err: "Contents and Directory"},
+		{name: "directory with source", file: File{Path: "etc/app", Directory: true, Source: source}, err: "Source and Directory"},
+		{name: "directory with optional source", file: File{Path: "etc/app", Directory: true, Source: filepath.Join(dir, "missing"), Optional: true}, err: "Source and Directory"},
+		{name: "symlink with contents", file: File{Path: "etc/app", Symlink: "/opt/app", Contents: &contents}, err: "Contents and Symlink"},
+		{name: "symlink with source", file: File{Path: "etc/app", Symlink: "/opt/app", Source: source}, err: "Source and Symlink"},
+		{name: "symlink with optional source", file: File{Path: "etc/app", Symlink: "/opt/app", Source: filepath.Join(dir, "missing"), Optional: true}, err: "Source and Symlink"},
+		{name: "symlink with metadata", file: File{Path: "etc/app", Symlink: "/opt/app", Metadata: "yaml"}, err: "Metadata and Symlink"},
+		{name: "root", file: File{Path: "/", Directory: true}, err: "at /"},
+	} {
+		hdrs, err := filesystemHeaders(Moby{Files: []File{tc.file}})
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if tc.path == "" {
+			if len(hdrs) != 0 {
+				t.Errorf("%s: expected the file to be skipped, got %v", tc.name, hdrs)
+			}
+			continue
+		}
+		hdr, ok := hdrs[tc.path]
+		if !ok {
+			t.Errorf("%s: expected %s in the image, got %v", tc.name, tc.path, hdrs)
+			continue
+		}
+		if hdr.Typeflag != tc.typeflag || hdr.Mode != tc.mode || hdr.Linkname != tc.linkname {
+			t.Errorf("%s: expected type %c mode %o link %q, got type %c mode %o link %q", tc.name, tc.typeflag, tc.mode, tc.linkname, hdr.Typeflag, hdr.Mode, hdr.Linkname)
+		}
+		if len(hdrs) != strings.Count(tc.path, "/")+1 {
+			t.Errorf("%s: expected only %s and its parents, got %v", tc.name, tc.path, hdrs)
+		}
+		for name, parent := range hdrs {
+			if name != tc.path && (parent.Typeflag != tar.TypeDir || parent.Mode&0700 != 0700) {
+				t.Errorf("%s: expected parent %s to be a traversable directory, got type %c mode %o", tc.name, name, parent.Typeflag, parent.Mode)
+			}
+		}
+	}
+}
+
+func TestURLSources(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/app.conf" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+	sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	for _, tc := range []struct {
+		name    string
+		file    File
+		skipped bool
+		err     string
+	}{
+		{name: "url", file: File{Path: "etc/app.conf", Source: srv.URL + "/app.conf"}},
+		{name: "url with sha256", file: File{Path: "etc/app.conf", Source: srv.URL + "/app.conf", SHA256: sum}},
+		{name: "url with wrong sha256", file: File{Path: "etc/app.conf", Source: srv.URL + "/app.conf", SHA256: strings.Repeat("0", 64)}, err: "expected " + strings.Repeat("0", 64)},
+		{name: "missing url", file: File{Path: "etc/app.conf", Source: srv.URL + "/missing"}, err: "404"},
+		{name: "missing optional url", file: File{Path: "etc/app.conf", Source: srv.URL + "/missing", Optional: true}, skipped: true},
+		{name: "sha256 without source", file: File{Path: "etc/app.conf", Contents: &sum, SHA256: sum}, err: "SHA256 without Source"},
+	} {
+		hdrs, err := filesystemHeaders(Moby{Files: []File{tc.file}})
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		hdr, ok := hdrs["etc/app.conf"]
+		if tc.skipped {
+			if ok {
+				t.Errorf("%s: expected the file to be skipped", tc.name)
+			}
+			continue
+		}
+		if !ok || hdr.Size != 5 {
+			t.Errorf("%s: expected the downloaded file in the image, got %v", tc.name, hdrs)
+		}
+	}
+
+	// URL sources are not checked before the build
+	if err := checkFileSources(Moby{Files: []File{{Path: "etc/app.conf", Source: srv.URL + "/missing"}}}); err != nil {
+		t.Errorf("Expected URL sources to be skipped by checkFileSources, got %v", err)
+	}
+}
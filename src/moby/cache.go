@@ -0,0 +1,236 @@
+package moby
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// linuxkitSuffixes are the files cached for each LinuxKit helper image
+var linuxkitSuffixes = []string{"-kernel", "-initrd.img", "-cmdline"}
+
+// cacheFileRE matches the names of the cache files for any version of a
+// LinuxKit helper image, but not temporary files being written
+var cacheFileRE = regexp.MustCompile(`^[a-zA-Z0-9_.]+-[0-9a-f]{64}(-kernel|-initrd\.img|-cmdline)$`)
+
+// currentCacheFiles returns the names of the cache files for the current helper images
+func currentCacheFiles() map[string]bool {
+	files := map[string]bool{}
+	for name := range linuxkitYaml {
+		base := filepath.Base(imageFilename(name))
+		for _, suffix := range linuxkitSuffixes {
+			files[base+suffix] = true
+		}
+	}
+	return files
+}
+
+// ExportCache writes the cached LinuxKit helper images as a tarball
+func ExportCache(w io.Writer) error {
+	dir := filepath.Join(MobyDir, "linuxkit")
+	tw := tar.NewWriter(w)
+	names := []string{}
+	for name := range currentCacheFiles() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			f.Close()
+			return err
+		}
+		log.Infof("  %s", name)
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// ImportCache restores cached LinuxKit helper images from a tarball written by
+// ExportCache, skipping any that do not match the current helper images
+func ImportCache(r io.Reader) (imported []string, skipped []string, err error) {
+	dir := filepath.Join(MobyDir, "linuxkit")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	current := currentCacheFiles()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, skipped, err
+		}
+		if hdr.Typeflag != tar.TypeReg || !current[hdr.Name] {
+			skipped = append(skipped, hdr.Name)
+			continue
+		}
+		// write to a temporary file so an interrupted import leaves no partial cache file
+		f, err := ioutil.TempFile(dir, hdr.Name)
+		if err != nil {
+			return imported, skipped, err
+		}
+		_, err = io.Copy(f, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), filepath.Join(dir, hdr.Name))
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return imported, skipped, fmt.Errorf("Cannot import %s: %v", hdr.Name, err)
+		}
+		imported = append(imported, hdr.Name)
+	}
+	return imported, skipped, nil
+}
+
+// PruneLinuxkitCache removes the cached LinuxKit helper images that are not
+// for the current helper configs, returning the names of the files removed.
+// It is only run by moby prune, not by builds, as other versions of moby
+// sharing the cache directory still use the images this one does not.
+func PruneLinuxkitCache() ([]string, error) {
+	dir := filepath.Join(MobyDir, "linuxkit")
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	current := currentCacheFiles()
+	var removed []string
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || !cacheFileRE.MatchString(e.Name()) || current[e.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			return removed, err
+		}
+		removed = append(removed, e.Name())
+	}
+	return removed, nil
+}
+
+// CachedImage is a file of a cached LinuxKit helper image
+type CachedImage struct {
+	Name    string
+	Size    int64
+	Current bool
+}
+
+// ListLinuxkitCache returns the files of the cached LinuxKit helper images,
+// sorted by name, and whether each is for a current helper config
+func ListLinuxkitCache() ([]CachedImage, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(MobyDir, "linuxkit"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	current := currentCacheFiles()
+	var images []CachedImage
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || !cacheFileRE.MatchString(e.Name()) {
+			continue
+		}
+		images = append(images, CachedImage{Name: e.Name(), Size: e.Size(), Current: current[e.Name()]})
+	}
+	return images, nil
+}
+
+// CacheSize returns the total size of the files in MobyDir
+func CacheSize() (int64, error) {
+	var size int64
+	err := filepath.Walk(MobyDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// PruneTmp removes the entries in MobyDir/tmp that have not been modified
+// for the given age, which are left behind by builds that did not finish,
+// returning their names
+func PruneTmp(age time.Duration) ([]string, error) {
+	dir := filepath.Join(MobyDir, "tmp")
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, e := range entries {
+		if time.Since(e.ModTime()) < age {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return removed, err
+		}
+		removed = append(removed, e.Name())
+	}
+	return removed, nil
+}
+
+// PruneAll removes everything in the tmp and linuxkit directories of MobyDir
+func PruneAll() error {
+	for _, sub := range []string{"tmp", "linuxkit"} {
+		dir := filepath.Join(MobyDir, sub)
+		entries, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	MobyDir = filepath.Join(dir, "a")
+	defer func() { MobyDir = "" }()
+
+	filename := imageFilename("mkimage")
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKernelInitrd(filename, []byte("kernel"), []byte("initrd"), "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := ExportCache(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// add a stale entry from an older helper
+	stale := new(bytes.Buffer)
+	tw := tar.NewWriter(stale)
+	if err := tw.WriteHeader(&tar.Header{Name: "mkimage-0000-kernel", Mode: 0644, Size: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	MobyDir = filepath.Join(dir, "b")
+	imported, skipped, err := ImportCache(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 3 || len(skipped) != 0 {
+		t.Errorf("Expected 3 files imported, got %v, skipped %v", imported, skipped)
+	}
+	kernel, err := ioutil.ReadFile(imageFilename("mkimage") + "-kernel")
+	if err != nil || string(kernel) != "kernel" {
+		t.Errorf("Expected imported kernel, got %q: %v", kernel, err)
+	}
+
+	imported, skipped, err = ImportCache(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 0 || !reflect.DeepEqual(skipped, []string{"mkimage-0000-kernel"}) {
+		t.Errorf("Expected stale entry to be skipped, got imported %v, skipped %v", imported, skipped)
+	}
+}
+
+func TestPruneLinuxkitCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	MobyDir = dir
+	defer func() { MobyDir = "" }()
+
+	filename := imageFilename("mkimage")
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKernelInitrd(filename, []byte("kernel"), []byte("initrd"), "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(dir, "linuxkit", "mkimage-"+strings.Repeat("0", 64))
+	if err := writeKernelInitrd(stale, []byte("kernel"), []byte("initrd"), "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+	partial := filepath.Join(dir, "linuxkit", "mkimage-"+strings.Repeat("0", 64)+"-kernel123456")
+	if err := ioutil.WriteFile(partial, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := PruneLinuxkitCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Base(stale)
+	expected := []string{base + "-cmdline", base + "-initrd.img", base + "-kernel"}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Errorf("Expected %v to be removed, got %v", expected, removed)
+	}
+	if !linuxkitImageCached("mkimage") {
+		t.Error("Expected the current image to be kept")
+	}
+	if _, err := os.Stat(partial); err != nil {
+		t.Errorf("Expected a file being written to be kept: %v", err)
+	}
+}
+
+func TestPruneCacheDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	MobyDir = dir
+	defer func() { MobyDir = "" }()
+
+	filename := imageFilename("mkimage")
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKernelInitrd(filename, []byte("kernel"), []byte("initrd"), "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(dir, "linuxkit", "mkimage-"+strings.Repeat("0", 64))
+	if err := ioutil.WriteFile(stale+"-kernel", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"old", "new"} {
+		if err := os.MkdirAll(filepath.Join(dir, "tmp", d), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "tmp", d, "disk"), []byte("disk"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "tmp", "old"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := CacheSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len("kernel")+len("initrd")+len("console=ttyS0")+len("old")+2*len("disk")) {
+		t.Errorf("Unexpected cache size %d", size)
+	}
+
+	images, err := ListLinuxkitCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stales int
+	for _, image := range images {
+		if !image.Current {
+			stales++
+			if image.Name != filepath.Base(stale)+"-kernel" || image.Size != 3 {
+				t.Errorf("Unexpected stale image %+v", image)
+			}
+		}
+	}
+	if len(images) != 4 || stales != 1 {
+		t.Errorf("Expected 3 current and 1 stale cache files, got %+v", images)
+	}
+
+	removed, err := PruneTmp(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, []string{"old"}) {
+		t.Errorf("Expected only the old tmp entry to be removed, got %v", removed)
+	}
+
+	if err := PruneAll(); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := CacheSize(); err != nil || size != 0 {
+		t.Errorf("Expected an empty cache, got %d bytes: %v", size, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tmp")); err != nil {
+		t.Errorf("Expected the tmp directory to be kept: %v", err)
+	}
+}
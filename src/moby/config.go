@@ -1,12 +1,20 @@
 package moby
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+	// timezones are checked against the tz database built in to the binary,
+	// as hosts such as minimal containers may have no zoneinfo
+	_ "time/tzdata"
 
 	"github.com/containerd/containerd/reference"
 	"github.com/docker/docker/api/types"
@@ -17,30 +25,146 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+// ConfigLabel is the image label that default image config is read from,
+// projects that rebrand the label can change it
+var ConfigLabel = "org.mobyproject.config"
+
+// RuntimeAnnotation is the annotation in the OCI config of a container that
+// names the low level runtime, such as runc or kata, to run it with
+const RuntimeAnnotation = "org.mobyproject.runtime"
+
+// BuildVersionAnnotation and BuildCommitAnnotation are the annotations in the
+// OCI config of every container that record the version and commit of the
+// tool that built it, unless the config sets them
+const (
+	BuildVersionAnnotation = "org.mobyproject.build.version"
+	BuildCommitAnnotation  = "org.mobyproject.build.commit"
+)
+
+// BuildVersion and BuildCommit are the version and commit of the tool, which
+// are not recorded in the OCI configs if empty
+var (
+	BuildVersion string
+	BuildCommit  string
+)
+
+// DefaultRlimits is a list of rlimits, in the same "name,soft,hard" form as the
+// rlimits image field, applied to every container that does not set them itself
+var DefaultRlimits []string
+
+// ExtraBinds are binds added from the command line to the containers with the
+// given names, in the same "source:destination[:options]" form as binds
+var ExtraBinds = map[string][]string{}
+
 // Moby is the type of a Moby config file
 type Moby struct {
-	Kernel     KernelConfig `kernel:"cmdline,omitempty" json:"kernel,omitempty"`
-	Init       []string     `init:"cmdline" json:"init"`
-	Onboot     []*Image     `yaml:"onboot" json:"onboot"`
-	Onshutdown []*Image     `yaml:"onshutdown" json:"onshutdown"`
-	Services   []*Image     `yaml:"services" json:"services"`
-	Trust      TrustConfig  `yaml:"trust,omitempty" json:"trust,omitempty"`
-	Files      []File       `yaml:"files" json:"files"`
+	Kernel     KernelConfig            `kernel:"cmdline,omitempty" json:"kernel,omitempty"`
+	Init       []string                `init:"cmdline" json:"init"`
+	Onboot     []*Image                `yaml:"onboot" json:"onboot"`
+	Onshutdown []*Image                `yaml:"onshutdown" json:"onshutdown"`
+	Services   []*Image                `yaml:"services" json:"services"`
+	Trust      TrustConfig             `yaml:"trust,omitempty" json:"trust,omitempty"`
+	Files      []File                  `yaml:"files" json:"files"`
+	Images     map[string]string       `yaml:"images,omitempty" json:"images,omitempty"`
+	Banner     *BannerConfig           `yaml:"banner,omitempty" json:"banner,omitempty"`
+	Timezone   string                  `yaml:"timezone,omitempty" json:"timezone,omitempty"`
+	Outputs    map[string]OutputConfig `yaml:"outputs,omitempty" json:"outputs,omitempty"`
+	Fstab      []FstabEntry            `yaml:"fstab,omitempty" json:"fstab,omitempty"`
+	ImageFiles *ImageFilesConfig       `yaml:"imageFiles,omitempty" json:"imageFiles,omitempty"`
+
+	initRefs    []*reference.Spec
+	usedAliases map[string]bool
+	opts        *buildOptions
+}
 
-	initRefs []*reference.Spec
+// ImageFilesConfig changes the files removed from and replaced in the
+// filesystem of each image as it is added. Exclude removes a path, and
+// everything under it if it is a directory. Replace sets the contents of
+// files the image has. Defaults false stops the default contents being put
+// in etc/hosts and etc/resolv.conf, keeping those of the image.
+type ImageFilesConfig struct {
+	Exclude  []string          `yaml:"exclude,omitempty" json:"exclude,omitempty"`
+	Replace  map[string]string `yaml:"replace,omitempty" json:"replace,omitempty"`
+	Defaults *bool             `yaml:"defaults,omitempty" json:"defaults,omitempty"`
 }
 
 // KernelConfig is the type of the config for a kernel
 type KernelConfig struct {
-	Image   string  `yaml:"image" json:"image"`
-	Cmdline string  `yaml:"cmdline,omitempty" json:"cmdline,omitempty"`
-	Binary  string  `yaml:"binary,omitempty" json:"binary,omitempty"`
-	Tar     *string `yaml:"tar,omitempty" json:"tar,omitempty"`
-	UCode   *string `yaml:"ucode,omitempty" json:"ucode,omitempty"`
+	Image    string   `yaml:"image" json:"image"`
+	Cmdline  string   `yaml:"cmdline,omitempty" json:"cmdline,omitempty"`
+	Binary   string   `yaml:"binary,omitempty" json:"binary,omitempty"`
+	Tar      *string  `yaml:"tar,omitempty" json:"tar,omitempty"`
+	UCode    *string  `yaml:"ucode,omitempty" json:"ucode,omitempty"`
+	Console  []string `yaml:"console,omitempty" json:"console,omitempty"`
+	InitArgs []string `yaml:"initArgs,omitempty" json:"initArgs,omitempty"`
+
+	Microcode *MicrocodeConfig `yaml:"microcode,omitempty" json:"microcode,omitempty"`
+
+	ref *reference.Spec
+}
+
+// MicrocodeConfig is the early CPU microcode placed ahead of the initrd, an
+// uncompressed cpio archive from a local file or from a path in an image
+type MicrocodeConfig struct {
+	Source string `yaml:"source,omitempty" json:"source,omitempty"`
+	Image  string `yaml:"image,omitempty" json:"image,omitempty"`
+	Path   string `yaml:"path,omitempty" json:"path,omitempty"`
 
 	ref *reference.Spec
 }
 
+// FullCmdline returns the kernel command line with a console= argument for
+// each console, and any init arguments after a "--" separator, which the
+// kernel passes on to init
+func (k KernelConfig) FullCmdline() string {
+	args := strings.Fields(k.Cmdline)
+	for _, c := range k.Console {
+		args = append(args, "console="+c)
+	}
+	if len(k.InitArgs) != 0 {
+		args = append(append(args, "--"), k.InitArgs...)
+	}
+	if len(k.Console) == 0 && len(k.InitArgs) == 0 {
+		return k.Cmdline
+	}
+	return strings.Join(args, " ")
+}
+
+// BannerConfig is the type of the config for the login banner, which is
+// written to /etc/motd and optionally /etc/issue
+type BannerConfig struct {
+	Contents string `yaml:"contents,omitempty" json:"contents,omitempty"`
+	Source   string `yaml:"source,omitempty" json:"source,omitempty"`
+	Issue    bool   `yaml:"issue,omitempty" json:"issue,omitempty"`
+}
+
+// FstabEntry is the type of the config for a line of /etc/fstab, for
+// filesystems mounted by the host at boot rather than by a container
+type FstabEntry struct {
+	Device     string   `yaml:"device" json:"device"`
+	Mountpoint string   `yaml:"mountpoint" json:"mountpoint"`
+	Type       string   `yaml:"type" json:"type"`
+	Options    []string `yaml:"options,omitempty" json:"options,omitempty"`
+	Dump       int      `yaml:"dump,omitempty" json:"dump,omitempty"`
+	Pass       int      `yaml:"pass,omitempty" json:"pass,omitempty"`
+}
+
+// OutputConfig is the type of the config for an output format
+type OutputConfig struct {
+	Args []string `yaml:"args,omitempty" json:"args,omitempty"`
+}
+
+// HelperArgs returns the extra mkimage helper arguments for each output format
+func (m Moby) HelperArgs() map[string][]string {
+	args := map[string][]string{}
+	for format, o := range m.Outputs {
+		if len(o.Args) != 0 {
+			args[format] = o.Args
+		}
+	}
+	return args
+}
+
 // TrustConfig is the type of a content trust config
 type TrustConfig struct {
 	Image []string `yaml:"image,omitempty" json:"image,omitempty"`
@@ -54,6 +178,7 @@ type File struct {
 	Symlink   string      `yaml:"symlink,omitempty" json:"symlink,omitempty"`
 	Contents  *string     `yaml:"contents,omitempty" json:"contents,omitempty"`
 	Source    string      `yaml:"source,omitempty" json:"source,omitempty"`
+	SHA256    string      `yaml:"sha256,omitempty" json:"sha256,omitempty"`
 	Metadata  string      `yaml:"metadata,omitempty" json:"metadata,omitempty"`
 	Optional  bool        `yaml:"optional" json:"optional"`
 	Mode      string      `yaml:"mode,omitempty" json:"mode,omitempty"`
@@ -96,18 +221,44 @@ type ImageConfig struct {
 	OOMScoreAdj       *int                    `yaml:"oomScoreAdj,omitempty" json:"oomScoreAdj,omitempty"`
 	RootfsPropagation *string                 `yaml:"rootfsPropagation,omitempty" json:"rootfsPropagation,omitempty"`
 	CgroupsPath       *string                 `yaml:"cgroupsPath,omitempty" json:"cgroupsPath,omitempty"`
-	Resources         *specs.LinuxResources   `yaml:"resources,omitempty" json:"resources,omitempty"`
+	Resources         *Resources              `yaml:"resources,omitempty" json:"resources,omitempty"`
 	Sysctl            *map[string]string      `yaml:"sysctl,omitempty" json:"sysctl,omitempty"`
 	Rlimits           *[]string               `yaml:"rlimits,omitempty" json:"rlimits,omitempty"`
+	Devices           *[]Device               `yaml:"devices,omitempty" json:"devices,omitempty"`
+	Seccomp           *interface{}            `yaml:"seccomp,omitempty" json:"seccomp,omitempty"`
+	ApparmorProfile   *string                 `yaml:"apparmorProfile,omitempty" json:"apparmorProfile,omitempty"`
 	UIDMappings       *[]specs.LinuxIDMapping `yaml:"uidMappings,omitempty" json:"uidMappings,omitempty"`
 	GIDMappings       *[]specs.LinuxIDMapping `yaml:"gidMappings,omitempty" json:"gidMappings,omitempty"`
 	Annotations       *map[string]string      `yaml:"annotations,omitempty" json:"annotations,omitempty"`
+	OCIRuntime        *string                 `yaml:"ociRuntime,omitempty" json:"ociRuntime,omitempty"`
 
 	Runtime *Runtime `yaml:"runtime,omitempty" json:"runtime,omitempty"`
 
 	ref *reference.Spec
 }
 
+// Resources is the cgroup resources of an image, as per the OCI spec, with
+// shorthands for the common memory and CPU limits that are applied over them
+type Resources struct {
+	specs.LinuxResources `yaml:",inline"`
+
+	MemoryLimit *int64  `yaml:"memoryLimit,omitempty" json:"memoryLimit,omitempty"`
+	CPUShares   *uint64 `yaml:"cpuShares,omitempty" json:"cpuShares,omitempty"`
+	CPUQuota    *int64  `yaml:"cpuQuota,omitempty" json:"cpuQuota,omitempty"`
+	CPUPeriod   *uint64 `yaml:"cpuPeriod,omitempty" json:"cpuPeriod,omitempty"`
+}
+
+// Device is a device node created in a container, which its device cgroup
+// allows access to. Type is "c", "b", "u" or "p" as for mknod, and Mode is
+// the octal file mode, default 0666.
+type Device struct {
+	Path  string `yaml:"path" json:"path"`
+	Type  string `yaml:"type" json:"type"`
+	Major int64  `yaml:"major" json:"major"`
+	Minor int64  `yaml:"minor" json:"minor"`
+	Mode  string `yaml:"mode,omitempty" json:"mode,omitempty"`
+}
+
 // Runtime is the type of config processed at runtime, not used to build the OCI spec
 type Runtime struct {
 	Cgroups    *[]string      `yaml:"cgroups,omitempty" json:"cgroups,omitempty"`
@@ -137,6 +288,21 @@ type Interface struct {
 	CreateInRoot bool   `yaml:"createInRoot" json:"createInRoot"`
 }
 
+// rawSchemaErrors validates a parsed YAML document against the schema
+func rawSchemaErrors(rawYaml interface{}) ([]gojsonschema.ResultError, error) {
+	// Convert to raw JSON
+	rawJSON := convert(rawYaml)
+
+	// Validate raw yaml with JSON schema
+	schemaLoader := gojsonschema.NewStringLoader(schema)
+	documentLoader := gojsonschema.NewGoLoader(rawJSON)
+	result, err := gojsonschema.Validate(schemaLoader, documentLoader)
+	if err != nil {
+		return nil, err
+	}
+	return result.Errors(), nil
+}
+
 // github.com/go-yaml/yaml treats map keys as interface{} while encoding/json
 // requires them to be strings, integers or to implement encoding.TextMarshaler.
 // Fix this up by recursively mapping all map[interface{}]interface{} types into
@@ -170,6 +336,179 @@ func uniqueServices(m Moby) error {
 	return nil
 }
 
+// resolveAlias expands an "@name" image reference using the images map
+func resolveAlias(image string, images map[string]string, used map[string]bool) (string, error) {
+	if !strings.HasPrefix(image, "@") {
+		return image, nil
+	}
+	ref, ok := images[image[1:]]
+	if !ok {
+		return "", fmt.Errorf("undefined image alias: %s", image)
+	}
+	used[image[1:]] = true
+	return ref, nil
+}
+
+func resolveImageAliases(m *Moby) error {
+	var err error
+	if m.usedAliases == nil {
+		m.usedAliases = map[string]bool{}
+	}
+	if m.Kernel.Image, err = resolveAlias(m.Kernel.Image, m.Images, m.usedAliases); err != nil {
+		return err
+	}
+	if mc := m.Kernel.Microcode; mc != nil && mc.Image != "" {
+		if mc.Image, err = resolveAlias(mc.Image, m.Images, m.usedAliases); err != nil {
+			return err
+		}
+	}
+	for i, ii := range m.Init {
+		if m.Init[i], err = resolveAlias(ii, m.Images, m.usedAliases); err != nil {
+			return err
+		}
+	}
+	for _, images := range [][]*Image{m.Onboot, m.Onshutdown, m.Services} {
+		for _, image := range images {
+			if image.Image, err = resolveAlias(image.Image, m.Images, m.usedAliases); err != nil {
+				return fmt.Errorf("%s: %v", image.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateEnv checks that each entry in an environment is NAME=value with a valid POSIX name
+func validateEnv(env []string) error {
+	for _, e := range env {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("environment variable missing '=': %s", e)
+		}
+		name := parts[0]
+		if name == "" {
+			return fmt.Errorf("environment variable has empty name: %s", e)
+		}
+		for i, c := range name {
+			if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9') {
+				continue
+			}
+			return fmt.Errorf("invalid environment variable name %q: %s", name, e)
+		}
+	}
+	return nil
+}
+
+func validateImages(m Moby) error {
+	for _, images := range [][]*Image{m.Onboot, m.Onshutdown, m.Services} {
+		for _, image := range images {
+			if image.Env != nil {
+				if err := validateEnv(*image.Env); err != nil {
+					return fmt.Errorf("%s: %v", image.Name, err)
+				}
+			}
+			for _, caps := range []*[]string{image.Capabilities, image.Ambient} {
+				if caps == nil {
+					continue
+				}
+				if _, err := expandCaps(*caps); err != nil {
+					return fmt.Errorf("%s: %v", image.Name, err)
+				}
+			}
+			if image.ApparmorProfile != nil && strings.TrimSpace(*image.ApparmorProfile) == "" {
+				return fmt.Errorf("%s: apparmorProfile must not be empty", image.Name)
+			}
+			if image.OCIRuntime != nil && (*image.OCIRuntime == "" || strings.ContainsAny(*image.OCIRuntime, " \t\n")) {
+				return fmt.Errorf("%s: invalid ociRuntime %q", image.Name, *image.OCIRuntime)
+			}
+			if image.Seccomp != nil {
+				if _, err := parseSeccomp(*image.Seccomp); err != nil {
+					return fmt.Errorf("%s: %v", image.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateTimezone checks that a timezone is a zone in the tz database
+func validateTimezone(zone string) error {
+	if zone == "" {
+		return nil
+	}
+	if zone == "Local" {
+		return fmt.Errorf("Invalid timezone %s", zone)
+	}
+	if _, err := time.LoadLocation(zone); err != nil {
+		return fmt.Errorf("Invalid timezone %s: %v", zone, err)
+	}
+	return nil
+}
+
+// validateFstab checks that each fstab entry can be written as a line of
+// /etc/fstab, which separates fields with whitespace
+func validateFstab(entries []FstabEntry) error {
+	mountpoints := map[string]bool{}
+	for _, e := range entries {
+		fields := map[string]string{"device": e.Device, "mountpoint": e.Mountpoint, "type": e.Type}
+		for _, name := range []string{"device", "mountpoint", "type"} {
+			v := fields[name]
+			if v == "" || strings.ContainsAny(v, " \t\n#") {
+				return fmt.Errorf("Invalid fstab %s %q", name, v)
+			}
+		}
+		if e.Mountpoint != "none" && !filepath.IsAbs(e.Mountpoint) {
+			return fmt.Errorf("Fstab mountpoint %s must be an absolute path or none", e.Mountpoint)
+		}
+		if e.Mountpoint != "none" {
+			if mountpoints[e.Mountpoint] {
+				return fmt.Errorf("Fstab has more than one entry for %s", e.Mountpoint)
+			}
+			mountpoints[e.Mountpoint] = true
+		}
+		for _, o := range e.Options {
+			if o == "" || strings.ContainsAny(o, " \t\n#,") {
+				return fmt.Errorf("Invalid fstab option %q for %s", o, e.Mountpoint)
+			}
+		}
+		if e.Dump != 0 && e.Dump != 1 {
+			return fmt.Errorf("Fstab dump for %s must be 0 or 1, not %d", e.Mountpoint, e.Dump)
+		}
+		if e.Pass < 0 || e.Pass > 2 {
+			return fmt.Errorf("Fstab pass for %s must be 0, 1 or 2, not %d", e.Mountpoint, e.Pass)
+		}
+	}
+	return nil
+}
+
+// AddExtraBind adds a bind given as "name:source:destination[:options]" to ExtraBinds
+func AddExtraBind(bind string) error {
+	parts := strings.SplitN(bind, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("Cannot parse bind, must be name:source:destination[:options]: %s", bind)
+	}
+	if _, err := parseBind(parts[1]); err != nil {
+		return err
+	}
+	ExtraBinds[parts[0]] = append(ExtraBinds[parts[0]], parts[1])
+	return nil
+}
+
+// ValidateExtraBinds checks that every container given a bind in ExtraBinds is in the config
+func ValidateExtraBinds(m Moby) error {
+	names := map[string]bool{}
+	for _, images := range [][]*Image{m.Onboot, m.Onshutdown, m.Services} {
+		for _, image := range images {
+			names[image.Name] = true
+		}
+	}
+	for name := range ExtraBinds {
+		if !names[name] {
+			return fmt.Errorf("Cannot add bind to %s, no such container in the config", name)
+		}
+	}
+	return nil
+}
+
 func extractReferences(m *Moby) error {
 	if m.Kernel.Image != "" {
 		r, err := reference.Parse(m.Kernel.Image)
@@ -178,6 +517,13 @@ func extractReferences(m *Moby) error {
 		}
 		m.Kernel.ref = &r
 	}
+	if mc := m.Kernel.Microcode; mc != nil && mc.Image != "" {
+		r, err := reference.Parse(mc.Image)
+		if err != nil {
+			return fmt.Errorf("extract microcode image reference: %v", err)
+		}
+		mc.ref = &r
+	}
 	for _, ii := range m.Init {
 		r, err := reference.Parse(ii)
 		if err != nil {
@@ -213,6 +559,9 @@ func updateImages(m *Moby) {
 	if m.Kernel.ref != nil {
 		m.Kernel.Image = m.Kernel.ref.String()
 	}
+	if mc := m.Kernel.Microcode; mc != nil && mc.ref != nil {
+		mc.Image = mc.ref.String()
+	}
 	for i, ii := range m.initRefs {
 		m.Init[i] = ii.String()
 	}
@@ -233,42 +582,242 @@ func updateImages(m *Moby) {
 	}
 }
 
-// NewConfig parses a config file
+// configDocuments parses each YAML document in a config file, both as raw
+// YAML for the schema and as a Moby. Empty documents are skipped. The files
+// a document includes are read relative to dir and their documents come
+// before it. dir is empty for a config from a URL, which may only include
+// files below the working directory. including is the chain of files being
+// read, to detect cycles.
+func configDocuments(config []byte, dir string, including []string) ([]interface{}, []Moby, error) {
+	var raws []interface{}
+	var docs []Moby
+	rawDecoder := yaml.NewDecoder(bytes.NewReader(config))
+	decoder := yaml.NewDecoder(bytes.NewReader(config))
+	for {
+		var raw interface{}
+		err := rawDecoder.Decode(&raw)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		var m Moby
+		if err := decoder.Decode(&m); err != nil {
+			return nil, nil, err
+		}
+		if raw == nil {
+			continue
+		}
+		includes, err := configIncludes(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := resolveSeccomp(m, dir); err != nil {
+			return nil, nil, err
+		}
+		for _, include := range includes {
+			if dir == "" && outsideWorkingDir(include) {
+				return nil, nil, fmt.Errorf("A config from a URL cannot include %s, which is outside the working directory", include)
+			}
+			r, d, err := includeConfig(include, dir, including)
+			if err != nil {
+				return nil, nil, err
+			}
+			raws = append(raws, r...)
+			docs = append(docs, d...)
+		}
+		raws = append(raws, raw)
+		docs = append(docs, m)
+	}
+	return raws, docs, nil
+}
+
+// outsideWorkingDir reports whether a path is not below the working directory
+func outsideWorkingDir(file string) bool {
+	clean := filepath.Clean(file)
+	return filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
+
+// resolveSeccomp makes the path of each seccomp profile file in a document
+// relative to dir, the directory of the config. A config from a URL, with an
+// empty dir, may only use profiles below the working directory.
+func resolveSeccomp(m Moby, dir string) error {
+	for _, images := range [][]*Image{m.Onboot, m.Onshutdown, m.Services} {
+		for _, image := range images {
+			if image == nil || image.Seccomp == nil {
+				continue
+			}
+			file, ok := (*image.Seccomp).(string)
+			if !ok {
+				continue
+			}
+			if dir == "" {
+				if outsideWorkingDir(file) {
+					return fmt.Errorf("%s: a config from a URL cannot read the seccomp profile %s, which is outside the working directory", image.Name, file)
+				}
+				continue
+			}
+			file = expandSource(file)
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(dir, file)
+			}
+			var v interface{} = file
+			image.Seccomp = &v
+		}
+	}
+	return nil
+}
+
+// configIncludes returns the files listed by the include key of a document
+func configIncludes(raw interface{}) ([]string, error) {
+	m, ok := raw.(map[interface{}]interface{})
+	if !ok || m["include"] == nil {
+		return nil, nil
+	}
+	list, ok := m["include"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("include must be a list of files")
+	}
+	var includes []string
+	for _, i := range list {
+		file, ok := i.(string)
+		if !ok || file == "" {
+			return nil, fmt.Errorf("Invalid include %v", i)
+		}
+		includes = append(includes, file)
+	}
+	return includes, nil
+}
+
+// includeConfig reads the documents of an included config file
+func includeConfig(file, dir string, including []string) ([]interface{}, []Moby, error) {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, f := range including {
+		if f == abs {
+			return nil, nil, fmt.Errorf("Include cycle: %s", strings.Join(append(including[i:], abs), " -> "))
+		}
+	}
+	config, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot read included config: %v", err)
+	}
+	raws, docs, err := configDocuments(config, filepath.Dir(file), append(including[:len(including):len(including)], abs))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return raws, docs, nil
+}
+
+// NewConfig parses a config file. The file can contain several YAML documents
+// separated by "---", which are merged in order as by AppendConfig. A document
+// can include other config files, which are merged before it; they are read
+// relative to the working directory.
 func NewConfig(config []byte) (Moby, error) {
+	return newConfig(config, ".", nil)
+}
+
+// NewRemoteConfig parses a config fetched from a URL. The files it includes
+// are read relative to the working directory, and must be below it.
+func NewRemoteConfig(config []byte) (Moby, error) {
+	return newConfig(config, "", nil)
+}
+
+// NewConfigFile parses a config read from a file, reading the files it
+// includes relative to the directory of the file
+func NewConfigFile(file string, config []byte) (Moby, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return Moby{}, err
+	}
+	return newConfig(config, filepath.Dir(file), []string{abs})
+}
+
+func newConfig(config []byte, dir string, including []string) (Moby, error) {
 	m := Moby{}
 
-	// Parse raw yaml
-	var rawYaml interface{}
-	err := yaml.Unmarshal(config, &rawYaml)
+	raws, docs, err := configDocuments(config, dir, including)
 	if err != nil {
 		return m, err
 	}
+	if len(docs) == 0 {
+		// an empty config is still checked against the schema
+		raws, docs = []interface{}{nil}, []Moby{{}}
+	}
+	for i, raw := range raws {
+		errs, err := rawSchemaErrors(raw)
+		if err != nil {
+			return m, err
+		}
+		if len(errs) != 0 {
+			if len(raws) > 1 {
+				fmt.Printf("Document %d of the configuration file is invalid:\n", i+1)
+			} else {
+				fmt.Printf("The configuration file is invalid:\n")
+			}
+			for _, desc := range errs {
+				fmt.Printf("- %s\n", desc)
+			}
+			return m, fmt.Errorf("invalid configuration file")
+		}
+	}
 
-	// Convert to raw JSON
-	rawJSON := convert(rawYaml)
+	m = docs[0]
+	for _, d := range docs[1:] {
+		if m, err = AppendConfig(m, d); err != nil {
+			return m, err
+		}
+	}
 
-	// Validate raw yaml with JSON schema
-	schemaLoader := gojsonschema.NewStringLoader(schema)
-	documentLoader := gojsonschema.NewGoLoader(rawJSON)
-	result, err := gojsonschema.Validate(schemaLoader, documentLoader)
-	if err != nil {
+	if err := uniqueServices(m); err != nil {
 		return m, err
 	}
-	if !result.Valid() {
-		fmt.Printf("The configuration file is invalid:\n")
-		for _, desc := range result.Errors() {
-			fmt.Printf("- %s\n", desc)
+
+	if err := validateImages(m); err != nil {
+		return m, err
+	}
+
+	if len(m.Kernel.InitArgs) != 0 {
+		for _, f := range strings.Fields(m.Kernel.Cmdline) {
+			if f == "--" {
+				return m, fmt.Errorf("Kernel cmdline cannot contain '--' when initArgs is set")
+			}
 		}
-		return m, fmt.Errorf("invalid configuration file")
 	}
 
-	// Parse yaml
-	err = yaml.Unmarshal(config, &m)
-	if err != nil {
+	for _, c := range m.Kernel.Console {
+		if c == "" || strings.ContainsAny(c, " \t=") {
+			return m, fmt.Errorf("Invalid kernel console %q", c)
+		}
+	}
+
+	if err := validateMicrocode(m.Kernel); err != nil {
 		return m, err
 	}
 
-	if err := uniqueServices(m); err != nil {
+	if err := validateTimezone(m.Timezone); err != nil {
+		return m, err
+	}
+
+	if err := validateFstab(m.Fstab); err != nil {
+		return m, err
+	}
+
+	if err := validateHelperArgs(m.HelperArgs()); err != nil {
+		return m, err
+	}
+
+	if m.Banner != nil && (m.Banner.Contents == "") == (m.Banner.Source == "") {
+		return m, fmt.Errorf("Banner must specify exactly one of contents or source")
+	}
+
+	if err := resolveImageAliases(&m); err != nil {
 		return m, err
 	}
 
@@ -279,6 +828,28 @@ func NewConfig(config []byte) (Moby, error) {
 	return m, nil
 }
 
+// validateMicrocode checks the microcode comes from exactly one of a file or
+// a path in an image, and is not also taken from the kernel image
+func validateMicrocode(k KernelConfig) error {
+	mc := k.Microcode
+	if mc == nil {
+		return nil
+	}
+	if (mc.Source == "") == (mc.Image == "") {
+		return fmt.Errorf("Kernel microcode must specify exactly one of source or image")
+	}
+	if mc.Image != "" && mc.Path == "" {
+		return fmt.Errorf("Kernel microcode from image %s must specify the path of the cpio archive", mc.Image)
+	}
+	if mc.Source != "" && mc.Path != "" {
+		return fmt.Errorf("Kernel microcode path is only used with an image")
+	}
+	if k.UCode != nil {
+		return fmt.Errorf("Kernel microcode cannot be used with ucode from the kernel image")
+	}
+	return nil
+}
+
 // AppendConfig appends two configs.
 func AppendConfig(m0, m1 Moby) (Moby, error) {
 	moby := m0
@@ -297,6 +868,15 @@ func AppendConfig(m0, m1 Moby) (Moby, error) {
 	if m1.Kernel.UCode != nil {
 		moby.Kernel.UCode = m1.Kernel.UCode
 	}
+	if m1.Kernel.Console != nil {
+		moby.Kernel.Console = m1.Kernel.Console
+	}
+	if m1.Kernel.InitArgs != nil {
+		moby.Kernel.InitArgs = m1.Kernel.InitArgs
+	}
+	if m1.Kernel.Microcode != nil {
+		moby.Kernel.Microcode = m1.Kernel.Microcode
+	}
 	if m1.Kernel.ref != nil {
 		moby.Kernel.ref = m1.Kernel.ref
 	}
@@ -307,8 +887,56 @@ func AppendConfig(m0, m1 Moby) (Moby, error) {
 	moby.Files = append(moby.Files, m1.Files...)
 	moby.Trust.Image = append(moby.Trust.Image, m1.Trust.Image...)
 	moby.Trust.Org = append(moby.Trust.Org, m1.Trust.Org...)
+	for k, v := range m1.Images {
+		if moby.Images == nil {
+			moby.Images = map[string]string{}
+		}
+		moby.Images[k] = v
+	}
+	if m1.Banner != nil {
+		moby.Banner = m1.Banner
+	}
+	moby.Fstab = append(moby.Fstab, m1.Fstab...)
+	if f := m1.ImageFiles; f != nil {
+		files := ImageFilesConfig{}
+		if moby.ImageFiles != nil {
+			files = *moby.ImageFiles
+		}
+		files.Exclude = append(append([]string{}, files.Exclude...), f.Exclude...)
+		replace := map[string]string{}
+		for k, v := range files.Replace {
+			replace[k] = v
+		}
+		for k, v := range f.Replace {
+			replace[k] = v
+		}
+		files.Replace = replace
+		if f.Defaults != nil {
+			files.Defaults = f.Defaults
+		}
+		moby.ImageFiles = &files
+	}
+	if m1.Timezone != "" {
+		moby.Timezone = m1.Timezone
+	}
+	for k, v := range m1.Outputs {
+		if moby.Outputs == nil {
+			moby.Outputs = map[string]OutputConfig{}
+		}
+		moby.Outputs[k] = v
+	}
 	moby.initRefs = append(moby.initRefs, m1.initRefs...)
+	for k := range m1.usedAliases {
+		if moby.usedAliases == nil {
+			moby.usedAliases = map[string]bool{}
+		}
+		moby.usedAliases[k] = true
+	}
 
+	// each config is valid alone, but two may mount the same path
+	if err := validateFstab(moby.Fstab); err != nil {
+		return moby, err
+	}
 	return moby, uniqueServices(moby)
 }
 
@@ -355,7 +983,7 @@ func NewImage(config []byte) (Image, error) {
 		return mi, err
 	}
 	if !result.Valid() {
-		fmt.Printf("The org.mobyproject.config label is invalid:\n")
+		fmt.Printf("The %s label is invalid:\n", ConfigLabel)
 		for _, desc := range result.Errors() {
 			fmt.Printf("- %s\n", desc)
 		}
@@ -380,18 +1008,28 @@ func NewImage(config []byte) (Image, error) {
 
 // ConfigToOCI converts a config specification to an OCI config file and a runtime config
 func ConfigToOCI(image *Image, trust bool, idMap map[string]uint32) (specs.Spec, Runtime, error) {
+	return configToOCI(image, trust, idMap, globalOptions())
+}
+
+func configToOCI(image *Image, trust bool, idMap map[string]uint32, opts *buildOptions) (specs.Spec, Runtime, error) {
 
-	// TODO pass through same docker client to all functions
-	cli, err := dockerClient()
+	inspect, fromStore, err := storeInspect(image.ref, opts)
 	if err != nil {
-		return specs.Spec{}, Runtime{}, err
+		return specs.Spec{}, Runtime{}, fmt.Errorf("Cannot read image %s from the content store: %v", image.ref, err)
 	}
-	inspect, err := dockerInspectImage(cli, image.ref, trust)
-	if err != nil {
-		return specs.Spec{}, Runtime{}, err
+	if !fromStore {
+		// TODO pass through same docker client to all functions
+		cli, err := dockerClient(opts.timeout)
+		if err != nil {
+			return specs.Spec{}, Runtime{}, err
+		}
+		inspect, err = dockerInspectImage(cli, image.ref, trust, opts.platform, opts.timeout)
+		if err != nil {
+			return specs.Spec{}, Runtime{}, err
+		}
 	}
 
-	oci, runtime, err := ConfigInspectToOCI(image, inspect, idMap)
+	oci, runtime, err := configInspectToOCI(image, inspect, idMap, opts)
 	if err != nil {
 		return specs.Spec{}, Runtime{}, err
 	}
@@ -432,6 +1070,17 @@ func (m mlist) parts(i int) int {
 	return strings.Count(filepath.Clean(m[i].Destination), string(os.PathSeparator))
 }
 
+// bindOptions adds "rbind" to a list of bind mount options unless a bind type
+// is already given; other options, such as the recursive "rro", pass through as is
+func bindOptions(opts []string) []string {
+	for _, opt := range opts {
+		if opt == "bind" || opt == "rbind" {
+			return opts
+		}
+	}
+	return append(opts, "rbind")
+}
+
 // assignBool does ordered overrides from JSON bool pointers
 func assignBool(v1, v2 *bool) bool {
 	if v2 != nil {
@@ -521,6 +1170,46 @@ func assignMaps(v1, v2 *map[string]string) map[string]string {
 	return map[string]string{}
 }
 
+// parseBind parses a "source:destination[:options]" bind into a mount
+func parseBind(b string) (specs.Mount, error) {
+	parts := strings.Split(b, ":")
+	if len(parts) < 2 {
+		return specs.Mount{}, fmt.Errorf("Cannot parse bind, missing ':': %s", b)
+	}
+	if len(parts) > 3 {
+		return specs.Mount{}, fmt.Errorf("Cannot parse bind, too many ':': %s", b)
+	}
+	src := parts[0]
+	dest := parts[1]
+	// default to rshared if not specified
+	opts := []string{"rw", "rbind", "rshared"}
+	if len(parts) == 3 {
+		opts = bindOptions(strings.Split(parts[2], ","))
+	}
+	return specs.Mount{Destination: dest, Type: "bind", Source: src, Options: opts}, nil
+}
+
+// bindSourceWarnings checks that the sources of bind mounts are absolute,
+// clean paths. The sources are on the host at runtime so cannot be checked
+// for existence at build time, but a malformed source is usually a typo.
+func bindSourceWarnings(mounts []specs.Mount) []string {
+	var warnings []string
+	for _, m := range mounts {
+		if m.Type != "bind" {
+			continue
+		}
+		switch {
+		case m.Source == "":
+			warnings = append(warnings, fmt.Sprintf("bind mount on %s has no source", m.Destination))
+		case !path.IsAbs(m.Source):
+			warnings = append(warnings, fmt.Sprintf("bind mount source %s for %s is not an absolute path", m.Source, m.Destination))
+		case path.Clean(m.Source) != m.Source:
+			warnings = append(warnings, fmt.Sprintf("bind mount source %s for %s is not a clean path, did you mean %s", m.Source, m.Destination, path.Clean(m.Source)))
+		}
+	}
+	return warnings
+}
+
 // assignBinds does ordered overrides from JSON Bind array pointers
 func assignBinds(v1, v2 *[]specs.Mount) []specs.Mount {
 	if v2 != nil {
@@ -566,15 +1255,47 @@ func assignMappings(v1, v2 *[]specs.LinuxIDMapping) []specs.LinuxIDMapping {
 	return []specs.LinuxIDMapping{}
 }
 
-// assignResources does ordered overrides from Resources
-func assignResources(v1, v2 *specs.LinuxResources) specs.LinuxResources {
-	if v2 != nil {
-		return *v2
+// assignResources does ordered overrides from Resources. The OCI resources
+// are replaced by the last config that sets any, while each shorthand limit
+// overrides just its own field, so a label can set defaults for the others
+func assignResources(v1, v2 *Resources) specs.LinuxResources {
+	return applyResources(applyResources(specs.LinuxResources{}, v1), v2)
+}
+
+func applyResources(res specs.LinuxResources, r *Resources) specs.LinuxResources {
+	if r == nil {
+		return res
 	}
-	if v1 != nil {
-		return *v1
+	oci := r.LinuxResources
+	if oci.Devices != nil || oci.Memory != nil || oci.CPU != nil || oci.Pids != nil ||
+		oci.BlockIO != nil || oci.HugepageLimits != nil || oci.Network != nil {
+		res = oci
+	}
+	if r.MemoryLimit != nil {
+		memory := specs.LinuxMemory{}
+		if res.Memory != nil {
+			memory = *res.Memory
+		}
+		memory.Limit = r.MemoryLimit
+		res.Memory = &memory
 	}
-	return specs.LinuxResources{}
+	if r.CPUShares != nil || r.CPUQuota != nil || r.CPUPeriod != nil {
+		cpu := specs.LinuxCPU{}
+		if res.CPU != nil {
+			cpu = *res.CPU
+		}
+		if r.CPUShares != nil {
+			cpu.Shares = r.CPUShares
+		}
+		if r.CPUQuota != nil {
+			cpu.Quota = r.CPUQuota
+		}
+		if r.CPUPeriod != nil {
+			cpu.Period = r.CPUPeriod
+		}
+		res.CPU = &cpu
+	}
+	return res
 }
 
 // assignRuntime does ordered overrides from Runtime
@@ -686,6 +1407,174 @@ var allCaps = []string{
 	"CAP_WAKE_ALARM",
 }
 
+// capSet is the set of capabilities in allCaps
+var capSet = func() map[string]bool {
+	m := map[string]bool{}
+	for _, capability := range allCaps {
+		m[capability] = true
+	}
+	return m
+}()
+
+// expandCaps expands a list of capabilities that is just "all" or "none",
+// and checks that every other capability is in allCaps
+func expandCaps(caps []string) ([]string, error) {
+	if len(caps) == 1 {
+		switch strings.ToLower(caps[0]) {
+		case "none":
+			return []string{}, nil
+		case "all":
+			return allCaps[:], nil
+		}
+	}
+	for _, capability := range caps {
+		if !capSet[capability] {
+			return nil, fmt.Errorf("unknown capability: %s", capability)
+		}
+	}
+	return caps, nil
+}
+
+func parseRlimit(limitString string) (specs.POSIXRlimit, error) {
+	rs := strings.SplitN(limitString, ",", 3)
+	if len(rs) != 3 {
+		return specs.POSIXRlimit{}, fmt.Errorf("Cannot parse rlimit: %s", limitString)
+	}
+	limit := strings.ToUpper(strings.TrimSpace(rs[0]))
+	if !strings.HasPrefix(limit, "RLIMIT_") {
+		limit = "RLIMIT_" + limit
+	}
+	switch limit {
+	case
+		"RLIMIT_CPU",
+		"RLIMIT_FSIZE",
+		"RLIMIT_DATA",
+		"RLIMIT_STACK",
+		"RLIMIT_CORE",
+		"RLIMIT_RSS",
+		"RLIMIT_NPROC",
+		"RLIMIT_NOFILE",
+		"RLIMIT_MEMLOCK",
+		"RLIMIT_AS",
+		"RLIMIT_LOCKS",
+		"RLIMIT_SIGPENDING",
+		"RLIMIT_MSGQUEUE",
+		"RLIMIT_NICE",
+		"RLIMIT_RTPRIO",
+		"RLIMIT_RTTIME":
+	default:
+		return specs.POSIXRlimit{}, fmt.Errorf("Unknown limit: %s", rs[0])
+	}
+	soft, err := parseRlimitValue(rs[1])
+	if err != nil {
+		return specs.POSIXRlimit{}, err
+	}
+	hard, err := parseRlimitValue(rs[2])
+	if err != nil {
+		return specs.POSIXRlimit{}, err
+	}
+	return specs.POSIXRlimit{Type: limit, Soft: soft, Hard: hard}, nil
+}
+
+func parseRlimitValue(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if strings.ToLower(s) == "unlimited" {
+		return 18446744073709551615, nil
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot parse %s as uint64: %v", s, err)
+	}
+	return v, nil
+}
+
+// assignRlimits parses the default rlimits and overrides them by type
+// with the rlimits set for the image
+func assignRlimits(defaults, limits []string) ([]specs.POSIXRlimit, error) {
+	rlimits := []specs.POSIXRlimit{}
+	index := map[string]int{}
+	all := append([]string{}, defaults...)
+	for _, limitString := range append(all, limits...) {
+		rlimit, err := parseRlimit(limitString)
+		if err != nil {
+			return nil, err
+		}
+		if i, ok := index[rlimit.Type]; ok {
+			rlimits[i] = rlimit
+			continue
+		}
+		index[rlimit.Type] = len(rlimits)
+		rlimits = append(rlimits, rlimit)
+	}
+	return rlimits, nil
+}
+
+// assignDevices merges the devices of the label and the yaml, which overrides
+// by path, returning the devices and the device cgroup rules allowing them
+func assignDevices(v1, v2 *[]Device) ([]specs.LinuxDevice, []specs.LinuxDeviceCgroup, error) {
+	var all []Device
+	if v1 != nil {
+		all = append(all, *v1...)
+	}
+	if v2 != nil {
+		all = append(all, *v2...)
+	}
+	devices := []specs.LinuxDevice{}
+	index := map[string]int{}
+	for _, d := range all {
+		if !filepath.IsAbs(d.Path) {
+			return nil, nil, fmt.Errorf("Device path %s is not absolute", d.Path)
+		}
+		switch d.Type {
+		case "c", "b", "u", "p":
+		default:
+			return nil, nil, fmt.Errorf("Device %s has invalid type %q, must be c, b, u or p", d.Path, d.Type)
+		}
+		mode := os.FileMode(0666)
+		if d.Mode != "" {
+			m, err := strconv.ParseUint(d.Mode, 8, 32)
+			if err != nil || m&^0777 != 0 {
+				return nil, nil, fmt.Errorf("Device %s has invalid mode %q", d.Path, d.Mode)
+			}
+			mode = os.FileMode(m)
+		}
+		dev := specs.LinuxDevice{
+			Path:     path.Clean(d.Path),
+			Type:     d.Type,
+			Major:    d.Major,
+			Minor:    d.Minor,
+			FileMode: &mode,
+		}
+		if i, ok := index[dev.Path]; ok {
+			devices[i] = dev
+			continue
+		}
+		index[dev.Path] = len(devices)
+		devices = append(devices, dev)
+	}
+
+	var rules []specs.LinuxDeviceCgroup
+	for _, d := range devices {
+		// the device cgroup only controls character and block devices
+		typ := d.Type
+		switch typ {
+		case "p":
+			continue
+		case "u":
+			typ = "c"
+		}
+		major, minor := d.Major, d.Minor
+		rules = append(rules, specs.LinuxDeviceCgroup{
+			Allow:  true,
+			Type:   typ,
+			Major:  &major,
+			Minor:  &minor,
+			Access: "rwm",
+		})
+	}
+	return devices, rules, nil
+}
+
 func idNumeric(v interface{}, idMap map[string]uint32) (uint32, error) {
 	switch id := v.(type) {
 	case nil:
@@ -709,6 +1598,10 @@ func idNumeric(v interface{}, idMap map[string]uint32) (uint32, error) {
 
 // ConfigInspectToOCI converts a config and the output of image inspect to an OCI config
 func ConfigInspectToOCI(yaml *Image, inspect types.ImageInspect, idMap map[string]uint32) (specs.Spec, Runtime, error) {
+	return configInspectToOCI(yaml, inspect, idMap, globalOptions())
+}
+
+func configInspectToOCI(yaml *Image, inspect types.ImageInspect, idMap map[string]uint32, opts *buildOptions) (specs.Spec, Runtime, error) {
 	oci := specs.Spec{}
 	runtime := Runtime{}
 
@@ -717,9 +1610,9 @@ func ConfigInspectToOCI(yaml *Image, inspect types.ImageInspect, idMap map[strin
 		inspectConfig = inspect.Config
 	}
 
-	// look for org.mobyproject.config label
+	// look for the config label, usually org.mobyproject.config
 	var label Image
-	labelString := inspectConfig.Labels["org.mobyproject.config"]
+	labelString := inspectConfig.Labels[ConfigLabel]
 	if labelString != "" {
 		var err error
 		label, err = NewImage([]byte(labelString))
@@ -731,9 +1624,17 @@ func ConfigInspectToOCI(yaml *Image, inspect types.ImageInspect, idMap map[strin
 	// command, env and cwd can be taken from image, as they are commonly specified in Dockerfile
 
 	// TODO we could handle entrypoint and cmd independently more like Docker
-	inspectCommand := append(inspectConfig.Entrypoint, inspectConfig.Cmd...)
+	// copy so as not to append the cmd to the entrypoint of the image config
+	inspectCommand := append(append([]string{}, inspectConfig.Entrypoint...), inspectConfig.Cmd...)
 	args := assignStrings3(inspectCommand, label.Command, yaml.Command)
 
+	// the env of the upstream image is not checked as it cannot be fixed in
+	// the config, and the yaml env is checked when the config is read
+	if label.Env != nil {
+		if err := validateEnv(*label.Env); err != nil {
+			return oci, runtime, fmt.Errorf("%s: image label: %v", yaml.Name, err)
+		}
+	}
 	env := assignStrings3(inspectConfig.Env, label.Env, yaml.Env)
 
 	// empty Cwd not allowed in OCI, must be / in that case
@@ -775,22 +1676,12 @@ func ConfigInspectToOCI(yaml *Image, inspect types.ImageInspect, idMap map[strin
 		}
 		mounts[dest] = specs.Mount{Destination: dest, Type: "tmpfs", Source: "tmpfs", Options: opts}
 	}
-	for _, b := range assignStrings(label.Binds, yaml.Binds) {
-		parts := strings.Split(b, ":")
-		if len(parts) < 2 {
-			return oci, runtime, fmt.Errorf("Cannot parse bind, missing ':': %s", b)
-		}
-		if len(parts) > 3 {
-			return oci, runtime, fmt.Errorf("Cannot parse bind, too many ':': %s", b)
-		}
-		src := parts[0]
-		dest := parts[1]
-		// default to rshared if not specified
-		opts := []string{"rw", "rbind", "rshared"}
-		if len(parts) == 3 {
-			opts = append(strings.Split(parts[2], ","), "rbind")
+	for _, b := range append(assignStrings(label.Binds, yaml.Binds), opts.binds[yaml.Name]...) {
+		m, err := parseBind(b)
+		if err != nil {
+			return oci, runtime, err
 		}
-		mounts[dest] = specs.Mount{Destination: dest, Type: "bind", Source: src, Options: opts}
+		mounts[m.Destination] = m
 	}
 	for _, m := range assignBinds(label.Mounts, yaml.Mounts) {
 		tp := m.Type
@@ -826,6 +1717,14 @@ func ConfigInspectToOCI(yaml *Image, inspect types.ImageInspect, idMap map[strin
 		mountList = append(mountList, m)
 	}
 	sort.Sort(mountList)
+	if warnings := bindSourceWarnings(mountList); len(warnings) != 0 {
+		if opts.strict {
+			return oci, runtime, fmt.Errorf("%s: %s", yaml.Name, strings.Join(warnings, "; "))
+		}
+		for _, w := range warnings {
+			log.Warnf("%s: %s", yaml.Name, w)
+		}
+	}
 
 	namespaces := []specs.LinuxNamespace{}
 
@@ -876,39 +1775,19 @@ func ConfigInspectToOCI(yaml *Image, inspect types.ImageInspect, idMap map[strin
 	// TODO cgroup namespaces
 
 	// Capabilities
-	capCheck := map[string]bool{}
-	for _, capability := range allCaps {
-		capCheck[capability] = true
-	}
 	boundingSet := map[string]bool{}
-	caps := assignStrings(label.Capabilities, yaml.Capabilities)
-	if len(caps) == 1 {
-		switch cap := strings.ToLower(caps[0]); cap {
-		case "none":
-			caps = []string{}
-		case "all":
-			caps = allCaps[:]
-		}
+	caps, err := expandCaps(assignStrings(label.Capabilities, yaml.Capabilities))
+	if err != nil {
+		return oci, runtime, err
 	}
 	for _, capability := range caps {
-		if !capCheck[capability] {
-			return oci, runtime, fmt.Errorf("unknown capability: %s", capability)
-		}
 		boundingSet[capability] = true
 	}
-	ambient := assignStrings(label.Ambient, yaml.Ambient)
-	if len(ambient) == 1 {
-		switch cap := strings.ToLower(ambient[0]); cap {
-		case "none":
-			ambient = []string{}
-		case "all":
-			ambient = allCaps[:]
-		}
+	ambient, err := expandCaps(assignStrings(label.Ambient, yaml.Ambient))
+	if err != nil {
+		return oci, runtime, err
 	}
 	for _, capability := range ambient {
-		if !capCheck[capability] {
-			return oci, runtime, fmt.Errorf("unknown capability: %s", capability)
-		}
 		boundingSet[capability] = true
 	}
 	bounding := []string{}
@@ -916,64 +1795,9 @@ func ConfigInspectToOCI(yaml *Image, inspect types.ImageInspect, idMap map[strin
 		bounding = append(bounding, capability)
 	}
 
-	rlimitsString := assignStrings(label.Rlimits, yaml.Rlimits)
-	rlimits := []specs.POSIXRlimit{}
-	for _, limitString := range rlimitsString {
-		rs := strings.SplitN(limitString, ",", 3)
-		var limit string
-		var soft, hard uint64
-		switch len(rs) {
-		case 3:
-			origLimit := limit
-			limit = strings.ToUpper(strings.TrimSpace(rs[0]))
-			if !strings.HasPrefix(limit, "RLIMIT_") {
-				limit = "RLIMIT_" + limit
-			}
-			softString := strings.TrimSpace(rs[1])
-			if strings.ToLower(softString) == "unlimited" {
-				soft = 18446744073709551615
-			} else {
-				var err error
-				soft, err = strconv.ParseUint(softString, 10, 64)
-				if err != nil {
-					return oci, runtime, fmt.Errorf("Cannot parse %s as uint64: %v", softString, err)
-				}
-			}
-			hardString := strings.TrimSpace(rs[2])
-			if strings.ToLower(hardString) == "unlimited" {
-				hard = 18446744073709551615
-			} else {
-				var err error
-				hard, err = strconv.ParseUint(hardString, 10, 64)
-				if err != nil {
-					return oci, runtime, fmt.Errorf("Cannot parse %s as uint64: %v", hardString, err)
-				}
-			}
-			switch limit {
-			case
-				"RLIMIT_CPU",
-				"RLIMIT_FSIZE",
-				"RLIMIT_DATA",
-				"RLIMIT_STACK",
-				"RLIMIT_CORE",
-				"RLIMIT_RSS",
-				"RLIMIT_NPROC",
-				"RLIMIT_NOFILE",
-				"RLIMIT_MEMLOCK",
-				"RLIMIT_AS",
-				"RLIMIT_LOCKS",
-				"RLIMIT_SIGPENDING",
-				"RLIMIT_MSGQUEUE",
-				"RLIMIT_NICE",
-				"RLIMIT_RTPRIO",
-				"RLIMIT_RTTIME":
-				rlimits = append(rlimits, specs.POSIXRlimit{Type: limit, Soft: soft, Hard: hard})
-			default:
-				return oci, runtime, fmt.Errorf("Unknown limit: %s", origLimit)
-			}
-		default:
-			return oci, runtime, fmt.Errorf("Cannot parse rlimit: %s", rlimitsString)
-		}
+	rlimits, err := assignRlimits(opts.rlimits, assignStrings(label.Rlimits, yaml.Rlimits))
+	if err != nil {
+		return oci, runtime, err
 	}
 
 	// handle mapping of named uid, gid to numbers
@@ -1020,8 +1844,8 @@ func ConfigInspectToOCI(yaml *Image, inspect types.ImageInspect, idMap map[strin
 		},
 		Rlimits:         rlimits,
 		NoNewPrivileges: assignBool(label.NoNewPrivileges, yaml.NoNewPrivileges),
-		// ApparmorProfile
-		OOMScoreAdj: assignIntPtr(label.OOMScoreAdj, yaml.OOMScoreAdj),
+		ApparmorProfile: assignString(label.ApparmorProfile, yaml.ApparmorProfile),
+		OOMScoreAdj:     assignIntPtr(label.OOMScoreAdj, yaml.OOMScoreAdj),
 		// SelinuxLabel
 	}
 
@@ -1033,18 +1857,54 @@ func ConfigInspectToOCI(yaml *Image, inspect types.ImageInspect, idMap map[strin
 	oci.Hostname = assignStringEmpty(label.Hostname, yaml.Hostname)
 	oci.Mounts = mountList
 	oci.Annotations = assignMaps(label.Annotations, yaml.Annotations)
+	// copy so as not to change the annotations of the config
+	annotations := map[string]string{}
+	if BuildVersion != "" {
+		annotations[BuildVersionAnnotation] = BuildVersion
+	}
+	if BuildCommit != "" {
+		annotations[BuildCommitAnnotation] = BuildCommit
+	}
+	for k, v := range oci.Annotations {
+		annotations[k] = v
+	}
+	if r := assignString(label.OCIRuntime, yaml.OCIRuntime); r != "" {
+		annotations[RuntimeAnnotation] = r
+	}
+	if len(annotations) != 0 {
+		oci.Annotations = annotations
+	}
 
 	resources := assignResources(label.Resources, yaml.Resources)
+	devices, deviceRules, err := assignDevices(label.Devices, yaml.Devices)
+	if err != nil {
+		return oci, runtime, err
+	}
+	resources.Devices = append(resources.Devices, deviceRules...)
+
+	var seccomp *specs.LinuxSeccomp
+	if yaml.Seccomp == nil && label.Seccomp != nil {
+		// a path in a label would read a file on the build host
+		if file, ok := (*label.Seccomp).(string); ok {
+			return oci, runtime, fmt.Errorf("The seccomp profile in the image label must be inline, not the path %s", file)
+		}
+	}
+	if label.Seccomp != nil || yaml.Seccomp != nil {
+		seccomp, err = parseSeccomp(assignInterface(label.Seccomp, yaml.Seccomp))
+		if err != nil {
+			return oci, runtime, err
+		}
+	}
 
 	oci.Linux = &specs.Linux{
-		UIDMappings: assignMappings(label.UIDMappings, yaml.UIDMappings),
-		GIDMappings: assignMappings(label.GIDMappings, yaml.GIDMappings),
-		Sysctl:      assignMaps(label.Sysctl, yaml.Sysctl),
-		Resources:   &resources,
-		CgroupsPath: assignString(label.CgroupsPath, yaml.CgroupsPath),
-		Namespaces:  namespaces,
-		// Devices
-		// Seccomp
+		UIDMappings:       assignMappings(label.UIDMappings, yaml.UIDMappings),
+		GIDMappings:       assignMappings(label.GIDMappings, yaml.GIDMappings),
+		Sysctl:            assignMaps(label.Sysctl, yaml.Sysctl),
+		Resources:         &resources,
+		CgroupsPath:       assignString(label.CgroupsPath, yaml.CgroupsPath),
+		Namespaces:        namespaces,
+		Devices:           devices,
+		Seccomp:           seccomp,
 		RootfsPropagation: assignString(label.RootfsPropagation, yaml.RootfsPropagation),
 		MaskedPaths:       assignStrings(label.MaskedPaths, yaml.MaskedPaths),
 		ReadonlyPaths:     assignStrings(label.ReadonlyPaths, yaml.ReadonlyPaths),
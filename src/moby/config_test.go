@@ -2,11 +2,17 @@ package moby
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/opencontainers/runtime-spec/specs-go"
 )
 
 func setupInspect(t *testing.T, label ImageConfig) types.ImageInspect {
@@ -17,7 +23,7 @@ func setupInspect(t *testing.T, label ImageConfig) types.ImageInspect {
 	if err != nil {
 		t.Error(err)
 	}
-	config.Labels = map[string]string{"org.mobyproject.config": string(labelJSON)}
+	config.Labels = map[string]string{ConfigLabel: string(labelJSON)}
 
 	inspect.Config = &config
 
@@ -59,6 +65,84 @@ func TestOverrides(t *testing.T) {
 	}
 }
 
+func TestOverridePrecedence(t *testing.T) {
+	strs := func(s ...string) *[]string { return &s }
+	mqueue := func(opts ...string) *[]specs.Mount {
+		return &[]specs.Mount{{Type: "mqueue", Options: opts}}
+	}
+	args := func(oci specs.Spec) interface{} { return oci.Process.Args }
+	env := func(oci specs.Spec) interface{} { return oci.Process.Env }
+	cwd := func(oci specs.Spec) interface{} { return oci.Process.Cwd }
+	caps := func(oci specs.Spec) interface{} { return oci.Process.Capabilities.Effective }
+	mount := func(oci specs.Spec) interface{} {
+		for _, m := range oci.Mounts {
+			if m.Destination == "/dev/mqueue" {
+				return m.Options
+			}
+		}
+		return nil
+	}
+	image := container.Config{
+		Entrypoint: []string{"/bin/image"},
+		Cmd:        []string{"-v"},
+		Env:        []string{"FROM=image"},
+		WorkingDir: "/image",
+	}
+
+	for _, tc := range []struct {
+		name  string
+		yaml  ImageConfig
+		label ImageConfig
+		got   func(specs.Spec) interface{}
+		want  interface{}
+	}{
+		{"command from yaml", ImageConfig{Command: strs("/bin/yaml")}, ImageConfig{Command: strs("/bin/label")}, args, []string{"/bin/yaml"}},
+		{"command from label", ImageConfig{}, ImageConfig{Command: strs("/bin/label")}, args, []string{"/bin/label"}},
+		{"command from image", ImageConfig{}, ImageConfig{}, args, []string{"/bin/image", "-v"}},
+		{"env from yaml", ImageConfig{Env: strs("FROM=yaml")}, ImageConfig{Env: strs("FROM=label")}, env, []string{"FROM=yaml"}},
+		{"env from label", ImageConfig{}, ImageConfig{Env: strs("FROM=label")}, env, []string{"FROM=label"}},
+		{"env from image", ImageConfig{}, ImageConfig{}, env, []string{"FROM=image"}},
+		{"empty env in yaml", ImageConfig{Env: &[]string{}}, ImageConfig{Env: strs("FROM=label")}, env, []string{}},
+		{"cwd from yaml", ImageConfig{Cwd: "/yaml"}, ImageConfig{Cwd: "/label"}, cwd, "/yaml"},
+		{"cwd from label", ImageConfig{}, ImageConfig{Cwd: "/label"}, cwd, "/label"},
+		{"cwd from image", ImageConfig{}, ImageConfig{}, cwd, "/image"},
+		{"capabilities from yaml", ImageConfig{Capabilities: strs("CAP_SYS_ADMIN")}, ImageConfig{Capabilities: strs("CAP_SYS_CHROOT")}, caps, []string{"CAP_SYS_ADMIN"}},
+		{"capabilities from label", ImageConfig{}, ImageConfig{Capabilities: strs("CAP_SYS_CHROOT")}, caps, []string{"CAP_SYS_CHROOT"}},
+		{"no capabilities", ImageConfig{}, ImageConfig{}, caps, []string{}},
+		{"mounts from yaml", ImageConfig{Mounts: mqueue("nosuid")}, ImageConfig{Mounts: mqueue("nodev")}, mount, []string{"nosuid"}},
+		{"mounts from label", ImageConfig{}, ImageConfig{Mounts: mqueue("nodev")}, mount, []string{"nodev"}},
+		{"no mounts", ImageConfig{}, ImageConfig{}, mount, nil},
+	} {
+		inspect := setupInspect(t, tc.label)
+		config := image
+		config.Labels = inspect.Config.Labels
+		inspect.Config = &config
+		yaml := Image{Name: "test", Image: "testimage", ImageConfig: tc.yaml}
+
+		oci, _, err := ConfigInspectToOCI(&yaml, inspect, map[string]uint32{})
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got := tc.got(oci); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+
+	// the command from the image must not change the entrypoint of the inspect
+	entrypoint := make([]string, 1, 2)
+	entrypoint[0] = "/bin/image"
+	inspect := setupInspect(t, ImageConfig{})
+	inspect.Config.Entrypoint = entrypoint
+	inspect.Config.Cmd = []string{"-v"}
+	if _, _, err := ConfigInspectToOCI(&Image{Name: "test", Image: "testimage"}, inspect, map[string]uint32{}); err != nil {
+		t.Fatal(err)
+	}
+	if entrypoint[:2][1] != "" {
+		t.Errorf("Expected the image entrypoint to be left alone, got %v", entrypoint[:2])
+	}
+}
+
 func TestInvalidCap(t *testing.T) {
 	idMap := map[string]uint32{}
 
@@ -80,6 +164,28 @@ func TestInvalidCap(t *testing.T) {
 	}
 }
 
+func TestInvalidCapConfig(t *testing.T) {
+	for _, field := range []string{"capabilities", "ambient"} {
+		_, err := NewConfig([]byte(`
+onboot:
+  - name: sysctl
+    image: linuxkit/sysctl:v1
+    ` + field + `:
+      - CAP_SYS_ADMIN
+      - NOT_A_CAP
+`))
+		if err == nil || !strings.Contains(err.Error(), "sysctl") || !strings.Contains(err.Error(), "NOT_A_CAP") {
+			t.Errorf("Expected %s error naming the image and capability, got %v", field, err)
+		}
+	}
+
+	for _, caps := range []string{"[all]", "[none]", "[CAP_NET_ADMIN]"} {
+		if _, err := NewConfig([]byte("services:\n  - name: dhcpcd\n    image: linuxkit/dhcpcd:v1\n    capabilities: " + caps + "\n")); err != nil {
+			t.Errorf("Expected capabilities %s to be valid, got %v", caps, err)
+		}
+	}
+}
+
 func TestIdMap(t *testing.T) {
 	idMap := map[string]uint32{"test": 199}
 
@@ -111,3 +217,708 @@ func TestIdMap(t *testing.T) {
 		t.Error("Expected numerical gid to work")
 	}
 }
+
+func TestBindOptions(t *testing.T) {
+	idMap := map[string]uint32{}
+
+	binds := []string{"/var/lib:/var/lib:rro", "/etc:/etc:ro,bind", "/run:/run"}
+	yaml := Image{
+		Name:  "test",
+		Image: "testimage",
+		ImageConfig: ImageConfig{
+			Binds: &binds,
+		},
+	}
+
+	inspect := setupInspect(t, ImageConfig{})
+
+	oci, _, err := ConfigInspectToOCI(&yaml, inspect, idMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"/var/lib": {"rro", "rbind"},
+		"/etc":     {"ro", "bind"},
+		"/run":     {"rw", "rbind", "rshared"},
+	}
+	for _, m := range oci.Mounts {
+		opts, ok := expected[m.Destination]
+		if !ok {
+			continue
+		}
+		if !reflect.DeepEqual(m.Options, opts) {
+			t.Errorf("Expected options %v for bind mount %s, got %v", opts, m.Destination, m.Options)
+		}
+		delete(expected, m.Destination)
+	}
+	if len(expected) != 0 {
+		t.Errorf("Bind mounts missing from spec: %v", expected)
+	}
+}
+
+func TestDefaultRlimits(t *testing.T) {
+	idMap := map[string]uint32{}
+
+	DefaultRlimits = []string{"nofile,65536,65536", "nproc,1024,2048"}
+	defer func() { DefaultRlimits = nil }()
+
+	rlimits := []string{"nofile,1024,unlimited"}
+	yaml := Image{
+		Name:  "test",
+		Image: "testimage",
+		ImageConfig: ImageConfig{
+			Rlimits: &rlimits,
+		},
+	}
+
+	inspect := setupInspect(t, ImageConfig{})
+
+	oci, _, err := ConfigInspectToOCI(&yaml, inspect, idMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []specs.POSIXRlimit{
+		{Type: "RLIMIT_NOFILE", Soft: 1024, Hard: 18446744073709551615},
+		{Type: "RLIMIT_NPROC", Soft: 1024, Hard: 2048},
+	}
+	if !reflect.DeepEqual(oci.Process.Rlimits, expected) {
+		t.Errorf("Expected rlimits %v, got %v", expected, oci.Process.Rlimits)
+	}
+}
+
+func TestImageAliases(t *testing.T) {
+	config := []byte(`
+images:
+  proxy: linuxkit/proxy:v1
+onboot:
+  - name: setup
+    image: "@proxy"
+services:
+  - name: proxy
+    image: "@proxy"
+  - name: other
+    image: linuxkit/other:v2
+`)
+	m, err := NewConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Onboot[0].Image != "linuxkit/proxy:v1" {
+		t.Errorf("Expected onboot alias to be expanded, got %s", m.Onboot[0].Image)
+	}
+	if m.Services[0].Image != "linuxkit/proxy:v1" {
+		t.Errorf("Expected service alias to be expanded, got %s", m.Services[0].Image)
+	}
+	if m.Services[1].Image != "linuxkit/other:v2" {
+		t.Errorf("Expected plain reference to be unchanged, got %s", m.Services[1].Image)
+	}
+
+	_, err = NewConfig([]byte(`
+services:
+  - name: proxy
+    image: "@missing"
+`))
+	if err == nil {
+		t.Error("Expected error for undefined image alias")
+	}
+}
+
+func TestMultipleDocuments(t *testing.T) {
+	m, err := NewConfig([]byte(`
+kernel:
+  image: linuxkit/kernel:4.9.x
+  cmdline: console=tty0
+images:
+  getty: linuxkit/getty:v1
+onboot:
+  - name: sysctl
+    image: linuxkit/sysctl:v1
+---
+kernel:
+  cmdline: console=ttyS0
+onboot:
+  - name: dhcpcd
+    image: linuxkit/dhcpcd:v1
+services:
+  - name: getty
+    image: "@getty"
+---
+files:
+  - path: etc/motd
+    contents: hello
+---
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Kernel.Image != "linuxkit/kernel:4.9.x" || m.Kernel.Cmdline != "console=ttyS0" {
+		t.Errorf("Expected later kernel fields to replace earlier ones, got %+v", m.Kernel)
+	}
+	if len(m.Onboot) != 2 || m.Onboot[0].Name != "sysctl" || m.Onboot[1].Name != "dhcpcd" {
+		t.Errorf("Expected onboot images to be appended in order, got %v", m.Onboot)
+	}
+	if len(m.Services) != 1 || m.Services[0].Image != "linuxkit/getty:v1" {
+		t.Errorf("Expected an alias from an earlier document to resolve, got %v", m.Services)
+	}
+	if len(m.Files) != 1 || m.Files[0].Path != "etc/motd" {
+		t.Errorf("Expected files from the last document, got %v", m.Files)
+	}
+
+	if _, err := NewConfig([]byte("services:\n  - name: a\n    image: linuxkit/a:v1\n---\nservices:\n  - name: a\n    image: linuxkit/a:v1\n")); err == nil {
+		t.Error("Expected duplicate service names across documents to be rejected")
+	}
+	if _, err := NewConfig([]byte("kernel:\n  image: linuxkit/kernel:4.9.x\n---\nkernal:\n  image: linuxkit/kernel:4.9.x\n")); err == nil {
+		t.Error("Expected a later invalid document to be rejected")
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, contents string) string {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	write("kernel.yml", "kernel:\n  image: linuxkit/kernel:4.9.x\n  cmdline: console=tty0\n")
+	write("services/getty.yml", "include: [../common.yml]\nservices:\n  - name: getty\n    image: linuxkit/getty:v1\n")
+	write("common.yml", "onboot:\n  - name: sysctl\n    image: linuxkit/sysctl:v1\n")
+	main := write("main.yml", "include:\n  - kernel.yml\n  - services/getty.yml\nkernel:\n  cmdline: console=ttyS0\nservices:\n  - name: dhcpcd\n    image: linuxkit/dhcpcd:v1\n")
+
+	config, err := ioutil.ReadFile(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewConfigFile(main, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Kernel.Image != "linuxkit/kernel:4.9.x" || m.Kernel.Cmdline != "console=ttyS0" {
+		t.Errorf("Expected the including file to override included kernel fields, got %+v", m.Kernel)
+	}
+	if len(m.Onboot) != 1 || m.Onboot[0].Name != "sysctl" {
+		t.Errorf("Expected a nested include relative to the including file, got %v", m.Onboot)
+	}
+	if len(m.Services) != 2 || m.Services[0].Name != "getty" || m.Services[1].Name != "dhcpcd" {
+		t.Errorf("Expected included services before the including file's, got %v", m.Services)
+	}
+
+	for name, tc := range map[string]struct {
+		files map[string]string
+		err   string
+	}{
+		"missing": {
+			files: map[string]string{"a.yml": "include: [missing.yml]\n"},
+			err:   "Cannot read included config",
+		},
+		"cycle": {
+			files: map[string]string{"a.yml": "include: [b.yml]\n", "b.yml": "include: [a.yml]\n"},
+			err:   filepath.Join("cycle", "a.yml") + " -> " + filepath.Join(dir, "cycle", "b.yml") + " -> " + filepath.Join(dir, "cycle", "a.yml"),
+		},
+		"self": {
+			files: map[string]string{"a.yml": "include: [a.yml]\n"},
+			err:   "Include cycle",
+		},
+		"invalid": {
+			files: map[string]string{"a.yml": "include: [b.yml]\n", "b.yml": "kernal:\n  image: linuxkit/kernel:4.9.x\n"},
+			err:   "invalid configuration file",
+		},
+	} {
+		for file, contents := range tc.files {
+			write(filepath.Join(name, file), contents)
+		}
+		file := filepath.Join(dir, name, "a.yml")
+		_, err := NewConfigFile(file, []byte(tc.files["a.yml"]))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error containing %q, got %v", name, tc.err, err)
+		}
+	}
+}
+
+func TestRemoteConfigIncludes(t *testing.T) {
+	for _, include := range []string{"/etc/passwd", "../secret.yml", "a/../../secret.yml"} {
+		_, err := NewRemoteConfig([]byte("include: [" + include + "]\n"))
+		if err == nil || !strings.Contains(err.Error(), "cannot include") {
+			t.Errorf("Expected a config from a URL not to include %s, got %v", include, err)
+		}
+	}
+	_, err := NewRemoteConfig([]byte("include: [missing.yml]\n"))
+	if err == nil || !strings.Contains(err.Error(), "Cannot read included config") {
+		t.Errorf("Expected a config from a URL to include files in the working directory, got %v", err)
+	}
+}
+
+func TestValidateEnv(t *testing.T) {
+	testCases := []struct {
+		env   string
+		valid bool
+	}{
+		{"FOO=bar", true},
+		{"_foo_1=", true},
+		{"PATH=/bin:/usr/bin=x", true},
+		{"FOO", false},
+		{"1FOO=bar", false},
+		{"FOO-BAR=baz", false},
+		{"=bar", false},
+	}
+	for _, tc := range testCases {
+		err := validateEnv([]string{tc.env})
+		if tc.valid && err != nil {
+			t.Errorf("Expected %s to be valid, got %v", tc.env, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("Expected %s to be invalid", tc.env)
+		}
+	}
+
+	_, err := NewConfig([]byte(`
+services:
+  - name: broken
+    image: linuxkit/broken:v1
+    env:
+      - 1FOO=bar
+`))
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("Expected error naming the service, got %v", err)
+	}
+
+	inspect := setupInspect(t, ImageConfig{})
+	inspect.Config.Env = []string{"PATH=/bin", "com.example.version=1"}
+	if _, _, err := ConfigInspectToOCI(&Image{Name: "upstream", Image: "testimage"}, inspect, map[string]uint32{}); err != nil {
+		t.Errorf("Expected the env of the upstream image not to be checked, got %v", err)
+	}
+	inspect = setupInspect(t, ImageConfig{Env: &[]string{"1FOO=bar"}})
+	if _, _, err := ConfigInspectToOCI(&Image{Name: "label", Image: "testimage"}, inspect, map[string]uint32{}); err == nil || !strings.Contains(err.Error(), "image label") {
+		t.Errorf("Expected an invalid env in the image label to be rejected, got %v", err)
+	}
+}
+
+func TestCustomConfigLabel(t *testing.T) {
+	idMap := map[string]uint32{}
+
+	ConfigLabel = "org.example.config"
+	defer func() { ConfigLabel = "org.mobyproject.config" }()
+
+	yaml := Image{
+		Name:  "test",
+		Image: "testimage",
+	}
+
+	inspect := setupInspect(t, ImageConfig{Cwd: "/custom"})
+	inspect.Config.Labels["org.mobyproject.config"] = `{"cwd": "/default"}`
+
+	oci, _, err := ConfigInspectToOCI(&yaml, inspect, idMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oci.Process.Cwd != "/custom" {
+		t.Errorf("Expected config from custom label, got cwd %s", oci.Process.Cwd)
+	}
+}
+
+func TestExtraBinds(t *testing.T) {
+	defer func() { ExtraBinds = map[string][]string{} }()
+	if err := AddExtraBind("sshd:/src:/src:ro"); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{"/src:/src", "sshd:/src", "sshd:/a:/b:ro:x"} {
+		if err := AddExtraBind(bad); err == nil {
+			t.Errorf("Expected bind %q to be rejected", bad)
+		}
+	}
+
+	m := Moby{Services: []*Image{{Name: "getty"}}}
+	if err := ValidateExtraBinds(m); err == nil {
+		t.Error("Expected bind for a missing service to be rejected")
+	}
+	m.Services = append(m.Services, &Image{Name: "sshd"})
+	if err := ValidateExtraBinds(m); err != nil {
+		t.Error(err)
+	}
+
+	inspect := setupInspect(t, ImageConfig{})
+	for _, name := range []string{"sshd", "getty"} {
+		yaml := Image{Name: name, Image: "testimage"}
+		oci, _, err := ConfigInspectToOCI(&yaml, inspect, map[string]uint32{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, m := range oci.Mounts {
+			if m.Destination == "/src" {
+				found = true
+				if m.Source != "/src" || !reflect.DeepEqual(m.Options, []string{"ro", "rbind"}) {
+					t.Errorf("Unexpected bind %v", m)
+				}
+			}
+		}
+		if found != (name == "sshd") {
+			t.Errorf("Expected bind only in sshd, found in %s: %t", name, found)
+		}
+	}
+}
+
+func TestHelperOptions(t *testing.T) {
+	defer func() { ExtraBinds = map[string][]string{} }()
+	if err := AddExtraBind("mkimage:/src:/src"); err != nil {
+		t.Fatal(err)
+	}
+	DefaultRlimits = []string{"nofile,1024,2048"}
+	defer func() { DefaultRlimits = nil }()
+
+	inspect := setupInspect(t, ImageConfig{})
+	yaml := Image{Name: "mkimage", Image: "testimage"}
+	global, _, err := configInspectToOCI(&yaml, inspect, map[string]uint32{}, globalOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	helper, _, err := configInspectToOCI(&yaml, inspect, map[string]uint32{}, &buildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(global.Process.Rlimits) != 1 || len(helper.Process.Rlimits) != 0 {
+		t.Errorf("Expected the default rlimits in the build but not the helper, got %v and %v", global.Process.Rlimits, helper.Process.Rlimits)
+	}
+	if len(helper.Mounts) != len(global.Mounts)-1 {
+		t.Errorf("Expected the extra bind in the build but not the helper, got %v", helper.Mounts)
+	}
+
+	Platform = "linux/arm64"
+	defer func() { Platform = "" }()
+	if opts := hostOptions(); opts.platform != "" || opts.arch != runtime.GOARCH {
+		t.Errorf("Expected helpers to be built for the host, got %s %s", opts.platform, opts.arch)
+	}
+}
+
+func TestKernelConsole(t *testing.T) {
+	m, err := NewConfig([]byte(`
+kernel:
+  cmdline: "quiet"
+  console:
+    - tty0
+    - ttyS0,115200
+  initArgs: ["single"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmdline := m.Kernel.FullCmdline(); cmdline != "quiet console=tty0 console=ttyS0,115200 -- single" {
+		t.Errorf("Unexpected cmdline %q", cmdline)
+	}
+
+	m.Kernel = KernelConfig{Console: []string{"ttyAMA0"}}
+	if cmdline := m.Kernel.FullCmdline(); cmdline != "console=ttyAMA0" {
+		t.Errorf("Unexpected cmdline %q", cmdline)
+	}
+
+	if _, err := NewConfig([]byte("kernel:\n  console: [\"tty0 quiet\"]\n")); err == nil {
+		t.Error("Expected a console containing a space to be rejected")
+	}
+}
+
+func TestBindSourceWarnings(t *testing.T) {
+	binds := []string{"var/log:/var/log", "/etc//resolv.conf:/etc/resolv.conf", "/dev:/dev"}
+	yaml := Image{
+		Name:  "test",
+		Image: "testimage",
+		ImageConfig: ImageConfig{
+			Binds: &binds,
+		},
+	}
+	inspect := setupInspect(t, ImageConfig{})
+
+	oci, _, err := ConfigInspectToOCI(&yaml, inspect, map[string]uint32{})
+	if err != nil {
+		t.Fatalf("Expected only warnings for bind sources, got %v", err)
+	}
+	warnings := strings.Join(bindSourceWarnings(oci.Mounts), "\n")
+	if strings.Count(warnings, "\n") != 1 || !strings.Contains(warnings, "source var/log ") || !strings.Contains(warnings, "source /etc//resolv.conf ") {
+		t.Errorf("Expected warnings for the relative and unclean sources, got %v", warnings)
+	}
+
+	if _, _, err := configInspectToOCI(&yaml, inspect, map[string]uint32{}, &buildOptions{strict: true}); err == nil {
+		t.Error("Expected a relative bind source to be an error with strict config")
+	}
+}
+
+func TestResources(t *testing.T) {
+	idMap := map[string]uint32{}
+
+	shares, quota, memory := uint64(512), int64(10000), int64(64<<20)
+	label := ImageConfig{
+		Resources: &Resources{
+			LinuxResources: specs.LinuxResources{
+				CPU: &specs.LinuxCPU{Shares: &shares, Quota: &quota},
+			},
+			MemoryLimit: &memory,
+		},
+	}
+	inspect := setupInspect(t, label)
+
+	m, err := NewConfig([]byte(`
+services:
+  - name: shares
+    image: testimage
+    resources:
+      cpuShares: 1024
+  - name: memory
+    image: testimage
+    resources:
+      memory:
+        reservation: 1024
+      cpuPeriod: 20000
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oci, _, err := ConfigInspectToOCI(m.Services[0], inspect, idMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := oci.Linux.Resources
+	if res.CPU == nil || res.CPU.Shares == nil || *res.CPU.Shares != 1024 {
+		t.Errorf("Expected yaml cpuShares to override, got %+v", res.CPU)
+	}
+	if res.CPU.Quota == nil || *res.CPU.Quota != quota {
+		t.Errorf("Expected label CPU quota to be kept, got %+v", res.CPU)
+	}
+	if res.Memory == nil || res.Memory.Limit == nil || *res.Memory.Limit != memory {
+		t.Errorf("Expected label memoryLimit to be kept, got %+v", res.Memory)
+	}
+
+	oci, _, err = ConfigInspectToOCI(m.Services[1], inspect, idMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = oci.Linux.Resources
+	if res.Memory == nil || res.Memory.Limit != nil || res.Memory.Reservation == nil || *res.Memory.Reservation != 1024 {
+		t.Errorf("Expected yaml memory section to replace the label resources, got %+v", res.Memory)
+	}
+	if res.CPU == nil || res.CPU.Quota != nil || res.CPU.Period == nil || *res.CPU.Period != 20000 {
+		t.Errorf("Expected only the yaml cpuPeriod, got %+v", res.CPU)
+	}
+}
+
+func TestDevices(t *testing.T) {
+	idMap := map[string]uint32{}
+
+	label := ImageConfig{
+		Devices: &[]Device{
+			{Path: "/dev/kvm", Type: "c", Major: 10, Minor: 232},
+			{Path: "/dev/sda", Type: "b", Major: 8, Minor: 0},
+		},
+	}
+	inspect := setupInspect(t, label)
+
+	m, err := NewConfig([]byte(`
+services:
+  - name: vm
+    image: testimage
+    devices:
+      - path: /dev/sda
+        type: b
+        major: 8
+        minor: 16
+        mode: "0600"
+      - path: /dev/fifo
+        type: p
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oci, _, err := ConfigInspectToOCI(m.Services[0], inspect, idMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devices := oci.Linux.Devices
+	if len(devices) != 3 {
+		t.Fatalf("Expected 3 devices, got %v", devices)
+	}
+	if devices[0].Path != "/dev/kvm" || *devices[0].FileMode != 0666 {
+		t.Errorf("Expected the label /dev/kvm with the default mode, got %+v", devices[0])
+	}
+	if devices[1].Path != "/dev/sda" || devices[1].Minor != 16 || *devices[1].FileMode != 0600 {
+		t.Errorf("Expected the yaml to override /dev/sda, got %+v", devices[1])
+	}
+	rules := oci.Linux.Resources.Devices
+	if len(rules) != 2 {
+		t.Fatalf("Expected cgroup rules for the character and block devices, got %v", rules)
+	}
+	if !rules[1].Allow || rules[1].Type != "b" || *rules[1].Major != 8 || *rules[1].Minor != 16 || rules[1].Access != "rwm" {
+		t.Errorf("Expected /dev/sda to be allowed, got %+v", rules[1])
+	}
+
+	yaml := Image{
+		Name:  "test",
+		Image: "testimage",
+		ImageConfig: ImageConfig{
+			Devices: &[]Device{{Path: "/dev/null", Type: "c", Major: 1, Minor: 3, Mode: "999"}},
+		},
+	}
+	if _, _, err := ConfigInspectToOCI(&yaml, inspect, idMap); err == nil {
+		t.Error("Expected an invalid device mode to fail")
+	}
+}
+
+func TestApparmorProfile(t *testing.T) {
+	idMap := map[string]uint32{}
+
+	labelProfile := "moby-default"
+	inspect := setupInspect(t, ImageConfig{ApparmorProfile: &labelProfile})
+
+	m, err := NewConfig([]byte(`
+services:
+  - name: label
+    image: testimage
+  - name: hardened
+    image: testimage
+    apparmorProfile: moby-hardened
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"moby-default", "moby-hardened"} {
+		oci, _, err := ConfigInspectToOCI(m.Services[i], inspect, idMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if oci.Process.ApparmorProfile != want {
+			t.Errorf("Expected apparmor profile %s, got %q", want, oci.Process.ApparmorProfile)
+		}
+	}
+
+	oci, _, err := ConfigInspectToOCI(m.Services[0], setupInspect(t, ImageConfig{}), idMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oci.Process.ApparmorProfile != "" {
+		t.Errorf("Expected no apparmor profile by default, got %q", oci.Process.ApparmorProfile)
+	}
+
+	if _, err := NewConfig([]byte("services:\n  - name: bad\n    image: testimage\n    apparmorProfile: \"\"\n")); err == nil {
+		t.Error("Expected an empty apparmor profile to be rejected")
+	}
+}
+
+func TestOCIRuntime(t *testing.T) {
+	idMap := map[string]uint32{}
+	inspect := setupInspect(t, ImageConfig{})
+
+	m, err := NewConfig([]byte(`
+services:
+  - name: plain
+    image: testimage
+  - name: isolated
+    image: testimage
+    ociRuntime: kata
+    annotations:
+      org.example.team: storage
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oci, _, err := ConfigInspectToOCI(m.Services[0], inspect, idMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := oci.Annotations[RuntimeAnnotation]; ok {
+		t.Errorf("Expected no runtime annotation by default, got %q", r)
+	}
+
+	oci, _, err = ConfigInspectToOCI(m.Services[1], inspect, idMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oci.Annotations[RuntimeAnnotation] != "kata" {
+		t.Errorf("Expected runtime annotation kata, got %q", oci.Annotations[RuntimeAnnotation])
+	}
+	if oci.Annotations["org.example.team"] != "storage" {
+		t.Errorf("Expected the other annotations to be kept, got %v", oci.Annotations)
+	}
+	if _, ok := (*m.Services[1].Annotations)[RuntimeAnnotation]; ok {
+		t.Error("Expected the annotations of the config not to be changed")
+	}
+
+	labelRuntime := "runsc"
+	oci, _, err = ConfigInspectToOCI(m.Services[0], setupInspect(t, ImageConfig{OCIRuntime: &labelRuntime}), idMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oci.Annotations[RuntimeAnnotation] != "runsc" {
+		t.Errorf("Expected runtime annotation runsc from the label, got %q", oci.Annotations[RuntimeAnnotation])
+	}
+
+	if _, err := NewConfig([]byte("services:\n  - name: bad\n    image: testimage\n    ociRuntime: \"run c\"\n")); err == nil {
+		t.Error("Expected a runtime with a space to be rejected")
+	}
+}
+
+func TestBuildAnnotations(t *testing.T) {
+	idMap := map[string]uint32{}
+	inspect := setupInspect(t, ImageConfig{})
+
+	m, err := NewConfig([]byte(`
+services:
+  - name: plain
+    image: testimage
+  - name: annotated
+    image: testimage
+    annotations:
+      org.example.source: https://example.com/repo
+      org.mobyproject.build.commit: pinned
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oci, _, err := ConfigInspectToOCI(m.Services[0], inspect, idMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(oci.Annotations) != 0 {
+		t.Errorf("Expected no annotations without a build version, got %v", oci.Annotations)
+	}
+
+	BuildVersion = "0.1"
+	BuildCommit = "abc123"
+	defer func() {
+		BuildVersion = ""
+		BuildCommit = ""
+	}()
+	oci, _, err = ConfigInspectToOCI(m.Services[0], inspect, idMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{BuildVersionAnnotation: "0.1", BuildCommitAnnotation: "abc123"}
+	if !reflect.DeepEqual(oci.Annotations, expected) {
+		t.Errorf("Expected annotations %v, got %v", expected, oci.Annotations)
+	}
+
+	oci, _, err = ConfigInspectToOCI(m.Services[1], inspect, idMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]string{
+		BuildVersionAnnotation: "0.1",
+		BuildCommitAnnotation:  "pinned",
+		"org.example.source":   "https://example.com/repo",
+	}
+	if !reflect.DeepEqual(oci.Annotations, expected) {
+		t.Errorf("Expected annotations %v, got %v", expected, oci.Annotations)
+	}
+	if _, ok := (*m.Services[1].Annotations)[BuildVersionAnnotation]; ok {
+		t.Error("Expected the annotations of the config not to be changed")
+	}
+}
@@ -0,0 +1,516 @@
+package moby
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
+)
+
+// ContentStore is the root of a local containerd content store, such as
+// /var/lib/containerd/io.containerd.content.v1.content. Images pinned by
+// digest that are in it are flattened from their layers there rather than
+// exported from a Docker container. Other images are still exported with Docker.
+var ContentStore string
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// exportDirs and exportFiles are the entries that docker export always
+// includes, which are added if an image does not have them, so that they
+// are excluded or replaced in the same way whichever way an image is read
+var (
+	exportDirs  = []string{"dev", "dev/pts", "dev/shm", "etc", "proc", "sys"}
+	exportFiles = []string{"etc/hosts", "etc/resolv.conf"}
+)
+
+// blobPath returns the path of a blob in the content store
+func blobPath(store string, dgst digest.Digest) string {
+	return filepath.Join(store, "blobs", dgst.Algorithm().String(), dgst.Hex())
+}
+
+// contentManifest is the parts of an image index or manifest that are used
+type contentManifest struct {
+	MediaType string               `json:"mediaType,omitempty"`
+	Manifests []ocispec.Descriptor `json:"manifests,omitempty"`
+	Config    ocispec.Descriptor   `json:"config"`
+	Layers    []ocispec.Descriptor `json:"layers"`
+}
+
+func readBlobJSON(store string, dgst digest.Digest, v interface{}) error {
+	f, err := os.Open(blobPath(store, dgst))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		return fmt.Errorf("Cannot parse blob %s: %v", dgst, err)
+	}
+	return nil
+}
+
+// inContentStore returns true if an image is pinned by digest and that
+// digest is in the content store, so that it is read from there rather
+// than pulled and exported with Docker
+func inContentStore(ref *reference.Spec) bool {
+	if ContentStore == "" {
+		return false
+	}
+	dgst := ref.Digest()
+	if dgst == "" || dgst.Validate() != nil {
+		return false
+	}
+	_, err := os.Stat(blobPath(ContentStore, dgst))
+	return err == nil
+}
+
+// storeImage returns the layers of an image in the content store, from the
+// bottom up, and its config, choosing the manifest for the target platform
+// from an index. It returns false if the image is not in the store.
+func storeImage(store string, ref *reference.Spec, opts *buildOptions) ([]ocispec.Descriptor, ocispec.Image, bool, error) {
+	var config ocispec.Image
+	dgst := ref.Digest()
+	if dgst == "" {
+		return nil, config, false, nil
+	}
+	if err := dgst.Validate(); err != nil {
+		return nil, config, false, err
+	}
+	if _, err := os.Stat(blobPath(store, dgst)); os.IsNotExist(err) {
+		return nil, config, false, nil
+	}
+
+	var m contentManifest
+	if err := readBlobJSON(store, dgst, &m); err != nil {
+		return nil, config, true, err
+	}
+	if len(m.Manifests) != 0 {
+		desc, err := platformManifest(m.Manifests, opts)
+		if err != nil {
+			return nil, config, true, fmt.Errorf("Image %s: %v", ref, err)
+		}
+		m = contentManifest{}
+		if err := readBlobJSON(store, desc.Digest, &m); err != nil {
+			return nil, config, true, err
+		}
+	}
+	if m.Config.Digest == "" {
+		return nil, config, true, fmt.Errorf("Image %s has no config in its manifest", ref)
+	}
+
+	if err := readBlobJSON(store, m.Config.Digest, &config); err != nil {
+		return nil, config, true, err
+	}
+	// the image is not in Docker, so checkArch cannot inspect it
+	if err := matchArch(ref, config.Architecture, opts.arch); err != nil {
+		return nil, config, true, err
+	}
+	return m.Layers, config, true, nil
+}
+
+// storeInspect returns the config of an image in the content store in the
+// form Docker inspects it in, or false if the image is not in the store
+func storeInspect(ref *reference.Spec, opts *buildOptions) (types.ImageInspect, bool, error) {
+	if ContentStore == "" {
+		return types.ImageInspect{}, false, nil
+	}
+	_, config, ok, err := storeImage(ContentStore, ref, opts)
+	if err != nil || !ok {
+		return types.ImageInspect{}, ok, err
+	}
+	return types.ImageInspect{
+		Architecture: config.Architecture,
+		Os:           config.OS,
+		Config: &container.Config{
+			User:       config.Config.User,
+			Env:        config.Config.Env,
+			Entrypoint: config.Config.Entrypoint,
+			Cmd:        config.Config.Cmd,
+			WorkingDir: config.Config.WorkingDir,
+			Labels:     config.Config.Labels,
+		},
+	}, true, nil
+}
+
+// platformManifest chooses the manifest for the target platform from an index
+func platformManifest(manifests []ocispec.Descriptor, opts *buildOptions) (ocispec.Descriptor, error) {
+	goos, arch, variant := "linux", opts.arch, ""
+	if opts.platform != "" {
+		var err error
+		if goos, arch, variant, err = ParsePlatform(opts.platform); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	if arch == "" {
+		arch = runtime.GOARCH
+	}
+	for _, desc := range manifests {
+		p := desc.Platform
+		if p == nil || p.OS != goos || p.Architecture != arch {
+			continue
+		}
+		if variant != "" && p.Variant != variant {
+			continue
+		}
+		return desc, nil
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("no manifest for %s/%s", goos, arch)
+}
+
+// verifiedReader reads a blob, returning an error instead of io.EOF if the
+// blob does not match its digest
+type verifiedReader struct {
+	r        io.Reader
+	dgst     digest.Digest
+	verifier digest.Verifier
+}
+
+func (v verifiedReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.verifier.Write(p[:n])
+	if err == io.EOF && !v.verifier.Verified() {
+		return n, fmt.Errorf("Layer %s in the content store does not match its digest", v.dgst)
+	}
+	return n, err
+}
+
+// openLayer opens a layer blob as a tar stream, decompressing it if needed.
+// The blob is checked against its digest once it has been read to the end.
+func openLayer(store string, desc ocispec.Descriptor) (io.Reader, io.Closer, bool, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, nil, false, err
+	}
+	f, err := os.Open(blobPath(store, desc.Digest))
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("Layer %s is not in the content store: %v", desc.Digest, err)
+	}
+	br := bufio.NewReader(verifiedReader{r: f, dgst: desc.Digest, verifier: desc.Digest.Verifier()})
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, nil, false, fmt.Errorf("Cannot decompress layer %s: %v", desc.Digest, err)
+		}
+		return zr, f, true, nil
+	}
+	if strings.HasSuffix(desc.MediaType, "zstd") {
+		f.Close()
+		return nil, nil, false, fmt.Errorf("Layer %s is zstd compressed, which is not supported", desc.Digest)
+	}
+	return br, f, false, nil
+}
+
+// layerInfo is what a layer hides of the layers below it
+type layerInfo struct {
+	// entries maps each path in the layer to whether it is a directory
+	entries map[string]bool
+	// whiteouts are paths removed from the layers below
+	whiteouts map[string]bool
+	// opaque are directories whose contents in the layers below are removed
+	opaque map[string]bool
+	// dirs are the headers of the directories in the layer
+	dirs map[string]*tar.Header
+	// linked are the paths that hardlinks in the layer point to
+	linked map[string]bool
+	// spool is the decompressed layer, if it was compressed, so that it is
+	// only decompressed once
+	spool *os.File
+}
+
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// scanLayer reads the headers of a layer, spooling it decompressed to a
+// temporary file if it is compressed
+func scanLayer(store string, desc ocispec.Descriptor) (layerInfo, error) {
+	info := layerInfo{
+		entries:   map[string]bool{},
+		whiteouts: map[string]bool{},
+		opaque:    map[string]bool{},
+		dirs:      map[string]*tar.Header{},
+		linked:    map[string]bool{},
+	}
+	r, c, compressed, err := openLayer(store, desc)
+	if err != nil {
+		return info, err
+	}
+	defer c.Close()
+	if compressed {
+		if info.spool, err = ioutil.TempFile("", "moby-layer"); err != nil {
+			return info, err
+		}
+		r = io.TeeReader(r, info.spool)
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			// read any padding after the end of the archive, so that the
+			// whole blob is checked against its digest
+			if _, err := io.Copy(ioutil.Discard, r); err != nil {
+				return info, err
+			}
+			return info, nil
+		}
+		if err != nil {
+			return info, fmt.Errorf("Cannot read layer %s: %v", desc.Digest, err)
+		}
+		name := cleanName(hdr.Name)
+		dir, base := parentDir(name), path.Base(name)
+		switch {
+		case base == whiteoutOpaque:
+			info.opaque[dir] = true
+		case strings.HasPrefix(base, whiteoutPrefix):
+			info.whiteouts[path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))] = true
+		default:
+			isDir := hdr.Typeflag == tar.TypeDir
+			info.entries[name] = isDir
+			if isDir {
+				info.dirs[name] = hdr
+			}
+			if hdr.Typeflag == tar.TypeLink {
+				info.linked[cleanName(hdr.Linkname)] = true
+			}
+		}
+	}
+}
+
+// reopen returns the tar stream of a layer that has been scanned
+func (info layerInfo) reopen(store string, desc ocispec.Descriptor) (*tar.Reader, io.Closer, error) {
+	if info.spool != nil {
+		if _, err := info.spool.Seek(0, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+		return tar.NewReader(bufio.NewReader(info.spool)), ioutil.NopCloser(info.spool), nil
+	}
+	r, c, _, err := openLayer(store, desc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tar.NewReader(r), c, nil
+}
+
+// hidden returns true if an entry in a layer is hidden by the layers above
+func hidden(layers []layerInfo, i int, name string, isDir bool) bool {
+	for _, upper := range layers[i+1:] {
+		// a directory is merged with one above it, anything else replaced
+		if d, ok := upper.entries[name]; ok && !(d && isDir) {
+			return true
+		}
+		if upper.whiteouts[name] || upper.opaque[""] {
+			return true
+		}
+		for p := parentDir(name); p != ""; p = parentDir(p) {
+			if upper.whiteouts[p] || upper.opaque[p] {
+				return true
+			}
+			if d, ok := upper.entries[p]; ok && !d {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parentDir(name string) string {
+	dir := path.Dir(name)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// flattenLayers writes the filesystem made by applying the layers in order
+// as a single tarball, in the same form as docker export. Each layer is read
+// twice, first for what it hides of the layers below and then to write what
+// is not hidden, but only decompressed once.
+func flattenLayers(store string, layers []ocispec.Descriptor, w io.Writer) error {
+	infos := make([]layerInfo, len(layers))
+	defer func() {
+		for _, info := range infos {
+			if info.spool != nil {
+				info.spool.Close()
+				os.Remove(info.spool.Name())
+			}
+		}
+	}()
+	for i, desc := range layers {
+		info, err := scanLayer(store, desc)
+		infos[i] = info
+		if err != nil {
+			return err
+		}
+	}
+
+	// the last visible header of each directory, which is written with the
+	// first visible one so that it comes before the files in it
+	dirHeaders := map[string]*tar.Header{}
+	exists := map[string]bool{}
+	for i, info := range infos {
+		for name, isDir := range info.entries {
+			if hidden(infos, i, name, isDir) {
+				continue
+			}
+			exists[name] = true
+			if isDir {
+				dirHeaders[name] = info.dirs[name]
+			}
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	written := map[string]bool{}
+	for i, desc := range layers {
+		if err := flattenLayer(store, desc, infos, i, dirHeaders, written, tw); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range exportDirs {
+		if !exists[name] {
+			if err := tw.WriteHeader(&tar.Header{Name: name + "/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range exportFiles {
+		if !exists[name] {
+			if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// linkTarget is a file that hardlinks in a layer point to but that a layer
+// above replaces or removes, kept so that the links are written as copies of
+// it
+type linkTarget struct {
+	hdr      *tar.Header
+	contents *os.File
+	// copied is the first link written as a copy, which the other links to
+	// the same file are written as links to
+	copied string
+}
+
+// flattenLayer writes the entries of layer i that the layers above do not
+// hide
+func flattenLayer(store string, desc ocispec.Descriptor, infos []layerInfo, i int, dirHeaders map[string]*tar.Header, written map[string]bool, tw *tar.Writer) error {
+	tr, c, err := infos[i].reopen(store, desc)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	targets := map[string]*linkTarget{}
+	defer func() {
+		for _, t := range targets {
+			t.contents.Close()
+			os.Remove(t.contents.Name())
+		}
+	}()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot read layer %s: %v", desc.Digest, err)
+		}
+		name := cleanName(hdr.Name)
+		if name == "" || strings.HasPrefix(path.Base(name), whiteoutPrefix) {
+			continue
+		}
+		isDir := hdr.Typeflag == tar.TypeDir
+		if written[name] {
+			continue
+		}
+		if hidden(infos, i, name, isDir) {
+			if !isDir && hdr.Typeflag != tar.TypeLink && infos[i].linked[name] {
+				t := &linkTarget{hdr: hdr}
+				if t.contents, err = ioutil.TempFile("", "moby-link"); err != nil {
+					return err
+				}
+				targets[name] = t
+				if _, err := io.Copy(t.contents, tr); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		var contents io.Reader = tr
+		switch {
+		case isDir:
+			hdr = dirHeaders[name]
+			hdr.Name = name + "/"
+		case hdr.Typeflag == tar.TypeLink:
+			hdr.Name = name
+			hdr.Linkname = cleanName(hdr.Linkname)
+			if t, ok := targets[hdr.Linkname]; ok {
+				if t.copied != "" {
+					hdr.Linkname = t.copied
+					break
+				}
+				// the file linked to is replaced or removed above, so the
+				// link has to be a copy of it
+				copyHdr := *t.hdr
+				copyHdr.Name = name
+				hdr = &copyHdr
+				if _, err := t.contents.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+				contents = t.contents
+				t.copied = name
+			}
+		default:
+			hdr.Name = name
+		}
+		written[name] = true
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !isDir {
+			if _, err := io.Copy(tw, contents); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// storeExport returns the flattened filesystem of an image from the content
+// store, or false if the image is not in the store
+func storeExport(ref *reference.Spec, opts *buildOptions) (io.ReadCloser, bool, error) {
+	if ContentStore == "" {
+		return nil, false, nil
+	}
+	layers, _, ok, err := storeImage(ContentStore, ref, opts)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+	log.Debugf("image tar: %s from content store %s", ref, ContentStore)
+	recordImage(ref.String(), ref.Digest().String())
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(flattenLayers(ContentStore, layers, w))
+	}()
+	return r, true, nil
+}
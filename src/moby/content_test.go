@@ -0,0 +1,295 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testEntry is an entry of a test layer. The contents of a hardlink are the
+// path it links to.
+type testEntry struct {
+	name     string
+	typeflag byte
+	mode     int64
+	contents string
+}
+
+func TestContentStore(t *testing.T) {
+	store, err := ioutil.TempDir("", "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(store)
+
+	writeBlob := func(b []byte) ocispec.Descriptor {
+		dgst := digest.FromBytes(b)
+		file := blobPath(store, dgst)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return ocispec.Descriptor{Digest: dgst, Size: int64(len(b))}
+	}
+	writeJSON := func(v interface{}) ocispec.Descriptor {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return writeBlob(b)
+	}
+	layer := func(compress bool, entries []testEntry) ocispec.Descriptor {
+		buf := new(bytes.Buffer)
+		var w io.Writer = buf
+		var zw *gzip.Writer
+		if compress {
+			zw = gzip.NewWriter(buf)
+			w = zw
+		}
+		tw := tar.NewWriter(w)
+		for _, e := range entries {
+			hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: e.mode, Size: int64(len(e.contents))}
+			if e.typeflag == tar.TypeLink {
+				hdr.Linkname, hdr.Size = e.contents, 0
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Size != 0 {
+				if _, err := tw.Write([]byte(e.contents)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if zw != nil {
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return writeBlob(buf.Bytes())
+	}
+
+	layers := []ocispec.Descriptor{
+		layer(true, []testEntry{
+			{"./", tar.TypeDir, 0755, ""},
+			{"etc/", tar.TypeDir, 0755, ""},
+			{"etc/passwd", tar.TypeReg, 0644, "root"},
+			{"etc/hosts", tar.TypeReg, 0644, "1.2.3.4 image"},
+			{"bin/", tar.TypeDir, 0755, ""},
+			{"bin/sh", tar.TypeReg, 0755, "sh"},
+			{"bin/gone", tar.TypeReg, 0755, "gone"},
+			{"bin/alias", tar.TypeLink, 0755, "bin/gone"},
+			{"bin/sh2", tar.TypeLink, 0755, "bin/sh"},
+			{"usr/", tar.TypeDir, 0755, ""},
+			{"usr/bin/", tar.TypeDir, 0755, ""},
+			{"usr/bin/real", tar.TypeReg, 0755, "old"},
+			{"usr/bin/link", tar.TypeLink, 0755, "usr/bin/real"},
+			{"usr/bin/link2", tar.TypeLink, 0755, "usr/bin/real"},
+			{"usr/lib/", tar.TypeDir, 0755, ""},
+			{"usr/lib/a", tar.TypeReg, 0644, "a"},
+			{"usr/lib/b", tar.TypeReg, 0644, "b"},
+			{"var/", tar.TypeDir, 0755, ""},
+			{"var/cache/", tar.TypeDir, 0755, ""},
+			{"var/cache/x", tar.TypeReg, 0644, "x"},
+			{"opt", tar.TypeReg, 0644, "opt"},
+		}),
+		layer(false, []testEntry{
+			{"etc/", tar.TypeDir, 0700, ""},
+			{"etc/.wh.passwd", tar.TypeReg, 0644, ""},
+			{"usr/lib/.wh..wh..opq", tar.TypeReg, 0644, ""},
+			{"usr/lib/c", tar.TypeReg, 0644, "c"},
+			{"opt/", tar.TypeDir, 0755, ""},
+			{"opt/tool", tar.TypeReg, 0755, "tool"},
+			{"var/cache", tar.TypeReg, 0644, "cache"},
+			{"bin/.wh.gone", tar.TypeReg, 0644, ""},
+			{"usr/bin/real", tar.TypeReg, 0755, "new"},
+		}),
+	}
+	armConfig := ocispec.Image{Architecture: "arm64", OS: "linux"}
+	armConfig.Config.Cmd = []string{"/bin/sh"}
+	armConfig.Config.Env = []string{"PATH=/bin"}
+	arm := writeJSON(ocispec.Manifest{
+		Config: writeJSON(armConfig),
+		Layers: layers,
+	})
+	arm.Platform = &ocispec.Platform{OS: "linux", Architecture: "arm64"}
+	amd := writeJSON(ocispec.Manifest{
+		Config: writeJSON(ocispec.Image{Architecture: "amd64", OS: "linux"}),
+		Layers: []ocispec.Descriptor{layer(true, []testEntry{{"amd64", tar.TypeReg, 0644, ""}})},
+	})
+	amd.Platform = &ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	index := writeJSON(ocispec.Index{Manifests: []ocispec.Descriptor{amd, arm}})
+
+	arch := TargetArch
+	TargetArch = "arm64"
+	ContentStore = store
+	defer func() {
+		TargetArch = arch
+		ContentStore = ""
+	}()
+
+	ref, err := reference.Parse("docker.io/linuxkit/test@" + index.Digest.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	if err := ImageTar(&ref, "containers/test/", tw, false, PullMissing, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(buf)
+	seen := map[string]*tar.Header{}
+	contents := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(hdr.Name, "containers/test/"), "/")
+		if parent := filepath.Dir(name); parent != "." {
+			if _, ok := seen[parent]; !ok {
+				t.Errorf("Expected %s to come after its directory", name)
+			}
+		}
+		if _, ok := seen[name]; ok {
+			t.Errorf("Expected %s only once", name)
+		}
+		b, _ := ioutil.ReadAll(tr)
+		seen[name] = hdr
+		contents[name] = string(b)
+	}
+
+	for _, name := range []string{"etc/passwd", "usr/lib/a", "usr/lib/b", "var/cache/x", "amd64", "bin/gone"} {
+		if _, ok := seen[name]; ok {
+			t.Errorf("Expected %s to be removed", name)
+		}
+	}
+	for name, want := range map[string]string{
+		"bin/sh":          "sh",
+		"usr/lib/c":       "c",
+		"opt/tool":        "tool",
+		"var/cache":       "cache",
+		"usr/bin/real":    "new",
+		"usr/bin/link":    "old",
+		"bin/alias":       "gone",
+		"etc/hosts":       replace["etc/hosts"],
+		"etc/resolv.conf": replace["etc/resolv.conf"],
+	} {
+		if _, ok := seen[name]; !ok {
+			t.Errorf("Expected %s in the image", name)
+		} else if contents[name] != want {
+			t.Errorf("Expected %s to contain %q, got %q", name, want, contents[name])
+		}
+	}
+	if hdr := seen["etc"]; hdr == nil || hdr.Typeflag != tar.TypeDir || hdr.Mode != 0700 {
+		t.Errorf("Expected etc to be a directory with the mode from the top layer, got %+v", hdr)
+	}
+	if hdr := seen["opt"]; hdr == nil || hdr.Typeflag != tar.TypeDir {
+		t.Errorf("Expected opt to be replaced by a directory, got %+v", hdr)
+	}
+	// links to a file replaced or removed above are copies of the old file
+	for name, target := range map[string]string{
+		"usr/bin/link":  "",
+		"bin/alias":     "",
+		"usr/bin/link2": "containers/test/usr/bin/link",
+		"bin/sh2":       "containers/test/bin/sh",
+	} {
+		hdr := seen[name]
+		switch {
+		case hdr == nil:
+			t.Errorf("Expected %s in the image", name)
+		case target == "" && hdr.Typeflag != tar.TypeReg:
+			t.Errorf("Expected %s to be a copy of the file it linked to, got %+v", name, hdr)
+		case target != "" && (hdr.Typeflag != tar.TypeLink || hdr.Linkname != target):
+			t.Errorf("Expected %s to link to %s, got %+v", name, target, hdr)
+		}
+	}
+	for _, name := range []string{"dev", "proc", "sys"} {
+		if hdr := seen[name]; hdr == nil || hdr.Typeflag != tar.TypeDir {
+			t.Errorf("Expected the %s directory docker export adds, got %+v", name, hdr)
+		}
+	}
+
+	// the image config is read from the store rather than inspected with Docker
+	host := os.Getenv("DOCKER_HOST")
+	os.Setenv("DOCKER_HOST", "tcp://127.0.0.1:1")
+	defer os.Setenv("DOCKER_HOST", host)
+	spec, _, err := ConfigToOCI(&Image{Name: "test", Image: ref.String(), ref: &ref}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(spec.Process.Args, []string{"/bin/sh"}) || !reflect.DeepEqual(spec.Process.Env, []string{"PATH=/bin"}) {
+		t.Errorf("Expected the command and env of the image config, got %v %v", spec.Process.Args, spec.Process.Env)
+	}
+	if err := prePull(Moby{Onboot: []*Image{{Name: "test", Image: ref.String(), ref: &ref}}}, PullAlways); err != nil {
+		t.Errorf("Expected an image in the content store not to be pulled, got %v", err)
+	}
+
+	TargetArch = "s390x"
+	if err := ImageTar(&ref, "containers/test/", tar.NewWriter(ioutil.Discard), false, PullMissing, "", nil); err == nil {
+		t.Error("Expected an image with no manifest for the target architecture to fail")
+	}
+	armRef, err := reference.Parse("docker.io/linuxkit/test@" + arm.Digest.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	TargetArch = "amd64"
+	if err := ImageTar(&armRef, "containers/test/", tar.NewWriter(ioutil.Discard), false, PullMissing, "", nil); err == nil || !strings.Contains(err.Error(), "not the target architecture") {
+		t.Errorf("Expected an image for another architecture to fail, got %v", err)
+	}
+
+	// a layer blob that does not match its digest is rejected
+	for _, compress := range []bool{false, true} {
+		bad := layer(compress, []testEntry{{"etc/motd", tar.TypeReg, 0644, "good"}})
+		other := layer(compress, []testEntry{{"etc/motd", tar.TypeReg, 0644, "evil"}})
+		b, err := ioutil.ReadFile(blobPath(store, other.Digest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(blobPath(store, bad.Digest), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		badRef, err := reference.Parse("docker.io/linuxkit/test@" + writeJSON(ocispec.Manifest{
+			Config: writeJSON(ocispec.Image{Architecture: "amd64", OS: "linux"}),
+			Layers: []ocispec.Descriptor{bad},
+		}).Digest.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ImageTar(&badRef, "containers/test/", tar.NewWriter(ioutil.Discard), false, PullMissing, "", nil); err == nil || !strings.Contains(err.Error(), "does not match its digest") {
+			t.Errorf("Expected a layer that does not match its digest to fail, got %v", err)
+		}
+	}
+
+	unpinned, err := reference.Parse("docker.io/linuxkit/test:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok, err := storeImage(store, &unpinned, globalOptions()); ok || err != nil {
+		t.Errorf("Expected an image not pinned by digest not to be read from the store, got %t %v", ok, err)
+	}
+}
@@ -0,0 +1,98 @@
+package moby
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dockerEndpoint is the Docker endpoint of a Docker CLI context
+type dockerEndpoint struct {
+	Host          string
+	SkipTLSVerify bool
+	// TLSPath is the directory holding the ca.pem, cert.pem and key.pem of
+	// the endpoint, or empty if it has none
+	TLSPath string
+}
+
+// resolveDockerContext reads the Docker endpoint of a context from the
+// context store in a Docker CLI configuration directory
+func resolveDockerContext(configDir, name string) (dockerEndpoint, error) {
+	var ep dockerEndpoint
+	sum := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(sum[:])
+
+	b, err := ioutil.ReadFile(filepath.Join(configDir, "contexts", "meta", id, "meta.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ep, fmt.Errorf("Docker context %s not found", name)
+		}
+		return ep, err
+	}
+	var meta struct {
+		Name      string
+		Endpoints map[string]struct {
+			Host          string
+			SkipTLSVerify bool
+		}
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return ep, fmt.Errorf("Cannot parse Docker context %s: %v", name, err)
+	}
+	docker, ok := meta.Endpoints["docker"]
+	if !ok || docker.Host == "" {
+		return ep, fmt.Errorf("Docker context %s has no Docker endpoint", name)
+	}
+	ep.Host = docker.Host
+	ep.SkipTLSVerify = docker.SkipTLSVerify
+
+	tls := filepath.Join(configDir, "contexts", "tls", id, "docker")
+	if _, err := os.Stat(filepath.Join(tls, "ca.pem")); err == nil {
+		ep.TLSPath = tls
+	}
+	return ep, nil
+}
+
+// UseDockerContext makes the Docker API client, and the docker commands run
+// for the mkimage helpers, use the endpoint of a Docker CLI context rather
+// than the one from the environment. The "default" context is the environment.
+func UseDockerContext(name string) error {
+	if name == "" || name == "default" {
+		return nil
+	}
+	ep, err := resolveDockerContext(dockerConfigDir(), name)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(ep.Host, "ssh://") {
+		return fmt.Errorf("Docker context %s uses an ssh endpoint, which is not supported", name)
+	}
+	log.Debugf("Using Docker context %s at %s", name, ep.Host)
+	env := map[string]string{
+		"DOCKER_HOST":       ep.Host,
+		"DOCKER_CERT_PATH":  ep.TLSPath,
+		"DOCKER_TLS_VERIFY": "",
+	}
+	if ep.TLSPath != "" && !ep.SkipTLSVerify {
+		env["DOCKER_TLS_VERIFY"] = "1"
+	}
+	for k, v := range env {
+		var err error
+		if v == "" {
+			err = os.Unsetenv(k)
+		} else {
+			err = os.Setenv(k, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package moby
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveDockerContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, meta string, tls bool) {
+		sum := sha256.Sum256([]byte(name))
+		id := hex.EncodeToString(sum[:])
+		metaDir := filepath.Join(dir, "contexts", "meta", id)
+		if err := os.MkdirAll(metaDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(metaDir, "meta.json"), []byte(meta), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if tls {
+			tlsDir := filepath.Join(dir, "contexts", "tls", id, "docker")
+			if err := os.MkdirAll(tlsDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range []string{"ca.pem", "cert.pem", "key.pem"} {
+				if err := ioutil.WriteFile(filepath.Join(tlsDir, f), []byte("pem"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	write("mybuilder", `{"Name":"mybuilder","Metadata":{},"Endpoints":{"docker":{"Host":"tcp://builder:2376","SkipTLSVerify":false}}}`, true)
+	write("plain", `{"Name":"plain","Metadata":{},"Endpoints":{"docker":{"Host":"unix:///run/other.sock"}}}`, false)
+	write("kube", `{"Name":"kube","Metadata":{},"Endpoints":{"kubernetes":{"Host":"https://k8s"}}}`, false)
+
+	ep, err := resolveDockerContext(dir, "mybuilder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ep.Host != "tcp://builder:2376" || ep.SkipTLSVerify {
+		t.Errorf("Unexpected endpoint %+v", ep)
+	}
+	if ep.TLSPath == "" || filepath.Base(ep.TLSPath) != "docker" {
+		t.Errorf("Expected the context TLS directory, got %q", ep.TLSPath)
+	}
+
+	ep, err = resolveDockerContext(dir, "plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ep.Host != "unix:///run/other.sock" || ep.TLSPath != "" {
+		t.Errorf("Unexpected endpoint %+v", ep)
+	}
+
+	if _, err := resolveDockerContext(dir, "kube"); err == nil {
+		t.Error("Expected a context without a Docker endpoint to fail")
+	}
+	if _, err := resolveDockerContext(dir, "missing"); err == nil {
+		t.Error("Expected a missing context to fail")
+	}
+}
@@ -0,0 +1,37 @@
+package moby
+
+import (
+	"strings"
+)
+
+// debugYaml is the default overlay for a debug build, which adds a shell on
+// the console and makes sure the kernel writes to the usual consoles
+const debugYaml = `
+kernel:
+  cmdline: "console=tty0 console=ttyS0"
+services:
+  - name: debug
+    image: linuxkit/getty:797cb79e0a229fcd16ebf44a0da74bcec03968ec
+    env:
+     - INSECURE=true
+`
+
+// DebugConfig merges a debug overlay into a config. If the overlay is empty
+// the default overlay is used. Unlike AppendConfig, the kernel cmdline of the
+// overlay is appended to the existing cmdline rather than replacing it.
+func DebugConfig(m Moby, overlay []byte) (Moby, error) {
+	if len(overlay) == 0 {
+		overlay = []byte(debugYaml)
+	}
+	d, err := NewConfig(overlay)
+	if err != nil {
+		return m, err
+	}
+	cmdline := strings.TrimSpace(m.Kernel.Cmdline + " " + d.Kernel.Cmdline)
+	m, err = AppendConfig(m, d)
+	if err != nil {
+		return m, err
+	}
+	m.Kernel.Cmdline = cmdline
+	return m, nil
+}
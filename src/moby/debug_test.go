@@ -0,0 +1,48 @@
+package moby
+
+import (
+	"testing"
+)
+
+func TestDebugConfig(t *testing.T) {
+	m, err := NewConfig([]byte(`
+kernel:
+  image: linuxkit/kernel:4.9.41
+  cmdline: "quiet"
+services:
+  - name: rngd
+    image: linuxkit/rngd:558e86a36242bb74353bc9287b715ddb8567357e
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := DebugConfig(m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Services) != 2 || d.Services[1].Name != "debug" {
+		t.Fatalf("Expected debug service to be added, got %v", d.Services)
+	}
+	if d.Kernel.Cmdline != "quiet console=tty0 console=ttyS0" {
+		t.Errorf("Expected console to be appended to cmdline, got %q", d.Kernel.Cmdline)
+	}
+	if d.Kernel.Image != "linuxkit/kernel:4.9.41" {
+		t.Errorf("Expected kernel image to be unchanged, got %s", d.Kernel.Image)
+	}
+
+	d, err = DebugConfig(m, []byte(`
+services:
+  - name: shell
+    image: docker.io/library/alpine:3.7
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Services) != 2 || d.Services[1].Name != "shell" {
+		t.Errorf("Expected custom overlay service to be added, got %v", d.Services)
+	}
+	if d.Kernel.Cmdline != "quiet" {
+		t.Errorf("Expected cmdline to be unchanged, got %q", d.Kernel.Cmdline)
+	}
+}
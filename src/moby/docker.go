@@ -4,24 +4,114 @@ package moby
 // and also using the Docker API not shelling out
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/containerd/containerd/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/versions"
 	"github.com/docker/docker/client"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 )
 
-func dockerRun(input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+// DockerTimeout limits how long each Docker API call of a build, including
+// reading the stream it returns, may take, 0 is no limit
+var DockerTimeout time.Duration
+
+// dockerContext returns the context for a Docker API call limited to
+// timeout, or unlimited if it is 0, which must be cancelled once the call and
+// any stream it returns are finished with
+func dockerContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// cancelReadCloser is a stream from a Docker API call that cancels the
+// context of the call when it is closed
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// Platform is the platform, as os/arch[/variant], to pull images for, or
+// empty to pull for the default platform of the Docker daemon
+var Platform string
+
+// platformAPIVersion is the first Docker API version that pulls for a platform
+const platformAPIVersion = "1.32"
+
+// ParsePlatform splits a platform of the form os/arch[/variant]
+func ParsePlatform(platform string) (goos, goarch, variant string, err error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", "", "", fmt.Errorf("Invalid platform %s, must be os/arch[/variant]", platform)
+	}
+	for _, p := range parts {
+		if p == "" || strings.TrimSpace(p) != p {
+			return "", "", "", fmt.Errorf("Invalid platform %s, must be os/arch[/variant]", platform)
+		}
+	}
+	if len(parts) == 3 {
+		variant = parts[2]
+	}
+	return parts[0], parts[1], variant, nil
+}
+
+// PullAttempts is the number of times to try pulling an image when pulls
+// fail with errors that may be transient, such as timeouts
+var PullAttempts = 3
+
+// pullBackoff is the delay before the first retry of a pull, which doubles
+// for each further retry
+var pullBackoff = 2 * time.Second
+
+// permanentPullErrors and transientPullErrors are parts of the messages of
+// pull errors that are not and are worth retrying, as the daemon passes the
+// errors from the registry on as text
+var (
+	permanentPullErrors = []string{"unauthorized", "authentication required", "denied", "not found", "manifest unknown", "does not exist", "invalid reference format"}
+	transientPullErrors = []string{"timeout", "timed out", "deadline exceeded", "connection reset", "connection refused", "unexpected eof", "tls handshake", "too many requests", "toomanyrequests", "internal server error", "bad gateway", "service unavailable", "gateway time"}
+)
+
+// recordHelper records a helper image as used by the build, with the digest
+// it was pulled at
+func recordHelper(img string, timeout time.Duration) {
+	key, err := lockKey(img)
+	if err != nil {
+		recordImage(img, "")
+		return
+	}
+	var digest string
+	if ref, err := reference.Parse(key); err == nil {
+		digest, _ = imageDigest(&ref, timeout)
+	}
+	recordImage(key, digest)
+}
+
+func dockerRun(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
 	log.Debugf("docker run %s (trust=%t) (input): %s", img, trust, strings.Join(args, " "))
 	docker, err := exec.LookPath("docker")
 	if err != nil {
@@ -33,25 +123,85 @@ func dockerRun(input io.Reader, output io.Writer, trust bool, img string, args .
 		env = append(env, "DOCKER_CONTENT_TRUST=1")
 	}
 
+	ctx, cancel := dockerContext(opts.Timeout)
+	defer cancel()
+
 	// Pull first to avoid https://github.com/docker/cli/issues/631
-	pull := exec.Command(docker, "pull", img)
+	pull := exec.CommandContext(ctx, docker, "pull", img)
 	pull.Env = env
+	pullStderr := new(bytes.Buffer)
+	pull.Stderr = pullStderr
 	if err := pull.Run(); err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			return fmt.Errorf("docker pull %s failed: %v output:\n%s", img, err, exitError.Stderr)
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("docker pull %s timed out after %s", img, opts.Timeout)
+		}
+		if _, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("docker pull %s failed: %v output:\n%s", img, err, tail(pullStderr.String(), helperLogLines))
 		}
 		return err
 	}
+	recordHelper(img, opts.Timeout)
 
-	args = append([]string{"run", "--network=none", "--rm", "-i", img}, args...)
-	cmd := exec.Command(docker, args...)
+	runArgs := []string{"run", "--network=none", "-i"}
+	// the container ID is needed to keep a failed container, or to remove one
+	// that is left running when docker run is killed on a timeout
+	var cidFile string
+	if opts.KeepFailedHelpers || opts.Timeout > 0 {
+		dir, err := ioutil.TempDir("", "moby-helper")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		cidFile = filepath.Join(dir, "cid")
+		runArgs = append(runArgs, "--cidfile", cidFile)
+	}
+	if !opts.KeepFailedHelpers {
+		runArgs = append(runArgs, "--rm")
+	}
+	if opts.HelperMemory != "" {
+		runArgs = append(runArgs, "--memory", opts.HelperMemory)
+	}
+	if opts.HelperCPUs != "" {
+		runArgs = append(runArgs, "--cpus", opts.HelperCPUs)
+	}
+	args = append(append(runArgs, img), args...)
+	cmd := exec.CommandContext(ctx, docker, args...)
 	cmd.Stdin = input
 	cmd.Stdout = output
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
 	cmd.Env = env
 
-	if err := cmd.Run(); err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			return fmt.Errorf("docker run %s failed: %v output:\n%s", img, err, exitError.Stderr)
+	err = cmd.Run()
+	timedOut := ctx.Err() == context.DeadlineExceeded
+	if cidFile != "" {
+		id, cidErr := ioutil.ReadFile(cidFile)
+		if cidErr == nil && len(id) > 0 {
+			switch {
+			case timedOut && !opts.KeepFailedHelpers:
+				if rmErr := exec.Command(docker, "rm", "-f", string(id)).Run(); rmErr != nil {
+					log.Warnf("Could not remove helper container %s: %v", id, rmErr)
+				}
+			case timedOut:
+				if killErr := exec.Command(docker, "kill", string(id)).Run(); killErr != nil {
+					log.Warnf("Could not stop helper container %s: %v", id, killErr)
+				}
+				log.Errorf("Helper container %s has been kept, inspect it with 'docker logs %s' and remove it with 'docker rm %s'", id, id, id)
+			case err != nil && opts.KeepFailedHelpers:
+				log.Errorf("Helper container %s has been kept, inspect it with 'docker logs %s' and remove it with 'docker rm %s'", id, id, id)
+			case opts.KeepFailedHelpers:
+				if rmErr := exec.Command(docker, "rm", string(id)).Run(); rmErr != nil {
+					log.Warnf("Could not remove helper container %s: %v", id, rmErr)
+				}
+			}
+		}
+	}
+	if timedOut {
+		return fmt.Errorf("docker run %s timed out after %s output:\n%s", img, opts.Timeout, tail(stderr.String(), helperLogLines))
+	}
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("docker run %s failed: %v output:\n%s", img, err, tail(stderr.String(), helperLogLines))
 		}
 		return err
 	}
@@ -60,9 +210,21 @@ func dockerRun(input io.Reader, output io.Writer, trust bool, img string, args .
 	return nil
 }
 
-func dockerCreate(image string) (string, error) {
+// helperLogLines is the number of lines of helper output included in errors
+const helperLogLines = 20
+
+// tail returns the last n lines of s
+func tail(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func dockerCreate(image string, timeout time.Duration) (string, error) {
 	log.Debugf("docker create: %s", image)
-	cli, err := dockerClient()
+	cli, err := dockerClient(timeout)
 	if err != nil {
 		return "", errors.New("could not initialize Docker API client")
 	}
@@ -71,7 +233,9 @@ func dockerCreate(image string) (string, error) {
 		Cmd:   []string{"/dev/null"},
 		Image: image,
 	}
-	respBody, err := cli.ContainerCreate(context.Background(), config, nil, nil, "")
+	ctx, cancel := dockerContext(timeout)
+	defer cancel()
+	respBody, err := cli.ContainerCreate(ctx, config, nil, nil, "")
 	if err != nil {
 		return "", err
 	}
@@ -80,43 +244,87 @@ func dockerCreate(image string) (string, error) {
 	return respBody.ID, nil
 }
 
-func dockerExport(container string) (io.ReadCloser, error) {
+func dockerExport(container string, timeout time.Duration) (io.ReadCloser, error) {
 	log.Debugf("docker export: %s", container)
-	cli, err := dockerClient()
+	cli, err := dockerClient(timeout)
 	if err != nil {
 		return nil, errors.New("could not initialize Docker API client")
 	}
-	responseBody, err := cli.ContainerExport(context.Background(), container)
+	ctx, cancel := dockerContext(timeout)
+	responseBody, err := cli.ContainerExport(ctx, container)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 
-	return responseBody, err
+	return cancelReadCloser{ReadCloser: responseBody, cancel: cancel}, nil
 }
 
-func dockerRm(container string) error {
+func dockerRm(container string, timeout time.Duration) error {
 	log.Debugf("docker rm: %s", container)
-	cli, err := dockerClient()
+	cli, err := dockerClient(timeout)
 	if err != nil {
 		return errors.New("could not initialize Docker API client")
 	}
-	if err = cli.ContainerRemove(context.Background(), container, types.ContainerRemoveOptions{}); err != nil {
+	ctx, cancel := dockerContext(timeout)
+	defer cancel()
+	if err = cli.ContainerRemove(ctx, container, types.ContainerRemoveOptions{}); err != nil {
 		return err
 	}
 	log.Debugf("docker rm: %s...Done", container)
 	return nil
 }
 
-func dockerPull(ref *reference.Spec, forcePull, trustedPull bool) error {
+// dockerLoad loads an image tarball in the format written by docker save
+// into the Docker daemon
+func dockerLoad(image io.Reader, timeout time.Duration) error {
+	log.Debugf("docker load")
+	cli, err := dockerClient(timeout)
+	if err != nil {
+		return errors.New("could not initialize Docker API client")
+	}
+	ctx, cancel := dockerContext(timeout)
+	defer cancel()
+	resp, err := cli.ImageLoad(ctx, image, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !resp.JSON {
+		_, err := io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Stream string `json:"stream"`
+			Error  string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		if msg.Stream != "" {
+			log.Debugf("%s", strings.TrimSpace(msg.Stream))
+		}
+	}
+}
+
+func dockerPull(ref *reference.Spec, forcePull, trustedPull bool, platform string, timeout time.Duration) error {
 	log.Debugf("docker pull: %s", ref)
-	cli, err := dockerClient()
+	cli, err := dockerClient(timeout)
 	if err != nil {
 		return errors.New("could not initialize Docker API client")
 	}
 
 	if trustedPull {
 		log.Debugf("pulling %s with content trust", ref)
-		trustedImg, err := TrustedReference(ref.String())
+		trustedImg, err := trustedReference(ref.String())
 		if err != nil {
 			return fmt.Errorf("Trusted pull for %s failed: %v", ref, err)
 		}
@@ -124,7 +332,9 @@ func dockerPull(ref *reference.Spec, forcePull, trustedPull bool) error {
 		// tag the image on a best-effort basis after pulling with content trust,
 		// ensuring that docker picks up the tag and digest fom the canonical format
 		defer func(src, dst string) {
-			if err := cli.ImageTag(context.Background(), src, dst); err != nil {
+			ctx, cancel := dockerContext(timeout)
+			defer cancel()
+			if err := cli.ImageTag(ctx, src, dst); err != nil {
 				log.Debugf("could not tag trusted image %s to %s", src, dst)
 			}
 		}(trustedImg.String(), ref.String())
@@ -139,46 +349,170 @@ func dockerPull(ref *reference.Spec, forcePull, trustedPull bool) error {
 
 		imageSearchArg := filters.NewArgs()
 		imageSearchArg.Add("reference", trustedImg.String())
-		if _, err := cli.ImageList(context.Background(), types.ImageListOptions{Filters: imageSearchArg}); err == nil && !forcePull {
+		ctx, cancel := dockerContext(timeout)
+		images, err := cli.ImageList(ctx, types.ImageListOptions{Filters: imageSearchArg})
+		cancel()
+		if err == nil && len(images) != 0 && !forcePull {
 			log.Debugf("docker pull: trusted image %s already cached...Done", trustedImg.String())
+			recordImage(ref.String(), trustedSpec.Digest().String())
 			return nil
 		}
 	}
 
-	log.Infof("Pull image: %s", ref)
-	r, err := cli.ImagePull(context.Background(), ref.String(), types.ImagePullOptions{})
+	auth, err := registryAuth(ref.Locator)
 	if err != nil {
-		return err
+		return fmt.Errorf("Cannot get registry credentials for %s: %v", ref, err)
+	}
+
+	if platform != "" && versions.LessThan(cli.ClientVersion(), platformAPIVersion) {
+		return fmt.Errorf("Cannot pull %s for platform %s, Docker API version %s is needed but the daemon supports %s", ref, platform, platformAPIVersion, cli.ClientVersion())
 	}
-	defer r.Close()
-	_, err = io.Copy(ioutil.Discard, r)
+
+	log.Infof("Pull image: %s", ref)
+	atomic.AddInt64(&imagesPulled, 1)
+	err = retryPull(ref.String(), func() error {
+		ctx, cancel := dockerContext(timeout)
+		defer cancel()
+		r, err := cli.ImagePull(ctx, ref.String(), types.ImagePullOptions{RegistryAuth: auth, Platform: platform})
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return readPullProgress(ref.String(), r)
+	})
 	if err != nil {
 		return err
 	}
+	var digest string
+	if inspect, err := imageInspect(cli, ref.String(), timeout); err == nil {
+		digest = repoDigest(inspect, ref)
+	}
+	recordImage(ref.String(), digest)
 	log.Debugf("docker pull: %s...Done", ref)
 	return nil
 }
 
-func dockerClient() (*client.Client, error) {
-	// for maximum compatibility as we use nothing new
-	err := os.Setenv("DOCKER_API_VERSION", "1.23")
+// retryPull calls pull until it succeeds, fails with an error that is not
+// transient, or has been tried PullAttempts times, backing off exponentially
+func retryPull(ref string, pull func() error) error {
+	delay := pullBackoff
+	for attempt := 1; ; attempt++ {
+		err := pull()
+		if err == nil {
+			return nil
+		}
+		if attempt >= PullAttempts || !retryablePullError(err) {
+			return err
+		}
+		log.Warnf("Pull of %s failed, retrying in %s (attempt %d of %d): %v", ref, delay, attempt, PullAttempts, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// retryablePullError returns true if a pull error may be transient
+func retryablePullError(err error) bool {
+	if client.IsErrNotFound(err) || client.IsErrUnauthorized(err) || client.IsErrConnectionFailed(err) {
+		return false
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range permanentPullErrors {
+		if strings.Contains(msg, s) {
+			return false
+		}
+	}
+	for _, s := range transientPullErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// minAPIVersion is the Docker API version used with daemons too old to
+// report the version they support
+const minAPIVersion = "1.23"
+
+// apiVersions are the API versions negotiated with each Docker daemon that
+// has been reached, keyed by its host
+var (
+	apiVersions   = map[string]string{}
+	apiVersionsMu sync.Mutex
+)
+
+// dockerClient returns a Docker API client using the highest API version
+// both it and the daemon support, unless DOCKER_API_VERSION pins a version.
+// It fails if the daemon cannot be reached to negotiate the version, rather
+// than guessing one that later calls would be checked against.
+func dockerClient(timeout time.Duration) (*client.Client, error) {
+	cli, err := client.NewEnvClient()
 	if err != nil {
 		return nil, err
 	}
-	return client.NewEnvClient()
+	if os.Getenv("DOCKER_API_VERSION") != "" {
+		return cli, nil
+	}
+
+	apiVersionsMu.Lock()
+	defer apiVersionsMu.Unlock()
+	version, ok := apiVersions[cli.DaemonHost()]
+	if !ok {
+		ctx, cancel := dockerContext(timeout)
+		defer cancel()
+		ping, err := cli.Ping(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot negotiate Docker API version with %s: %v", cli.DaemonHost(), err)
+		}
+		if ping.APIVersion == "" {
+			ping.APIVersion = minAPIVersion
+		}
+		cli.NegotiateAPIVersionPing(ping)
+		version = cli.ClientVersion()
+		apiVersions[cli.DaemonHost()] = version
+		log.Debugf("Using Docker API version %s with %s", version, cli.DaemonHost())
+	}
+	cli.NegotiateAPIVersionPing(types.Ping{APIVersion: version})
+	return cli, nil
+}
+
+// imageInspect inspects a local image
+func imageInspect(cli *client.Client, image string, timeout time.Duration) (types.ImageInspect, error) {
+	inspect, _, err := imageInspectVariant(cli, image, timeout)
+	return inspect, err
+}
+
+// imageInspectVariant inspects a local image, returning the variant of its
+// architecture too, which is empty if the daemon does not report it
+func imageInspectVariant(cli *client.Client, image string, timeout time.Duration) (types.ImageInspect, string, error) {
+	ctx, cancel := dockerContext(timeout)
+	defer cancel()
+	inspect, raw, err := cli.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return inspect, "", err
+	}
+	var variant struct {
+		Variant string
+	}
+	if err := json.Unmarshal(raw, &variant); err != nil {
+		return inspect, "", err
+	}
+	return inspect, variant.Variant, nil
 }
 
-func dockerInspectImage(cli *client.Client, ref *reference.Spec, trustedPull bool) (types.ImageInspect, error) {
+func dockerInspectImage(cli *client.Client, ref *reference.Spec, trustedPull bool, platform string, timeout time.Duration) (types.ImageInspect, error) {
 	log.Debugf("docker inspect image: %s", ref)
 
-	inspect, _, err := cli.ImageInspectWithRaw(context.Background(), ref.String())
+	inspect, err := imageInspect(cli, ref.String(), timeout)
 	if err != nil {
 		if client.IsErrNotFound(err) {
-			pullErr := dockerPull(ref, true, trustedPull)
+			pullErr := dockerPull(ref, true, trustedPull, platform, timeout)
 			if pullErr != nil {
 				return types.ImageInspect{}, pullErr
 			}
-			inspect, _, err = cli.ImageInspectWithRaw(context.Background(), ref.String())
+			inspect, err = imageInspect(cli, ref.String(), timeout)
 			if err != nil {
 				return types.ImageInspect{}, err
 			}
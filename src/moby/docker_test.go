@@ -0,0 +1,214 @@
+package moby
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api"
+)
+
+// fakeDocker puts a docker script that records its arguments first on the
+// PATH, returning a function that reads the recorded invocations
+func fakeDocker(t *testing.T, run string) func() []string {
+	dir, err := ioutil.TempDir("", "fake-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := filepath.Join(dir, "log")
+	script := `#!/bin/sh
+echo "$@" >> ` + log + `
+case "$1" in
+run)
+	while [ $# -gt 0 ]; do
+		if [ "$1" = "--cidfile" ]; then printf c0ffee > "$2"; fi
+		shift
+	done
+	` + run + `
+	;;
+esac
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	})
+	return func() []string {
+		b, _ := ioutil.ReadFile(log)
+		return strings.Split(strings.TrimSpace(string(b)), "\n")
+	}
+}
+
+func TestKeepFailedHelpers(t *testing.T) {
+	opts := &OutputOptions{KeepFailedHelpers: true}
+	calls := fakeDocker(t, "exit 1")
+	if err := dockerRun(opts, nil, new(bytes.Buffer), false, "helper"); err == nil {
+		t.Fatal("Expected failing helper to return an error")
+	}
+	for _, c := range calls() {
+		if strings.HasPrefix(c, "rm") {
+			t.Errorf("Expected failed helper container to be kept, got %q", c)
+		}
+		if strings.HasPrefix(c, "run") && strings.Contains(c, "--rm") {
+			t.Errorf("Expected helper to run without --rm, got %q", c)
+		}
+	}
+
+	calls = fakeDocker(t, "exit 0")
+	if err := dockerRun(opts, nil, new(bytes.Buffer), false, "helper"); err != nil {
+		t.Fatal(err)
+	}
+	got := calls()
+	if last := got[len(got)-1]; last != "rm c0ffee" {
+		t.Errorf("Expected successful helper container to be removed, got %q", last)
+	}
+}
+
+func TestHelperErrorOutput(t *testing.T) {
+	fakeDocker(t, `i=1; while [ $i -le 30 ]; do echo "line $i" >&2; i=$((i+1)); done; echo "mkimage: no space left on device" >&2; exit 1`)
+	err := dockerRun(&OutputOptions{}, nil, new(bytes.Buffer), false, "helper")
+	if err == nil {
+		t.Fatal("Expected failing helper to return an error")
+	}
+	if !strings.Contains(err.Error(), "mkimage: no space left on device") {
+		t.Errorf("Expected helper output in error, got %v", err)
+	}
+	if strings.Contains(err.Error(), "line 5\n") {
+		t.Errorf("Expected only the tail of the helper output in error, got %v", err)
+	}
+}
+
+func TestHelperLimits(t *testing.T) {
+	opts := &OutputOptions{HelperMemory: "2g", HelperCPUs: "1.5"}
+	calls := fakeDocker(t, "exit 0")
+	if err := dockerRun(opts, nil, new(bytes.Buffer), false, "helper", "arg"); err != nil {
+		t.Fatal(err)
+	}
+	got := calls()
+	if run := got[len(got)-1]; run != "run --network=none -i --rm --memory 2g --cpus 1.5 helper arg" {
+		t.Errorf("Expected limits on the helper container, got %q", run)
+	}
+}
+
+func TestHelperTimeout(t *testing.T) {
+	calls := fakeDocker(t, "exec sleep 5")
+	err := dockerRun(&OutputOptions{Timeout: 200 * time.Millisecond}, nil, new(bytes.Buffer), false, "helper")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Expected helper to time out, got %v", err)
+	}
+	got := calls()
+	if last := got[len(got)-1]; last != "rm -f c0ffee" {
+		t.Errorf("Expected timed out helper container to be removed, got %q", last)
+	}
+}
+
+func TestDockerClientNegotiatesVersion(t *testing.T) {
+	for _, tc := range []struct {
+		header, pinned, want string
+	}{
+		{header: "1.30", want: "1.30"},
+		{header: "1.99", want: api.DefaultVersion},
+		{want: minAPIVersion},
+		{header: "1.30", pinned: "1.25", want: "1.25"},
+	} {
+		pings := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/_ping" {
+				pings++
+				if tc.header != "" {
+					w.Header().Set("API-Version", tc.header)
+				}
+			}
+			w.Write([]byte("OK"))
+		}))
+		setenv(t, "DOCKER_HOST", "tcp://"+srv.Listener.Addr().String())
+		setenv(t, "DOCKER_API_VERSION", tc.pinned)
+
+		for i := 0; i < 2; i++ {
+			cli, err := dockerClient(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cli.ClientVersion(); got != tc.want {
+				t.Errorf("Expected API version %s for daemon version %q, got %s", tc.want, tc.header, got)
+			}
+		}
+		if tc.pinned == "" && pings != 1 {
+			t.Errorf("Expected the version to be negotiated once, got %d pings", pings)
+		}
+		srv.Close()
+	}
+
+	// a daemon that cannot be reached is an error, not the oldest version
+	srv := httptest.NewServer(http.NotFoundHandler())
+	setenv(t, "DOCKER_HOST", "tcp://"+srv.Listener.Addr().String())
+	setenv(t, "DOCKER_API_VERSION", "")
+	srv.Close()
+	if _, err := dockerClient(0); err == nil {
+		t.Error("Expected an error when the daemon cannot be reached")
+	}
+}
+
+// setenv sets an environment variable for the rest of a test, unsetting it
+// if value is empty, and restores it, or unsets it if it was unset, after
+func setenv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestRetryPull(t *testing.T) {
+	backoff := pullBackoff
+	pullBackoff = time.Millisecond
+	defer func() { pullBackoff = backoff }()
+
+	for _, tc := range []struct {
+		errs     []error
+		attempts int
+		fail     bool
+	}{
+		{errs: nil, attempts: 1},
+		{errs: []error{errors.New("Get https://registry/v2/: net/http: TLS handshake timeout")}, attempts: 2},
+		{errs: []error{errors.New("received unexpected HTTP status: 503 Service Unavailable"), errors.New("unexpected EOF")}, attempts: 3},
+		{errs: []error{errors.New("504 Gateway Timeout"), errors.New("502 Bad Gateway"), errors.New("500 Internal Server Error")}, attempts: 3, fail: true},
+		{errs: []error{errors.New("unauthorized: authentication required")}, attempts: 1, fail: true},
+		{errs: []error{errors.New("manifest for linuxkit/nope:v1 not found")}, attempts: 1, fail: true},
+		{errs: []error{errors.New("something else")}, attempts: 1, fail: true},
+	} {
+		attempts := 0
+		err := retryPull("linuxkit/test:v1", func() error {
+			attempts++
+			if attempts <= len(tc.errs) {
+				return tc.errs[attempts-1]
+			}
+			return nil
+		})
+		if attempts != tc.attempts {
+			t.Errorf("Expected %d attempts for %v, got %d", tc.attempts, tc.errs, attempts)
+		}
+		if (err != nil) != tc.fail {
+			t.Errorf("Expected failure %t for %v, got %v", tc.fail, tc.errs, err)
+		}
+	}
+}
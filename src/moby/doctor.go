@@ -0,0 +1,187 @@
+package moby
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+
+	"github.com/docker/docker/client"
+)
+
+// Check is a single check that the environment can build images. A failing
+// optional check is only reported as a warning, as it is only needed for
+// some output formats.
+type Check struct {
+	Name     string
+	Optional bool
+	Run      func() error
+}
+
+// DoctorChecks returns the checks for the tools and images the build uses
+func DoctorChecks() []Check {
+	checks := []Check{
+		{Name: "docker executable", Run: lookPath("docker")},
+		{Name: "Docker daemon reachable", Run: checkDocker},
+		{Name: "cache directory writable", Run: checkMobyDir},
+		{Name: "linuxkit executable", Optional: true, Run: lookPath("linuxkit")},
+		{Name: "qemu executable", Optional: true, Run: lookPath(qemuName())},
+	}
+	formats := []string{}
+	for format := range outputImages {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	for _, format := range formats {
+		image := outputImages[format]
+		checks = append(checks, Check{
+			Name:     fmt.Sprintf("%s helper image %s cached", format, image),
+			Optional: true,
+			Run:      func() error { return checkImage(image) },
+		})
+	}
+	return checks
+}
+
+// helperImageFormats maps the output formats that are made with the helper
+// image of another format to that format
+var helperImageFormats = map[string]string{
+	"kernel+squashfs": "squashfs",
+	"vagrant":         "vmdk",
+	"ova":             "vmdk",
+}
+
+// FormatChecks returns the checks that the output formats can be built in
+// this environment. Unlike ValidateFormats it has no side effects, so images
+// are not pulled and the LinuxKit helper images are not built. The options
+// are those the formats would be built with, and may be nil.
+func FormatChecks(formats []string, opts *OutputOptions) ([]Check, error) {
+	if opts == nil {
+		opts = &OutputOptions{}
+	}
+	checks := []Check{
+		{Name: "docker executable", Run: lookPath("docker")},
+		{Name: "Docker daemon reachable", Run: checkDocker},
+	}
+	seen := map[string]bool{}
+	add := func(c Check) {
+		if !seen[c.Name] {
+			seen[c.Name] = true
+			checks = append(checks, c)
+		}
+	}
+	for _, format := range formats {
+		if streamable[format] {
+			continue
+		}
+		if outFuns[format] == nil {
+			return nil, fmt.Errorf("Unknown format type %s", format)
+		}
+		helper := format
+		if f, ok := helperImageFormats[format]; ok {
+			helper = f
+		}
+		if image, ok := outputImages[helper]; ok {
+			add(Check{
+				Name:     fmt.Sprintf("%s helper image %s cached", format, image),
+				Optional: true,
+				Run:      func() error { return checkImage(image) },
+			})
+		}
+		if p := prereq[format]; p != "" {
+			add(Check{Name: "linuxkit executable", Run: lookPath("linuxkit")})
+			add(Check{Name: "qemu executable", Run: lookPath(qemuName())})
+			add(Check{
+				Name:     fmt.Sprintf("LinuxKit %s image built", p),
+				Optional: true,
+				Run:      checkLinuxkitImage(p),
+			})
+		}
+		if format == "qcow2-bios" && opts.QCOW2BackingFile != "" {
+			add(Check{Name: "qemu-img executable", Run: lookPath("qemu-img")})
+		}
+	}
+	return checks, nil
+}
+
+// RunChecks runs the checks writing a report to w, and returns false if any
+// required check failed
+func RunChecks(w io.Writer, checks []Check) bool {
+	ok := true
+	for _, c := range checks {
+		err := c.Run()
+		switch {
+		case err == nil:
+			fmt.Fprintf(w, "[PASS] %s\n", c.Name)
+		case c.Optional:
+			fmt.Fprintf(w, "[WARN] %s: %v\n", c.Name, err)
+		default:
+			fmt.Fprintf(w, "[FAIL] %s: %v\n", c.Name, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+func lookPath(name string) func() error {
+	return func() error {
+		_, err := exec.LookPath(name)
+		return err
+	}
+}
+
+func qemuName() string {
+	switch runtime.GOARCH {
+	case "arm64":
+		return "qemu-system-aarch64"
+	default:
+		return "qemu-system-x86_64"
+	}
+}
+
+func checkDocker() error {
+	cli, err := dockerClient(0)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := dockerContext(0)
+	defer cancel()
+	_, err = cli.Ping(ctx)
+	return err
+}
+
+func checkMobyDir() error {
+	if MobyDir == "" {
+		MobyDir = defaultMobyConfigDir()
+	}
+	f, err := ioutil.TempFile(MobyDir, "doctor")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func checkImage(image string) error {
+	cli, err := dockerClient(0)
+	if err != nil {
+		return err
+	}
+	_, err = imageInspect(cli, image, 0)
+	if client.IsErrNotFound(err) {
+		return fmt.Errorf("not found locally, it will be pulled when needed")
+	}
+	return err
+}
+
+func checkLinuxkitImage(name string) func() error {
+	return func() error {
+		if !linuxkitImageCached(name) {
+			return fmt.Errorf("not built, it will be built before the output which takes some time")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,83 @@
+package moby
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRunChecks(t *testing.T) {
+	pass := func() error { return nil }
+	fail := func() error { return errors.New("not found") }
+
+	buf := new(bytes.Buffer)
+	ok := RunChecks(buf, []Check{
+		{Name: "docker", Run: pass},
+		{Name: "linuxkit", Optional: true, Run: fail},
+	})
+	if !ok {
+		t.Error("Expected a failing optional check not to fail the report")
+	}
+	if !strings.Contains(buf.String(), "[PASS] docker") || !strings.Contains(buf.String(), "[WARN] linuxkit: not found") {
+		t.Errorf("Unexpected report:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	ok = RunChecks(buf, []Check{
+		{Name: "docker", Run: fail},
+		{Name: "cache", Run: pass},
+	})
+	if ok {
+		t.Error("Expected a failing required check to fail the report")
+	}
+	if !strings.Contains(buf.String(), "[FAIL] docker: not found") || !strings.Contains(buf.String(), "[PASS] cache") {
+		t.Errorf("Unexpected report:\n%s", buf.String())
+	}
+}
+
+func TestFormatChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	MobyDir = dir
+	defer func() { MobyDir = "" }()
+	// an empty PATH so that linuxkit cannot be found
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+
+	if _, err := FormatChecks([]string{"not-a-format"}, nil); err == nil {
+		t.Error("Expected an unknown format to be an error")
+	}
+
+	checks, err := FormatChecks([]string{"tar", "iso-bios", "qcow2-bios", "aws"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	var prereqs []Check
+	for _, c := range checks {
+		if names[c.Name] {
+			t.Errorf("Expected check %s once", c.Name)
+		}
+		names[c.Name] = true
+		if c.Name == "linuxkit executable" || strings.HasPrefix(c.Name, "LinuxKit ") {
+			prereqs = append(prereqs, c)
+		}
+	}
+	if !names["iso-bios helper image "+outputImages["iso-bios"]+" cached"] {
+		t.Errorf("Expected a check for the iso-bios helper image, got %v", names)
+	}
+
+	buf := new(bytes.Buffer)
+	if RunChecks(buf, prereqs) {
+		t.Error("Expected the missing linuxkit executable to fail")
+	}
+	if !strings.Contains(buf.String(), "[FAIL] linuxkit executable") || !strings.Contains(buf.String(), "[WARN] LinuxKit mkimage image built") {
+		t.Errorf("Unexpected report:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,84 @@
+package moby
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Estimates of the files open for each output format being generated, which
+// includes the attach streams of its helper container, for each image being
+// pulled, and for the rest of the build
+const (
+	fdsPerOutput = 32
+	fdsPerPull   = 16
+	fdsReserved  = 64
+)
+
+// fdsNeeded estimates the files open when jobs builds run at once, each
+// running n steps at a time that open per files each
+func fdsNeeded(jobs, n, per int) uint64 {
+	return uint64(fdsReserved + jobs*n*per)
+}
+
+// fitFdLimit reduces the number of outputs and pulls run at the same time
+// by each of jobs builds until their estimated open files fit in limit
+func fitFdLimit(limit uint64, jobs, outputs, pulls int) (int, int) {
+	for outputs > 1 && fdsNeeded(jobs, outputs, fdsPerOutput) > limit {
+		outputs--
+	}
+	for pulls > 1 && fdsNeeded(jobs, pulls, fdsPerPull) > limit {
+		pulls--
+	}
+	return outputs, pulls
+}
+
+// CheckFdLimit makes sure that jobs builds at once, each with ParallelOutputs
+// outputs and ParallelPulls pulls at the same time, will not run out of open
+// files. The soft limit is raised as far as the hard limit allows, and if
+// that is still too low ParallelOutputs and ParallelPulls are reduced.
+func CheckFdLimit(jobs int) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	soft, hard, err := fdLimit()
+	if err != nil {
+		log.Debugf("Cannot get the open file limit: %v", err)
+		return
+	}
+	if soft == 0 {
+		return
+	}
+	need := fdsNeeded(jobs, ParallelOutputs, fdsPerOutput)
+	if n := fdsNeeded(jobs, ParallelPulls, fdsPerPull); n > need {
+		need = n
+	}
+	if need <= soft {
+		return
+	}
+	raise := need
+	if raise > hard {
+		raise = hard
+	}
+	if raise > soft {
+		if err := setFdLimit(raise); err != nil {
+			log.Debugf("Cannot raise the open file limit to %d: %v", raise, err)
+		} else {
+			log.Debugf("Raised the open file limit from %d to %d", soft, raise)
+			soft = raise
+		}
+	}
+	if need <= soft {
+		return
+	}
+
+	outputs, pulls := fitFdLimit(soft, jobs, ParallelOutputs, ParallelPulls)
+	if outputs != ParallelOutputs || pulls != ParallelPulls {
+		log.Warnf("The open file limit of %d is too low to generate %d outputs and pull %d images at the same time, using %d and %d", soft, ParallelOutputs, ParallelPulls, outputs, pulls)
+		ParallelOutputs, ParallelPulls = outputs, pulls
+		if ParallelHeavyOutputs > outputs {
+			ParallelHeavyOutputs = outputs
+		}
+	}
+	if fdsNeeded(jobs, outputs, fdsPerOutput) > soft || fdsNeeded(jobs, pulls, fdsPerPull) > soft {
+		log.Warnf("The open file limit of %d may be too low for the build, raise it with ulimit -n", soft)
+	}
+}
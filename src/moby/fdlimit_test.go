@@ -0,0 +1,30 @@
+package moby
+
+import (
+	"testing"
+)
+
+func TestFitFdLimit(t *testing.T) {
+	outputs, pulls := fitFdLimit(4096, 1, 4, 4)
+	if outputs != 4 || pulls != 4 {
+		t.Errorf("Expected a high limit to keep 4 outputs and pulls, got %d and %d", outputs, pulls)
+	}
+
+	outputs, pulls = fitFdLimit(128, 1, 4, 4)
+	if outputs != 2 || pulls != 4 {
+		t.Errorf("Expected a limit of 128 to reduce to 2 outputs and 4 pulls, got %d and %d", outputs, pulls)
+	}
+	if fdsNeeded(1, outputs, fdsPerOutput) > 128 || fdsNeeded(1, pulls, fdsPerPull) > 128 {
+		t.Errorf("Expected the reduced concurrency to fit in the limit")
+	}
+
+	outputs, pulls = fitFdLimit(256, 4, 4, 4)
+	if outputs != 1 || pulls != 3 {
+		t.Errorf("Expected 4 jobs with a limit of 256 to reduce to 1 output and 3 pulls, got %d and %d", outputs, pulls)
+	}
+
+	outputs, pulls = fitFdLimit(16, 1, 4, 4)
+	if outputs != 1 || pulls != 1 {
+		t.Errorf("Expected concurrency not to go below 1, got %d and %d", outputs, pulls)
+	}
+}
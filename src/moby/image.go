@@ -8,7 +8,10 @@ import (
 	"io"
 	"io/ioutil"
 	"path"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/containerd/containerd/reference"
 	"github.com/opencontainers/runtime-spec/specs-go"
@@ -22,9 +25,9 @@ type tarWriter interface {
 	WriteHeader(hdr *tar.Header) error
 }
 
-// This uses Docker to convert a Docker image into a tarball. It would be an improvement if we
-// used the containerd libraries to do this instead locally direct from a local image
-// cache as it would be much simpler.
+// This uses Docker to convert a Docker image into a tarball, unless the image is pinned by
+// digest and in the local containerd content store set by ContentStore, when its layers are
+// flattened directly, see content.go.
 
 // Unfortunately there are some files that Docker always makes appear in a running image and
 // export shows them. In particular we have no way for a user to specify their own resolv.conf.
@@ -53,6 +56,110 @@ ff02::2 ip6-allrouters
 `,
 }
 
+// TargetArch is the architecture the image is built for, every image used must
+// be for this architecture. If empty the architecture is not checked.
+var TargetArch = runtime.GOARCH
+
+// imageArch returns the architecture of a local image
+var imageArch = archOf
+
+func archOf(ref *reference.Spec, timeout time.Duration) (string, error) {
+	cli, err := dockerClient(timeout)
+	if err != nil {
+		return "", err
+	}
+	inspect, err := imageInspect(cli, ref.String(), timeout)
+	if err != nil {
+		return "", err
+	}
+	return inspect.Architecture, nil
+}
+
+// checkArch checks that an image is for the target architecture arch, any
+// architecture if it is empty
+func checkArch(ref *reference.Spec, arch string, timeout time.Duration) error {
+	if arch == "" {
+		return nil
+	}
+	imgArch, err := imageArch(ref, timeout)
+	if err != nil {
+		return fmt.Errorf("Cannot get architecture of image %s: %v", ref, err)
+	}
+	return matchArch(ref, imgArch, arch)
+}
+
+// matchArch checks that imgArch, the architecture of an image, is the target
+// architecture arch. Either may be empty if it is not known.
+func matchArch(ref *reference.Spec, imgArch, arch string) error {
+	if arch != "" && imgArch != "" && imgArch != arch {
+		return fmt.Errorf("Image %s is for %s, not the target architecture %s", ref, imgArch, arch)
+	}
+	return nil
+}
+
+// OwnerRemap changes the ownership of every file extracted from the images,
+// if nil the ownership in the images is kept
+var OwnerRemap *IDRemap
+
+// IDRemap is a blanket change to the ownership of files, either adding an
+// offset to the uid and gid or setting them to a fixed uid and gid
+type IDRemap struct {
+	Offset int
+	UID    int
+	GID    int
+}
+
+// ParseIDRemap parses a remap given as +offset or uid:gid
+func ParseIDRemap(s string) (*IDRemap, error) {
+	if strings.HasPrefix(s, "+") {
+		offset, err := strconv.Atoi(s[1:])
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("Invalid ownership offset: %s", s)
+		}
+		return &IDRemap{Offset: offset, UID: -1, GID: -1}, nil
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Ownership remap must be +offset or uid:gid: %s", s)
+	}
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil || uid < 0 {
+		return nil, fmt.Errorf("Invalid uid in ownership remap: %s", s)
+	}
+	gid, err := strconv.Atoi(parts[1])
+	if err != nil || gid < 0 {
+		return nil, fmt.Errorf("Invalid gid in ownership remap: %s", s)
+	}
+	return &IDRemap{UID: uid, GID: gid}, nil
+}
+
+func (r IDRemap) apply(hdr *tar.Header) {
+	if r.UID >= 0 {
+		hdr.Uid = r.UID
+	} else {
+		hdr.Uid += r.Offset
+	}
+	if r.GID >= 0 {
+		hdr.Gid = r.GID
+	} else {
+		hdr.Gid += r.Offset
+	}
+	// the names may not exist in the image for the new ids
+	hdr.Uname = ""
+	hdr.Gname = ""
+}
+
+// remapWriter applies an ownership remap to each header written
+type remapWriter struct {
+	tarWriter
+	remap IDRemap
+}
+
+func (w remapWriter) WriteHeader(hdr *tar.Header) error {
+	w.remap.apply(hdr)
+	return w.tarWriter.WriteHeader(hdr)
+}
+
 // tarPrefix creates the leading directories for a path
 func tarPrefix(path string, tw tarWriter) error {
 	if path == "" {
@@ -83,54 +190,44 @@ func tarPrefix(path string, tw tarWriter) error {
 }
 
 // ImageTar takes a Docker image and outputs it to a tar stream
-func ImageTar(ref *reference.Spec, prefix string, tw tarWriter, trust bool, pull bool, resolv string) (e error) {
+func ImageTar(ref *reference.Spec, prefix string, tw tarWriter, trust bool, pull PullPolicy, resolv string, files *ImageFilesConfig) error {
+	return imageTar(ref, prefix, tw, trust, pull, resolv, files, globalOptions())
+}
+
+func imageTar(ref *reference.Spec, prefix string, tw tarWriter, trust bool, pull PullPolicy, resolv string, files *ImageFilesConfig, opts *buildOptions) (e error) {
 	log.Debugf("image tar: %s %s", ref, prefix)
 	if prefix != "" && prefix[len(prefix)-1] != byte('/') {
 		return fmt.Errorf("prefix does not end with /: %s", prefix)
 	}
+	if opts.remap != nil {
+		tw = remapWriter{tarWriter: tw, remap: *opts.remap}
+	}
 
 	err := tarPrefix(prefix, tw)
 	if err != nil {
 		return err
 	}
 
-	if pull || trust {
-		err := dockerPull(ref, pull, trust)
-		if err != nil {
-			return fmt.Errorf("Could not pull image %s: %v", ref, err)
-		}
-	}
-	container, err := dockerCreate(ref.String())
+	contents, fromStore, err := storeExport(ref, opts)
 	if err != nil {
-		// if the image wasn't found, pull it down.  Bail on other errors.
-		if strings.Contains(err.Error(), "No such image") {
-			err := dockerPull(ref, true, trust)
-			if err != nil {
-				return fmt.Errorf("Could not pull image %s: %v", ref, err)
-			}
-			container, err = dockerCreate(ref.String())
-			if err != nil {
-				return fmt.Errorf("Failed to docker create image %s: %v", ref, err)
-			}
-		} else {
-			return fmt.Errorf("Failed to create docker image %s: %v", ref, err)
-		}
+		return fmt.Errorf("Cannot read image %s from the content store: %v", ref, err)
 	}
-	contents, err := dockerExport(container)
-	if err != nil {
-		return fmt.Errorf("Failed to docker export container from container %s: %v", container, err)
+	if !fromStore {
+		contents, err = containerExport(ref, trust, pull, opts)
+		if err != nil {
+			return err
+		}
 	}
 	defer func() {
-		contents.Close()
-
-		if err := dockerRm(container); e == nil && err != nil {
-			e = fmt.Errorf("Failed to docker rm container %s: %v", container, err)
+		if err := contents.Close(); e == nil && err != nil {
+			e = err
 		}
 	}()
 
 	// now we need to filter out some files from the resulting tar archive
 
 	tr := tar.NewReader(contents)
+	filter := newFileFilter(files)
 
 	for {
 		hdr, err := tr.Next()
@@ -140,36 +237,37 @@ func ImageTar(ref *reference.Spec, prefix string, tw tarWriter, trust bool, pull
 		if err != nil {
 			return err
 		}
-		if exclude[hdr.Name] {
+		if filter.excluded(hdr.Name) {
 			log.Debugf("image tar: %s %s exclude %s", ref, prefix, hdr.Name)
 			_, err = io.Copy(ioutil.Discard, tr)
 			if err != nil {
 				return err
 			}
-		} else if replace[hdr.Name] != "" {
-			if hdr.Name != "etc/resolv.conf" || resolv == "" {
-				contents := replace[hdr.Name]
-				hdr.Size = int64(len(contents))
-				hdr.Name = prefix + hdr.Name
-				log.Debugf("image tar: %s %s add %s", ref, prefix, hdr.Name)
-				if err := tw.WriteHeader(hdr); err != nil {
-					return err
-				}
-				buf := bytes.NewBufferString(contents)
-				_, err = io.Copy(tw, buf)
-				if err != nil {
-					return err
-				}
-			} else {
-				// replace resolv.conf with specified symlink
-				hdr.Name = prefix + hdr.Name
-				hdr.Size = 0
-				hdr.Typeflag = tar.TypeSymlink
-				hdr.Linkname = resolv
-				log.Debugf("image tar: %s %s add resolv symlink /etc/resolv.conf -> %s", ref, prefix, resolv)
-				if err := tw.WriteHeader(hdr); err != nil {
-					return err
-				}
+		} else if hdr.Name == "etc/resolv.conf" && resolv != "" && !filter.replaced[hdr.Name] {
+			// replace resolv.conf with specified symlink
+			hdr.Name = prefix + hdr.Name
+			hdr.Size = 0
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = resolv
+			log.Debugf("image tar: %s %s add resolv symlink /etc/resolv.conf -> %s", ref, prefix, resolv)
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err = io.Copy(ioutil.Discard, tr)
+			if err != nil {
+				return err
+			}
+		} else if contents, ok := filter.replace[hdr.Name]; ok {
+			hdr.Size = int64(len(contents))
+			hdr.Name = prefix + hdr.Name
+			log.Debugf("image tar: %s %s add %s", ref, prefix, hdr.Name)
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			buf := bytes.NewBufferString(contents)
+			_, err = io.Copy(tw, buf)
+			if err != nil {
+				return err
 			}
 			_, err = io.Copy(ioutil.Discard, tr)
 			if err != nil {
@@ -194,8 +292,119 @@ func ImageTar(ref *reference.Spec, prefix string, tw tarWriter, trust bool, pull
 	return nil
 }
 
+// fileFilter is the files removed from and replaced in an image
+type fileFilter struct {
+	exclude map[string]bool
+	// trees are excluded paths that everything under is excluded too
+	trees    []string
+	replace  map[string]string
+	replaced map[string]bool
+}
+
+// newFileFilter combines the default exclude and replace lists with the config
+func newFileFilter(files *ImageFilesConfig) fileFilter {
+	f := fileFilter{
+		exclude:  map[string]bool{},
+		replace:  map[string]string{},
+		replaced: map[string]bool{},
+	}
+	for k := range exclude {
+		f.exclude[k] = true
+	}
+	if files == nil || files.Defaults == nil || *files.Defaults {
+		for k, v := range replace {
+			f.replace[k] = v
+		}
+	}
+	if files == nil {
+		return f
+	}
+	for _, p := range files.Exclude {
+		f.trees = append(f.trees, cleanName(p))
+	}
+	for k, v := range files.Replace {
+		k = cleanName(k)
+		f.replace[k] = v
+		f.replaced[k] = true
+	}
+	return f
+}
+
+func (f fileFilter) excluded(name string) bool {
+	if f.exclude[name] {
+		return true
+	}
+	name = strings.TrimSuffix(name, "/")
+	for _, t := range f.trees {
+		if name == t || strings.HasPrefix(name, t+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// containerExport exports the filesystem of an image by creating a container
+// from it, which is removed when the returned stream is closed. The image is
+// only pulled if it is missing, as a build has already pulled the images it
+// uses as the pull policy says.
+func containerExport(ref *reference.Spec, trust bool, pull PullPolicy, opts *buildOptions) (io.ReadCloser, error) {
+	container, err := dockerCreate(ref.String(), opts.timeout)
+	if err != nil {
+		// if the image wasn't found, pull it down.  Bail on other errors.
+		if strings.Contains(err.Error(), "No such image") {
+			if pull == PullNever {
+				return nil, fmt.Errorf("Image %s is not available locally and the pull policy is never", ref)
+			}
+			err := dockerPull(ref, true, trust, opts.platform, opts.timeout)
+			if err != nil {
+				return nil, fmt.Errorf("Could not pull image %s: %v", ref, err)
+			}
+			container, err = dockerCreate(ref.String(), opts.timeout)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to docker create image %s: %v", ref, err)
+			}
+		} else {
+			return nil, fmt.Errorf("Failed to create docker image %s: %v", ref, err)
+		}
+	}
+	if err := checkArch(ref, opts.arch, opts.timeout); err != nil {
+		if rmErr := dockerRm(container, opts.timeout); rmErr != nil {
+			log.Debugf("Failed to remove container %s: %v", container, rmErr)
+		}
+		return nil, err
+	}
+	contents, err := dockerExport(container, opts.timeout)
+	if err != nil {
+		if rmErr := dockerRm(container, opts.timeout); rmErr != nil {
+			log.Debugf("Failed to remove container %s: %v", container, rmErr)
+		}
+		return nil, fmt.Errorf("Failed to docker export container from container %s: %v", container, err)
+	}
+	return containerStream{ReadCloser: contents, container: container, timeout: opts.timeout}, nil
+}
+
+// containerStream is the exported filesystem of a container, which removes
+// the container when closed
+type containerStream struct {
+	io.ReadCloser
+	container string
+	timeout   time.Duration
+}
+
+func (c containerStream) Close() error {
+	c.ReadCloser.Close()
+	if err := dockerRm(c.container, c.timeout); err != nil {
+		return fmt.Errorf("Failed to docker rm container %s: %v", c.container, err)
+	}
+	return nil
+}
+
 // ImageBundle produces an OCI bundle at the given path in a tarball, given an image and a config.json
-func ImageBundle(prefix string, ref *reference.Spec, config []byte, runtime Runtime, tw tarWriter, trust bool, pull bool, readonly bool, dupMap map[string]string) error { // nolint: lll
+func ImageBundle(prefix string, ref *reference.Spec, config []byte, runtime Runtime, tw tarWriter, trust bool, pull PullPolicy, readonly bool, dupMap map[string]string, files *ImageFilesConfig) error { // nolint: lll
+	return imageBundle(prefix, ref, config, runtime, tw, trust, pull, readonly, dupMap, files, globalOptions())
+}
+
+func imageBundle(prefix string, ref *reference.Spec, config []byte, runtime Runtime, tw tarWriter, trust bool, pull PullPolicy, readonly bool, dupMap map[string]string, files *ImageFilesConfig, opts *buildOptions) error { // nolint: lll
 	// if read only, just unpack in rootfs/ but otherwise set up for overlay
 	rootExtract := "rootfs"
 	if !readonly {
@@ -206,7 +415,7 @@ func ImageBundle(prefix string, ref *reference.Spec, config []byte, runtime Runt
 	root := path.Join(prefix, rootExtract)
 	var foundElsewhere = dupMap[ref.String()] != ""
 	if !foundElsewhere {
-		if err := ImageTar(ref, root+"/", tw, trust, pull, ""); err != nil {
+		if err := imageTar(ref, root+"/", tw, trust, pull, "", files, opts); err != nil {
 			return err
 		}
 		dupMap[ref.String()] = root
@@ -0,0 +1,207 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestCheckArch(t *testing.T) {
+	imageArch = func(ref *reference.Spec, timeout time.Duration) (string, error) {
+		if strings.Contains(ref.Locator, "amd64only") {
+			return "amd64", nil
+		}
+		return "arm64", nil
+	}
+	defer func() { imageArch = archOf }()
+	ok, err := reference.Parse("docker.io/linuxkit/getty:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkArch(&ok, "arm64", 0); err != nil {
+		t.Errorf("Expected arm64 image to be accepted: %v", err)
+	}
+
+	bad, err := reference.Parse("docker.io/example/amd64only:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkArch(&bad, "arm64", 0)
+	if err == nil || !strings.Contains(err.Error(), "is for amd64, not the target architecture arm64") {
+		t.Errorf("Expected amd64 image to be rejected, got %v", err)
+	}
+
+	if err := checkArch(&bad, "", 0); err != nil {
+		t.Errorf("Expected no check without a target architecture: %v", err)
+	}
+}
+
+func TestOwnerRemap(t *testing.T) {
+	testCases := []struct {
+		remap string
+		// ownership expected for the prefix directories, owned by 0:0, and a file owned by 0:50
+		prefix [2]int
+		file   [2]int
+	}{
+		{"+100000", [2]int{100000, 100000}, [2]int{100000, 100050}},
+		{"1000:1001", [2]int{1000, 1001}, [2]int{1000, 1001}},
+	}
+	for _, tc := range testCases {
+		remap, err := ParseIDRemap(tc.remap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		tw := remapWriter{tarWriter: tar.NewWriter(buf), remap: *remap}
+		if err := tarPrefix("containers/services/", tw); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: "containers/services/etc", Typeflag: tar.TypeDir, Mode: 0755, Gid: 50, Uname: "root"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		tr := tar.NewReader(buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := tc.prefix
+			if hdr.Name == "containers/services/etc" {
+				expected = tc.file
+			}
+			if hdr.Uid != expected[0] || hdr.Gid != expected[1] || hdr.Uname != "" {
+				t.Errorf("Expected %s owned by %d:%d with %s, got %d:%d %q", hdr.Name, expected[0], expected[1], tc.remap, hdr.Uid, hdr.Gid, hdr.Uname)
+			}
+		}
+	}
+
+	for _, bad := range []string{"100", "+x", "-1:0", "1:2:3"} {
+		if _, err := ParseIDRemap(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestFileFilter(t *testing.T) {
+	f := newFileFilter(nil)
+	if !f.excluded("etc/hostname") || f.excluded("usr/share/doc/x") {
+		t.Errorf("Expected only the default exclusions without a config")
+	}
+	if f.replace["etc/hosts"] != replace["etc/hosts"] {
+		t.Errorf("Expected the default etc/hosts without a config")
+	}
+
+	defaults := false
+	f = newFileFilter(&ImageFilesConfig{
+		Exclude:  []string{"/usr/share/doc/"},
+		Replace:  map[string]string{"/etc/motd": "hello\n"},
+		Defaults: &defaults,
+	})
+	for _, name := range []string{"etc/hostname", "usr/share/doc", "usr/share/doc/", "usr/share/doc/x/y"} {
+		if !f.excluded(name) {
+			t.Errorf("Expected %s to be excluded", name)
+		}
+	}
+	if f.excluded("usr/share/docs") {
+		t.Errorf("Expected usr/share/docs not to be excluded")
+	}
+	if f.replace["etc/motd"] != "hello\n" || !f.replaced["etc/motd"] {
+		t.Errorf("Expected etc/motd to be replaced, got %q", f.replace["etc/motd"])
+	}
+	for _, name := range []string{"etc/hosts", "etc/resolv.conf"} {
+		if _, ok := f.replace[name]; ok {
+			t.Errorf("Expected %s not to be replaced with defaults false", name)
+		}
+	}
+}
+
+func TestImageTarStreams(t *testing.T) {
+	store, err := ioutil.TempDir("", "content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(store)
+
+	writeBlob := func(write func(io.Writer) error) digest.Digest {
+		tmp := filepath.Join(store, "blob")
+		f, err := os.Create(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digester := digest.Canonical.Digester()
+		if err := write(io.MultiWriter(f, digester.Hash())); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		dgst := digester.Digest()
+		if err := os.MkdirAll(filepath.Dir(blobPath(store, dgst)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, blobPath(store, dgst)); err != nil {
+			t.Fatal(err)
+		}
+		return dgst
+	}
+	writeJSON := func(v interface{}) digest.Digest {
+		return writeBlob(func(w io.Writer) error { return json.NewEncoder(w).Encode(v) })
+	}
+
+	// an image with a large file, written without holding it in memory
+	const size = 64 << 20
+	layer := writeBlob(func(w io.Writer) error {
+		tw := tar.NewWriter(w)
+		if err := tw.WriteHeader(&tar.Header{Name: "big", Typeflag: tar.TypeReg, Mode: 0644, Size: size}); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(tw, zeroReader{}, size); err != nil {
+			return err
+		}
+		return tw.Close()
+	})
+	manifest := writeJSON(ocispec.Manifest{
+		Config: ocispec.Descriptor{Digest: writeJSON(ocispec.Image{OS: "linux"})},
+		Layers: []ocispec.Descriptor{{Digest: layer}},
+	})
+
+	ContentStore = store
+	defer func() { ContentStore = "" }()
+	ref, err := reference.Parse("docker.io/linuxkit/big@" + manifest.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	tw := tar.NewWriter(ioutil.Discard)
+	if err := ImageTar(&ref, "containers/big/", tw, false, PullMissing, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > size/4 {
+		t.Errorf("Expected the image to be streamed, allocated %d bytes", alloc)
+	}
+}
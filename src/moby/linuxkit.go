@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -29,40 +30,152 @@ trust:
     - linuxkit
 `}
 
+// imageFilename is the base name of the cached LinuxKit helper image, named
+// from the config and the options it is built with
 func imageFilename(name string) string {
 	yaml := linuxkitYaml[name]
-	hash := sha256.Sum256([]byte(yaml))
+	hash := sha256.Sum256([]byte(yaml + "\n" + hostOptions().key()))
 	return filepath.Join(MobyDir, "linuxkit", name+"-"+fmt.Sprintf("%x", hash))
 }
 
-func ensureLinuxkitImage(name string) error {
+// runQemuImg runs qemu-img with the given arguments
+var runQemuImg = qemuImg
+
+func qemuImg(args ...string) error {
+	path, err := exec.LookPath("qemu-img")
+	if err != nil {
+		return fmt.Errorf("Cannot find qemu-img executable, needed for a qcow2 backing file: %v", err)
+	}
+	log.Debugf("run %s: %v", path, args)
+	cmd := exec.Command(path, args...)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// rebaseQcow2 rewrites a standalone qcow2 image as an overlay on backing,
+// copying it with qemu-img convert, which leaves out the clusters that are
+// the same in the backing file, so that the overlay only holds those that
+// differ
+func rebaseQcow2(filename, backing string) error {
+	if _, err := os.Stat(backing); err != nil {
+		return fmt.Errorf("Cannot use qcow2 backing file: %v", err)
+	}
+	abs, err := filepath.Abs(backing)
+	if err != nil {
+		return err
+	}
+	overlay := filename + ".overlay"
+	if err := runQemuImg("convert", "-f", "qcow2", "-O", "qcow2", "-B", abs, "-F", "qcow2", filename, overlay); err != nil {
+		os.Remove(overlay)
+		return err
+	}
+	return os.Rename(overlay, filename)
+}
+
+// NoCache rebuilds the LinuxKit helper images even if they are already cached
+var NoCache bool
+
+// LinuxkitPull is when the images of a LinuxKit helper image are pulled
+// when it is built, which is the pull policy of the build using it
+var LinuxkitPull = PullMissing
+
+// buildLinuxkitImage builds the named LinuxKit helper image to files named from filename
+var buildLinuxkitImage = buildLinuxkitKernelInitrd
+
+// linuxkitImageCached reports whether the named LinuxKit helper image has been built
+func linuxkitImageCached(name string) bool {
 	filename := imageFilename(name)
 	_, err1 := os.Stat(filename + "-kernel")
 	_, err2 := os.Stat(filename + "-initrd.img")
 	_, err3 := os.Stat(filename + "-cmdline")
-	if err1 == nil && err2 == nil && err3 == nil {
+	return err1 == nil && err2 == nil && err3 == nil
+}
+
+// linuxkitImages is the result of making each helper image available, keyed
+// by its file name, which is only done once by a process, as the formats
+// that use a helper can run at the same time and -no-cache would otherwise
+// rebuild it for each
+var (
+	linuxkitImages   = map[string]*linuxkitImage{}
+	linuxkitImagesMu sync.Mutex
+)
+
+type linuxkitImage struct {
+	once sync.Once
+	err  error
+}
+
+// ensureLinuxkitImage makes sure the named helper image is cached, building
+// it if needed. A failure is not kept, so a later call tries again.
+func ensureLinuxkitImage(name string) error {
+	filename := imageFilename(name)
+	linuxkitImagesMu.Lock()
+	image, ok := linuxkitImages[filename]
+	if !ok {
+		image = &linuxkitImage{}
+		linuxkitImages[filename] = image
+	}
+	linuxkitImagesMu.Unlock()
+
+	image.once.Do(func() {
+		image.err = makeLinuxkitImage(name)
+	})
+	if image.err != nil {
+		linuxkitImagesMu.Lock()
+		if linuxkitImages[filename] == image {
+			delete(linuxkitImages, filename)
+		}
+		linuxkitImagesMu.Unlock()
+	}
+	return image.err
+}
+
+func makeLinuxkitImage(name string) error {
+	filename := imageFilename(name)
+	if linuxkitImageCached(name) && !NoCache {
 		return nil
 	}
 	err := os.MkdirAll(filepath.Join(MobyDir, "linuxkit"), 0755)
 	if err != nil {
 		return err
 	}
-	// TODO clean up old files
+	if RemoteCache != "" && !NoCache {
+		fetched, err := fetchRemoteCache(name)
+		if err != nil {
+			log.Warnf("Cannot fetch LinuxKit image %s from remote cache, building it: %v", name, err)
+		} else if fetched {
+			return nil
+		}
+	}
 	log.Infof("Building LinuxKit image %s to generate output formats", name)
+	if err := buildLinuxkitImage(name, filename); err != nil {
+		return err
+	}
+	if RemoteCache != "" {
+		if err := pushRemoteCache(name); err != nil {
+			log.Warnf("Cannot push LinuxKit image %s to remote cache: %v", name, err)
+		}
+	}
+	return nil
+}
 
+func buildLinuxkitKernelInitrd(name, filename string) error {
 	yaml := linuxkitYaml[name]
 
 	m, err := NewConfig([]byte(yaml))
 	if err != nil {
 		return err
 	}
-	// TODO pass through --pull to here
+	// the helper is cached for every build, so none of the options of this one apply
+	m.opts = hostOptions()
 	tf, err := ioutil.TempFile("", "")
 	if err != nil {
 		return err
 	}
 	defer os.Remove(tf.Name())
-	Build(m, tf, false, "")
+	if err := Build(m, tf, LinuxkitPull, ""); err != nil {
+		return err
+	}
 	if err := tf.Close(); err != nil {
 		return err
 	}
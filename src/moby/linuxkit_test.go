@@ -0,0 +1,153 @@
+package moby
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEnsureLinuxkitImageNoCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	MobyDir = dir
+	defer func() { MobyDir = "" }()
+
+	var builds int32
+	buildLinuxkitImage = func(name, filename string) error {
+		atomic.AddInt32(&builds, 1)
+		return writeKernelInitrd(filename, []byte("kernel"), []byte("initrd"), "console=ttyS0")
+	}
+	defer func() { buildLinuxkitImage = buildLinuxkitKernelInitrd }()
+	resetLinuxkitImages := func() {
+		linuxkitImagesMu.Lock()
+		linuxkitImages = map[string]*linuxkitImage{}
+		linuxkitImagesMu.Unlock()
+	}
+	resetLinuxkitImages()
+	defer resetLinuxkitImages()
+
+	for i := 0; i < 2; i++ {
+		if err := ensureLinuxkitImage("mkimage"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if builds != 1 {
+		t.Errorf("Expected the cached image to be reused, built %d times", builds)
+	}
+
+	// a new build with -no-cache rebuilds the image once, however many
+	// formats use it at the same time
+	resetLinuxkitImages()
+	NoCache = true
+	defer func() { NoCache = false }()
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = ensureLinuxkitImage("mkimage")
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if builds != 2 {
+		t.Errorf("Expected -no-cache to rebuild the cached image once, built %d times", builds)
+	}
+}
+
+func TestEnsureLinuxkitImageKeepsOthers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	MobyDir = dir
+	defer func() { MobyDir = "" }()
+
+	buildLinuxkitImage = func(name, filename string) error {
+		return writeKernelInitrd(filename, []byte("kernel"), []byte("initrd"), "console=ttyS0")
+	}
+	defer func() { buildLinuxkitImage = buildLinuxkitKernelInitrd }()
+
+	// the helper of another version of moby sharing the cache directory
+	other := filepath.Join(dir, "linuxkit", "mkimage-"+strings.Repeat("0", 64))
+	if err := os.MkdirAll(filepath.Dir(other), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKernelInitrd(other, []byte("kernel"), []byte("initrd"), "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureLinuxkitImage("mkimage"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(other + "-kernel"); err != nil {
+		t.Errorf("Expected a build to keep the helpers of other versions: %v", err)
+	}
+}
+
+func TestRebaseQcow2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backing := filepath.Join(dir, "golden.qcow2")
+	if err := rebaseQcow2(filepath.Join(dir, "test.qcow2"), backing); err == nil {
+		t.Error("Expected a missing backing file to be rejected")
+	}
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("qemu-img is not installed")
+	}
+
+	// the image differs from the backing file in its first MiB
+	data := make([]byte, 16<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	raw := filepath.Join(dir, "disk.raw")
+	if err := ioutil.WriteFile(raw, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runQemuImg("convert", "-f", "raw", "-O", "qcow2", raw, backing); err != nil {
+		t.Fatal(err)
+	}
+	rand.New(rand.NewSource(2)).Read(data[:1<<20])
+	if err := ioutil.WriteFile(raw, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(dir, "test.qcow2")
+	if err := runQemuImg("convert", "-f", "raw", "-O", "qcow2", raw, image); err != nil {
+		t.Fatal(err)
+	}
+	standalone, err := os.Stat(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rebaseQcow2(image, backing); err != nil {
+		t.Fatal(err)
+	}
+	overlay, err := os.Stat(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overlay.Size() >= standalone.Size()/4 {
+		t.Errorf("Expected the overlay to leave out the clusters in the backing file, got %d bytes from %d", overlay.Size(), standalone.Size())
+	}
+	if _, err := os.Stat(image + ".overlay"); !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary overlay to be renamed, got %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package moby
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	distref "github.com/docker/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Lockfile maps image references to the content digests they are locked to
+type Lockfile map[string]string
+
+// ParseLockfile parses a lockfile, a YAML map from image reference to digest
+func ParseLockfile(b []byte) (Lockfile, error) {
+	raw := Lockfile{}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("Cannot parse lockfile: %v", err)
+	}
+	lock := Lockfile{}
+	for image, d := range raw {
+		key, err := lockKey(image)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid image %s in lockfile: %v", image, err)
+		}
+		if _, err := digest.Parse(d); err != nil {
+			return nil, fmt.Errorf("Invalid digest for %s in lockfile: %v", image, err)
+		}
+		lock[key] = d
+	}
+	return lock, nil
+}
+
+// lockKey normalizes an image reference, so that "linuxkit/getty:v1" and
+// "docker.io/linuxkit/getty:v1" are the same entry in a lockfile
+func lockKey(image string) (string, error) {
+	named, err := distref.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", err
+	}
+	return distref.TagNameOnly(named).String(), nil
+}
+
+// ApplyLockfile pins every image in the config that is in the lockfile to its
+// locked digest. If frozen is set, it is an error for an image that is not
+// already pinned to a digest to be missing from the lockfile.
+func ApplyLockfile(m *Moby, lock Lockfile, frozen bool) error {
+	refs := imageRefs(*m)
+
+	missing := map[string]bool{}
+	for _, ref := range refs {
+		if ref.Digest() != "" {
+			continue
+		}
+		key, err := lockKey(ref.String())
+		if err != nil {
+			return err
+		}
+		d, ok := lock[key]
+		if !ok {
+			missing[ref.String()] = true
+			continue
+		}
+		ref.Object = ref.Object + "@" + d
+	}
+	updateImages(m)
+
+	if frozen && len(missing) != 0 {
+		var images []string
+		for image := range missing {
+			images = append(images, image)
+		}
+		sort.Strings(images)
+		return fmt.Errorf("Images not in lockfile: %s", strings.Join(images, ", "))
+	}
+	return nil
+}
+
+// imageDigest returns the registry digest of a local image, or "" if it
+// has none, such as an image that was built locally
+var imageDigest = lookupImageDigest
+
+func lookupImageDigest(ref *reference.Spec, timeout time.Duration) (string, error) {
+	cli, err := dockerClient(timeout)
+	if err != nil {
+		return "", err
+	}
+	inspect, err := imageInspect(cli, ref.String(), timeout)
+	if err != nil {
+		return "", err
+	}
+	return repoDigest(inspect, ref), nil
+}
+
+// LockImages returns a lockfile with the digest of every image in the config
+// that is referenced by tag. Images pinned in the config, or by a lockfile
+// applied to it, keep their digest. The others are looked up in the local
+// images, so it is called after a build has pulled them.
+func LockImages(m Moby) (Lockfile, error) {
+	lock := Lockfile{}
+	for _, ref := range imageRefs(m) {
+		tag := strings.SplitN(ref.Object, "@", 2)[0]
+		d := ref.Digest().String()
+		if tag == "" && d != "" {
+			// only pinned to a digest, so there is no tag to lock
+			continue
+		}
+		image := ref.Locator
+		if tag != "" {
+			image += ":" + tag
+		}
+		key, err := lockKey(image)
+		if err != nil {
+			return nil, err
+		}
+		if d == "" {
+			if d, err = imageDigest(ref, m.options().timeout); err != nil {
+				return nil, fmt.Errorf("Cannot get digest of %s: %v", ref, err)
+			}
+			if d == "" {
+				log.Warnf("Image %s has no registry digest, leaving it out of the lockfile", ref)
+				continue
+			}
+		}
+		lock[key] = d
+	}
+	return lock, nil
+}
+
+// WriteFile writes the lockfile as YAML, replacing the file atomically
+func (l Lockfile) WriteFile(filename string) error {
+	b, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, b)
+}
@@ -0,0 +1,145 @@
+package moby
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+)
+
+func TestApplyLockfile(t *testing.T) {
+	const getty = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	const kernel = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	lock, err := ParseLockfile([]byte(`
+linuxkit/kernel:4.9.39: ` + kernel + `
+docker.io/linuxkit/getty:v1: ` + getty + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := []byte(`
+kernel:
+  image: linuxkit/kernel:4.9.39
+services:
+  - name: getty
+    image: linuxkit/getty:v1
+  - name: sshd
+    image: linuxkit/sshd:v1
+`)
+	m, err := NewConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyLockfile(&m, lock, false); err != nil {
+		t.Fatal(err)
+	}
+	if m.Kernel.Image != "linuxkit/kernel:4.9.39@"+kernel {
+		t.Errorf("Expected kernel to be locked, got %s", m.Kernel.Image)
+	}
+	if m.Services[0].Image != "linuxkit/getty:v1@"+getty || m.Services[0].ref.Digest() != getty {
+		t.Errorf("Expected getty to be locked, got %s", m.Services[0].Image)
+	}
+	if m.Services[1].Image != "linuxkit/sshd:v1" {
+		t.Errorf("Expected sshd to be unchanged, got %s", m.Services[1].Image)
+	}
+
+	m, err = NewConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ApplyLockfile(&m, lock, true)
+	if err == nil || !strings.Contains(err.Error(), "linuxkit/sshd:v1") {
+		t.Errorf("Expected frozen lockfile to reject sshd, got %v", err)
+	}
+
+	if _, err := ParseLockfile([]byte("linuxkit/getty:v1: notadigest\n")); err == nil {
+		t.Error("Expected an invalid digest to be rejected")
+	}
+}
+
+func TestLockImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const kernel = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	const init = "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+	const pulled = "sha256:4444444444444444444444444444444444444444444444444444444444444444"
+	config := []byte(`
+kernel:
+  image: linuxkit/kernel:4.9.39
+init:
+  - linuxkit/init:v1@` + init + `
+  - linuxkit/runc@` + init + `
+services:
+  - name: getty
+    image: linuxkit/getty:v1
+  - name: local
+    image: local/app:dev
+`)
+	m, err := NewConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyLockfile(&m, Lockfile{"docker.io/linuxkit/kernel:4.9.39": kernel}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	var looked []string
+	imageDigest = func(ref *reference.Spec, timeout time.Duration) (string, error) {
+		looked = append(looked, ref.String())
+		if strings.HasPrefix(ref.String(), "local/") {
+			return "", nil
+		}
+		return pulled, nil
+	}
+	defer func() { imageDigest = lookupImageDigest }()
+
+	lock, err := LockImages(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Lockfile{
+		"docker.io/linuxkit/kernel:4.9.39": kernel,
+		"docker.io/linuxkit/init:v1":       init,
+		"docker.io/linuxkit/getty:v1":      pulled,
+	}
+	if !reflect.DeepEqual(lock, want) {
+		t.Errorf("Expected lockfile %v, got %v", want, lock)
+	}
+	if !reflect.DeepEqual(looked, []string{"linuxkit/getty:v1", "local/app:dev"}) {
+		t.Errorf("Expected only unpinned images to be looked up, got %v", looked)
+	}
+
+	// re-running with the written lockfile pins the images
+	file := filepath.Join(dir, "moby.lock")
+	if err := lock.WriteFile(file); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := ParseLockfile(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = NewConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyLockfile(&m, written, false); err != nil {
+		t.Fatal(err)
+	}
+	if m.Services[0].Image != "linuxkit/getty:v1@"+pulled || m.Kernel.Image != "linuxkit/kernel:4.9.39@"+kernel {
+		t.Errorf("Expected the written lockfile to pin images, got %s and %s", m.Kernel.Image, m.Services[0].Image)
+	}
+}
@@ -0,0 +1,107 @@
+package moby
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// imagesPulled counts the images pulled from a registry
+var imagesPulled int64
+
+// ImagesPulled returns the number of images pulled from a registry so far
+func ImagesPulled() int64 {
+	return atomic.LoadInt64(&imagesPulled)
+}
+
+// usedImages maps the images used by a build, whether pulled, already
+// present locally or in the content store, or run as helpers, to the digests
+// they resolved to, which are empty if they could not be found
+var (
+	usedImages   = map[string]string{}
+	usedImagesMu sync.Mutex
+)
+
+func recordImage(ref, digest string) {
+	usedImagesMu.Lock()
+	usedImages[ref] = digest
+	usedImagesMu.Unlock()
+}
+
+// UsedImages returns the images used so far, mapped to the digests they
+// resolved to
+func UsedImages() map[string]string {
+	usedImagesMu.Lock()
+	defer usedImagesMu.Unlock()
+	images := make(map[string]string, len(usedImages))
+	for ref, digest := range usedImages {
+		images[ref] = digest
+	}
+	return images
+}
+
+// BuildMetrics are the metrics for a build, written in the Prometheus textfile format
+type BuildMetrics struct {
+	Duration     time.Duration
+	Artifacts    map[string]int64
+	ImagesPulled int64
+}
+
+// ArtifactSizes returns the total size of the artifacts of each format
+func ArtifactSizes(artifacts []Artifact) map[string]int64 {
+	sizes := map[string]int64{}
+	for _, a := range artifacts {
+		sizes[a.Format] += a.Size
+	}
+	return sizes
+}
+
+// Write writes the metrics in the Prometheus text exposition format
+func (m BuildMetrics) Write(w io.Writer) error {
+	formats := make([]string, 0, len(m.Artifacts))
+	for f := range m.Artifacts {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+
+	if _, err := fmt.Fprintf(w, "# HELP moby_build_duration_seconds Time taken to build the image and outputs.\n# TYPE moby_build_duration_seconds gauge\nmoby_build_duration_seconds %g\n", m.Duration.Seconds()); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "# HELP moby_artifact_bytes Size of the files created for each output format.\n# TYPE moby_artifact_bytes gauge\n"); err != nil {
+		return err
+	}
+	for _, f := range formats {
+		if _, err := fmt.Fprintf(w, "moby_artifact_bytes{format=%q} %d\n", f, m.Artifacts[f]); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "# HELP moby_images_pulled_total Number of images pulled from a registry.\n# TYPE moby_images_pulled_total counter\nmoby_images_pulled_total %d\n", m.ImagesPulled)
+	return err
+}
+
+// WriteFile writes the metrics to a file, replacing it atomically so that a
+// collector never reads a partial file
+func (m BuildMetrics) WriteFile(filename string) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := m.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
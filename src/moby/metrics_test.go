@@ -0,0 +1,51 @@
+package moby
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "test")
+	for file, size := range map[string]int{"-kernel": 100, "-initrd.img": 200, "-cmdline": 10, ".iso": 1000} {
+		if err := ioutil.WriteFile(base+file, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	artifacts, err := OutputArtifacts(base, []string{"kernel+initrd", "iso-bios"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := ArtifactSizes(artifacts)
+
+	metrics := filepath.Join(dir, "moby.prom")
+	m := BuildMetrics{Duration: 90 * time.Second, Artifacts: sizes, ImagesPulled: 3}
+	if err := m.WriteFile(metrics); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"moby_build_duration_seconds 90",
+		`moby_artifact_bytes{format="iso-bios"} 1000`,
+		`moby_artifact_bytes{format="kernel+initrd"} 310`,
+		"moby_images_pulled_total 3",
+		"# TYPE moby_images_pulled_total counter",
+	} {
+		if !strings.Contains(string(b), line+"\n") {
+			t.Errorf("Expected %q in metrics:\n%s", line, b)
+		}
+	}
+}
@@ -3,18 +3,37 @@ package moby
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 
+	distref "github.com/docker/distribution/reference"
 	"github.com/moby/tool/src/initrd"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 )
 
 var (
+	// GCPCompressionLevel is the gzip level used to compress the gcp output,
+	// the default leaves the output of the mkimage-gcp helper unchanged
+	GCPCompressionLevel = gzip.DefaultCompression
+
+	// GCPCompression is gzip to write the gcp output as a gzipped tarball of
+	// the disk, as the GCP image import expects, or none to write the raw disk
+	GCPCompression = "gzip"
+
 	outputImages = map[string]string{
 		"iso-bios":    "linuxkit/mkimage-iso-bios:9a51dc64a461f1cc50ba05f30a38f73f5227ac03",
 		"iso-efi":     "linuxkit/mkimage-iso-efi:343cf1a8ac0aba7d8a1f13b7f45fa0b57ab897dc",
@@ -30,6 +49,114 @@ var (
 	}
 )
 
+// outputBase returns the base name for the files of a format, which is the
+// name it has in names, in the directory of base, if it has one
+func outputBase(base, format string, names map[string]string) string {
+	if name, ok := names[format]; ok {
+		return filepath.Join(filepath.Dir(base), name)
+	}
+	return base
+}
+
+// outputSuffixes are the suffixes added to the base name for the files each format creates
+var outputSuffixes = map[string][]string{
+	"kernel+initrd":      {"-kernel", "-initrd.img", "-cmdline"},
+	"tar-kernel-initrd":  {"-initrd.tar"},
+	"kernel+initrd+meta": {"-kernel", "-initrd.img", "-ucode.cpio", "-meta.json"},
+	"iso-bios":           {".iso"},
+	"iso-efi":            {"-efi.iso"},
+	"raw-bios":           {"-bios.img"},
+	"raw-efi":            {"-efi.img"},
+	"kernel+squashfs":    {"-kernel", "-squashfs.img", "-cmdline"},
+	"squashfs":           {"-squashfs.img", "-cmdline"},
+	"verity":             {"-kernel", "-squashfs.img", "-verity.img", "-roothash", "-cmdline"},
+	"aws":                {".raw"},
+	"gcp":                {".img.tar.gz"},
+	"qcow2-efi":          {"-efi.qcow2"},
+	"qcow2-bios":         {".qcow2"},
+	"vhd":                {".vhd"},
+	"dynamic-vhd":        {".vhd"},
+	"vmdk":               {".vmdk"},
+	"manifest":           {".manifest"},
+	"vagrant":            {".box"},
+	"ova":                {".ova"},
+	"rpi3":               {".tar"},
+	"wsl":                {"-rootfs.tar.gz"},
+}
+
+// OutputFiles returns the files that a format creates from the shared base
+// name, or from its own name in names
+func OutputFiles(base, format string, names map[string]string) []string {
+	base = outputBase(base, format, names)
+	suffixes := outputSuffixes[format]
+	if format == "gcp" {
+		suffixes = []string{gcpSuffix()}
+	}
+	var files []string
+	for _, suffix := range suffixes {
+		files = append(files, base+suffix)
+	}
+	return files
+}
+
+// writeWithMode calls write with a base name in a private temporary
+// directory next to base, then sets the files it created for format to mode
+// and moves them to base, so that they never have another mode under their
+// own name. The files keep their base names, which some formats record in
+// their contents.
+func writeWithMode(base, format string, mode os.FileMode, write func(base string) error) error {
+	dir, err := ioutil.TempDir(filepath.Dir(base), ".moby-output")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := write(filepath.Join(dir, filepath.Base(base))); err != nil {
+		return err
+	}
+	for _, file := range OutputFiles(base, format, nil) {
+		tmp := filepath.Join(dir, filepath.Base(file))
+		if err := os.Chmod(tmp, mode); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("Cannot set mode of %s: %v", file, err)
+		}
+		if err := os.Rename(tmp, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteChecksum writes the sidecar for a file, which names it relative to
+// the sidecar so that sha256sum -c can be run in the directory of both
+func WriteChecksum(file string) error {
+	sum, err := fileSHA256(file)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file+".sha256", []byte(sum+"  "+filepath.Base(file)+"\n"), 0644)
+}
+
+// writeChecksums writes the sidecars for the files created for a format,
+// skipping those it did not create, such as the cmdline of an image without
+// one
+func writeChecksums(base, format string, names map[string]string) error {
+	for _, file := range OutputFiles(base, format, names) {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue
+		}
+		if err := WriteChecksum(file); err != nil {
+			return fmt.Errorf("Cannot write checksum of %s: %v", file, err)
+		}
+	}
+	return nil
+}
+
+// runHelper runs a mkimage helper image with input on stdin, writing its stdout to output,
+// with the helper settings in opts
+var runHelper = dockerRun
+
 // UpdateOutputImages overwrite the docker images used to build the outputs
 // 'update' is a map where the key is the output format and the value is a LinuxKit 'mkimage' image.
 func UpdateOutputImages(update map[string]string) error {
@@ -42,164 +169,234 @@ func UpdateOutputImages(update map[string]string) error {
 	return nil
 }
 
-var outFuns = map[string]func(string, io.Reader, int) error{
-	"kernel+initrd": func(base string, image io.Reader, size int) error {
-		kernel, initrd, cmdline, ucode, err := tarToInitrd(image)
-		if err != nil {
-			return fmt.Errorf("Error converting to initrd: %v", err)
+// helperImageEnvPrefix prefixes the environment variables that override the
+// mkimage helper images, such as MOBY_HELPER_IMAGE_ISO_BIOS for iso-bios
+const helperImageEnvPrefix = "MOBY_HELPER_IMAGE_"
+
+// HelperImageOverrides returns the mkimage helper images overridden by a YAML
+// file mapping helper names to images, which need not exist, and by
+// MOBY_HELPER_IMAGE_<NAME> variables in environ, which take precedence
+func HelperImageOverrides(environ []string, file string) (map[string]string, error) {
+	update := map[string]string{}
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := yaml.Unmarshal(b, &update); err != nil {
+				return nil, fmt.Errorf("Cannot parse helper images in %s: %v", file, err)
+			}
+		}
+	}
+	envNames := map[string]string{}
+	for name := range outputImages {
+		envNames[helperImageEnvPrefix+strings.ToUpper(strings.Replace(name, "-", "_", -1))] = name
+	}
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], helperImageEnvPrefix) || parts[1] == "" {
+			continue
 		}
-		err = outputKernelInitrd(base, kernel, initrd, cmdline, ucode)
+		name, ok := envNames[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("Unknown helper image variable %s", parts[0])
+		}
+		update[name] = parts[1]
+	}
+	for name, img := range update {
+		if _, err := distref.ParseNormalizedNamed(img); err != nil {
+			return nil, fmt.Errorf("Invalid image %s for helper %s: %v", img, name, err)
+		}
+	}
+	return update, nil
+}
+
+var outFuns = map[string]func(string, io.Reader, *kernelInitrd, int, []string, *OutputOptions) error{
+	"kernel+initrd": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		err := outputKernelInitrd(base, ki.kernel, ki.bootInitrd(), ki.cmdline)
 		if err != nil {
 			return fmt.Errorf("Error writing kernel+initrd output: %v", err)
 		}
 		return nil
 	},
-	"tar-kernel-initrd": func(base string, image io.Reader, size int) error {
-		kernel, initrd, cmdline, ucode, err := tarToInitrd(image)
-		if err != nil {
-			return fmt.Errorf("Error converting to initrd: %v", err)
-		}
-		if err := outputKernelInitrdTarball(base, kernel, initrd, cmdline, ucode); err != nil {
+	"tar-kernel-initrd": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		if err := outputKernelInitrdTarball(base, ki.kernel, ki.bootInitrd(), ki.cmdline, ki.ucode); err != nil {
 			return fmt.Errorf("Error writing kernel+initrd tarball output: %v", err)
 		}
 		return nil
 	},
-	"iso-bios": func(base string, image io.Reader, size int) error {
-		err := outputIso(outputImages["iso-bios"], base+".iso", image)
+	"kernel+initrd+meta": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		if err := outputKernelInitrdMeta(base, ki.kernel, ki.bootInitrd(), ki.cmdline, ki.ucode); err != nil {
+			return fmt.Errorf("Error writing kernel+initrd+meta output: %v", err)
+		}
+		return nil
+	},
+	"iso-bios": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		err := outputIso(opts, outputImages["iso-bios"], base+".iso", image, args...)
 		if err != nil {
 			return fmt.Errorf("Error writing iso-bios output: %v", err)
 		}
 		return nil
 	},
-	"iso-efi": func(base string, image io.Reader, size int) error {
-		err := outputIso(outputImages["iso-efi"], base+"-efi.iso", image)
+	"iso-efi": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		err := outputIso(opts, outputImages["iso-efi"], base+"-efi.iso", image, args...)
 		if err != nil {
 			return fmt.Errorf("Error writing iso-efi output: %v", err)
 		}
 		return nil
 	},
-	"raw-bios": func(base string, image io.Reader, size int) error {
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
-		if err != nil {
-			return fmt.Errorf("Error converting to initrd: %v", err)
-		}
-		// TODO: Handle ucode
-		err = outputImg(outputImages["raw-bios"], base+"-bios.img", kernel, initrd, cmdline)
+	"raw-bios": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		err := outputImg(opts, outputImages["raw-bios"], base+"-bios.img", ki.kernel, ki.bootInitrd(), ki.cmdline, args...)
 		if err != nil {
 			return fmt.Errorf("Error writing raw-bios output: %v", err)
 		}
 		return nil
 	},
-	"raw-efi": func(base string, image io.Reader, size int) error {
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
-		if err != nil {
-			return fmt.Errorf("Error converting to initrd: %v", err)
-		}
-		err = outputImg(outputImages["raw-efi"], base+"-efi.img", kernel, initrd, cmdline)
+	"raw-efi": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		err := outputImg(opts, outputImages["raw-efi"], base+"-efi.img", ki.kernel, ki.bootInitrd(), ki.cmdline, args...)
 		if err != nil {
 			return fmt.Errorf("Error writing raw-efi output: %v", err)
 		}
 		return nil
 	},
-	"kernel+squashfs": func(base string, image io.Reader, size int) error {
-		err := outputKernelSquashFS(outputImages["squashfs"], base, image)
+	"kernel+squashfs": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		err := outputKernelSquashFS(opts, outputImages["squashfs"], base, image, args...)
 		if err != nil {
 			return fmt.Errorf("Error writing kernel+squashfs output: %v", err)
 		}
 		return nil
 	},
-	"aws": func(base string, image io.Reader, size int) error {
-		filename := base + ".raw"
-		log.Infof("  %s", filename)
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
+	"squashfs": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		err := outputSquashFS(opts, outputImages["squashfs"], base, image, false, args...)
 		if err != nil {
-			return fmt.Errorf("Error converting to initrd: %v", err)
+			return fmt.Errorf("Error writing squashfs output: %v", err)
 		}
-		err = outputLinuxKit("raw", filename, kernel, initrd, cmdline, size)
+		return nil
+	},
+	"verity": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		err := outputVerity(opts, outputImages["squashfs"], base, image, args...)
 		if err != nil {
-			return fmt.Errorf("Error writing raw output: %v", err)
+			return fmt.Errorf("Error writing verity output: %v", err)
 		}
 		return nil
 	},
-	"gcp": func(base string, image io.Reader, size int) error {
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
+	"aws": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		filename := base + ".raw"
+		log.Infof("  %s", filename)
+		err := outputLinuxKit("raw", filename, ki.kernel, ki.bootInitrd(), ki.cmdline, size)
 		if err != nil {
-			return fmt.Errorf("Error converting to initrd: %v", err)
+			return fmt.Errorf("Error writing raw output: %v", err)
 		}
-		err = outputImg(outputImages["gcp"], base+".img.tar.gz", kernel, initrd, cmdline)
+		return nil
+	},
+	"gcp": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		err := outputGCP(opts, outputImages["gcp"], base+gcpSuffix(), ki.kernel, ki.bootInitrd(), ki.cmdline, GCPCompression, GCPCompressionLevel, args...)
 		if err != nil {
 			return fmt.Errorf("Error writing gcp output: %v", err)
 		}
 		return nil
 	},
-	"qcow2-efi": func(base string, image io.Reader, size int) error {
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
-		if err != nil {
-			return fmt.Errorf("Error converting to initrd: %v", err)
-		}
-		err = outputImg(outputImages["qcow2-efi"], base+"-efi.qcow2", kernel, initrd, cmdline)
+	"qcow2-efi": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		err := outputImg(opts, outputImages["qcow2-efi"], base+"-efi.qcow2", ki.kernel, ki.bootInitrd(), ki.cmdline, args...)
 		if err != nil {
 			return fmt.Errorf("Error writing qcow2 EFI output: %v", err)
 		}
 		return nil
 	},
-	"qcow2-bios": func(base string, image io.Reader, size int) error {
+	"qcow2-bios": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
 		filename := base + ".qcow2"
 		log.Infof("  %s", filename)
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
-		if err != nil {
-			return fmt.Errorf("Error converting to initrd: %v", err)
+		if opts.QCOW2BackingFile != "" {
+			if _, err := os.Stat(opts.QCOW2BackingFile); err != nil {
+				return fmt.Errorf("Cannot use qcow2 backing file: %v", err)
+			}
 		}
-		// TODO: Handle ucode
-		err = outputLinuxKit("qcow2", filename, kernel, initrd, cmdline, size)
+		err := outputLinuxKit("qcow2", filename, ki.kernel, ki.bootInitrd(), ki.cmdline, size)
 		if err != nil {
 			return fmt.Errorf("Error writing qcow2 output: %v", err)
 		}
+		if opts.QCOW2BackingFile != "" {
+			if err := rebaseQcow2(filename, opts.QCOW2BackingFile); err != nil {
+				return fmt.Errorf("Error rebasing qcow2 output on backing file: %v", err)
+			}
+		}
 		return nil
 	},
-	"vhd": func(base string, image io.Reader, size int) error {
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
+	"vhd": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		err := outputImg(opts, outputImages["vhd"], base+".vhd", ki.kernel, ki.bootInitrd(), ki.cmdline, args...)
 		if err != nil {
-			return fmt.Errorf("Error converting to initrd: %v", err)
+			return fmt.Errorf("Error writing vhd output: %v", err)
 		}
-		err = outputImg(outputImages["vhd"], base+".vhd", kernel, initrd, cmdline)
+		return nil
+	},
+	"dynamic-vhd": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		err := outputImg(opts, outputImages["dynamic-vhd"], base+".vhd", ki.kernel, ki.bootInitrd(), ki.cmdline, args...)
 		if err != nil {
 			return fmt.Errorf("Error writing vhd output: %v", err)
 		}
 		return nil
 	},
-	"dynamic-vhd": func(base string, image io.Reader, size int) error {
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
+	"vmdk": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		err := outputImg(opts, outputImages["vmdk"], base+".vmdk", ki.kernel, ki.bootInitrd(), ki.cmdline, args...)
 		if err != nil {
-			return fmt.Errorf("Error converting to initrd: %v", err)
+			return fmt.Errorf("Error writing vmdk output: %v", err)
 		}
-		err = outputImg(outputImages["dynamic-vhd"], base+".vhd", kernel, initrd, cmdline)
+		return nil
+	},
+	"manifest": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		err := outputManifest(base+".manifest", image)
 		if err != nil {
-			return fmt.Errorf("Error writing vhd output: %v", err)
+			return fmt.Errorf("Error writing manifest output: %v", err)
 		}
 		return nil
 	},
-	"vmdk": func(base string, image io.Reader, size int) error {
-		kernel, initrd, cmdline, _, err := tarToInitrd(image)
+	"vagrant": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		err := outputVagrant(opts, outputImages["vmdk"], base+".box", ki.kernel, ki.bootInitrd(), ki.cmdline, args...)
 		if err != nil {
-			return fmt.Errorf("Error converting to initrd: %v", err)
+			return fmt.Errorf("Error writing vagrant output: %v", err)
 		}
-		err = outputImg(outputImages["vmdk"], base+".vmdk", kernel, initrd, cmdline)
+		return nil
+	},
+	"ova": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		err := outputOVA(opts, outputImages["vmdk"], base+".ova", ki.kernel, ki.bootInitrd(), ki.cmdline, args...)
 		if err != nil {
-			return fmt.Errorf("Error writing vmdk output: %v", err)
+			return fmt.Errorf("Error writing ova output: %v", err)
 		}
 		return nil
 	},
-	"rpi3": func(base string, image io.Reader, size int) error {
+	"rpi3": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
 		if runtime.GOARCH != "arm64" {
 			return fmt.Errorf("Raspberry Pi output currently only supported on arm64")
 		}
-		err := outputRPi3(outputImages["rpi3"], base+".tar", image)
+		err := outputRPi3(opts, outputImages["rpi3"], base+".tar", image, args...)
 		if err != nil {
 			return fmt.Errorf("Error writing rpi3 output: %v", err)
 		}
 		return nil
 	},
+	"docker-image": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		tag := opts.DockerImageTag
+		if tag == "" {
+			tag = filepath.Base(base)
+		}
+		arch := opts.Arch
+		if arch == "" {
+			arch = runtime.GOARCH
+		}
+		err := outputDockerImage(tag, arch, image, opts.Timeout)
+		if err != nil {
+			return fmt.Errorf("Error writing docker-image output: %v", err)
+		}
+		return nil
+	},
+	"wsl": func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		err := outputRootfsTar(base+"-rootfs.tar.gz", image)
+		if err != nil {
+			return fmt.Errorf("Error writing wsl output: %v", err)
+		}
+		return nil
+	},
 }
 
 var prereq = map[string]string{
@@ -234,29 +431,313 @@ func ValidateFormats(formats []string) error {
 	return nil
 }
 
-// Formats generates all the specified output formats
-func Formats(base string, image string, formats []string, size int) error {
+// helperFormats are the output formats made by a mkimage helper container,
+// which can be given extra arguments for the helper
+var helperFormats = map[string]bool{
+	"iso-bios":        true,
+	"iso-efi":         true,
+	"raw-bios":        true,
+	"raw-efi":         true,
+	"kernel+squashfs": true,
+	"squashfs":        true,
+	"verity":          true,
+	"gcp":             true,
+	"qcow2-efi":       true,
+	"vhd":             true,
+	"dynamic-vhd":     true,
+	"vmdk":            true,
+	"vagrant":         true,
+	"ova":             true,
+	"rpi3":            true,
+}
+
+// validateHelperArgs checks that extra helper arguments are for formats made
+// by a helper, and can be passed to it
+func validateHelperArgs(args map[string][]string) error {
+	for format, a := range args {
+		if !helperFormats[format] {
+			return fmt.Errorf("Output format %s does not take helper arguments", format)
+		}
+		for _, arg := range a {
+			if arg == "" || strings.ContainsAny(arg, "\x00\n") {
+				return fmt.Errorf("Invalid helper argument for %s: %q", format, arg)
+			}
+		}
+	}
+	return nil
+}
+
+// ParallelOutputs is the number of output formats generated at the same time,
+// and ParallelHeavyOutputs the number of those that run a qemu virtual machine
+var (
+	ParallelOutputs      = 4
+	ParallelHeavyOutputs = 1
+)
+
+// kernelInitrd is an image split into the kernel, initrd, cmdline and CPU
+// microcode, shared by all the formats that are built from them
+type kernelInitrd struct {
+	kernel  []byte
+	initrd  []byte
+	cmdline string
+	ucode   []byte
+
+	bootOnce sync.Once
+	boot     []byte
+}
+
+// bootInitrd returns the initrd that the image boots with, which is the
+// microcode followed by the initrd, as the kernel only loads microcode from
+// the first archive of the initrd. Only the formats that keep the microcode
+// in a file of its own use the initrd without it.
+func (ki *kernelInitrd) bootInitrd() []byte {
+	ki.bootOnce.Do(func() {
+		ki.boot = ki.initrd
+		if len(ki.ucode) != 0 {
+			ki.boot = append(append(make([]byte, 0, len(ki.ucode)+len(ki.initrd)), ki.ucode...), ki.initrd...)
+		}
+	})
+	return ki.boot
+}
+
+// filesystemFormats are the output formats built from the image tarball
+// rather than from the kernel and initrd
+var filesystemFormats = map[string]bool{
+	"iso-bios":        true,
+	"iso-efi":         true,
+	"kernel+squashfs": true,
+	"squashfs":        true,
+	"verity":          true,
+	"manifest":        true,
+	"rpi3":            true,
+	"wsl":             true,
+	"docker-image":    true,
+}
+
+// OutputFunc creates an output format registered with RegisterOutput. base
+// is the path, without a suffix, to name the files it creates from, image is
+// the image tarball as written by Build, and size is the disk size in MB
+// requested for the build, 0 if none was. It may run at the same time as the
+// functions creating other formats, so must not share state with them.
+type OutputFunc func(base string, image io.Reader, size int) error
+
+// RegisterOutput adds an output format, which Formats and ValidateFormats
+// then accept like the built in formats. The suffixes are those added to the
+// base name for the files fn creates, so that OutputFiles, the checksums and
+// the file mode cover them. It must be called before building, such as from
+// an init function, and fails if the name is already in use.
+func RegisterOutput(name string, suffixes []string, fn OutputFunc) error {
+	if name == "" || fn == nil {
+		return fmt.Errorf("An output format needs a name and a function")
+	}
+	if _, ok := outFuns[name]; ok || streamable[name] {
+		return fmt.Errorf("Output format %s is already registered", name)
+	}
+	outFuns[name] = func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+		if err := fn(base, image, size); err != nil {
+			return fmt.Errorf("Error writing %s output: %v", name, err)
+		}
+		return nil
+	}
+	outputSuffixes[name] = append([]string{}, suffixes...)
+	filesystemFormats[name] = true
+	return nil
+}
+
+// OutputOptions are the settings of the output formats that come from the
+// command line rather than the config
+type OutputOptions struct {
+	// Names are the base names of the formats named in place of the shared base
+	Names map[string]string
+	// OVAName is the virtual machine name in the descriptor of the ova
+	// output, the base name of the output if empty
+	OVAName string
+	// DockerImageTag is the name the docker-image output is loaded into
+	// Docker as, the base name of the output if empty
+	DockerImageTag string
+	// Mode is the file mode to give the files created for each format, or
+	// zero to keep the mode each is written with
+	Mode os.FileMode
+	// QCOW2BackingFile makes the qcow2-bios output a thin overlay on this
+	// qcow2 backing file, rather than a standalone image
+	QCOW2BackingFile string
+	// Arch is the architecture the image was built for, which the
+	// docker-image output is labelled with, the host architecture if empty
+	Arch string
+	// KeepFailedHelpers stops mkimage helper containers from being removed
+	// automatically, so that a container that fails can be inspected afterwards
+	KeepFailedHelpers bool
+	// HelperMemory and HelperCPUs limit the memory and CPUs available to
+	// mkimage helper containers, in the form accepted by docker run, empty
+	// is unlimited
+	HelperMemory string
+	HelperCPUs   string
+	// Timeout limits how long each mkimage helper container, and each Docker
+	// API call of the outputs, may take, 0 is no limit
+	Timeout time.Duration
+	// Checksums writes a sidecar file with the SHA256 of each file created
+	// for each format, named with a .sha256 suffix, in the format of sha256sum
+	Checksums bool
+}
+
+// Formats generates all the specified output formats, passing any extra
+// arguments for a format to its mkimage helper. The image is split into the
+// kernel and initrd once for all the formats, and up to ParallelOutputs
+// formats are generated at the same time, with at most ParallelHeavyOutputs
+// of the formats that need a LinuxKit virtual machine. Formats that write any
+// of the same files, such as vhd and dynamic-vhd, are generated one after the
+// other rather than at the same time. If cmdline is set it is the kernel
+// command line of every format, instead of the one in the image. A format
+// with a name in the options uses it for its files in place of base.
+func Formats(base string, image string, formats []string, size int, helperArgs map[string][]string, cmdline string, opts *OutputOptions) error {
 	log.Debugf("format: %v %s", formats, base)
+	if opts == nil {
+		opts = &OutputOptions{}
+	}
 
 	err := ValidateFormats(formats)
 	if err != nil {
 		return err
 	}
+	if err := validateHelperArgs(helperArgs); err != nil {
+		return err
+	}
+
+	var ki *kernelInitrd
 	for _, o := range formats {
+		if filesystemFormats[o] {
+			continue
+		}
 		ir, err := os.Open(image)
 		if err != nil {
 			return err
 		}
-		defer ir.Close()
-		f := outFuns[o]
-		if err := f(base, ir, size); err != nil {
-			return err
+		kernel, initrd, imageCmdline, ucode, err := splitImage(ir)
+		ir.Close()
+		if err != nil {
+			return fmt.Errorf("Error converting to initrd: %v", err)
+		}
+		ki = &kernelInitrd{kernel: kernel, initrd: initrd, cmdline: imageCmdline, ucode: ucode}
+		if cmdline != "" {
+			ki.cmdline = cmdline
 		}
+		break
+	}
+
+	n := ParallelOutputs
+	if n < 1 {
+		n = 1
+	}
+	heavy := ParallelHeavyOutputs
+	if heavy < 1 {
+		heavy = 1
+	}
+	errs := make([]error, len(formats))
+	sem := make(chan struct{}, n)
+	heavySem := make(chan struct{}, heavy)
+	var wg sync.WaitGroup
+	for _, group := range outputGroups(base, formats, opts.Names) {
+		wg.Add(1)
+		go func(group []int) {
+			defer wg.Done()
+			// formats in a group write some of the same files so run in turn
+			for _, i := range group {
+				errs[i] = runFormat(base, image, formats[i], ki, size, helperArgs[formats[i]], cmdline, opts, sem, heavySem)
+			}
+		}(group)
 	}
+	wg.Wait()
 
+	// every format names itself in its errors, report the first in the order given
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// outputGroups groups the indexes of formats so that formats that write any
+// of the same files are in the same group, in the order they were given
+func outputGroups(base string, formats []string, names map[string]string) [][]int {
+	group := make([]int, len(formats))
+	for i := range group {
+		group[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if group[i] != i {
+			group[i] = find(group[i])
+		}
+		return group[i]
+	}
+	owner := map[string]int{}
+	for i, o := range formats {
+		for _, file := range append(OutputFiles(base, o, names), "format:"+o) {
+			if j, ok := owner[file]; ok {
+				group[find(i)] = find(j)
+			} else {
+				owner[file] = i
+			}
+		}
+	}
+	var groups [][]int
+	index := map[int]int{}
+	for i := range formats {
+		root := find(i)
+		g, ok := index[root]
+		if !ok {
+			g = len(groups)
+			index[root] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups
+}
+
+// runFormat generates one output format, holding sem while it runs, and
+// heavySem too if it needs a LinuxKit virtual machine. heavySem is taken
+// first, so that a format waiting for it does not hold a slot in sem that
+// another format could run in.
+func runFormat(base, image, o string, ki *kernelInitrd, size int, args []string, cmdline string, opts *OutputOptions, sem, heavySem chan struct{}) error {
+	if prereq[o] != "" {
+		heavySem <- struct{}{}
+		defer func() { <-heavySem }()
+	}
+	sem <- struct{}{}
+	defer func() { <-sem }()
+	ir, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer ir.Close()
+	var r io.Reader = ir
+	if cmdline != "" && filesystemFormats[o] {
+		pr := replaceCmdline(ir, cmdline)
+		defer pr.Close()
+		r = pr
+	}
+	write := func(base string) error {
+		return outFuns[o](base, r, ki, size, args, opts)
+	}
+	if opts.Mode != 0 {
+		err = writeWithMode(outputBase(base, o, opts.Names), o, opts.Mode, write)
+	} else {
+		err = write(outputBase(base, o, opts.Names))
+	}
+	if err != nil {
+		return err
+	}
+	if !opts.Checksums {
+		return nil
+	}
+	return writeChecksums(base, o, opts.Names)
+}
+
+// splitImage splits an image tarball into the kernel, initrd, cmdline and microcode
+var splitImage = tarToInitrd
+
 func tarToInitrd(r io.Reader) ([]byte, []byte, string, []byte, error) {
 	w := new(bytes.Buffer)
 	iw := initrd.NewWriter(w)
@@ -317,65 +798,338 @@ func tarInitrdKernel(kernel, initrd []byte, cmdline string) (*bytes.Buffer, erro
 	return buf, tw.Close()
 }
 
-func outputImg(image, filename string, kernel []byte, initrd []byte, cmdline string) error {
+func outputImg(opts *OutputOptions, image, filename string, kernel []byte, initrd []byte, cmdline string, args ...string) error {
 	log.Debugf("output img: %s %s", image, filename)
 	log.Infof("  %s", filename)
 	buf, err := tarInitrdKernel(kernel, initrd, cmdline)
 	if err != nil {
 		return err
 	}
+	return writeHelperOutput(opts, filename, buf, image, append([]string{cmdline}, args...)...)
+}
+
+// writeHelperOutput runs a mkimage helper writing its output to filename. If the
+// helper fails the file is removed, so that a partial image is not left behind.
+func writeHelperOutput(opts *OutputOptions, filename string, input io.Reader, image string, args ...string) error {
 	output, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
-	defer output.Close()
-	return dockerRun(buf, output, true, image, cmdline)
+	err = runHelper(opts, input, output, true, image, args...)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+		return err
+	}
+	return nil
 }
 
-func outputIso(image, filename string, filesystem io.Reader) error {
-	log.Debugf("output ISO: %s %s", image, filename)
+// gcpSuffix is the suffix of the gcp output for GCPCompression
+func gcpSuffix() string {
+	if GCPCompression == "none" {
+		return ".img"
+	}
+	return ".img.tar.gz"
+}
+
+// outputGCP runs the gcp helper, which writes a gzipped tarball of the disk.
+// With gzip compression the tarball is written as it is, or compressed again
+// at level if it is not the default, and with none the disk is extracted.
+func outputGCP(opts *OutputOptions, image, filename string, kernel []byte, initrd []byte, cmdline string, compression string, level int, args ...string) error {
+	if compression != "gzip" && compression != "none" {
+		return fmt.Errorf("Unknown gcp compression %s", compression)
+	}
+	if compression == "gzip" && level == gzip.DefaultCompression {
+		return outputImg(opts, image, filename, kernel, initrd, cmdline, args...)
+	}
+	log.Debugf("output gcp: %s %s %s level %d", image, filename, compression, level)
 	log.Infof("  %s", filename)
+	buf, err := tarInitrdKernel(kernel, initrd, cmdline)
+	if err != nil {
+		return err
+	}
 	output, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
-	defer output.Close()
-	return dockerRun(filesystem, output, true, image)
+	pr, pw := io.Pipe()
+	helperErr := make(chan error, 1)
+	go func() {
+		err := runHelper(opts, buf, pw, true, image, append([]string{cmdline}, args...)...)
+		pw.CloseWithError(err)
+		helperErr <- err
+	}()
+	if compression == "none" {
+		err = extractGCPDisk(output, pr)
+	} else {
+		err = recompress(output, pr, level)
+	}
+	if err == nil {
+		// the helper can still fail after writing the disk
+		_, err = io.Copy(ioutil.Discard, pr)
+	}
+	pr.Close()
+	if hErr := <-helperErr; err == nil {
+		err = hErr
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+		return err
+	}
+	return nil
 }
 
-func outputRPi3(image, filename string, filesystem io.Reader) error {
-	log.Debugf("output RPi3: %s %s", image, filename)
-	log.Infof("  %s", filename)
-	output, err := os.Create(filename)
+// extractGCPDisk copies the disk.raw from a gzipped tarball written by the
+// gcp helper
+func extractGCPDisk(w io.Writer, r io.Reader) error {
+	zr, err := gzip.NewReader(r)
 	if err != nil {
 		return err
 	}
-	defer output.Close()
-	return dockerRun(filesystem, output, true, image)
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("No disk.raw in the output of the gcp helper")
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Name == "disk.raw" {
+			_, err := io.Copy(w, tr)
+			return err
+		}
+	}
 }
 
-func outputKernelInitrd(base string, kernel []byte, initrd []byte, cmdline string, ucode []byte) error {
-	log.Debugf("output kernel/initrd: %s %s", base, cmdline)
+// recompress copies a gzip stream, compressing it again at the given level
+func recompress(w io.Writer, r io.Reader, level int) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	zw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, zr); err != nil {
+		return err
+	}
+	return zw.Close()
+}
 
-	if len(ucode) != 0 {
-		log.Infof("  %s ucode+%s %s", base+"-kernel", base+"-initrd.img", base+"-cmdline")
-		if err := ioutil.WriteFile(base+"-initrd.img", ucode, os.FileMode(0644)); err != nil {
+const vagrantMetadata = `{"provider": "virtualbox"}`
+
+const vagrantfile = `Vagrant.configure("2") do |config|
+  # LinuxKit images do not have the VirtualBox guest additions
+  config.vm.synced_folder ".", "/vagrant", disabled: true
+  config.ssh.insert_key = false
+end
+`
+
+// tempVmdk runs the vmdk helper writing the disk to a temporary file, which
+// the caller must remove
+func tempVmdk(opts *OutputOptions, image string, kernel []byte, initrd []byte, cmdline string, args ...string) (*os.File, error) {
+	buf, err := tarInitrdKernel(kernel, initrd, cmdline)
+	if err != nil {
+		return nil, err
+	}
+	disk, err := ioutil.TempFile(filepath.Join(MobyDir, "tmp"), "vmdk")
+	if err != nil {
+		return nil, err
+	}
+	if err := runHelper(opts, buf, disk, true, image, append([]string{cmdline}, args...)...); err != nil {
+		disk.Close()
+		os.Remove(disk.Name())
+		return nil, err
+	}
+	return disk, nil
+}
+
+// outputVagrant builds a vmdk disk and packages it as a VirtualBox Vagrant box
+func outputVagrant(opts *OutputOptions, image, filename string, kernel []byte, initrd []byte, cmdline string, args ...string) error {
+	log.Debugf("output vagrant: %s %s", image, filename)
+	log.Infof("  %s", filename)
+	disk, err := tempVmdk(opts, image, kernel, initrd, cmdline, args...)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(disk.Name())
+	defer disk.Close()
+	fi, err := disk.Stat()
+	if err != nil {
+		return err
+	}
+	capacity, err := vmdkCapacity(disk)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	ovf := new(bytes.Buffer)
+	err = ovfDescriptor{
+		Name:       name,
+		SystemType: "virtualbox-2.2",
+		Disk:       "box-disk1.vmdk",
+		DiskSize:   fi.Size(),
+		Capacity:   capacity,
+		CPUs:       1,
+		Memory:     1024,
+	}.Write(ovf)
+	if err != nil {
+		return err
+	}
+	if _, err := disk.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	output, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	zw := gzip.NewWriter(output)
+	tw := tar.NewWriter(zw)
+	files := []struct {
+		name string
+		size int64
+		r    io.Reader
+	}{
+		{"metadata.json", int64(len(vagrantMetadata)), strings.NewReader(vagrantMetadata)},
+		{"Vagrantfile", int64(len(vagrantfile)), strings.NewReader(vagrantfile)},
+		{"box.ovf", int64(ovf.Len()), ovf},
+		{"box-disk1.vmdk", fi.Size(), disk},
+	}
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:   f.name,
+			Mode:   0644,
+			Size:   f.size,
+			Format: tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
 			return err
 		}
-		f, err := os.OpenFile(base+"-initrd.img", os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
+		if _, err := io.Copy(tw, f.r); err != nil {
 			return err
 		}
-		defer f.Close()
-		if _, err = f.Write(initrd); err != nil {
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// outputOVA packages a vmdk disk with an OVF descriptor and a manifest of their
+// SHA256 hashes in a tarball that vSphere can deploy
+func outputOVA(opts *OutputOptions, image, filename string, kernel []byte, initrd []byte, cmdline string, args ...string) error {
+	log.Debugf("output ova: %s %s", image, filename)
+	log.Infof("  %s", filename)
+	disk, err := tempVmdk(opts, image, kernel, initrd, cmdline, args...)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(disk.Name())
+	defer disk.Close()
+	fi, err := disk.Stat()
+	if err != nil {
+		return err
+	}
+	capacity, err := vmdkCapacity(disk)
+	if err != nil {
+		return err
+	}
+	base := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	name := opts.OVAName
+	if name == "" {
+		name = base
+	}
+	ovfName := base + ".ovf"
+	diskName := base + "-disk1.vmdk"
+	ovf := new(bytes.Buffer)
+	err = ovfDescriptor{
+		Name:       name,
+		SystemType: "vmx-10",
+		Disk:       diskName,
+		DiskSize:   fi.Size(),
+		Capacity:   capacity,
+		CPUs:       1,
+		Memory:     1024,
+	}.Write(ovf)
+	if err != nil {
+		return err
+	}
+
+	if _, err := disk.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, disk); err != nil {
+		return err
+	}
+	ovfSum := sha256.Sum256(ovf.Bytes())
+	mf := fmt.Sprintf("SHA256(%s)= %x\nSHA256(%s)= %x\n", ovfName, ovfSum, diskName, h.Sum(nil))
+	if _, err := disk.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	output, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	// the descriptor must be the first file in an ova, followed by the manifest
+	tw := tar.NewWriter(output)
+	files := []struct {
+		name string
+		size int64
+		r    io.Reader
+	}{
+		{ovfName, int64(ovf.Len()), ovf},
+		{base + ".mf", int64(len(mf)), strings.NewReader(mf)},
+		{diskName, fi.Size(), disk},
+	}
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:   f.name,
+			Mode:   0644,
+			Size:   f.size,
+			Format: tar.FormatUSTAR,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
 			return err
 		}
-	} else {
-		log.Infof("  %s %s %s", base+"-kernel", base+"-initrd.img", base+"-cmdline")
-		if err := ioutil.WriteFile(base+"-initrd.img", initrd, os.FileMode(0644)); err != nil {
+		if _, err := io.Copy(tw, f.r); err != nil {
 			return err
 		}
 	}
+	return tw.Close()
+}
+
+func outputIso(opts *OutputOptions, image, filename string, filesystem io.Reader, args ...string) error {
+	log.Debugf("output ISO: %s %s", image, filename)
+	log.Infof("  %s", filename)
+	return writeHelperOutput(opts, filename, filesystem, image, args...)
+}
+
+func outputRPi3(opts *OutputOptions, image, filename string, filesystem io.Reader, args ...string) error {
+	log.Debugf("output RPi3: %s %s", image, filename)
+	log.Infof("  %s", filename)
+	return writeHelperOutput(opts, filename, filesystem, image, args...)
+}
+
+func outputKernelInitrd(base string, kernel []byte, initrd []byte, cmdline string) error {
+	log.Debugf("output kernel/initrd: %s %s", base, cmdline)
+	log.Infof("  %s %s %s", base+"-kernel", base+"-initrd.img", base+"-cmdline")
+	if err := ioutil.WriteFile(base+"-initrd.img", initrd, os.FileMode(0644)); err != nil {
+		return err
+	}
 	if err := ioutil.WriteFile(base+"-kernel", kernel, os.FileMode(0644)); err != nil {
 		return err
 	}
@@ -444,13 +1198,145 @@ func outputKernelInitrdTarball(base string, kernel []byte, initrd []byte, cmdlin
 	return tw.Close()
 }
 
-func outputKernelSquashFS(image, base string, filesystem io.Reader) error {
+// KernelInitrdMeta describes the files written by the kernel+initrd+meta
+// output, for bootloaders that load them individually
+type KernelInitrdMeta struct {
+	Cmdline string    `json:"cmdline"`
+	Kernel  MetaFile  `json:"kernel"`
+	Initrd  MetaFile  `json:"initrd"`
+	Ucode   *MetaFile `json:"ucode,omitempty"`
+}
+
+// MetaFile is the name, size and hash of an output file
+type MetaFile struct {
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func metaFile(filename string, data []byte) MetaFile {
+	sum := sha256.Sum256(data)
+	return MetaFile{
+		File:   filepath.Base(filename),
+		Size:   int64(len(data)),
+		SHA256: hex.EncodeToString(sum[:]),
+	}
+}
+
+// outputKernelInitrdMeta writes the kernel, the initrd and any CPU microcode
+// as separate files, and the cmdline with the sizes and hashes of the files
+// to a JSON metadata file
+func outputKernelInitrdMeta(base string, kernel []byte, initrd []byte, cmdline string, ucode []byte) error {
+	log.Debugf("output kernel/initrd/meta: %s %s", base, cmdline)
+	meta := KernelInitrdMeta{
+		Cmdline: cmdline,
+		Kernel:  metaFile(base+"-kernel", kernel),
+		Initrd:  metaFile(base+"-initrd.img", initrd),
+	}
+	files := map[string][]byte{
+		base + "-kernel":     kernel,
+		base + "-initrd.img": initrd,
+	}
+	if len(ucode) != 0 {
+		ucodeMeta := metaFile(base+"-ucode.cpio", ucode)
+		meta.Ucode = &ucodeMeta
+		files[base+"-ucode.cpio"] = ucode
+		log.Infof("  %s %s %s %s", base+"-kernel", base+"-initrd.img", base+"-ucode.cpio", base+"-meta.json")
+	} else {
+		log.Infof("  %s %s %s", base+"-kernel", base+"-initrd.img", base+"-meta.json")
+	}
+	for filename, data := range files {
+		if err := ioutil.WriteFile(filename, data, os.FileMode(0644)); err != nil {
+			return err
+		}
+	}
+	buf, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(base+"-meta.json", append(buf, '\n'), os.FileMode(0644))
+}
+
+// replaceCmdline streams an image tarball with the contents of boot/cmdline
+// replaced by cmdline, adding boot/cmdline at the end if the image has none
+func replaceCmdline(image io.Reader, cmdline string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		tr := tar.NewReader(image)
+		tw := tar.NewWriter(pw)
+		replaced := false
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			var r io.Reader = tr
+			if hdr.Name == "boot/cmdline" {
+				hdr.Size = int64(len(cmdline))
+				r = strings.NewReader(cmdline)
+				replaced = true
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(tw, r); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		if !replaced {
+			hdr := &tar.Header{Name: "boot/cmdline", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(cmdline))}
+			if err := tw.WriteHeader(hdr); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.WriteString(tw, cmdline); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(tw.Close())
+	}()
+	return pr
+}
+
+func outputKernelSquashFS(opts *OutputOptions, image, base string, filesystem io.Reader, args ...string) error {
+	return outputSquashFS(opts, image, base, filesystem, true, args...)
+}
+
+// outputSquashFS writes the root filesystem of an image as a squashfs image
+// and its cmdline, and the kernel too if kernel is set
+func outputSquashFS(opts *OutputOptions, image, base string, filesystem io.Reader, kernel bool, args ...string) error {
 	log.Debugf("output kernel/squashfs: %s %s", image, base)
 	log.Infof("  %s-squashfs.img", base)
 
+	// stream the root filesystem to the helper rather than holding it in memory
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := splitKernelRootfs(base, filesystem, pw, kernel)
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+	err := writeHelperOutput(opts, base+"-squashfs.img", pr, image, args...)
+	pr.Close()
+	if splitErr := <-errc; splitErr != nil {
+		return splitErr
+	}
+	return err
+}
+
+// splitKernelRootfs writes the cmdline from an image, and the kernel if kernel
+// is set, to files named from base, and writes the rest of the image except
+// boot/ as a tar to rootfs
+func splitKernelRootfs(base string, filesystem io.Reader, rootfs io.Writer, kernel bool) error {
 	tr := tar.NewReader(filesystem)
-	buf := new(bytes.Buffer)
-	rootfs := tar.NewWriter(buf)
+	tw := tar.NewWriter(rootfs)
 
 	for {
 		var thdr *tar.Header
@@ -463,38 +1349,229 @@ func outputKernelSquashFS(image, base string, filesystem io.Reader) error {
 		}
 		thdr.Format = tar.FormatPAX
 		switch {
-		case thdr.Name == "boot/kernel":
-			kernel, err := ioutil.ReadAll(tr)
-			if err != nil {
-				return err
-			}
-			if err := ioutil.WriteFile(base+"-kernel", kernel, os.FileMode(0644)); err != nil {
+		case thdr.Name == "boot/kernel" && kernel:
+			if err := writeFileFrom(base+"-kernel", tr); err != nil {
 				return err
 			}
 		case thdr.Name == "boot/cmdline":
-			cmdline, err := ioutil.ReadAll(tr)
-			if err != nil {
-				return err
-			}
-			if err := ioutil.WriteFile(base+"-cmdline", cmdline, os.FileMode(0644)); err != nil {
+			if err := writeFileFrom(base+"-cmdline", tr); err != nil {
 				return err
 			}
 		case strings.HasPrefix(thdr.Name, "boot/"):
 			// skip the rest of boot/
 		default:
-			rootfs.WriteHeader(thdr)
-			if _, err := io.Copy(rootfs, tr); err != nil {
+			if err := tw.WriteHeader(thdr); err != nil {
 				return err
 			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+func writeFileFrom(filename string, r io.Reader) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// outputRootfsTar writes the root filesystem of an image, without boot/, as
+// a gzipped tarball that WSL can import with wsl --import
+func outputRootfsTar(filename string, filesystem io.Reader) error {
+	log.Debugf("output rootfs tarball: %s", filename)
+	log.Infof("  %s", filename)
+	output, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(output)
+	err = writeRootfs(zw, filesystem)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeRootfs writes the entries of an image except boot/ as a tar to w
+func writeRootfs(w io.Writer, filesystem io.Reader) error {
+	tr := tar.NewReader(filesystem)
+	tw := tar.NewWriter(w)
+	for {
+		thdr, err := tr.Next()
+		if err == io.EOF {
+			return tw.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(thdr.Name, "boot/") {
+			continue
+		}
+		thdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(thdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
 		}
 	}
-	rootfs.Close()
+}
+
+// dockerImageManifest is an entry in the manifest.json of a docker save tarball
+type dockerImageManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
 
-	output, err := os.Create(base + "-squashfs.img")
+// outputDockerImage loads the root filesystem of an image, without boot/,
+// into Docker as a single layer image named tag for the architecture arch
+func outputDockerImage(tag, arch string, filesystem io.Reader, timeout time.Duration) error {
+	log.Debugf("output docker image: %s", tag)
+	log.Infof("  %s", tag)
+	named, err := distref.ParseNormalizedNamed(tag)
+	if err != nil {
+		return fmt.Errorf("Invalid image name %s: %v", tag, err)
+	}
+	if _, ok := named.(distref.Digested); ok {
+		return fmt.Errorf("Invalid image name %s: cannot load an image by digest", tag)
+	}
+	named = distref.TagNameOnly(named)
+
+	// the layer is written to a temporary file as its size and digest are
+	// needed before it can be added to the tarball
+	layer, err := ioutil.TempFile("", "moby-layer")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(layer.Name())
+	defer layer.Close()
+	h := sha256.New()
+	if err := writeRootfs(io.MultiWriter(layer, h), filesystem); err != nil {
+		return err
+	}
+	layerSize, err := layer.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := layer.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	diffID := hex.EncodeToString(h.Sum(nil))
+
+	config, err := json.Marshal(ocispec.Image{
+		Architecture: arch,
+		OS:           "linux",
+		Config: ocispec.ImageConfig{
+			Entrypoint: []string{"/bin/rc.init"},
+		},
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{digest.NewDigestFromHex("sha256", diffID)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	configSum := sha256.Sum256(config)
+	configName := hex.EncodeToString(configSum[:]) + ".json"
+	layerName := diffID + "/layer.tar"
+	manifest, err := json.Marshal([]dockerImageManifest{{
+		Config:   configName,
+		RepoTags: []string{distref.FamiliarString(named)},
+		Layers:   []string{layerName},
+	}})
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := func() error {
+			for _, f := range []struct {
+				name string
+				b    []byte
+			}{{configName, config}, {"manifest.json", manifest}} {
+				if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.b)), Typeflag: tar.TypeReg}); err != nil {
+					return err
+				}
+				if _, err := tw.Write(f.b); err != nil {
+					return err
+				}
+			}
+			if err := tw.WriteHeader(&tar.Header{Name: layerName, Mode: 0644, Size: layerSize, Typeflag: tar.TypeReg}); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, layer); err != nil {
+				return err
+			}
+			return tw.Close()
+		}()
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+	err = dockerLoad(pr, timeout)
+	pr.Close()
+	if writeErr := <-errc; err == nil {
+		err = writeErr
+	}
+	return err
+}
+
+func outputManifest(filename string, filesystem io.Reader) error {
+	log.Debugf("output manifest: %s", filename)
+	log.Infof("  %s", filename)
+	output, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
 	defer output.Close()
+	return writeManifest(output, filesystem)
+}
+
+var manifestTypes = map[byte]string{
+	tar.TypeReg:     "file",
+	tar.TypeRegA:    "file",
+	tar.TypeLink:    "link",
+	tar.TypeSymlink: "symlink",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+	tar.TypeDir:     "dir",
+	tar.TypeFifo:    "fifo",
+}
 
-	return dockerRun(buf, output, true, image)
+// writeManifest lists every entry in a filesystem tarball, one per line, as
+// tab separated path, type, mode, uid, gid and size
+func writeManifest(w io.Writer, filesystem io.Reader) error {
+	tr := tar.NewReader(filesystem)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		tp, ok := manifestTypes[hdr.Typeflag]
+		if !ok {
+			tp = "other"
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%04o\t%d\t%d\t%d\n", hdr.Name, tp, hdr.Mode&07777, hdr.Uid, hdr.Gid, hdr.Size); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,1369 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testTar(t *testing.T, hdrs []*tar.Header) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, hdr := range hdrs {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write(make([]byte, hdr.Size)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestWriteManifest(t *testing.T) {
+	image := testTar(t, []*tar.Header{
+		{Name: "etc", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644, Size: 12},
+		{Name: "etc/mtab", Typeflag: tar.TypeSymlink, Mode: 0777, Linkname: "/proc/mounts"},
+		{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0600, Uid: 100, Gid: 101, Size: 3},
+	})
+
+	buf := new(bytes.Buffer)
+	if err := writeManifest(buf, image); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "etc\tdir\t0755\t0\t0\t0\n" +
+		"etc/hosts\tfile\t0644\t0\t0\t12\n" +
+		"etc/mtab\tsymlink\t0777\t0\t0\t0\n" +
+		"etc/shadow\tfile\t0600\t100\t101\t3\n"
+	if buf.String() != expected {
+		t.Errorf("Expected manifest:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestRecompress(t *testing.T) {
+	data := bytes.Repeat([]byte("moby gcp disk image "), 4096)
+	in := new(bytes.Buffer)
+	zw := gzip.NewWriter(in)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := new(bytes.Buffer)
+	if err := recompress(stored, bytes.NewReader(in.Bytes()), gzip.NoCompression); err != nil {
+		t.Fatal(err)
+	}
+	best := new(bytes.Buffer)
+	if err := recompress(best, bytes.NewReader(in.Bytes()), gzip.BestCompression); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Len() <= len(data) {
+		t.Errorf("Expected level 0 output to be stored uncompressed, got %d bytes for %d", stored.Len(), len(data))
+	}
+	if best.Len() >= stored.Len() {
+		t.Errorf("Expected level 9 output to be smaller than level 0, got %d and %d bytes", best.Len(), stored.Len())
+	}
+
+	zr, err := gzip.NewReader(best)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Error("Recompressed output does not match input")
+	}
+}
+
+func TestGCPUncompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	disk := bytes.Repeat([]byte("moby gcp disk image "), 4096)
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		zw := gzip.NewWriter(output)
+		tw := tar.NewWriter(zw)
+		if err := tw.WriteHeader(&tar.Header{Name: "disk.raw", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(disk))}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(disk); err != nil {
+			return err
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+	defer func() { runHelper = dockerRun }()
+	GCPCompression = "none"
+	defer func() { GCPCompression = "gzip" }()
+
+	base := filepath.Join(dir, "test")
+	ki := &kernelInitrd{kernel: []byte("kernel"), initrd: []byte("initrd"), cmdline: "console=ttyS0"}
+	if err := outFuns["gcp"](base, nil, ki, 0, nil, &OutputOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if files := OutputFiles(base, "gcp", nil); !reflect.DeepEqual(files, []string{base + ".img"}) {
+		t.Errorf("Expected the gcp output to be %s.img, got %v", base, files)
+	}
+	out, err := ioutil.ReadFile(base + ".img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, disk) {
+		t.Error("Expected the raw disk to be extracted from the helper output")
+	}
+	if _, err := os.Stat(base + ".img.tar.gz"); !os.IsNotExist(err) {
+		t.Errorf("Expected no tarball to be written, got %v", err)
+	}
+
+	// a helper that fails after writing the disk fails the output
+	written := runHelper
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		if err := written(opts, input, output, trust, img, args...); err != nil {
+			return err
+		}
+		return errors.New("helper exited with status 1")
+	}
+	if err := outFuns["gcp"](base, nil, ki, 0, nil, &OutputOptions{}); err == nil || !strings.Contains(err.Error(), "status 1") {
+		t.Errorf("Expected the helper error, got %v", err)
+	}
+	if _, err := os.Stat(base + ".img"); !os.IsNotExist(err) {
+		t.Errorf("Expected the disk to be removed when the helper fails, got %v", err)
+	}
+}
+
+func TestKernelInitrdWithSquashFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testTar(t, []*tar.Header{
+		{Name: "boot", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "boot/cmdline", Typeflag: tar.TypeReg, Mode: 0644, Size: 13},
+		{Name: "boot/kernel", Typeflag: tar.TypeReg, Mode: 0644, Size: 64},
+		{Name: "etc", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644, Size: 12},
+	})
+	imageFile := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(imageFile, image.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var rootfs []string
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		tr := tar.NewReader(input)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			rootfs = append(rootfs, hdr.Name)
+		}
+		_, err := output.Write([]byte("squashfs"))
+		return err
+	}
+	defer func() { runHelper = dockerRun }()
+
+	base := filepath.Join(dir, "test")
+	if err := Formats(base, imageFile, []string{"kernel+initrd", "kernel+squashfs"}, 0, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []string{"-kernel", "-initrd.img", "-cmdline", "-squashfs.img"} {
+		if _, err := os.Stat(base + f); err != nil {
+			t.Errorf("Expected output %s: %v", base+f, err)
+		}
+	}
+	if !reflect.DeepEqual(rootfs, []string{"boot", "etc", "etc/hosts"}) {
+		t.Errorf("Expected squashfs rootfs without boot files, got %v", rootfs)
+	}
+}
+
+func TestFormatsCmdline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testTar(t, []*tar.Header{
+		{Name: "boot", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "boot/cmdline", Typeflag: tar.TypeReg, Mode: 0644, Size: 13},
+		{Name: "boot/kernel", Typeflag: tar.TypeReg, Mode: 0644, Size: 64},
+		{Name: "etc", Typeflag: tar.TypeDir, Mode: 0755},
+	})
+	imageFile := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(imageFile, image.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		_, err := io.Copy(ioutil.Discard, input)
+		return err
+	}
+	defer func() { runHelper = dockerRun }()
+
+	const cmdline = "console=ttyS0 console=tty0 quiet"
+	for _, f := range []string{"kernel+initrd", "squashfs"} {
+		base := filepath.Join(dir, f)
+		if err := Formats(base, imageFile, []string{f}, 0, nil, cmdline, nil); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(base + "-cmdline")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != cmdline {
+			t.Errorf("Expected %s to have cmdline %q, got %q", f, cmdline, got)
+		}
+	}
+
+	base := filepath.Join(dir, "default")
+	if err := Formats(base, imageFile, []string{"squashfs"}, 0, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(base + "-cmdline"); err != nil || len(got) != 13 {
+		t.Errorf("Expected the cmdline of the image without an override, got %q: %v", got, err)
+	}
+
+	// an image without a cmdline gets one
+	image = testTar(t, []*tar.Header{
+		{Name: "boot", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "boot/kernel", Typeflag: tar.TypeReg, Mode: 0644, Size: 64},
+	})
+	if err := ioutil.WriteFile(imageFile, image.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	base = filepath.Join(dir, "nocmdline")
+	if err := Formats(base, imageFile, []string{"squashfs"}, 0, nil, cmdline, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(base + "-cmdline"); err != nil || string(got) != cmdline {
+		t.Errorf("Expected the cmdline to be added to an image without one, got %q: %v", got, err)
+	}
+}
+
+func TestKernelInitrdMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testTar(t, []*tar.Header{
+		{Name: "boot", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "boot/cmdline", Typeflag: tar.TypeReg, Mode: 0644, Size: 13},
+		{Name: "boot/kernel", Typeflag: tar.TypeReg, Mode: 0644, Size: 64},
+		{Name: "boot/ucode.cpio", Typeflag: tar.TypeReg, Mode: 0644, Size: 32},
+		{Name: "etc", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644, Size: 12},
+	})
+	imageFile := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(imageFile, image.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	base := filepath.Join(dir, "test")
+	if err := Formats(base, imageFile, []string{"kernel+initrd+meta"}, 0, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(base + "-cmdline"); !os.IsNotExist(err) {
+		t.Errorf("Expected no plain cmdline file, got %v", err)
+	}
+
+	buf, err := ioutil.ReadFile(base + "-meta.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta map[string]interface{}
+	if err := json.Unmarshal(buf, &meta); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"cmdline", "kernel", "initrd", "ucode"} {
+		if _, ok := meta[field]; !ok {
+			t.Errorf("Expected %s in the metadata, got %s", field, buf)
+		}
+	}
+	if meta["cmdline"] != string(make([]byte, 13)) {
+		t.Errorf("Expected the cmdline from the image, got %q", meta["cmdline"])
+	}
+
+	for _, field := range []string{"kernel", "initrd", "ucode"} {
+		file, ok := meta[field].(map[string]interface{})
+		if !ok {
+			t.Errorf("Expected an object for %s, got %v", field, meta[field])
+			continue
+		}
+		name, _ := file["file"].(string)
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("Cannot read %s file: %v", field, err)
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if file["size"] != float64(len(data)) || file["sha256"] != hex.EncodeToString(sum[:]) {
+			t.Errorf("Metadata for %s does not match %s: %v", field, name, file)
+		}
+	}
+	if name := meta["kernel"].(map[string]interface{})["file"]; name != "test-kernel" {
+		t.Errorf("Expected the kernel in test-kernel, got %v", name)
+	}
+}
+
+func TestDiskMicrocode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	initrds := map[string][]byte{}
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		tr := tar.NewReader(input)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if hdr.Name == "initrd.img" {
+				b, err := ioutil.ReadAll(tr)
+				if err != nil {
+					return err
+				}
+				mu.Lock()
+				initrds[img] = b
+				mu.Unlock()
+			}
+		}
+	}
+	defer func() { runHelper = dockerRun }()
+
+	ki := &kernelInitrd{kernel: []byte("kernel"), initrd: []byte("initrd"), cmdline: "console=ttyS0", ucode: []byte("ucode")}
+	for _, format := range []string{"raw-bios", "raw-efi", "vhd"} {
+		if err := outFuns[format](filepath.Join(dir, "test"), nil, ki, 0, nil, &OutputOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if initrd := initrds[outputImages[format]]; string(initrd) != "ucodeinitrd" {
+			t.Errorf("Expected %s to boot the microcode ahead of the initrd, got %q", format, initrd)
+		}
+	}
+	if string(ki.initrd) != "initrd" {
+		t.Errorf("Expected the initrd without microcode to be kept, got %q", ki.initrd)
+	}
+}
+
+func TestVagrantBox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	MobyDir = dir
+	defer func() { MobyDir = "" }()
+
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		// sparse vmdk header for a 1GB disk
+		header := make([]byte, 512)
+		copy(header, "KDMV")
+		binary.LittleEndian.PutUint64(header[12:], 2097152)
+		_, err := output.Write(header)
+		return err
+	}
+	defer func() { runHelper = dockerRun }()
+
+	filename := filepath.Join(dir, "test.box")
+	if err := outputVagrant(&OutputOptions{}, "vmdk", filename, []byte("kernel"), []byte("initrd"), "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	contents := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[hdr.Name], err = ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"metadata.json", "Vagrantfile", "box.ovf", "box-disk1.vmdk"} {
+		if _, ok := contents[name]; !ok {
+			t.Errorf("Expected %s in box", name)
+		}
+	}
+	if string(contents["metadata.json"]) != `{"provider": "virtualbox"}` {
+		t.Errorf("Unexpected metadata.json: %s", contents["metadata.json"])
+	}
+	ovf := string(contents["box.ovf"])
+	if !strings.Contains(ovf, `ovf:capacity="1073741824"`) || !strings.Contains(ovf, `ovf:size="512"`) {
+		t.Errorf("Expected disk size and capacity in box.ovf:\n%s", ovf)
+	}
+}
+
+func TestOVA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	MobyDir = dir
+	defer func() { MobyDir = "" }()
+
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		// sparse vmdk header for a 1GB disk
+		header := make([]byte, 512)
+		copy(header, "KDMV")
+		binary.LittleEndian.PutUint64(header[12:], 2097152)
+		_, err := output.Write(header)
+		return err
+	}
+	defer func() { runHelper = dockerRun }()
+
+	filename := filepath.Join(dir, "test.ova")
+	if err := outputOVA(&OutputOptions{OVAName: "linuxkit-vm"}, "vmdk", filename, []byte("kernel"), []byte("initrd"), "console=ttyS0"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	var names []string
+	contents := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		contents[hdr.Name], err = ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"test.ovf", "test.mf", "test-disk1.vmdk"}) {
+		t.Fatalf("Expected the descriptor, manifest and disk in order, got %v", names)
+	}
+	ovf := string(contents["test.ovf"])
+	if !strings.Contains(ovf, `ovf:capacity="1073741824"`) || !strings.Contains(ovf, `ovf:size="512"`) {
+		t.Errorf("Expected disk size and capacity in test.ovf:\n%s", ovf)
+	}
+	if !strings.Contains(ovf, "<Name>linuxkit-vm</Name>") || !strings.Contains(ovf, `ovf:href="test-disk1.vmdk"`) {
+		t.Errorf("Expected the VM name and disk in test.ovf:\n%s", ovf)
+	}
+	diskSum := sha256.Sum256(contents["test-disk1.vmdk"])
+	if !strings.Contains(string(contents["test.mf"]), fmt.Sprintf("SHA256(test-disk1.vmdk)= %x\n", diskSum)) {
+		t.Errorf("Expected the disk hash in the manifest, got:\n%s", contents["test.mf"])
+	}
+}
+
+func TestHelperFailureRemovesOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		if _, err := output.Write([]byte("partial")); err != nil {
+			return err
+		}
+		return fmt.Errorf("docker run %s failed: exit status 1", img)
+	}
+	defer func() { runHelper = dockerRun }()
+
+	filename := filepath.Join(dir, "test.iso")
+	if err := outputIso(&OutputOptions{}, "iso-bios", filename, new(bytes.Buffer)); err == nil {
+		t.Fatal("Expected failing helper to return an error")
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Expected partial output to be removed, got %v", err)
+	}
+}
+
+func TestKernelSquashFSStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// write an image with a large file to disk without holding it in memory
+	const size = 64 << 20
+	imageFile := filepath.Join(dir, "image.tar")
+	f, err := os.Create(imageFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	if err := tw.WriteHeader(&tar.Header{Name: "big", Typeflag: tar.TypeReg, Mode: 0644, Size: size}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.CopyN(tw, zeroReader{}, size); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		_, err := io.Copy(output, input)
+		return err
+	}
+	defer func() { runHelper = dockerRun }()
+
+	image, err := os.Open(imageFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	base := filepath.Join(dir, "test")
+	if err := outputKernelSquashFS(&OutputOptions{}, "squashfs", base, image); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+
+	fi, err := os.Stat(base + "-squashfs.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() < size {
+		t.Errorf("Expected at least %d bytes of output, got %d", size, fi.Size())
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > size/4 {
+		t.Errorf("Expected output to be streamed, allocated %d bytes", alloc)
+	}
+}
+
+func TestSquashFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for name, contents := range map[string]string{
+		"boot/kernel":  "kernel",
+		"boot/cmdline": "console=ttyS0 root=/dev/sda",
+		"etc/motd":     "hello",
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var rootfs []string
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		tr := tar.NewReader(input)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			rootfs = append(rootfs, hdr.Name)
+		}
+	}
+	defer func() { runHelper = dockerRun }()
+
+	base := filepath.Join(dir, "test")
+	if err := outFuns["squashfs"](base, buf, nil, 0, nil, &OutputOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(rootfs, ",") != "etc/motd" {
+		t.Errorf("Expected only etc/motd in the root filesystem, got %v", rootfs)
+	}
+	cmdline, err := ioutil.ReadFile(base + "-cmdline")
+	if err != nil || string(cmdline) != "console=ttyS0 root=/dev/sda" {
+		t.Errorf("Expected the cmdline to be written, got %q: %v", cmdline, err)
+	}
+	if _, err := os.Stat(base + "-squashfs.img"); err != nil {
+		t.Errorf("Expected the squashfs image to be written: %v", err)
+	}
+	if _, err := os.Stat(base + "-kernel"); !os.IsNotExist(err) {
+		t.Errorf("Expected no kernel to be written, got %v", err)
+	}
+}
+
+func TestRootfsTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testTar(t, []*tar.Header{
+		{Name: "boot/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "boot/kernel", Typeflag: tar.TypeReg, Mode: 0644, Size: 6},
+		{Name: "boot/cmdline", Typeflag: tar.TypeReg, Mode: 0644, Size: 13},
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+		{Name: "etc/mtab", Typeflag: tar.TypeSymlink, Mode: 0777, Linkname: "/proc/mounts"},
+	})
+
+	base := filepath.Join(dir, "test")
+	if err := outFuns["wsl"](base, image, nil, 0, nil, &OutputOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(base + "-rootfs.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Expected a gzipped tarball: %v", err)
+	}
+	var names []string
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if strings.Join(names, ",") != "etc/,etc/motd,etc/mtab" {
+		t.Errorf("Expected the root filesystem without boot/, got %v", names)
+	}
+	if _, err := os.Stat(base + "-cmdline"); !os.IsNotExist(err) {
+		t.Errorf("Expected no cmdline to be written, got %v", err)
+	}
+}
+
+func TestDockerImage(t *testing.T) {
+	loaded := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/images/load") {
+			w.Header().Set("API-Version", "1.30")
+			w.Write([]byte("OK"))
+			return
+		}
+		tr := tar.NewReader(r.Body)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			loaded[hdr.Name], _ = ioutil.ReadAll(tr)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"stream":"Loaded image: linuxkit/test:dev\n"}`))
+	}))
+	defer srv.Close()
+	host := os.Getenv("DOCKER_HOST")
+	os.Setenv("DOCKER_HOST", "tcp://"+srv.Listener.Addr().String())
+	defer os.Setenv("DOCKER_HOST", host)
+
+	image := testTar(t, []*tar.Header{
+		{Name: "boot/kernel", Typeflag: tar.TypeReg, Mode: 0644, Size: 6},
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+	})
+	if err := outFuns["docker-image"]("test", image, nil, 0, nil, &OutputOptions{DockerImageTag: "linuxkit/test:dev"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest []dockerImageManifest
+	if err := json.Unmarshal(loaded["manifest.json"], &manifest); err != nil {
+		t.Fatalf("Expected a manifest.json: %v", err)
+	}
+	if len(manifest) != 1 || !reflect.DeepEqual(manifest[0].RepoTags, []string{"linuxkit/test:dev"}) || len(manifest[0].Layers) != 1 {
+		t.Fatalf("Unexpected manifest %+v", manifest)
+	}
+	var config struct {
+		OS     string `json:"os"`
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(loaded[manifest[0].Config], &config); err != nil {
+		t.Fatalf("Expected the image config: %v", err)
+	}
+	layer := loaded[manifest[0].Layers[0]]
+	sum := sha256.Sum256(layer)
+	if config.OS != "linux" || len(config.RootFS.DiffIDs) != 1 || config.RootFS.DiffIDs[0] != "sha256:"+hex.EncodeToString(sum[:]) {
+		t.Errorf("Expected the config to have the digest of the layer, got %+v", config)
+	}
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(layer))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if strings.Join(names, ",") != "etc/,etc/motd" {
+		t.Errorf("Expected the layer to have the root filesystem without boot/, got %v", names)
+	}
+
+	if err := outputDockerImage("Invalid Name", "amd64", testTar(t, nil), 0); err == nil {
+		t.Error("Expected an invalid image name to fail")
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestOutputNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testTar(t, []*tar.Header{
+		{Name: "boot", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "boot/cmdline", Typeflag: tar.TypeReg, Mode: 0644, Size: 13},
+		{Name: "boot/kernel", Typeflag: tar.TypeReg, Mode: 0644, Size: 64},
+	})
+	imageFile := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(imageFile, image.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		_, err := output.Write([]byte("iso"))
+		return err
+	}
+	defer func() { runHelper = dockerRun }()
+	names := map[string]string{"iso-bios": "myapp-v1.2"}
+
+	if err := Formats(filepath.Join(dir, "myapp-latest"), imageFile, []string{"kernel+initrd", "iso-bios"}, 0, nil, "", &OutputOptions{Names: names}); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"myapp-latest-kernel", "myapp-latest-initrd.img", "myapp-v1.2.iso"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Errorf("Expected output %s: %v", f, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "myapp-latest.iso")); !os.IsNotExist(err) {
+		t.Errorf("Expected iso-bios not to use the shared base, got %v", err)
+	}
+}
+
+func TestHelperArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := NewConfig([]byte(`
+outputs:
+  raw-bios:
+    args: ["-label", "BOOT"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewConfig([]byte("outputs:\n  kernel+initrd:\n    args: [\"-x\"]\n")); err == nil {
+		t.Error("Expected helper arguments for a format without a helper to be rejected")
+	}
+
+	image := testTar(t, []*tar.Header{
+		{Name: "boot", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "boot/cmdline", Typeflag: tar.TypeReg, Mode: 0644, Size: 13},
+		{Name: "boot/kernel", Typeflag: tar.TypeReg, Mode: 0644, Size: 64},
+	})
+	imageFile := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(imageFile, image.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	cmds := map[string][]string{}
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		cmds[img] = args
+		return nil
+	}
+	defer func() { runHelper = dockerRun }()
+
+	if err := Formats(filepath.Join(dir, "test"), imageFile, []string{"raw-bios", "iso-bios"}, 0, m.HelperArgs(), "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := cmds[outputImages["raw-bios"]]; len(got) != 3 || !reflect.DeepEqual(got[1:], []string{"-label", "BOOT"}) {
+		t.Errorf("Expected the cmdline followed by the extra args for raw-bios, got %q", got)
+	}
+	if got := cmds[outputImages["iso-bios"]]; len(got) != 0 {
+		t.Errorf("Expected no args for iso-bios, got %q", got)
+	}
+}
+
+func TestParallelFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testTar(t, []*tar.Header{
+		{Name: "boot", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "boot/cmdline", Typeflag: tar.TypeReg, Mode: 0644, Size: 13},
+		{Name: "boot/kernel", Typeflag: tar.TypeReg, Mode: 0644, Size: 64},
+	})
+	imageFile := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(imageFile, image.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	running, most := 0, 0
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if img == outputImages["vhd"] {
+			return fmt.Errorf("helper failed")
+		}
+		return nil
+	}
+	defer func() { runHelper = dockerRun }()
+
+	ParallelOutputs = 2
+	defer func() { ParallelOutputs = 4 }()
+	err = Formats(filepath.Join(dir, "test"), imageFile, []string{"raw-bios", "raw-efi", "vhd", "vmdk"}, 0, nil, "", nil)
+	if err == nil || !strings.Contains(err.Error(), "vhd") {
+		t.Errorf("Expected an error naming the vhd output, got %v", err)
+	}
+	if most != 2 {
+		t.Errorf("Expected 2 outputs to be generated at once, got %d", most)
+	}
+}
+
+func TestOverlappingFormats(t *testing.T) {
+	groups := outputGroups("test", []string{"vhd", "raw-bios", "kernel+initrd", "dynamic-vhd", "squashfs", "verity", "iso-bios"}, nil)
+	if !reflect.DeepEqual(groups, [][]int{{0, 3}, {1}, {2, 4, 5}, {6}}) {
+		t.Errorf("Expected formats writing the same files to be grouped, got %v", groups)
+	}
+
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image := testTar(t, []*tar.Header{
+		{Name: "boot/cmdline", Typeflag: tar.TypeReg, Mode: 0644, Size: 13},
+		{Name: "boot/kernel", Typeflag: tar.TypeReg, Mode: 0644, Size: 64},
+	})
+	imageFile := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(imageFile, image.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	running, most := 0, 0
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}
+	defer func() { runHelper = dockerRun }()
+
+	if err := Formats(filepath.Join(dir, "test"), imageFile, []string{"vhd", "dynamic-vhd"}, 0, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if most != 1 {
+		t.Errorf("Expected formats writing the same file to run one at a time, got %d at once", most)
+	}
+}
+
+func TestFormatsSplitOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testTar(t, []*tar.Header{
+		{Name: "boot", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "boot/cmdline", Typeflag: tar.TypeReg, Mode: 0644, Size: 13},
+		{Name: "boot/kernel", Typeflag: tar.TypeReg, Mode: 0644, Size: 64},
+		{Name: "etc", Typeflag: tar.TypeDir, Mode: 0755},
+	})
+	imageFile := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(imageFile, image.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var splits int32
+	splitImage = func(r io.Reader) ([]byte, []byte, string, []byte, error) {
+		atomic.AddInt32(&splits, 1)
+		return tarToInitrd(r)
+	}
+	defer func() { splitImage = tarToInitrd }()
+	var mu sync.Mutex
+	inputs := map[string][]byte{}
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		buf, err := ioutil.ReadAll(input)
+		mu.Lock()
+		inputs[img] = buf
+		mu.Unlock()
+		return err
+	}
+	defer func() { runHelper = dockerRun }()
+
+	base := filepath.Join(dir, "test")
+	if err := Formats(base, imageFile, []string{"iso-bios"}, 0, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if splits != 0 {
+		t.Errorf("Expected the image not to be split for iso-bios, split %d times", splits)
+	}
+	if !bytes.Equal(inputs[outputImages["iso-bios"]], image.Bytes()) {
+		t.Error("Expected iso-bios to be given the original image tarball")
+	}
+
+	if err := Formats(base, imageFile, []string{"kernel+initrd", "raw-bios", "vhd", "iso-efi"}, 0, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if splits != 1 {
+		t.Errorf("Expected the image to be split once for all formats, split %d times", splits)
+	}
+	if !bytes.Equal(inputs[outputImages["iso-efi"]], image.Bytes()) {
+		t.Error("Expected iso-efi to be given the original image tarball")
+	}
+}
+
+func TestParallelHeavyFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	MobyDir = dir
+	defer func() { MobyDir = "" }()
+
+	image := testTar(t, []*tar.Header{
+		{Name: "boot", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "boot/cmdline", Typeflag: tar.TypeReg, Mode: 0644, Size: 13},
+		{Name: "boot/kernel", Typeflag: tar.TypeReg, Mode: 0644, Size: 64},
+	})
+	imageFile := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(imageFile, image.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buildLinuxkitImage = func(name, filename string) error {
+		return writeKernelInitrd(filename, nil, nil, "")
+	}
+	defer func() { buildLinuxkitImage = buildLinuxkitKernelInitrd }()
+
+	var mu sync.Mutex
+	running, heavy, mostHeavy, most, heavyDone := 0, 0, 0, 0, 0
+	lightWithFirstHeavy := false
+	track := func(isHeavy bool) func() {
+		mu.Lock()
+		if !isHeavy && heavy > 0 && heavyDone == 0 {
+			lightWithFirstHeavy = true
+		}
+		running++
+		if isHeavy {
+			heavy++
+		}
+		if running > most {
+			most = running
+		}
+		if heavy > mostHeavy {
+			mostHeavy = heavy
+		}
+		mu.Unlock()
+		return func() {
+			// heavy outputs run for longer, so light outputs have time to start alongside them
+			if isHeavy {
+				time.Sleep(150 * time.Millisecond)
+			} else {
+				time.Sleep(50 * time.Millisecond)
+			}
+			mu.Lock()
+			running--
+			if isHeavy {
+				heavy--
+				heavyDone++
+			}
+			mu.Unlock()
+		}
+	}
+	saved := map[string]func(string, io.Reader, *kernelInitrd, int, []string, *OutputOptions) error{}
+	for _, o := range []string{"aws", "qcow2-bios"} {
+		saved[o] = outFuns[o]
+		outFuns[o] = func(base string, image io.Reader, ki *kernelInitrd, size int, args []string, opts *OutputOptions) error {
+			track(true)()
+			return nil
+		}
+	}
+	defer func() {
+		for o, f := range saved {
+			outFuns[o] = f
+		}
+	}()
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		track(false)()
+		return nil
+	}
+	defer func() { runHelper = dockerRun }()
+
+	ParallelOutputs, ParallelHeavyOutputs = 4, 1
+	err = Formats(filepath.Join(dir, "test"), imageFile, []string{"aws", "qcow2-bios", "raw-bios", "vhd", "vmdk"}, 0, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mostHeavy != 1 {
+		t.Errorf("Expected one heavy output at a time, got %d", mostHeavy)
+	}
+	if most < 2 {
+		t.Errorf("Expected light outputs alongside the heavy output, got %d at once", most)
+	}
+
+	// a heavy output waiting for another does not hold the only other slot
+	heavyDone, lightWithFirstHeavy = 0, false
+	ParallelOutputs = 2
+	defer func() { ParallelOutputs = 4 }()
+	err = Formats(filepath.Join(dir, "test"), imageFile, []string{"aws", "qcow2-bios", "raw-bios", "vhd", "vmdk"}, 0, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lightWithFirstHeavy {
+		t.Errorf("Expected a light output to run alongside the first heavy output")
+	}
+}
+
+func TestOutputMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testTar(t, []*tar.Header{
+		{Name: "boot", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "boot/cmdline", Typeflag: tar.TypeReg, Mode: 0644, Size: 13},
+		{Name: "boot/kernel", Typeflag: tar.TypeReg, Mode: 0644, Size: 64},
+	})
+	imageFile := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(imageFile, image.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(dir, "test")
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		// the output only gets its own name once it has the mode
+		if _, err := os.Stat(base + ".iso"); !os.IsNotExist(err) {
+			return fmt.Errorf("Expected the iso to be written under another name, got %v", err)
+		}
+		_, err := io.Copy(ioutil.Discard, input)
+		return err
+	}
+	defer func() { runHelper = dockerRun }()
+
+	formats := []string{"kernel+initrd", "tar-kernel-initrd", "iso-bios"}
+	if err := Formats(base, imageFile, formats, 0, nil, "", &OutputOptions{Mode: 0640}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".moby-output") {
+			t.Errorf("Expected the temporary directory %s to be removed", e.Name())
+		}
+	}
+	for _, f := range formats {
+		for _, file := range OutputFiles(base, f, nil) {
+			fi, err := os.Stat(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0640 {
+				t.Errorf("Expected %s to have mode 0640, got %v", file, fi.Mode().Perm())
+			}
+		}
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testTar(t, []*tar.Header{
+		{Name: "boot", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "boot/cmdline", Typeflag: tar.TypeReg, Mode: 0644, Size: 13},
+		{Name: "boot/kernel", Typeflag: tar.TypeReg, Mode: 0644, Size: 64},
+	})
+	imageFile := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(imageFile, image.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		_, err := io.Copy(output, input)
+		return err
+	}
+	defer func() { runHelper = dockerRun }()
+
+	base := filepath.Join(dir, "test")
+	formats := []string{"kernel+initrd", "iso-bios"}
+	if err := Formats(base, imageFile, formats, 0, nil, "", &OutputOptions{Checksums: true}); err != nil {
+		t.Fatal(err)
+	}
+	var files int
+	for _, f := range formats {
+		for _, file := range OutputFiles(base, f, nil) {
+			files++
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum := sha256.Sum256(b)
+			expected := hex.EncodeToString(sum[:]) + "  " + filepath.Base(file) + "\n"
+			sidecar, err := ioutil.ReadFile(file + ".sha256")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(sidecar) != expected {
+				t.Errorf("Expected %q in checksum of %s, got %q", expected, file, sidecar)
+			}
+		}
+	}
+	if files != 4 {
+		t.Errorf("Expected checksums of 4 files, got %d", files)
+	}
+
+	// an image without a kernel or cmdline only has a squashfs image
+	noKernel := filepath.Join(dir, "nokernel.tar")
+	if err := ioutil.WriteFile(noKernel, testTar(t, []*tar.Header{{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}}).Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	base = filepath.Join(dir, "nokernel")
+	if err := Formats(base, noKernel, []string{"squashfs"}, 0, nil, "", &OutputOptions{Checksums: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(base + "-squashfs.img.sha256"); err != nil {
+		t.Errorf("Expected a checksum of the squashfs image: %v", err)
+	}
+	if _, err := os.Stat(base + "-cmdline.sha256"); !os.IsNotExist(err) {
+		t.Errorf("Expected no checksum of a missing cmdline, got %v", err)
+	}
+}
+
+func TestRegisterOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	image := testTar(t, []*tar.Header{
+		{Name: "etc", Typeflag: tar.TypeDir, Mode: 0755},
+	})
+	imageFile := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(imageFile, image.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var gotBase string
+	var gotImage []byte
+	var gotSize int
+	err = RegisterOutput("custom", []string{".custom"}, func(base string, image io.Reader, size int) error {
+		gotBase, gotSize = base, size
+		gotImage, err = ioutil.ReadAll(image)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(base+".custom", gotImage, 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		delete(outFuns, "custom")
+		delete(outputSuffixes, "custom")
+		delete(filesystemFormats, "custom")
+	}()
+
+	found := false
+	for _, o := range OutputTypes() {
+		found = found || o == "custom"
+	}
+	if !found {
+		t.Error("Expected the custom output to be listed in OutputTypes")
+	}
+	if err := ValidateFormats([]string{"custom"}); err != nil {
+		t.Fatal(err)
+	}
+
+	base := filepath.Join(dir, "test")
+	if err := Formats(base, imageFile, []string{"custom"}, 2048, nil, "", &OutputOptions{Checksums: true}); err != nil {
+		t.Fatal(err)
+	}
+	if gotBase != base || gotSize != 2048 || !bytes.Equal(gotImage, image.Bytes()) {
+		t.Errorf("Expected the custom output to get %s, the image and 2048, got %s, %d bytes and %d", base, gotBase, len(gotImage), gotSize)
+	}
+	if files := OutputFiles(base, "custom", nil); !reflect.DeepEqual(files, []string{base + ".custom"}) {
+		t.Errorf("Expected the files of the custom output to be listed, got %v", files)
+	}
+	if _, err := os.Stat(base + ".custom.sha256"); err != nil {
+		t.Errorf("Expected a checksum of the custom output: %v", err)
+	}
+
+	for _, name := range []string{"custom", "kernel+initrd", "tar", ""} {
+		if err := RegisterOutput(name, nil, func(string, io.Reader, int) error { return nil }); err == nil {
+			t.Errorf("Expected registering %q to fail", name)
+		}
+	}
+}
+
+func TestHelperImageOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "helper-images.yml")
+	if err := ioutil.WriteFile(file, []byte("iso-bios: mirror.local/mkimage-iso-bios:v1\nvmdk: mirror.local/mkimage-vmdk:v1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	environ := []string{"PATH=/bin", "MOBY_HELPER_IMAGE_ISO_BIOS=mirror.local/mkimage-iso-bios:v2", "MOBY_HELPER_IMAGE_DYNAMIC_VHD=mirror.local/mkimage-dynamic-vhd:v1", "MOBY_HELPER_IMAGE_RAW_EFI="}
+	update, err := HelperImageOverrides(environ, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"iso-bios":    "mirror.local/mkimage-iso-bios:v2",
+		"vmdk":        "mirror.local/mkimage-vmdk:v1",
+		"dynamic-vhd": "mirror.local/mkimage-dynamic-vhd:v1",
+	}
+	if !reflect.DeepEqual(update, expected) {
+		t.Errorf("Expected overrides %v, got %v", expected, update)
+	}
+
+	if update, err := HelperImageOverrides(nil, filepath.Join(dir, "missing.yml")); err != nil || len(update) != 0 {
+		t.Errorf("Expected no overrides without a file, got %v: %v", update, err)
+	}
+	if _, err := HelperImageOverrides([]string{"MOBY_HELPER_IMAGE_FLOPPY=mirror.local/floppy:v1"}, ""); err == nil {
+		t.Error("Expected an unknown helper to be rejected")
+	}
+	if _, err := HelperImageOverrides([]string{"MOBY_HELPER_IMAGE_VHD=Not A Reference"}, ""); err == nil {
+		t.Error("Expected an invalid image to be rejected")
+	}
+}
@@ -0,0 +1,121 @@
+package moby
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	units "github.com/docker/go-units"
+	log "github.com/sirupsen/logrus"
+)
+
+// ProgressInterval is how often the overall progress of an image pull is
+// logged. Each change in the status of a layer is logged at debug level.
+var ProgressInterval = 5 * time.Second
+
+// pullMessage is a message in the JSON progress stream of an image pull.
+// Only the messages about a layer have progress details, others such as
+// "Pulling from" have the tag as their ID.
+type pullMessage struct {
+	ID             string          `json:"id"`
+	Status         string          `json:"status"`
+	Error          string          `json:"error"`
+	ProgressDetail *progressDetail `json:"progressDetail"`
+}
+
+type progressDetail struct {
+	Current int64 `json:"current"`
+	Total   int64 `json:"total"`
+}
+
+type layerProgress struct {
+	status  string
+	current int64
+	total   int64
+	done    bool
+}
+
+// pullProgress is the progress of the layers of an image pull
+type pullProgress struct {
+	layers map[string]*layerProgress
+	order  []string
+}
+
+// update records a message, returning true if the status of its layer changed
+func (p *pullProgress) update(msg pullMessage) bool {
+	if msg.ID == "" || msg.ProgressDetail == nil {
+		return false
+	}
+	l, ok := p.layers[msg.ID]
+	if !ok {
+		l = &layerProgress{}
+		p.layers[msg.ID] = l
+		p.order = append(p.order, msg.ID)
+	}
+	changed := l.status != msg.Status
+	l.status = msg.Status
+	switch msg.Status {
+	case "Downloading":
+		l.current, l.total = msg.ProgressDetail.Current, msg.ProgressDetail.Total
+	case "Verifying Checksum", "Download complete", "Extracting":
+		l.current = l.total
+	case "Pull complete", "Already exists":
+		l.current = l.total
+		l.done = true
+	}
+	return changed
+}
+
+// summary describes the progress of every layer seen so far
+func (p *pullProgress) summary() string {
+	var done int
+	var current, total int64
+	for _, id := range p.order {
+		l := p.layers[id]
+		if l.done {
+			done++
+		}
+		current += l.current
+		total += l.total
+	}
+	s := fmt.Sprintf("%d/%d layers complete", done, len(p.order))
+	if total > 0 {
+		s += fmt.Sprintf(", %s of %s downloaded", units.HumanSize(float64(current)), units.HumanSize(float64(total)))
+	}
+	return s
+}
+
+// readPullProgress consumes the JSON progress stream of a pull of ref,
+// logging its progress and returning the first error reported in it
+func readPullProgress(ref string, r io.Reader) error {
+	p := pullProgress{layers: map[string]*layerProgress{}}
+	last := time.Now()
+	dec := json.NewDecoder(r)
+	for {
+		var msg pullMessage
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		if msg.ID == "" || msg.ProgressDetail == nil {
+			if msg.Status != "" {
+				log.Debugf("%s", msg.Status)
+			}
+			continue
+		}
+		if p.update(msg) {
+			log.Debugf("Pull image: %s: layer %s: %s", ref, msg.ID, msg.Status)
+		}
+		if time.Since(last) >= ProgressInterval {
+			last = time.Now()
+			log.Infof("Pull image: %s: %s", ref, p.summary())
+		}
+	}
+}
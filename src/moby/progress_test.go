@@ -0,0 +1,46 @@
+package moby
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPullProgress(t *testing.T) {
+	p := pullProgress{layers: map[string]*layerProgress{}}
+	msgs := []pullMessage{
+		{ID: "v1", Status: "Pulling from linuxkit/init"},
+		{ID: "a", Status: "Pulling fs layer", ProgressDetail: &progressDetail{}},
+		{ID: "b", Status: "Already exists", ProgressDetail: &progressDetail{}},
+		{ID: "a", Status: "Downloading", ProgressDetail: &progressDetail{Current: 1000, Total: 4000}},
+		{ID: "a", Status: "Downloading", ProgressDetail: &progressDetail{Current: 2000, Total: 4000}},
+	}
+	var changes int
+	for _, msg := range msgs {
+		if p.update(msg) {
+			changes++
+		}
+	}
+	if changes != 3 {
+		t.Errorf("Expected 3 status changes, got %d", changes)
+	}
+	if s := p.summary(); s != "1/2 layers complete, 2 kB of 4 kB downloaded" {
+		t.Errorf("Unexpected summary %q", s)
+	}
+	p.update(pullMessage{ID: "a", Status: "Pull complete", ProgressDetail: &progressDetail{}})
+	if s := p.summary(); s != "2/2 layers complete, 4 kB of 4 kB downloaded" {
+		t.Errorf("Unexpected summary %q", s)
+	}
+}
+
+func TestReadPullProgress(t *testing.T) {
+	stream := `{"status":"Pulling from linuxkit/init","id":"v1"}` +
+		`{"status":"Downloading","id":"a","progressDetail":{"current":10,"total":20}}` +
+		`{"status":"Digest: sha256:abc"}`
+	if err := readPullProgress("linuxkit/init:v1", strings.NewReader(stream)); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	err := readPullProgress("linuxkit/init:v1", strings.NewReader(`{"status":"Downloading","id":"a"}{"error":"unexpected EOF"}`))
+	if err == nil || !strings.Contains(err.Error(), "unexpected EOF") {
+		t.Errorf("Expected the error from the stream, got %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package moby
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// ParallelPulls is the number of images pulled at the same time
+var ParallelPulls = 4
+
+// PullPolicy is when a build pulls the images it uses
+type PullPolicy string
+
+const (
+	// PullAlways pulls every image, even if it is available locally
+	PullAlways PullPolicy = "always"
+	// PullMissing pulls an image only if it is not available locally
+	PullMissing PullPolicy = "missing"
+	// PullNever never pulls an image, and fails if it is not available locally
+	PullNever PullPolicy = "never"
+)
+
+// ParsePullPolicy parses a pull policy. For compatibility with the boolean
+// -pull option, "true" is PullAlways and "false" is PullMissing.
+func ParsePullPolicy(s string) (PullPolicy, error) {
+	switch s {
+	case "always", "true":
+		return PullAlways, nil
+	case "missing", "false":
+		return PullMissing, nil
+	case "never":
+		return PullNever, nil
+	}
+	return "", fmt.Errorf("Invalid pull policy %q, must be always, missing or never", s)
+}
+
+// pullImage pulls an image for a build
+var pullImage = pullIfNeeded
+
+// pullIfNeeded pulls an image as the pull policy says. An image that content
+// trust is enforced for is always resolved to its signed digest first, so a
+// local image with the same tag is not trusted.
+func pullIfNeeded(ref *reference.Spec, pull PullPolicy, trust bool, platform string, timeout time.Duration) error {
+	switch pull {
+	case PullAlways:
+		return dockerPull(ref, true, trust, platform, timeout)
+	case PullNever:
+		if trust {
+			if err := resolveTrusted(ref); err != nil {
+				return err
+			}
+		}
+	default:
+		if trust {
+			return dockerPull(ref, false, true, platform, timeout)
+		}
+	}
+
+	cli, err := dockerClient(timeout)
+	if err != nil {
+		return err
+	}
+	inspect, variant, err := imageInspectVariant(cli, ref.String(), timeout)
+	if err == nil {
+		if platformMatches(platform, inspect.Os, inspect.Architecture, variant) {
+			recordImage(ref.String(), repoDigest(inspect, ref))
+			return nil
+		}
+		if pull == PullNever {
+			return fmt.Errorf("Image %s is for %s/%s, not %s, and the pull policy is never", ref, inspect.Os, inspect.Architecture, platform)
+		}
+		log.Debugf("Image %s is for %s/%s, pulling for %s", ref, inspect.Os, inspect.Architecture, platform)
+	} else if !client.IsErrNotFound(err) {
+		return err
+	} else if pull == PullNever {
+		return fmt.Errorf("Image %s is not available locally and the pull policy is never", ref)
+	}
+	return dockerPull(ref, true, false, platform, timeout)
+}
+
+// platformMatches returns true if an image for goos, goarch and variant is
+// for platform, which any image is if platform is empty. An image without a
+// variant matches any variant, as older daemons do not report it.
+func platformMatches(platform, goos, goarch, variant string) bool {
+	if platform == "" {
+		return true
+	}
+	wantOS, wantArch, wantVariant, err := ParsePlatform(platform)
+	if err != nil {
+		return false
+	}
+	if wantVariant != "" && variant != "" && variant != wantVariant {
+		return false
+	}
+	return goos == wantOS && goarch == wantArch
+}
+
+// imageRefs returns the references of every image in the config
+func imageRefs(m Moby) []*reference.Spec {
+	refs := []*reference.Spec{}
+	if m.Kernel.ref != nil {
+		refs = append(refs, m.Kernel.ref)
+	}
+	if m.Kernel.Microcode != nil && m.Kernel.Microcode.ref != nil {
+		refs = append(refs, m.Kernel.Microcode.ref)
+	}
+	refs = append(refs, m.initRefs...)
+	for _, images := range [][]*Image{m.Onboot, m.Onshutdown, m.Services} {
+		for _, image := range images {
+			if image.ref != nil {
+				refs = append(refs, image.ref)
+			}
+		}
+	}
+	return refs
+}
+
+// trustedReference looks up the signed digest of an image
+var trustedReference = TrustedReference
+
+// ResolveTrust pins every image in the config that content trust is enforced
+// for to its signed digest, as a build does when it pulls the image
+func ResolveTrust(m *Moby) error {
+	for _, ref := range imageRefs(*m) {
+		if ref.Digest() != "" || !enforceContentTrust(ref.String(), &m.Trust) {
+			continue
+		}
+		if err := resolveTrusted(ref); err != nil {
+			return err
+		}
+	}
+	updateImages(m)
+	return nil
+}
+
+// resolveTrusted pins an image reference to its signed digest
+func resolveTrusted(ref *reference.Spec) error {
+	trusted, err := trustedReference(ref.String())
+	if err != nil {
+		return fmt.Errorf("Cannot resolve trusted digest for %s: %v", ref, err)
+	}
+	spec, err := reference.Parse(trusted.String())
+	if err != nil {
+		return fmt.Errorf("failed to convert trusted img %s to Spec: %v", trusted, err)
+	}
+	ref.Locator = spec.Locator
+	ref.Object = spec.Object
+	return nil
+}
+
+// prePull pulls the images in the config before they are used, with up to
+// ParallelPulls pulls at the same time. Images that are read from the
+// content store are not pulled.
+func prePull(m Moby, pull PullPolicy) error {
+	seen := map[string]bool{}
+	refs := []*reference.Spec{}
+	for _, ref := range imageRefs(m) {
+		if inContentStore(ref) {
+			continue
+		}
+		if !seen[ref.String()] {
+			seen[ref.String()] = true
+			refs = append(refs, ref)
+		}
+	}
+
+	n := ParallelPulls
+	if n < 1 {
+		n = 1
+	}
+	errs := make([]error, len(refs))
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for i, ref := range refs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, ref *reference.Spec) {
+			defer wg.Done()
+			errs[i] = pullImage(ref, pull, enforceContentTrust(ref.String(), &m.Trust), m.options().platform, m.options().timeout)
+			<-sem
+		}(i, ref)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", refs[i], err))
+		}
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("Could not pull images: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
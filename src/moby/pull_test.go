@@ -0,0 +1,351 @@
+package moby
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	distref "github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+func TestPrePullConcurrency(t *testing.T) {
+	var m Moby
+	for i := 0; i < 8; i++ {
+		ref, err := reference.Parse(fmt.Sprintf("docker.io/linuxkit/service%d:v1", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Services = append(m.Services, &Image{Name: fmt.Sprintf("service%d", i), ref: &ref})
+	}
+	// a duplicate image is only pulled once
+	m.Onboot = []*Image{{Name: "dup", ref: m.Services[0].ref}}
+
+	var mu sync.Mutex
+	var active, max, calls int32
+	pullImage = func(ref *reference.Spec, pull PullPolicy, trust bool, platform string, timeout time.Duration) error {
+		atomic.AddInt32(&calls, 1)
+		n := atomic.AddInt32(&active, 1)
+		mu.Lock()
+		if n > max {
+			max = n
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		return nil
+	}
+	defer func() { pullImage = pullIfNeeded }()
+	ParallelPulls = 3
+	defer func() { ParallelPulls = 4 }()
+
+	if err := prePull(m, PullAlways); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 8 {
+		t.Errorf("Expected 8 pulls, got %d", calls)
+	}
+	if max > 3 {
+		t.Errorf("Expected at most 3 simultaneous pulls, got %d", max)
+	}
+	if max < 2 {
+		t.Errorf("Expected pulls to run in parallel, got %d at once", max)
+	}
+}
+
+func TestPlatform(t *testing.T) {
+	for platform, want := range map[string][]string{
+		"linux/arm64":    {"linux", "arm64", ""},
+		"linux/arm/v7":   {"linux", "arm", "v7"},
+		"linux":          nil,
+		"linux/":         nil,
+		"linux/arm/v7/x": nil,
+		"linux/ amd64":   nil,
+	} {
+		goos, goarch, variant, err := ParsePlatform(platform)
+		if want == nil {
+			if err == nil {
+				t.Errorf("Expected %q to be invalid", platform)
+			}
+			continue
+		}
+		if err != nil || goos != want[0] || goarch != want[1] || variant != want[2] {
+			t.Errorf("Expected %q to parse as %v, got %s %s %s %v", platform, want, goos, goarch, variant, err)
+		}
+	}
+
+	if !platformMatches("", "linux", "s390x", "") {
+		t.Error("Expected any image to match when no platform is set")
+	}
+	if !platformMatches("linux/arm64/v8", "linux", "arm64", "") || platformMatches("linux/arm64/v8", "linux", "amd64", "") {
+		t.Error("Expected only linux/arm64 images to match linux/arm64/v8")
+	}
+	if !platformMatches("linux/arm/v7", "linux", "arm", "v7") || platformMatches("linux/arm/v6", "linux", "arm", "v7") {
+		t.Error("Expected only linux/arm/v7 images to match linux/arm/v7")
+	}
+}
+
+func TestResolveTrust(t *testing.T) {
+	m, err := NewConfig([]byte(`
+kernel:
+  image: linuxkit/kernel:4.9.x
+onboot:
+  - name: sysctl
+    image: linuxkit/sysctl:v1
+services:
+  - name: getty
+    image: linuxkit/getty:v1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Trust = TrustConfig{Image: []string{"linuxkit/sysctl", "linuxkit/kernel"}}
+	if err := ApplyLockfile(&m, Lockfile{"docker.io/linuxkit/kernel:4.9.x": "sha256:" + strings.Repeat("a", 64)}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	var looked []string
+	trustedReference = func(image string) (distref.Reference, error) {
+		looked = append(looked, image)
+		return distref.ParseAnyReference("docker.io/" + image + "@sha256:" + strings.Repeat("b", 64))
+	}
+	defer func() { trustedReference = TrustedReference }()
+
+	if err := ResolveTrust(&m); err != nil {
+		t.Fatal(err)
+	}
+	if len(looked) != 1 || looked[0] != "linuxkit/sysctl:v1" {
+		t.Errorf("Expected only the unpinned trusted image to be looked up, got %v", looked)
+	}
+	b, err := DumpConfig(m, "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, image := range []string{
+		"linuxkit/kernel:4.9.x@sha256:" + strings.Repeat("a", 64),
+		"docker.io/linuxkit/sysctl:v1@sha256:" + strings.Repeat("b", 64),
+		"image: linuxkit/getty:v1\n",
+	} {
+		if !strings.Contains(string(b), image) {
+			t.Errorf("Expected %s in the config, got:\n%s", image, b)
+		}
+	}
+}
+
+// fakeDaemon is a Docker API that has the images in local, and records the
+// images pulled
+type fakeDaemon struct {
+	mu     sync.Mutex
+	local  map[string]bool
+	pulled []string
+}
+
+func (d *fakeDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := r.URL.Path
+	switch {
+	case strings.HasSuffix(p, "/images/json"):
+		var filter struct {
+			Reference map[string]bool `json:"reference"`
+		}
+		json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filter)
+		list := []types.ImageSummary{}
+		for image := range filter.Reference {
+			if d.local[image] {
+				list = append(list, types.ImageSummary{RepoTags: []string{image}})
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+	case strings.HasSuffix(p, "/images/create"):
+		image := r.URL.Query().Get("fromImage") + ":" + r.URL.Query().Get("tag")
+		if strings.HasPrefix(r.URL.Query().Get("tag"), "sha256:") {
+			image = r.URL.Query().Get("fromImage") + "@" + r.URL.Query().Get("tag")
+		}
+		d.pulled = append(d.pulled, image)
+		d.local[image] = true
+		w.Write([]byte(`{"status":"Downloaded"}`))
+	case strings.HasSuffix(p, "/json") && strings.Contains(p, "/images/"):
+		image := strings.TrimSuffix(p[strings.Index(p, "/images/")+len("/images/"):], "/json")
+		if !d.local[image] {
+			http.Error(w, `{"message":"No such image"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(types.ImageInspect{ID: "sha256:1234", Os: "linux", Architecture: "amd64"})
+	default:
+		w.Header().Set("API-Version", "1.30")
+		w.Write([]byte("OK"))
+	}
+}
+
+func TestTrustedPull(t *testing.T) {
+	signed := "sha256:" + strings.Repeat("5", 64)
+	daemon := &fakeDaemon{}
+	srv := httptest.NewServer(daemon)
+	defer srv.Close()
+	host := os.Getenv("DOCKER_HOST")
+	os.Setenv("DOCKER_HOST", "tcp://"+srv.Listener.Addr().String())
+	defer os.Setenv("DOCKER_HOST", host)
+
+	var looked []string
+	trustedReference = func(image string) (distref.Reference, error) {
+		looked = append(looked, image)
+		if strings.Contains(image, "unsigned") {
+			return nil, fmt.Errorf("No trust data for %s", image)
+		}
+		return distref.ParseAnyReference("docker.io/" + image + "@" + signed)
+	}
+	defer func() { trustedReference = TrustedReference }()
+	defer func() {
+		usedImagesMu.Lock()
+		usedImages = map[string]string{}
+		usedImagesMu.Unlock()
+	}()
+
+	for _, tc := range []struct {
+		name   string
+		image  string
+		trust  TrustConfig
+		local  []string
+		pulled []string
+		looked bool
+		err    string
+	}{
+		{
+			name:  "untrusted local image",
+			image: "linuxkit/getty:v1",
+			local: []string{"linuxkit/getty:v1"},
+		},
+		{
+			name:   "untrusted missing image",
+			image:  "linuxkit/getty:v1",
+			pulled: []string{"linuxkit/getty:v1"},
+		},
+		{
+			name:   "trusted org with a local tag",
+			image:  "linuxkit/getty:v1",
+			trust:  TrustConfig{Org: []string{"linuxkit"}},
+			local:  []string{"linuxkit/getty:v1"},
+			pulled: []string{"linuxkit/getty@" + signed},
+			looked: true,
+		},
+		{
+			name:   "trusted image with the signed digest local",
+			image:  "linuxkit/getty:v1",
+			trust:  TrustConfig{Image: []string{"linuxkit/getty"}},
+			local:  []string{"docker.io/linuxkit/getty:v1@" + signed},
+			looked: true,
+		},
+		{
+			name:   "trusted image without trust data",
+			image:  "linuxkit/unsigned:v1",
+			trust:  TrustConfig{Org: []string{"linuxkit"}},
+			local:  []string{"linuxkit/unsigned:v1"},
+			looked: true,
+			err:    "No trust data",
+		},
+		{
+			name:   "image outside the trusted org",
+			image:  "example/app:v1",
+			trust:  TrustConfig{Org: []string{"linuxkit"}},
+			local:  []string{"example/app:v1"},
+			looked: false,
+		},
+	} {
+		daemon.local = map[string]bool{}
+		for _, image := range tc.local {
+			daemon.local[image] = true
+		}
+		daemon.pulled = nil
+		looked = nil
+
+		m, err := NewConfig([]byte("services:\n  - name: app\n    image: " + tc.image + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Trust = tc.trust
+		err = prePull(m, PullMissing)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: expected error containing %q, got %v", tc.name, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(daemon.pulled, tc.pulled) {
+			t.Errorf("%s: expected pulls %v, got %v", tc.name, tc.pulled, daemon.pulled)
+		}
+		if (len(looked) != 0) != tc.looked {
+			t.Errorf("%s: expected trust lookup %v, got %v", tc.name, tc.looked, looked)
+		}
+		if tc.looked && !strings.HasSuffix(m.Services[0].ref.String(), "@"+signed) {
+			t.Errorf("%s: expected the image to be pinned to its signed digest, got %s", tc.name, m.Services[0].ref)
+		}
+		if _, ok := UsedImages()[m.Services[0].ref.String()]; !ok {
+			t.Errorf("%s: expected %s to be recorded as used, got %v", tc.name, m.Services[0].ref, UsedImages())
+		}
+	}
+}
+
+func TestPullPolicy(t *testing.T) {
+	daemon := &fakeDaemon{}
+	srv := httptest.NewServer(daemon)
+	defer srv.Close()
+	host := os.Getenv("DOCKER_HOST")
+	os.Setenv("DOCKER_HOST", "tcp://"+srv.Listener.Addr().String())
+	defer os.Setenv("DOCKER_HOST", host)
+	defer func() {
+		usedImagesMu.Lock()
+		usedImages = map[string]string{}
+		usedImagesMu.Unlock()
+	}()
+
+	for _, tc := range []struct {
+		policy PullPolicy
+		local  bool
+		pulled bool
+		err    bool
+	}{
+		{policy: PullAlways, local: true, pulled: true},
+		{policy: PullAlways, pulled: true},
+		{policy: PullMissing, local: true},
+		{policy: PullMissing, pulled: true},
+		{policy: PullNever, local: true},
+		{policy: PullNever, err: true},
+	} {
+		daemon.local = map[string]bool{"linuxkit/getty:v1": tc.local}
+		daemon.pulled = nil
+		ref, err := reference.Parse("linuxkit/getty:v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pullIfNeeded(&ref, tc.policy, false, "", 0)
+		if (err != nil) != tc.err {
+			t.Errorf("%s with local image %v: expected error %v, got %v", tc.policy, tc.local, tc.err, err)
+		}
+		if (len(daemon.pulled) != 0) != tc.pulled {
+			t.Errorf("%s with local image %v: expected pull %v, got %v", tc.policy, tc.local, tc.pulled, daemon.pulled)
+		}
+	}
+
+	for _, s := range []string{"always", "missing", "never", "true", "false"} {
+		if _, err := ParsePullPolicy(s); err != nil {
+			t.Errorf("Expected %s to be a valid pull policy, got %v", s, err)
+		}
+	}
+	if _, err := ParsePullPolicy("sometimes"); err == nil {
+		t.Error("Expected an invalid pull policy to be rejected")
+	}
+}
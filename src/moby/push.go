@@ -0,0 +1,153 @@
+package moby
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	distref "github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Push uploads built output files to a registry as the image ref. A single
+// tarball, as built by the tar output, is imported as the image filesystem,
+// otherwise the files, such as those from kernel+initrd, are packaged as a
+// single layer with each file at the root. The credentials are those the
+// Docker client is configured with for the registry.
+func Push(ref string, files []string) error {
+	if len(files) == 0 {
+		return errors.New("No files to push")
+	}
+	named, err := distref.ParseNormalizedNamed(ref)
+	if err != nil {
+		return fmt.Errorf("Invalid reference %s: %v", ref, err)
+	}
+	if _, ok := named.(distref.Canonical); ok {
+		return fmt.Errorf("Cannot push to a digest reference %s", ref)
+	}
+	image := distref.TagNameOnly(named).String()
+
+	var layer io.Reader
+	if len(files) == 1 && strings.HasSuffix(files[0], ".tar") {
+		f, err := os.Open(files[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		layer = f
+	} else {
+		r, w := io.Pipe()
+		go func() {
+			w.CloseWithError(writePushLayer(w, files))
+		}()
+		defer r.Close()
+		layer = r
+	}
+
+	cli, err := dockerClient(0)
+	if err != nil {
+		return errors.New("could not initialize Docker API client")
+	}
+
+	log.Infof("Import %s", image)
+	ctx, cancel := dockerContext(0)
+	defer cancel()
+	rc, err := cli.ImageImport(ctx, types.ImageImportSource{Source: layer, SourceName: "-"}, image, types.ImageImportOptions{})
+	if err != nil {
+		return fmt.Errorf("Cannot import %s: %v", image, err)
+	}
+	err = readProgress(rc)
+	rc.Close()
+	if err != nil {
+		return fmt.Errorf("Cannot import %s: %v", image, err)
+	}
+
+	auth, err := registryAuth(named.Name())
+	if err != nil {
+		return fmt.Errorf("Cannot get registry credentials for %s: %v", image, err)
+	}
+	log.Infof("Push %s", image)
+	ctx, cancel = dockerContext(0)
+	defer cancel()
+	rc, err = cli.ImagePush(ctx, image, types.ImagePushOptions{RegistryAuth: auth})
+	if err != nil {
+		return fmt.Errorf("Cannot push %s: %v", image, err)
+	}
+	defer rc.Close()
+	if err := readProgress(rc); err != nil {
+		return fmt.Errorf("Cannot push %s: %v", image, err)
+	}
+	return nil
+}
+
+// writePushLayer writes a tarball holding each file at its root
+func writePushLayer(w io.Writer, files []string) error {
+	tw := tar.NewWriter(w)
+	seen := map[string]bool{}
+	for _, file := range files {
+		name := filepath.Base(file)
+		if seen[name] {
+			return fmt.Errorf("More than one file named %s", name)
+		}
+		seen[name] = true
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			f.Close()
+			return fmt.Errorf("%s is not a regular file", file)
+		}
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			f.Close()
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// readProgress consumes a stream of JSON progress messages from the Docker
+// API, returning the first error reported in it
+func readProgress(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var msg struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		if msg.Status != "" {
+			log.Debugf("%s", msg.Status)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWritePushLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := map[string]string{
+		"test-kernel":     "kernel",
+		"test-initrd.img": "initrd",
+		"test-cmdline":    "console=ttyS0",
+	}
+	var files []string
+	for name, data := range contents {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := writePushLayer(buf, files); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(buf)
+	found := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != contents[hdr.Name] {
+			t.Errorf("Expected %q in %s, got %q", contents[hdr.Name], hdr.Name, data)
+		}
+		found++
+	}
+	if found != len(contents) {
+		t.Errorf("Expected %d files in the layer, got %d", len(contents), found)
+	}
+
+	if err := writePushLayer(ioutil.Discard, []string{files[0], files[0]}); err == nil {
+		t.Error("Expected files with the same name to be rejected")
+	}
+	if err := writePushLayer(ioutil.Discard, []string{dir}); err == nil {
+		t.Error("Expected a directory to be rejected")
+	}
+}
+
+func TestReadProgress(t *testing.T) {
+	if err := readProgress(strings.NewReader(`{"status":"Preparing"}{"status":"Pushed"}`)); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	err := readProgress(strings.NewReader(`{"status":"Preparing"}{"error":"denied: requested access to the resource is denied"}`))
+	if err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("Expected the error from the stream, got %v", err)
+	}
+}
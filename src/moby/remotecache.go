@@ -0,0 +1,252 @@
+package moby
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RemoteCache is the URL of an S3 compatible bucket, with an optional key
+// prefix, such as https://s3.amazonaws.com/bucket/moby, that LinuxKit helper
+// images are fetched from before building them and pushed to after. Requests
+// are signed with AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY if they are set.
+var RemoteCache string
+
+// remoteCacheClient is the HTTP client for the remote cache
+var remoteCacheClient = &http.Client{Timeout: 10 * time.Minute}
+
+// remoteDigestSuffix is the suffix of the object listing the SHA256 digest of
+// each file of a cached image, which is pushed after the files and checked
+// against them when they are fetched
+const remoteDigestSuffix = ".sha256"
+
+// remoteCacheURL returns the URL of a cache file in the remote cache
+func remoteCacheURL(file string) string {
+	return strings.TrimRight(RemoteCache, "/") + "/" + file
+}
+
+// remoteGet downloads a file from the remote cache, returning nil if it is
+// not there
+func remoteGet(file string) ([]byte, error) {
+	req, err := http.NewRequest("GET", remoteCacheURL(file), nil)
+	if err != nil {
+		return nil, err
+	}
+	signS3(req, nil, time.Now())
+	resp, err := remoteCacheClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", file, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// remotePut uploads a file to the remote cache
+func remotePut(file string, b []byte) error {
+	req, err := http.NewRequest("PUT", remoteCacheURL(file), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	signS3(req, b, time.Now())
+	resp, err := remoteCacheClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("PUT %s: %s", file, resp.Status)
+	}
+	return nil
+}
+
+// parseDigests parses a digest object, in the format of sha256sum
+func parseDigests(b []byte) (map[string]string, error) {
+	digests := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || len(fields[0]) != 2*sha256.Size {
+			return nil, fmt.Errorf("Invalid digest line %q", scanner.Text())
+		}
+		digests[fields[1]] = fields[0]
+	}
+	return digests, scanner.Err()
+}
+
+// fetchRemoteCache downloads the named LinuxKit helper image from the remote
+// cache, returning false if it is not there
+func fetchRemoteCache(name string) (bool, error) {
+	filename := imageFilename(name)
+	base := filepath.Base(filename)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return false, err
+	}
+	// the digests are pushed last, so an image without them is incomplete
+	b, err := remoteGet(base + remoteDigestSuffix)
+	if err != nil || b == nil {
+		return false, err
+	}
+	digests, err := parseDigests(b)
+	if err != nil {
+		return false, err
+	}
+	var temps []string
+	defer func() {
+		for _, t := range temps {
+			os.Remove(t)
+		}
+	}()
+	for _, suffix := range linuxkitSuffixes {
+		file := base + suffix
+		want, ok := digests[file]
+		if !ok {
+			return false, fmt.Errorf("No digest for %s", file)
+		}
+		b, err := remoteGet(file)
+		if err != nil {
+			return false, err
+		}
+		if b == nil {
+			return false, nil
+		}
+		sum := sha256.Sum256(b)
+		if got := hex.EncodeToString(sum[:]); got != want {
+			return false, fmt.Errorf("Digest mismatch for %s: expected %s, got %s", file, want, got)
+		}
+		// download every file before renaming any so there is no partial cache entry
+		f, err := ioutil.TempFile(filepath.Dir(filename), file)
+		if err != nil {
+			return false, err
+		}
+		temps = append(temps, f.Name())
+		_, err = f.Write(b)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	for i, suffix := range linuxkitSuffixes {
+		if err := os.Rename(temps[i], filename+suffix); err != nil {
+			return false, err
+		}
+	}
+	log.Infof("Fetched LinuxKit image %s from %s", name, RemoteCache)
+	return true, nil
+}
+
+// pushRemoteCache uploads the named LinuxKit helper image to the remote cache
+func pushRemoteCache(name string) error {
+	filename := imageFilename(name)
+	base := filepath.Base(filename)
+	var digests bytes.Buffer
+	for _, suffix := range linuxkitSuffixes {
+		file := base + suffix
+		b, err := ioutil.ReadFile(filename + suffix)
+		if err != nil {
+			return err
+		}
+		if err := remotePut(file, b); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b)
+		fmt.Fprintf(&digests, "%x  %s\n", sum, file)
+	}
+	if err := remotePut(base+remoteDigestSuffix, digests.Bytes()); err != nil {
+		return err
+	}
+	log.Infof("Pushed LinuxKit image %s to %s", name, RemoteCache)
+	return nil
+}
+
+// signS3 signs a request to an S3 compatible store with AWS signature
+// version 4, using the credentials and region from the environment. It
+// leaves the request unsigned if there are no credentials.
+func signS3(req *http.Request, payload []byte, now time.Time) {
+	key := os.Getenv("AWS_ACCESS_KEY_ID")
+	secret := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if key == "" || secret == "" {
+		return
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadSum := sha256.Sum256(payload)
+	payloadHash := hex.EncodeToString(payloadSum[:])
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			headers[strings.ToLower(name)] = strings.Join(values, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + strings.TrimSpace(headers[name]) + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestSum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestSum[:])
+
+	signingKey := []byte("AWS4" + secret)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", key, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,131 @@
+package moby
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReproReport is the SHA256 digest of each artifact of a build, keyed by the
+// file name, which a later build of the same config can be compared against
+type ReproReport map[string]string
+
+// ReproDiff is an artifact that differs between two reports, with its digest
+// in each, which is empty if the artifact is only in one of them
+type ReproDiff struct {
+	Name  string
+	Prior string
+	Got   string
+}
+
+// NewReproReport hashes each file. A file listed more than once, as one that
+// several formats create, is only hashed once.
+func NewReproReport(files []string) (ReproReport, error) {
+	r := ReproReport{}
+	seen := map[string]bool{}
+	for _, file := range files {
+		if seen[file] {
+			continue
+		}
+		seen[file] = true
+		name := filepath.Base(file)
+		if _, ok := r[name]; ok {
+			return nil, fmt.Errorf("More than one artifact named %s", name)
+		}
+		sum, err := fileSHA256(file)
+		if err != nil {
+			return nil, err
+		}
+		r[name] = sum
+	}
+	return r, nil
+}
+
+// fileSums caches the digests of files, so that the checksums, manifest,
+// summary and reproducibility report of a build hash each output once. An
+// entry is only used while the size and modification time of the file match.
+var (
+	fileSums   = map[string]fileSum{}
+	fileSumsMu sync.Mutex
+)
+
+type fileSum struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// fileSHA256 returns the hex SHA256 digest of the contents of a file
+func fileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	fileSumsMu.Lock()
+	cached, ok := fileSums[file]
+	fileSumsMu.Unlock()
+	if ok && cached.size == fi.Size() && cached.modTime.Equal(fi.ModTime()) {
+		return cached.sum, nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	fileSumsMu.Lock()
+	fileSums[file] = fileSum{size: fi.Size(), modTime: fi.ModTime(), sum: sum}
+	fileSumsMu.Unlock()
+	return sum, nil
+}
+
+// ReadReproReport reads a report written by WriteFile
+func ReadReproReport(filename string) (ReproReport, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := ReproReport{}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("Cannot parse reproducibility report %s: %v", filename, err)
+	}
+	return r, nil
+}
+
+// WriteFile writes the report as JSON
+func (r ReproReport) WriteFile(filename string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(b, '\n'), 0644)
+}
+
+// Compare returns the artifacts that differ from a prior report, sorted by name
+func (r ReproReport) Compare(prior ReproReport) []ReproDiff {
+	var diffs []ReproDiff
+	for name, sum := range r {
+		if prior[name] != sum {
+			diffs = append(diffs, ReproDiff{Name: name, Prior: prior[name], Got: sum})
+		}
+	}
+	for name, sum := range prior {
+		if _, ok := r[name]; !ok {
+			diffs = append(diffs, ReproDiff{Name: name, Prior: sum})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Name < diffs[j].Name })
+	return diffs
+}
@@ -0,0 +1,99 @@
+package moby
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileSHA256Rewritten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "linuxkit-kernel")
+	sums := map[string]bool{}
+	for _, contents := range []string{"kernel", "kernel", "rebuilt kernel"} {
+		if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sum, err := fileSHA256(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sums[sum] = true
+	}
+	if len(sums) != 2 {
+		t.Errorf("Expected a rewritten file to be hashed again, got %v", sums)
+	}
+}
+
+func TestReproReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "repro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	build := func(name, kernel, initrd string) ReproReport {
+		var files []string
+		for suffix, contents := range map[string]string{"-kernel": kernel, "-initrd.img": initrd} {
+			file := filepath.Join(dir, name, "linuxkit"+suffix)
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			files = append(files, file)
+		}
+		r, err := NewReproReport(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	first := build("first", "kernel", "initrd")
+	report := filepath.Join(dir, "report.json")
+	if err := first.WriteFile(report); err != nil {
+		t.Fatal(err)
+	}
+	prior, err := ReadReproReport(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(prior, first) {
+		t.Errorf("Expected %v to be read back, got %v", first, prior)
+	}
+
+	if diffs := build("same", "kernel", "initrd").Compare(prior); len(diffs) != 0 {
+		t.Errorf("Expected identical builds to match, got %v", diffs)
+	}
+
+	second := build("second", "kernel", "initrd2")
+	diffs := second.Compare(prior)
+	want := []ReproDiff{{Name: "linuxkit-initrd.img", Prior: first["linuxkit-initrd.img"], Got: second["linuxkit-initrd.img"]}}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Errorf("Expected %v, got %v", want, diffs)
+	}
+
+	delete(second, "linuxkit-kernel")
+	if diffs := second.Compare(prior); len(diffs) != 2 || diffs[1].Name != "linuxkit-kernel" || diffs[1].Got != "" {
+		t.Errorf("Expected a missing kernel to differ, got %v", diffs)
+	}
+
+	// kernel+initrd and kernel+squashfs both create the kernel
+	kernel := filepath.Join(dir, "first", "linuxkit-kernel")
+	shared, err := NewReproReport([]string{kernel, filepath.Join(dir, "first", "linuxkit-initrd.img"), kernel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(shared, first) {
+		t.Errorf("Expected a file listed twice to be reported once, got %v", shared)
+	}
+}
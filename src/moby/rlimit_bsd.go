@@ -0,0 +1,9 @@
+// +build freebsd dragonfly
+
+package moby
+
+// rlimitValue converts a limit to the type of the fields of syscall.Rlimit,
+// which are signed on FreeBSD and DragonFly
+func rlimitValue(v uint64) int64 {
+	return int64(v)
+}
@@ -0,0 +1,8 @@
+// +build !windows,!freebsd,!dragonfly
+
+package moby
+
+// rlimitValue converts a limit to the type of the fields of syscall.Rlimit
+func rlimitValue(v uint64) uint64 {
+	return v
+}
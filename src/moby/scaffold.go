@@ -0,0 +1,60 @@
+package moby
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"text/template"
+)
+
+// ScaffoldOptions are the choices used to write a starter config
+type ScaffoldOptions struct {
+	Kernel       string
+	Cmdline      string
+	Init         []string
+	ServiceName  string
+	ServiceImage string
+}
+
+// DefaultScaffoldOptions returns the choices for a minimal starter config
+func DefaultScaffoldOptions() ScaffoldOptions {
+	return ScaffoldOptions{
+		Kernel:  "linuxkit/kernel:4.9.39",
+		Cmdline: "console=tty0 console=ttyS0",
+		Init: []string{
+			"linuxkit/init:00ab58c9681a0bf42b2e35134c1ccf1591ebb64d",
+			"linuxkit/runc:f5960b83a8766ae083efc744fa63dbf877450e4f",
+		},
+		ServiceName:  "getty",
+		ServiceImage: "linuxkit/getty:797cb79e0a229fcd16ebf44a0da74bcec03968ec",
+	}
+}
+
+var scaffoldTemplate = template.Must(template.New("config").Funcs(template.FuncMap{
+	"quote": strconv.Quote,
+}).Parse(`kernel:
+  image: {{ .Kernel }}
+  cmdline: {{ quote .Cmdline }}
+# services are run by containerd, which must be in init or onboot
+init:
+{{- range .Init }}
+  - {{ . }}
+{{- end }}
+{{- if .ServiceImage }}
+services:
+  - name: {{ .ServiceName }}
+    image: {{ .ServiceImage }}
+{{- end }}
+`))
+
+// Scaffold writes a starter config from the options, checking that it is valid
+func Scaffold(o ScaffoldOptions) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := scaffoldTemplate.Execute(buf, o); err != nil {
+		return nil, err
+	}
+	if _, err := NewConfig(buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("Invalid config: %v", err)
+	}
+	return buf.Bytes(), nil
+}
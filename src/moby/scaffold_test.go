@@ -0,0 +1,40 @@
+package moby
+
+import (
+	"testing"
+)
+
+func TestScaffold(t *testing.T) {
+	b, err := Scaffold(DefaultScaffoldOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewConfig(b)
+	if err != nil {
+		t.Fatalf("Expected minimal config to be valid: %v\n%s", err, b)
+	}
+	if len(m.Init) != 2 || len(m.Services) != 1 || m.Kernel.Cmdline != "console=tty0 console=ttyS0" {
+		t.Errorf("Unexpected minimal config:\n%s", b)
+	}
+
+	o := DefaultScaffoldOptions()
+	o.ServiceName = "sshd"
+	o.ServiceImage = "linuxkit/sshd:v1"
+	o.Cmdline = `console=ttyS0 root="quoted"`
+	b, err = Scaffold(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = NewConfig(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Services[0].Name != "sshd" || m.Services[0].Image != "linuxkit/sshd:v1" || m.Kernel.Cmdline != o.Cmdline {
+		t.Errorf("Unexpected config:\n%s", b)
+	}
+
+	o.ServiceName = ""
+	if _, err := Scaffold(o); err == nil {
+		t.Error("Expected a service without a name to be rejected")
+	}
+}
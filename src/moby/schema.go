@@ -14,7 +14,19 @@ var schema = string(`
         "cmdline": {"type": "string"},
         "binary": {"type": "string"},
         "tar": {"type": "string"},
-        "ucode": {"type": "string"}
+        "ucode": {"type": "string"},
+        "console": { "$ref": "#/definitions/strings" },
+        "initArgs": { "$ref": "#/definitions/strings" },
+        "microcode": { "$ref": "#/definitions/microcode" }
+      }
+    },
+    "microcode": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "source": {"type": "string"},
+        "image": {"type": "string"},
+        "path": {"type": "string"}
       }
     },
     "file": {
@@ -26,6 +38,7 @@ var schema = string(`
           "symlink": {"type": "string"},
           "contents": {"type": "string"},
           "source": {"type": "string"},
+          "sha256": {"type": "string", "pattern": "^[0-9a-fA-F]{64}$"},
           "metadata": {"type": "string"},
           "optional": {"type": "boolean"},
           "mode": {"type": "string"},
@@ -45,6 +58,38 @@ var schema = string(`
         "org": { "$ref": "#/definitions/strings" }
       }
     },
+    "banner": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "contents": { "type": "string" },
+        "source": { "type": "string" },
+        "issue": { "type": "boolean" }
+      }
+    },
+    "fstab": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "additionalProperties": false,
+        "required": ["device", "mountpoint", "type"],
+        "properties": {
+          "device": { "type": "string" },
+          "mountpoint": { "type": "string" },
+          "type": { "type": "string" },
+          "options": { "$ref": "#/definitions/strings" },
+          "dump": { "type": "integer" },
+          "pass": { "type": "integer" }
+        }
+      }
+    },
+    "output": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "args": { "$ref": "#/definitions/strings" }
+      }
+    },
     "strings": {
         "type": "array",
         "items": {"type": "string"}
@@ -210,9 +255,29 @@ var schema = string(`
         "pids": {"$ref": "#/definitions/pids"},
         "blockio": {"$ref": "#/definitions/blockio"},
         "hugepageLimits": {"$ref": "#/definitions/hugepagelimits"},
-        "network": {"$ref": "#/definitions/network"}
+        "network": {"$ref": "#/definitions/network"},
+        "memoryLimit": {"type": "integer"},
+        "cpuShares": {"type": "integer", "minimum": 0},
+        "cpuQuota": {"type": "integer"},
+        "cpuPeriod": {"type": "integer", "minimum": 0}
+      }
+    },
+    "device": {
+      "type": "object",
+      "additionalProperties": false,
+      "required": ["path", "type"],
+      "properties": {
+        "path": {"type": "string"},
+        "type": {"enum": ["c", "b", "u", "p"]},
+        "major": {"type": "integer"},
+        "minor": {"type": "integer"},
+        "mode": {"type": "string"}
       }
     },
+    "devices": {
+      "type": "array",
+      "items": {"$ref": "#/definitions/device"}
+    },
     "interfaces": {
       "type": "array",
       "items": {"$ref": "#/definitions/interface"}
@@ -289,9 +354,13 @@ var schema = string(`
         "resources": {"$ref": "#/definitions/resources"},
         "sysctl": { "$ref": "#/definitions/mapstring" },
         "rlimits": { "$ref": "#/definitions/strings" },
+        "devices": { "$ref": "#/definitions/devices" },
+        "seccomp": {"anyOf": [{"type": "string"}, {"type": "object"}]},
+        "apparmorProfile": {"type": "string"},
         "uidMappings": { "$ref": "#/definitions/idmappings" },
         "gidMappings": { "$ref": "#/definitions/idmappings" },
         "annotations": { "$ref": "#/definitions/mapstring" },
+        "ociRuntime": {"type": "string"},
         "runtime": {"$ref": "#/definitions/runtime"}
       }
     },
@@ -301,13 +370,31 @@ var schema = string(`
     }
   },
   "properties": {
+    "include": { "$ref": "#/definitions/strings" },
     "kernel": { "$ref": "#/definitions/kernel" },
     "init": { "$ref": "#/definitions/strings" },
     "onboot": { "$ref": "#/definitions/images" },
     "onshutdown": { "$ref": "#/definitions/images" },
     "services": { "$ref": "#/definitions/images" },
     "trust": { "$ref": "#/definitions/trust" },
-    "files": { "$ref": "#/definitions/files" }
+    "files": { "$ref": "#/definitions/files" },
+    "images": { "$ref": "#/definitions/mapstring" },
+    "banner": { "$ref": "#/definitions/banner" },
+    "timezone": { "type": "string" },
+    "fstab": { "$ref": "#/definitions/fstab" },
+    "imageFiles": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "exclude": { "$ref": "#/definitions/strings" },
+        "replace": { "$ref": "#/definitions/mapstring" },
+        "defaults": { "type": "boolean" }
+      }
+    },
+    "outputs": {
+      "type": "object",
+      "additionalProperties": { "$ref": "#/definitions/output" }
+    }
   }
 }
 `)
@@ -0,0 +1,109 @@
+package moby
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+var seccompActions = map[specs.LinuxSeccompAction]bool{
+	specs.ActKill:  true,
+	specs.ActTrap:  true,
+	specs.ActErrno: true,
+	specs.ActTrace: true,
+	specs.ActAllow: true,
+}
+
+var seccompOperators = map[specs.LinuxSeccompOperator]bool{
+	specs.OpNotEqual:     true,
+	specs.OpLessThan:     true,
+	specs.OpLessEqual:    true,
+	specs.OpEqualTo:      true,
+	specs.OpGreaterEqual: true,
+	specs.OpGreaterThan:  true,
+	specs.OpMaskedEqual:  true,
+}
+
+var seccompArches = map[specs.Arch]bool{
+	specs.ArchX86:         true,
+	specs.ArchX86_64:      true,
+	specs.ArchX32:         true,
+	specs.ArchARM:         true,
+	specs.ArchAARCH64:     true,
+	specs.ArchMIPS:        true,
+	specs.ArchMIPS64:      true,
+	specs.ArchMIPS64N32:   true,
+	specs.ArchMIPSEL:      true,
+	specs.ArchMIPSEL64:    true,
+	specs.ArchMIPSEL64N32: true,
+	specs.ArchPPC:         true,
+	specs.ArchPPC64:       true,
+	specs.ArchPPC64LE:     true,
+	specs.ArchS390:        true,
+	specs.ArchS390X:       true,
+	specs.ArchPARISC:      true,
+	specs.ArchPARISC64:    true,
+}
+
+// parseSeccomp parses the seccomp field of an image, which is either the path
+// of a JSON file holding an OCI seccomp profile or the profile inline
+func parseSeccomp(v interface{}) (*specs.LinuxSeccomp, error) {
+	var b []byte
+	var err error
+	switch x := v.(type) {
+	case string:
+		b, err = ioutil.ReadFile(x)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read seccomp profile: %v", err)
+		}
+	default:
+		b, err = json.Marshal(convert(x))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid seccomp profile: %v", err)
+		}
+	}
+
+	var profile specs.LinuxSeccomp
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&profile); err != nil {
+		return nil, fmt.Errorf("Invalid seccomp profile: %v", err)
+	}
+	if err := validateSeccomp(profile); err != nil {
+		return nil, fmt.Errorf("Invalid seccomp profile: %v", err)
+	}
+	return &profile, nil
+}
+
+// validateSeccomp checks the actions, operators and architectures in a
+// profile are those the runtime understands
+func validateSeccomp(profile specs.LinuxSeccomp) error {
+	if profile.DefaultAction == "" {
+		return fmt.Errorf("no defaultAction")
+	}
+	if !seccompActions[profile.DefaultAction] {
+		return fmt.Errorf("unknown action %s", profile.DefaultAction)
+	}
+	for _, arch := range profile.Architectures {
+		if !seccompArches[arch] {
+			return fmt.Errorf("unknown architecture %s", arch)
+		}
+	}
+	for _, syscall := range profile.Syscalls {
+		if len(syscall.Names) == 0 {
+			return fmt.Errorf("syscall rule with no names")
+		}
+		if !seccompActions[syscall.Action] {
+			return fmt.Errorf("unknown action %s for %v", syscall.Action, syscall.Names)
+		}
+		for _, arg := range syscall.Args {
+			if !seccompOperators[arg.Op] {
+				return fmt.Errorf("unknown operator %s for %v", arg.Op, syscall.Names)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package moby
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestSeccomp(t *testing.T) {
+	idMap := map[string]uint32{}
+
+	f, err := ioutil.TempFile("", "seccomp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(`{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["reboot"], "action": "SCMP_ACT_ERRNO"}]}`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	m, err := NewConfig([]byte(`
+services:
+  - name: file
+    image: testimage
+    seccomp: ` + f.Name() + `
+  - name: inline
+    image: testimage
+    seccomp:
+      defaultAction: SCMP_ACT_ERRNO
+      architectures: [SCMP_ARCH_X86_64]
+      syscalls:
+        - names: [read, write]
+          action: SCMP_ACT_ALLOW
+        - names: [personality]
+          action: SCMP_ACT_ALLOW
+          args:
+            - index: 0
+              value: 8
+              op: SCMP_CMP_EQ
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspect := setupInspect(t, ImageConfig{})
+
+	oci, _, err := ConfigInspectToOCI(m.Services[0], inspect, idMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := oci.Linux.Seccomp; s == nil || s.DefaultAction != specs.ActAllow || len(s.Syscalls) != 1 || s.Syscalls[0].Names[0] != "reboot" {
+		t.Errorf("Expected the profile from the file, got %+v", s)
+	}
+
+	oci, _, err = ConfigInspectToOCI(m.Services[1], inspect, idMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := oci.Linux.Seccomp
+	if s == nil || s.DefaultAction != specs.ActErrno || len(s.Syscalls) != 2 {
+		t.Fatalf("Expected the inline profile, got %+v", s)
+	}
+	if arg := s.Syscalls[1].Args; len(arg) != 1 || arg[0].Value != 8 || arg[0].Op != specs.OpEqualTo {
+		t.Errorf("Expected the personality argument rule, got %+v", arg)
+	}
+
+	oci, _, err = ConfigInspectToOCI(&Image{Name: "none", Image: "testimage"}, inspect, idMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oci.Linux.Seccomp != nil {
+		t.Errorf("Expected no profile, got %+v", oci.Linux.Seccomp)
+	}
+
+	for _, profile := range []string{
+		"{syscalls: [{names: [read], action: SCMP_ACT_ALLOW}]}",
+		"{defaultAction: SCMP_ACT_NOPE}",
+		"{defaultAction: SCMP_ACT_ALLOW, syscalls: [{names: [read], action: SCMP_ACT_KILL, args: [{index: 0, value: 1, op: LT}]}]}",
+		"{defaultAction: SCMP_ACT_ALLOW, architectures: [amd64]}",
+		"{defaultAction: SCMP_ACT_ALLOW, flags: [SECCOMP_FILTER_FLAG_LOG]}",
+		"/does/not/exist.json",
+	} {
+		_, err := NewConfig([]byte("services:\n  - name: bad\n    image: testimage\n    seccomp: " + profile + "\n"))
+		if err == nil || !strings.Contains(err.Error(), "seccomp profile") {
+			t.Errorf("Expected %s to be rejected, got %v", profile, err)
+		}
+	}
+}
+
+func TestSeccompPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "profile.json"), []byte(`{"defaultAction": "SCMP_ACT_ALLOW"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a relative path is read from the directory of the config, not the working directory
+	config := []byte("services:\n  - name: file\n    image: testimage\n    seccomp: profile.json\n")
+	m, err := NewConfigFile(filepath.Join(dir, "linuxkit.yml"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file := (*m.Services[0].Seccomp).(string); file != filepath.Join(dir, "profile.json") {
+		t.Errorf("Expected the profile to be read next to the config, got %s", file)
+	}
+
+	for _, profile := range []string{"/etc/profile.json", "../profile.json"} {
+		_, err := NewRemoteConfig([]byte("services:\n  - name: file\n    image: testimage\n    seccomp: " + profile + "\n"))
+		if err == nil || !strings.Contains(err.Error(), "outside the working directory") {
+			t.Errorf("Expected a config from a URL not to read %s, got %v", profile, err)
+		}
+	}
+
+	var label interface{} = filepath.Join(dir, "profile.json")
+	inspect := setupInspect(t, ImageConfig{Seccomp: &label})
+	_, _, err = ConfigInspectToOCI(&Image{Name: "label", Image: "testimage"}, inspect, map[string]uint32{})
+	if err == nil || !strings.Contains(err.Error(), "must be inline") {
+		t.Errorf("Expected a profile path in an image label to be refused, got %v", err)
+	}
+}
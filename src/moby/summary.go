@@ -0,0 +1,81 @@
+package moby
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// BuildSummary is the result of a build for pipelines to consume. It is
+// written when a build fails too, with the steps that ran up to the failure.
+type BuildSummary struct {
+	Success   bool           `json:"success"`
+	Error     string         `json:"error,omitempty"`
+	Duration  float64        `json:"durationSeconds"`
+	Steps     []SummaryStep  `json:"steps"`
+	Artifacts []Artifact     `json:"artifacts"`
+	Images    []SummaryImage `json:"images"`
+}
+
+// SummaryStep is a step of a build that ran
+type SummaryStep struct {
+	Name     string  `json:"name"`
+	Success  bool    `json:"success"`
+	Duration float64 `json:"durationSeconds"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// SummaryImage is an image used by a build, with the digest it resolved to
+type SummaryImage struct {
+	Reference string `json:"reference"`
+	Digest    string `json:"digest,omitempty"`
+}
+
+// Step runs a step of the build and records its result and duration. It
+// just runs the step if the summary is nil.
+func (s *BuildSummary) Step(name string, fn func() error) error {
+	if s == nil {
+		return fn()
+	}
+	start := time.Now()
+	err := fn()
+	step := SummaryStep{Name: name, Success: err == nil, Duration: time.Since(start).Seconds()}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	s.Steps = append(s.Steps, step)
+	return err
+}
+
+// Finish records the overall result of the build and the images used by it
+func (s *BuildSummary) Finish(start time.Time, err error) {
+	s.Success = err == nil
+	s.Error = ""
+	if err != nil {
+		s.Error = err.Error()
+	}
+	s.Duration = time.Since(start).Seconds()
+	s.Images = []SummaryImage{}
+	for ref, digest := range UsedImages() {
+		s.Images = append(s.Images, SummaryImage{Reference: ref, Digest: digest})
+	}
+	sort.Slice(s.Images, func(i, j int) bool { return s.Images[i].Reference < s.Images[j].Reference })
+}
+
+// WriteFile writes the summary as JSON, replacing the file atomically
+func (s BuildSummary) WriteFile(filename string) error {
+	if s.Steps == nil {
+		s.Steps = []SummaryStep{}
+	}
+	if s.Artifacts == nil {
+		s.Artifacts = []Artifact{}
+	}
+	if s.Images == nil {
+		s.Images = []SummaryImage{}
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, append(b, '\n'))
+}
@@ -0,0 +1,124 @@
+package moby
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBuildSummary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	recordImage("docker.io/linuxkit/init:v0.2", "sha256:abcd")
+	defer func() {
+		usedImagesMu.Lock()
+		delete(usedImages, "docker.io/linuxkit/init:v0.2")
+		usedImagesMu.Unlock()
+	}()
+
+	base := filepath.Join(dir, "test")
+	for _, file := range []string{"-kernel", "-initrd.img", "-cmdline"} {
+		if err := ioutil.WriteFile(base+file, []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	var s BuildSummary
+	for _, step := range []string{"build", "outputs"} {
+		if err := s.Step(step, func() error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.Artifacts, err = OutputArtifacts(base, []string{"kernel+initrd"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	s.Finish(start, nil)
+
+	summary := filepath.Join(dir, "summary.json")
+	if err := s.WriteFile(summary); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := func(m map[string]interface{}) []string {
+		var k []string
+		for key := range m {
+			k = append(k, key)
+		}
+		sort.Strings(k)
+		return k
+	}
+	if k := keys(got); !reflect.DeepEqual(k, []string{"artifacts", "durationSeconds", "images", "steps", "success"}) {
+		t.Errorf("Unexpected summary fields %v", k)
+	}
+	if got["success"] != true {
+		t.Errorf("Expected success, got %v", got["success"])
+	}
+	if _, ok := got["durationSeconds"].(float64); !ok {
+		t.Errorf("Expected a number for durationSeconds, got %v", got["durationSeconds"])
+	}
+
+	steps := got["steps"].([]interface{})
+	if len(steps) != 2 {
+		t.Fatalf("Expected 2 steps, got %v", steps)
+	}
+	if k := keys(steps[0].(map[string]interface{})); !reflect.DeepEqual(k, []string{"durationSeconds", "name", "success"}) {
+		t.Errorf("Unexpected step fields %v", k)
+	}
+
+	artifacts := got["artifacts"].([]interface{})
+	if len(artifacts) != 3 {
+		t.Fatalf("Expected 3 artifacts, got %v", artifacts)
+	}
+	a := artifacts[0].(map[string]interface{})
+	if k := keys(a); !reflect.DeepEqual(k, []string{"format", "path", "sha256", "size"}) {
+		t.Errorf("Unexpected artifact fields %v", k)
+	}
+	if a["path"] != base+"-kernel" || a["format"] != "kernel+initrd" || a["size"] != float64(5) {
+		t.Errorf("Unexpected artifact %v", a)
+	}
+	if a["sha256"] != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("Unexpected artifact digest %v", a["sha256"])
+	}
+
+	images := got["images"].([]interface{})
+	want := map[string]interface{}{"reference": "docker.io/linuxkit/init:v0.2", "digest": "sha256:abcd"}
+	if len(images) != 1 || !reflect.DeepEqual(images[0], want) {
+		t.Errorf("Expected images %v, got %v", want, images)
+	}
+}
+
+func TestBuildSummaryFailure(t *testing.T) {
+	var s BuildSummary
+	err := s.Step("build", func() error { return os.ErrNotExist })
+	s.Finish(time.Now(), err)
+	if s.Success || s.Error == "" {
+		t.Errorf("Expected a failed summary, got %+v", s)
+	}
+	if len(s.Steps) != 1 || s.Steps[0].Success || s.Steps[0].Error != os.ErrNotExist.Error() {
+		t.Errorf("Expected the failed step to be recorded, got %+v", s.Steps)
+	}
+
+	var nilSummary *BuildSummary
+	ran := false
+	if err := nilSummary.Step("build", func() error { ran = true; return nil }); err != nil || !ran {
+		t.Error("Expected a step to run without a summary")
+	}
+}
@@ -4,8 +4,28 @@ package moby
 
 import (
 	"os"
+	"syscall"
 )
 
 func homeDir() string {
 	return os.Getenv("HOME")
 }
+
+// fdLimit returns the soft and hard limits on open files
+func fdLimit() (uint64, uint64, error) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return 0, 0, err
+	}
+	return uint64(rlim.Cur), uint64(rlim.Max), nil
+}
+
+// setFdLimit sets the soft limit on open files
+func setFdLimit(soft uint64) error {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return err
+	}
+	rlim.Cur = rlimitValue(soft)
+	return syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlim)
+}
@@ -7,3 +7,12 @@ import (
 func homeDir() string {
 	return os.Getenv("USERPROFILE")
 }
+
+// fdLimit returns 0 as Windows has no limit on open files to check
+func fdLimit() (uint64, uint64, error) {
+	return 0, 0, nil
+}
+
+func setFdLimit(soft uint64) error {
+	return nil
+}
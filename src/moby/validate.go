@@ -0,0 +1,207 @@
+package moby
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigError is a problem found in a config by ValidateConfig. Line is the
+// 1-based line of the config the problem was found at, or 0 if unknown.
+// Document is the 1-based index of the YAML document it is in, or 0 if the
+// config has a single document.
+type ConfigError struct {
+	Field       string
+	Description string
+	Line        int
+	Document    int
+}
+
+func (e ConfigError) Error() string {
+	desc := e.Description
+	if e.Field != "" {
+		desc = e.Field + ": " + desc
+	}
+	if e.Document != 0 {
+		desc = fmt.Sprintf("document %d: %s", e.Document, desc)
+	}
+	return desc
+}
+
+// ValidateConfig checks a config without building it or calling Docker,
+// returning every schema violation found. Only once the config matches the
+// schema is it parsed with NewConfig, reporting any further error.
+func ValidateConfig(config []byte) []ConfigError {
+	return validateConfig(config, NewConfig)
+}
+
+// ValidateConfigFile checks a config read from a file, reading the files it
+// includes relative to the directory of the file as NewConfigFile does
+func ValidateConfigFile(file string, config []byte) []ConfigError {
+	return validateConfig(config, func(config []byte) (Moby, error) {
+		return NewConfigFile(file, config)
+	})
+}
+
+func validateConfig(config []byte, parse func([]byte) (Moby, error)) []ConfigError {
+	// empty documents, such as the one before a leading "---", are skipped,
+	// but an empty config is still checked against the schema
+	var docs []yamlDocument
+	var raws []interface{}
+	for _, d := range yamlDocuments(config) {
+		var raw interface{}
+		if err := yaml.Unmarshal(d.text, &raw); err != nil {
+			return []ConfigError{{Description: err.Error()}}
+		}
+		if raw != nil {
+			docs = append(docs, d)
+			raws = append(raws, raw)
+		}
+	}
+	if len(docs) == 0 {
+		docs, raws = []yamlDocument{{text: config}}, []interface{}{nil}
+	}
+
+	var res []ConfigError
+	for i, raw := range raws {
+		errs, err := rawSchemaErrors(raw)
+		if err != nil {
+			return []ConfigError{{Description: err.Error()}}
+		}
+		document := 0
+		if len(docs) > 1 {
+			document = i + 1
+		}
+		for _, e := range errs {
+			field := strings.TrimPrefix(e.Context().String(), "(root)")
+			field = strings.TrimPrefix(field, ".")
+			if e.Type() == "additional_property_not_allowed" {
+				if p, ok := e.Details()["property"].(string); ok {
+					if field != "" {
+						field += "."
+					}
+					field += p
+				}
+			}
+			line := yamlLine(docs[i].text, field)
+			if line != 0 {
+				line += docs[i].offset
+			}
+			res = append(res, ConfigError{
+				Field:       field,
+				Description: e.Description(),
+				Line:        line,
+				Document:    document,
+			})
+		}
+	}
+	if len(res) != 0 {
+		return res
+	}
+	if _, err := parse(config); err != nil {
+		return []ConfigError{{Description: err.Error()}}
+	}
+	return nil
+}
+
+// yamlDocument is a document of a YAML stream, with the number of lines of
+// the stream before it
+type yamlDocument struct {
+	text   []byte
+	offset int
+}
+
+// yamlDocuments splits a YAML stream at the "---" lines that start documents
+func yamlDocuments(config []byte) []yamlDocument {
+	var docs []yamlDocument
+	var lines []string
+	offset := 0
+	for i, l := range strings.Split(string(config), "\n") {
+		if l == "---" || strings.HasPrefix(l, "--- ") || strings.HasPrefix(l, "---\t") {
+			docs = append(docs, yamlDocument{text: []byte(strings.Join(lines, "\n")), offset: offset})
+			lines, offset = nil, i+1
+			continue
+		}
+		lines = append(lines, l)
+	}
+	return append(docs, yamlDocument{text: []byte(strings.Join(lines, "\n")), offset: offset})
+}
+
+// yamlToken is a line of a block style YAML document, or the part of a list
+// item line following the "- "
+type yamlToken struct {
+	line   int
+	indent int
+	item   bool
+	text   string
+}
+
+func yamlTokens(config []byte) []yamlToken {
+	var toks []yamlToken
+	for i, l := range strings.Split(string(config), "\n") {
+		text := strings.TrimLeft(l, " ")
+		indent := len(l) - len(text)
+		for {
+			if text == "" || strings.HasPrefix(text, "#") {
+				break
+			}
+			if text == "-" || strings.HasPrefix(text, "- ") {
+				toks = append(toks, yamlToken{line: i + 1, indent: indent, item: true})
+				rest := strings.TrimLeft(strings.TrimPrefix(text, "-"), " ")
+				indent += len(text) - len(rest)
+				text = rest
+				continue
+			}
+			toks = append(toks, yamlToken{line: i + 1, indent: indent, text: text})
+			break
+		}
+	}
+	return toks
+}
+
+// yamlLine finds the line of a field, given as a dotted path of keys and
+// list indexes, in a block style YAML document. It returns the line of the
+// deepest part of the path it finds, or 0 if it finds none of it.
+func yamlLine(config []byte, field string) int {
+	toks := yamlTokens(config)
+	parent, start, line := -1, 0, 0
+	for _, part := range strings.Split(field, ".") {
+		if part == "" {
+			continue
+		}
+		index, err := strconv.Atoi(part)
+		isIndex := err == nil
+		level, n, match := -1, 0, -1
+		for i := start; i < len(toks) && match < 0; i++ {
+			t := toks[i]
+			if t.indent <= parent {
+				break
+			}
+			if level < 0 {
+				level = t.indent
+			}
+			if t.indent != level {
+				continue
+			}
+			switch {
+			case isIndex && t.item:
+				if n == index {
+					match = i
+				}
+				n++
+			case !isIndex && !t.item:
+				key := strings.Trim(strings.SplitN(t.text, ":", 2)[0], `"' `)
+				if key == part && strings.Contains(t.text, ":") {
+					match = i
+				}
+			}
+		}
+		if match < 0 {
+			break
+		}
+		parent, start, line = toks[match].indent, match+1, toks[match].line
+	}
+	return line
+}
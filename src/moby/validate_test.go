@@ -0,0 +1,122 @@
+package moby
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	config := []byte(`kernel:
+  image: linuxkit/kernel:4.9.x
+  cmdline: "console=ttyS0"
+onboot:
+  - name: sysctl
+    image: linuxkit/sysctl:v0.1
+  - name: dhcpcd
+    image: linuxkit/dhcpcd:v0.1
+    binds: "/etc:/etc"
+services:
+  - name: getty
+    image: linuxkit/getty:v0.1
+    colour: blue
+trust:
+  org: [linuxkit]
+`)
+	errs := ValidateConfig(config)
+	want := map[string]int{
+		"onboot.1.binds":    9,
+		"services.0.colour": 13,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Expected %d errors, got %v", len(want), errs)
+	}
+	for _, e := range errs {
+		line, ok := want[e.Field]
+		if !ok {
+			t.Errorf("Unexpected error %v", e)
+			continue
+		}
+		if e.Line != line {
+			t.Errorf("Expected %s at line %d, got %d", e.Field, line, e.Line)
+		}
+	}
+
+	if errs := ValidateConfig([]byte("kernel:\n  image: linuxkit/kernel:4.9.x\n")); len(errs) != 0 {
+		t.Errorf("Expected a valid config, got %v", errs)
+	}
+	if errs := ValidateConfig([]byte("kernel: [\n")); len(errs) != 1 || errs[0].Field != "" {
+		t.Errorf("Expected a single YAML error, got %v", errs)
+	}
+}
+
+func TestValidateConfigDocuments(t *testing.T) {
+	config := []byte(`---
+kernel:
+  image: linuxkit/kernel:4.9.x
+---
+services:
+  - name: getty
+    image: linuxkit/getty:v0.1
+    colour: blue
+`)
+	errs := ValidateConfig(config)
+	if len(errs) != 1 {
+		t.Fatalf("Expected 1 error, got %v", errs)
+	}
+	if e := errs[0]; e.Field != "services.0.colour" || e.Document != 2 || e.Line != 8 {
+		t.Errorf("Expected services.0.colour in document 2 at line 8, got %+v", e)
+	}
+	if !strings.HasPrefix(errs[0].Error(), "document 2: services.0.colour: ") {
+		t.Errorf("Expected the document in the error, got %q", errs[0].Error())
+	}
+}
+
+func TestValidateConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "kernel.yml"), []byte("kernel:\n  image: linuxkit/kernel:4.9.x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := []byte("include: [kernel.yml]\n")
+	if errs := ValidateConfigFile(filepath.Join(dir, "main.yml"), config); len(errs) != 0 {
+		t.Errorf("Expected the include to be read next to the config, got %v", errs)
+	}
+	if errs := ValidateConfig(config); len(errs) != 1 || !strings.Contains(errs[0].Description, "Cannot read included config") {
+		t.Errorf("Expected the include to be read from the working directory, got %v", errs)
+	}
+}
+
+func TestYamlLine(t *testing.T) {
+	config := []byte(`# comment
+files:
+  - path: etc/a
+    contents: "a"
+  -
+    path: etc/b
+    mode: "0600"
+trust:
+  image:
+    - foo
+    - bar
+`)
+	for field, line := range map[string]int{
+		"files":         2,
+		"files.0.path":  3,
+		"files.1":       5,
+		"files.1.mode":  7,
+		"trust.image.1": 11,
+		"trust.org":     8,
+		"missing":       0,
+	} {
+		if got := yamlLine(config, field); got != line {
+			t.Errorf("Expected %s at line %d, got %d", field, line, got)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package moby
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/docker/docker/api/types"
+)
+
+// HelperStatus is the result of verifying a mkimage helper image
+type HelperStatus struct {
+	Format string
+	Image  string
+	Pinned string
+	Actual string
+	Err    error
+}
+
+// OK reports whether the helper content matches its pinned digest
+func (s HelperStatus) OK() bool {
+	return s.Err == nil && s.Pinned != "" && s.Pinned == s.Actual
+}
+
+// helperDigest pulls an image and returns the content digest it resolved to
+var helperDigest = pullDigest
+
+func pullDigest(image string) (string, error) {
+	ref, err := reference.Parse(image)
+	if err != nil {
+		return "", err
+	}
+	if err := dockerPull(&ref, true, false, Platform, 0); err != nil {
+		return "", err
+	}
+	cli, err := dockerClient(0)
+	if err != nil {
+		return "", err
+	}
+	inspect, err := imageInspect(cli, ref.String(), 0)
+	if err != nil {
+		return "", err
+	}
+	if digest := repoDigest(inspect, &ref); digest != "" {
+		return digest, nil
+	}
+	return "", fmt.Errorf("no repository digest for %s", image)
+}
+
+// repoDigest returns the digest an image was pulled from the repository of
+// ref with, or empty if it has none
+func repoDigest(inspect types.ImageInspect, ref *reference.Spec) string {
+	for _, rd := range inspect.RepoDigests {
+		parts := strings.SplitN(rd, "@", 2)
+		if len(parts) == 2 && strings.HasSuffix(ref.Locator, parts[0]) {
+			return parts[1]
+		}
+	}
+	return ""
+}
+
+// VerifyHelpers pulls each mkimage helper image and checks that its content
+// matches the digest the image reference is pinned to
+func VerifyHelpers() []HelperStatus {
+	formats := make([]string, 0, len(outputImages))
+	for f := range outputImages {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+
+	var status []HelperStatus
+	for _, f := range formats {
+		image := outputImages[f]
+		s := HelperStatus{Format: f, Image: image}
+		if i := strings.LastIndex(image, "@"); i >= 0 {
+			s.Pinned = image[i+1:]
+		}
+		s.Actual, s.Err = helperDigest(image)
+		status = append(status, s)
+	}
+	return status
+}
+
+// WriteHelperStatus reports the helper verification results, returning
+// false if any helper does not match its pinned digest
+func WriteHelperStatus(w io.Writer, status []HelperStatus) bool {
+	ok := true
+	for _, s := range status {
+		switch {
+		case s.Err != nil:
+			ok = false
+			fmt.Fprintf(w, "[FAIL] %s %s: %v\n", s.Format, s.Image, s.Err)
+		case s.Pinned == "":
+			fmt.Fprintf(w, "[WARN] %s %s: not pinned to a digest, content is %s\n", s.Format, s.Image, s.Actual)
+		case s.Pinned != s.Actual:
+			ok = false
+			fmt.Fprintf(w, "[FAIL] %s %s: pinned to %s but content is %s\n", s.Format, s.Image, s.Pinned, s.Actual)
+		default:
+			fmt.Fprintf(w, "[PASS] %s %s\n", s.Format, s.Image)
+		}
+	}
+	return ok
+}
@@ -0,0 +1,52 @@
+package moby
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestVerifyHelpers(t *testing.T) {
+	const good = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	const bad = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+
+	saved := outputImages
+	outputImages = map[string]string{
+		"iso-bios": "linuxkit/mkimage-iso-bios:v1@" + good,
+		"raw-bios": "linuxkit/mkimage-raw-bios:v1@" + good,
+		"vhd":      "linuxkit/mkimage-vhd:v1",
+	}
+	helperDigest = func(image string) (string, error) {
+		if strings.Contains(image, "raw-bios") {
+			return bad, nil
+		}
+		return good, nil
+	}
+	defer func() {
+		outputImages = saved
+		helperDigest = pullDigest
+	}()
+
+	status := VerifyHelpers()
+	if len(status) != 3 {
+		t.Fatalf("Expected a status for each helper, got %v", status)
+	}
+	if !status[0].OK() || status[1].OK() {
+		t.Errorf("Expected only iso-bios to match its pinned digest, got %v", status)
+	}
+
+	buf := new(bytes.Buffer)
+	if WriteHelperStatus(buf, status) {
+		t.Error("Expected drift to fail verification")
+	}
+	out := buf.String()
+	for _, s := range []string{
+		"[PASS] iso-bios",
+		"[FAIL] raw-bios linuxkit/mkimage-raw-bios:v1@" + good + ": pinned to " + good + " but content is " + bad,
+		"[WARN] vhd",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected %q in report:\n%s", s, out)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package moby
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// verityBlockSize is the data and hash block size of the verity hash tree
+const verityBlockSize = 4096
+
+// outputVerity writes the kernel+squashfs output along with a dm-verity hash
+// tree of the squashfs image and its root hash, which is added to the cmdline
+// so that the root filesystem can be verified as it is read
+func outputVerity(opts *OutputOptions, image, base string, filesystem io.Reader, args ...string) error {
+	if err := outputSquashFS(opts, image, base, filesystem, true, args...); err != nil {
+		return err
+	}
+	log.Infof("  %s-verity.img", base)
+	root, err := writeVerity(base+"-squashfs.img", base+"-verity.img")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(base+"-roothash", []byte(root+"\n"), 0644); err != nil {
+		return err
+	}
+	cmdline, err := ioutil.ReadFile(base + "-cmdline")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(base+"-cmdline", []byte(appendCmdline(string(cmdline), "roothash="+root)), 0644)
+}
+
+// appendCmdline adds an argument to a kernel command line, before any "--"
+// that starts the arguments passed on to init
+func appendCmdline(cmdline, arg string) string {
+	args := strings.Fields(cmdline)
+	for i, a := range args {
+		if a == "--" {
+			return strings.Join(append(append(args[:i:i], arg), args[i:]...), " ")
+		}
+	}
+	return strings.Join(append(args, arg), " ")
+}
+
+// writeVerity pads the data file to a whole number of blocks and writes the
+// dm-verity hash tree for it to hash, in the format of veritysetup with
+// --no-superblock and no salt, returning the root hash in hex. Each block is
+// hashed with SHA256, and each level of the tree is the hashes of the blocks
+// of the level below, until a level fits in one block. The levels are written
+// from the top down.
+func writeVerity(data, hash string) (string, error) {
+	f, err := os.OpenFile(data, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if fi.Size() == 0 {
+		return "", fmt.Errorf("Cannot make a verity hash tree of empty file %s", data)
+	}
+	if pad := fi.Size() % verityBlockSize; pad != 0 {
+		if err := f.Truncate(fi.Size() + verityBlockSize - pad); err != nil {
+			return "", err
+		}
+	}
+
+	level, err := hashBlocks(f)
+	if err != nil {
+		return "", err
+	}
+	levels := [][]byte{level}
+	for len(level) > verityBlockSize {
+		level, err = hashBlocks(bytes.NewReader(level))
+		if err != nil {
+			return "", err
+		}
+		levels = append(levels, level)
+	}
+	root := sha256.Sum256(level)
+
+	out, err := os.Create(hash)
+	if err != nil {
+		return "", err
+	}
+	for i := len(levels) - 1; i >= 0; i-- {
+		if _, err := out.Write(levels[i]); err != nil {
+			out.Close()
+			return "", err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(root[:]), nil
+}
+
+// hashBlocks returns the hash of each block read from r, zero padded to a
+// whole number of blocks
+func hashBlocks(r io.Reader) ([]byte, error) {
+	var hashes []byte
+	block := make([]byte, verityBlockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		for i := n; i < len(block); i++ {
+			block[i] = 0
+		}
+		sum := sha256.Sum256(block)
+		hashes = append(hashes, sum[:]...)
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	if pad := len(hashes) % verityBlockSize; pad != 0 {
+		hashes = append(hashes, make([]byte, verityBlockSize-pad)...)
+	}
+	return hashes, nil
+}
@@ -0,0 +1,147 @@
+package moby
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteVerity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 3.5 blocks, padded to 4 with a single level of hashes
+	data := bytes.Repeat([]byte("squashfs"), 7*verityBlockSize/16)
+	dataFile := filepath.Join(dir, "data")
+	if err := ioutil.WriteFile(dataFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := writeVerity(dataFile, filepath.Join(dir, "hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	padded := append(data, make([]byte, verityBlockSize/2)...)
+	level := make([]byte, verityBlockSize)
+	for i := 0; i < 4; i++ {
+		sum := sha256.Sum256(padded[i*verityBlockSize : (i+1)*verityBlockSize])
+		copy(level[i*sha256.Size:], sum[:])
+	}
+	want := sha256.Sum256(level)
+	if root != hex.EncodeToString(want[:]) {
+		t.Errorf("Expected root hash %x, got %s", want, root)
+	}
+	hash, err := ioutil.ReadFile(filepath.Join(dir, "hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hash, level) {
+		t.Error("Expected the hash tree to be the single level of block hashes")
+	}
+	if fi, err := os.Stat(dataFile); err != nil || fi.Size() != 4*verityBlockSize {
+		t.Errorf("Expected the data to be padded to 4 blocks: %v", err)
+	}
+
+	// more blocks than hashes fit in a block need a second level, written first
+	if err := ioutil.WriteFile(dataFile, make([]byte, 129*verityBlockSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root, err = writeVerity(dataFile, filepath.Join(dir, "hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err = ioutil.ReadFile(filepath.Join(dir, "hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hash) != 3*verityBlockSize {
+		t.Fatalf("Expected a hash tree of 3 blocks, got %d bytes", len(hash))
+	}
+	top := sha256.Sum256(hash[:verityBlockSize])
+	if root != hex.EncodeToString(top[:]) {
+		t.Errorf("Expected the root hash to be of the top level block")
+	}
+	for i := 0; i < 2; i++ {
+		sum := sha256.Sum256(hash[(i+1)*verityBlockSize : (i+2)*verityBlockSize])
+		if !bytes.Equal(hash[i*sha256.Size:(i+1)*sha256.Size], sum[:]) {
+			t.Errorf("Expected the top level to hold the hash of block %d of the level below", i)
+		}
+	}
+}
+
+func TestVerityOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for name, contents := range map[string]string{
+		"boot/kernel":  "kernel",
+		"boot/cmdline": "console=ttyS0 root=/dev/dm-0 -- --debug",
+		"etc/motd":     "hello",
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	runHelper = func(opts *OutputOptions, input io.Reader, output io.Writer, trust bool, img string, args ...string) error {
+		_, err := io.Copy(output, input)
+		return err
+	}
+	defer func() { runHelper = dockerRun }()
+
+	base := filepath.Join(dir, "test")
+	if err := outFuns["verity"](base, buf, nil, 0, nil, &OutputOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, suffix := range outputSuffixes["verity"] {
+		if _, err := os.Stat(base + suffix); err != nil {
+			t.Errorf("Expected output %s: %v", suffix, err)
+		}
+	}
+	root, err := ioutil.ReadFile(base + "-roothash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(strings.TrimSpace(string(root))) != 2*sha256.Size {
+		t.Errorf("Expected a SHA256 root hash, got %q", root)
+	}
+	artifacts, err := OutputArtifacts(base, []string{"verity"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, a := range artifacts {
+		found = found || a.Path == base+"-roothash" && a.Format == "verity"
+	}
+	if !found {
+		t.Errorf("Expected the root hash in the artifacts, got %+v", artifacts)
+	}
+	cmdline, err := ioutil.ReadFile(base + "-cmdline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "console=ttyS0 root=/dev/dm-0 roothash=" + strings.TrimSpace(string(root)) + " -- --debug"
+	if string(cmdline) != want {
+		t.Errorf("Expected cmdline %q, got %q", want, cmdline)
+	}
+}